@@ -0,0 +1,118 @@
+package sereal
+
+import "unsafe"
+
+// DefaultArenaBlockSize is the size of the blocks of an Arena whose
+// BlockSize is not set: bytes for strings and byte slices, elements for
+// slices of interface{} values.
+const DefaultArenaBlockSize = 64 << 10
+
+// An Arena holds the values decoded with WithArena in a few large blocks
+// rather than in one allocation each: strings, hash keys included, byte
+// slices and the []interface{} slices of arrays decoded into interface{}
+// values. Go doesn't let maps and the other values be allocated elsewhere
+// than on the heap, so they still are.
+//
+// Reset makes the blocks available again at once, without the garbage
+// collector having to find the values one by one. The values decoded
+// before must not be used anymore: their memory is reused, strings
+// included. The zero Arena is ready to use. An Arena is not safe for
+// concurrent use.
+type Arena struct {
+	// BlockSize overrides DefaultArenaBlockSize. Values larger than a
+	// quarter of it are allocated on their own.
+	BlockSize int
+
+	bytes  [][]byte        // blocks of bytes, those before the current one full
+	ifaces [][]interface{} // blocks of interface{} values, likewise
+	b, i   int             // indices of the current blocks
+}
+
+// WithArena allocates the values decoded by a single Unmarshal call into
+// a, see Arena
+func WithArena(a *Arena) UnmarshalOption {
+	return func(o *unmarshalOptions) {
+		o.arena = a
+	}
+}
+
+// Reset makes all the memory of a available for the values decoded next
+func (a *Arena) Reset() {
+	for j, blk := range a.ifaces {
+		// the values referred to can be collected
+		for k := range blk {
+			blk[k] = nil
+		}
+		a.ifaces[j] = blk[:0]
+	}
+	for j := range a.bytes {
+		a.bytes[j] = a.bytes[j][:0]
+	}
+	a.b, a.i = 0, 0
+}
+
+func (a *Arena) blockSize() int {
+	if a.BlockSize > 0 {
+		return a.BlockSize
+	}
+	return DefaultArenaBlockSize
+}
+
+// copyBytes returns a copy of b, capped so that appending to it can't
+// overwrite the next value
+func (a *Arena) copyBytes(b []byte) []byte {
+	n := len(b)
+	if n > a.blockSize()/4 {
+		return append(make([]byte, 0, n), b...)
+	}
+
+	for a.b < len(a.bytes) && cap(a.bytes[a.b])-len(a.bytes[a.b]) < n {
+		a.b++
+	}
+	if a.b == len(a.bytes) {
+		a.bytes = append(a.bytes, make([]byte, 0, a.blockSize()))
+	}
+
+	blk := a.bytes[a.b]
+	start := len(blk)
+	blk = append(blk, b...)
+	a.bytes[a.b] = blk
+	return blk[start:len(blk):len(blk)]
+}
+
+// string returns b as a string held by a
+func (a *Arena) string(b []byte) string {
+	if len(b) == 0 {
+		return ""
+	}
+	c := a.copyBytes(b)
+	return *(*string)(unsafe.Pointer(&c))
+}
+
+// slice returns a slice of n nil values, capped as copyBytes does
+func (a *Arena) slice(n int) []interface{} {
+	if n > a.blockSize()/4 {
+		return make([]interface{}, n)
+	}
+
+	for a.i < len(a.ifaces) && cap(a.ifaces[a.i])-len(a.ifaces[a.i]) < n {
+		a.i++
+	}
+	if a.i == len(a.ifaces) {
+		a.ifaces = append(a.ifaces, make([]interface{}, 0, a.blockSize()))
+	}
+
+	blk := a.ifaces[a.i]
+	start := len(blk)
+	blk = blk[:start+n]
+	a.ifaces[a.i] = blk
+	return blk[start : start+n : start+n]
+}
+
+// str returns val as a decoded string, held by the arena if there is one
+func (d *decoder) str(val []byte) string {
+	if d.arena != nil {
+		return d.arena.string(val)
+	}
+	return string(val)
+}
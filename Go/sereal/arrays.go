@@ -0,0 +1,41 @@
+package sereal
+
+import "fmt"
+
+// An ArrayOverflowPolicy is the way a Decoder handles an ARRAY with more
+// elements than the Go array it is decoded into. Arrays with fewer elements
+// always have their remaining elements set to their zero value.
+type ArrayOverflowPolicy int
+
+const (
+	// ArrayDiscard drops the elements beyond the length of the Go array
+	ArrayDiscard ArrayOverflowPolicy = iota
+
+	// ArrayError fails with an error wrapping ErrArrayOverflow, before any
+	// element is decoded
+	ArrayError
+)
+
+func (p ArrayOverflowPolicy) String() string {
+	switch p {
+	case ArrayDiscard:
+		return "discard"
+	case ArrayError:
+		return "error"
+	}
+	return fmt.Sprintf("ArrayOverflowPolicy(%d)", int(p))
+}
+
+// parseArrayOverflowPolicy returns the ArrayOverflowPolicy named s,
+// ArrayDiscard if s is empty
+func parseArrayOverflowPolicy(s string) (ArrayOverflowPolicy, error) {
+	for p := ArrayDiscard; p <= ArrayError; p++ {
+		if s == p.String() {
+			return p, nil
+		}
+	}
+	if s == "" {
+		return ArrayDiscard, nil
+	}
+	return 0, fmt.Errorf("sereal: unknown array overflow policy %q", s)
+}
@@ -0,0 +1,262 @@
+package sereal
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// A BatchSource yields the documents converted by ConvertAll. Next returns
+// io.EOF once all documents have been returned.
+type BatchSource interface {
+	Next() (name string, b []byte, err error)
+}
+
+// A BatchTransform converts the document b. It may be called from several
+// goroutines at once.
+type BatchTransform func(name string, b []byte) ([]byte, error)
+
+// BatchOptions configures ConvertAll
+type BatchOptions struct {
+	// Workers is the number of documents converted in parallel. The default,
+	// used when it is zero, is runtime.GOMAXPROCS(0).
+	Workers int
+
+	// Transform converts each document. Nil leaves documents unchanged.
+	Transform BatchTransform
+
+	// Output, if set, is given each converted document. Calls are
+	// serialized, but happen in no particular order.
+	Output func(name string, b []byte) error
+
+	// Progress, if set, is given the report after each document. Calls are
+	// serialized; the report must not be retained.
+	Progress func(r *BatchReport)
+
+	// StopOnError makes ConvertAll return at the first failed document
+	// instead of recording it and carrying on.
+	StopOnError bool
+}
+
+// A BatchError records a document ConvertAll failed to convert
+type BatchError struct {
+	Name string
+	Err  error
+}
+
+func (e BatchError) Error() string { return e.Name + ": " + e.Err.Error() }
+
+// A BatchReport summarizes the work done by ConvertAll
+type BatchReport struct {
+	Processed int   // documents converted successfully
+	Failed    int   // documents which couldn't be converted
+	BytesIn   int64 // size of the documents read
+	BytesOut  int64 // size of the converted documents
+	Errors    []BatchError
+}
+
+// ConvertAll converts all documents of src with opts.Transform, using a pool
+// of workers. Failed documents are recorded in the report; the returned
+// error is set when src fails, or on the first failure with StopOnError.
+func ConvertAll(src BatchSource, opts BatchOptions) (*BatchReport, error) {
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+
+	type job struct {
+		name string
+		b    []byte
+	}
+
+	var (
+		report BatchReport
+		mu     sync.Mutex // protects report and serializes callbacks
+		failed error      // first failure, with StopOnError
+		wg     sync.WaitGroup
+	)
+
+	jobs := make(chan job)
+	done := make(chan struct{})
+
+	finish := func(j job, out []byte, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		report.BytesIn += int64(len(j.b))
+
+		if err == nil && opts.Output != nil {
+			err = opts.Output(j.name, out)
+		}
+
+		if err != nil {
+			report.Failed++
+			report.Errors = append(report.Errors, BatchError{Name: j.name, Err: err})
+			if opts.StopOnError && failed == nil {
+				failed = report.Errors[len(report.Errors)-1]
+				close(done)
+			}
+		} else {
+			report.Processed++
+			report.BytesOut += int64(len(out))
+		}
+
+		if opts.Progress != nil {
+			opts.Progress(&report)
+		}
+	}
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				out, err := j.b, error(nil)
+				if opts.Transform != nil {
+					out, err = opts.Transform(j.name, j.b)
+				}
+				finish(j, out, err)
+			}
+		}()
+	}
+
+	var srcErr error
+loop:
+	for {
+		name, b, err := src.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			srcErr = err
+			break
+		}
+
+		select {
+		case jobs <- job{name, b}:
+		case <-done:
+			break loop
+		}
+	}
+
+	close(jobs)
+	wg.Wait()
+
+	if srcErr != nil {
+		return &report, srcErr
+	}
+	if failed != nil {
+		return &report, failed
+	}
+
+	return &report, nil
+}
+
+type dirSource struct {
+	root  string
+	files []string
+}
+
+// DirSource returns a BatchSource reading all regular files below dir. The
+// names of the documents are their paths relative to dir.
+func DirSource(dir string) (BatchSource, error) {
+	s := &dirSource{root: dir}
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			rel, err := filepath.Rel(dir, path)
+			if err != nil {
+				return err
+			}
+			s.files = append(s.files, rel)
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *dirSource) Next() (string, []byte, error) {
+	if len(s.files) == 0 {
+		return "", nil, io.EOF
+	}
+
+	name := s.files[0]
+	s.files = s.files[1:]
+
+	b, err := ioutil.ReadFile(filepath.Join(s.root, name))
+	return name, b, err
+}
+
+// DirOutput returns a BatchOptions.Output function writing documents below
+// dir, under their name. Missing directories are created. Names which are
+// absolute or lead out of dir once cleaned are rejected.
+func DirOutput(dir string) func(name string, b []byte) error {
+	return func(name string, b []byte) error {
+		clean := filepath.Clean(name)
+		if filepath.IsAbs(clean) || filepath.VolumeName(clean) != "" ||
+			clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("sereal: output name %q is outside of %s", name, dir)
+		}
+
+		path := filepath.Join(dir, clean)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		return ioutil.WriteFile(path, b, 0644)
+	}
+}
+
+// ValidateTransform returns a BatchTransform which decodes documents with d,
+// failing on invalid documents and returning valid ones unchanged.
+func ValidateTransform(d *Decoder) BatchTransform {
+	return func(name string, b []byte) ([]byte, error) {
+		var header, body interface{}
+		if err := d.UnmarshalHeaderBody(b, &header, &body); err != nil {
+			return nil, err
+		}
+		return b, nil
+	}
+}
+
+// ReencodeTransform returns a BatchTransform which decodes documents into
+// their Perl structure and encodes them again with e. Depending on how e is
+// configured, this recompresses documents or changes their protocol
+// version. If redact is set, it is given the decoded header and body and may
+// modify them before they are encoded.
+func ReencodeTransform(e *Encoder, redact func(header, body interface{}) error) BatchTransform {
+	// MarshalWithHeader sets the version of uninitialized encoders, do it
+	// now rather than concurrently
+	if e.version == 0 {
+		e.version = ProtocolVersion
+	}
+
+	return func(name string, b []byte) ([]byte, error) {
+		d := Decoder{PerlCompat: true}
+
+		var header, body interface{}
+		if err := d.UnmarshalHeaderBody(b, &header, &body); err != nil {
+			return nil, err
+		}
+
+		if redact != nil {
+			if err := redact(header, body); err != nil {
+				return nil, fmt.Errorf("redacting: %v", err)
+			}
+		}
+
+		return e.MarshalWithHeader(header, body)
+	}
+}
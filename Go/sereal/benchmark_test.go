@@ -1,6 +1,7 @@
 package sereal_test
 
 import (
+	"strconv"
 	"testing"
 
 	"github.com/Weborama/Sereal/Go/sereal"
@@ -70,3 +71,153 @@ func BenchmarkEncodeAndZlibComplexDataWithHeader(b *testing.B) {
 		}
 	}
 }
+
+// The header benchmarks below measure the cost of the header user data when
+// decoding, compared with BenchmarkDecodeComplexDataBodyOnly which never
+// looks at it
+
+func BenchmarkDecodeComplexDataWithHeader(b *testing.B) {
+	benchmarkDecode(b, false, func(dec *sereal.Decoder, doc []byte) error {
+		var header, body interface{}
+		return dec.UnmarshalHeaderBody(doc, &header, &body)
+	})
+}
+
+func BenchmarkDecodeComplexDataIgnoringHeader(b *testing.B) {
+	benchmarkDecode(b, false, func(dec *sereal.Decoder, doc []byte) error {
+		var body interface{}
+		return dec.Unmarshal(doc, &body)
+	})
+}
+
+func BenchmarkDecodeComplexDataBodyOnly(b *testing.B) {
+	benchmarkDecode(b, false, func(dec *sereal.Decoder, doc []byte) error {
+		var body interface{}
+		return dec.UnmarshalBodyOnly(doc, &body)
+	})
+}
+
+func BenchmarkDecodeComplexDataArena(b *testing.B) {
+	var arena sereal.Arena
+	b.ReportAllocs()
+	benchmarkDecode(b, false, func(dec *sereal.Decoder, doc []byte) error {
+		arena.Reset()
+		var body interface{}
+		return dec.Unmarshal(doc, &body, sereal.WithArena(&arena))
+	})
+}
+
+func BenchmarkDecodeZlibComplexDataIgnoringHeader(b *testing.B) {
+	benchmarkDecode(b, true, func(dec *sereal.Decoder, doc []byte) error {
+		var body interface{}
+		return dec.Unmarshal(doc, &body)
+	})
+}
+
+func BenchmarkDecodeZlibComplexDataBodyOnly(b *testing.B) {
+	benchmarkDecode(b, true, func(dec *sereal.Decoder, doc []byte) error {
+		var body interface{}
+		return dec.UnmarshalBodyOnly(doc, &body)
+	})
+}
+
+func benchmarkDecode(b *testing.B, zlib bool, decode func(dec *sereal.Decoder, doc []byte) error) {
+	enc := sereal.NewEncoderV3()
+	if zlib {
+		enc.Compression = sereal.ZlibCompressor{Level: sereal.ZlibDefaultCompression}
+		enc.CompressionThreshold = 0
+	}
+
+	doc, err := enc.MarshalWithHeader(solarSystemMeta, solarSystem)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	dec := sereal.NewDecoder()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := decode(dec, doc); err != nil {
+			b.FailNow()
+		}
+	}
+}
+
+func BenchmarkDecodeNumbers(b *testing.B) {
+	numbers := make([]interface{}, 10000)
+	for i := range numbers {
+		if i%2 == 0 {
+			numbers[i] = i * 1000
+		} else {
+			numbers[i] = float64(i) / 3
+		}
+	}
+
+	doc, err := sereal.NewEncoderV3().Marshal(numbers)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	dec := sereal.NewDecoder()
+	b.SetBytes(int64(len(doc)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var v []interface{}
+		if err := dec.Unmarshal(doc, &v); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEncodeUniqueKeys(b *testing.B) {
+	m := make(map[string]interface{}, 10000)
+	for i := 0; i < 10000; i++ {
+		m["k"+strconv.Itoa(i)] = i
+	}
+
+	for _, bc := range []struct {
+		name string
+		set  func(e *sereal.Encoder)
+	}{
+		{"dedup", func(e *sereal.Encoder) {}},
+		{"min_length", func(e *sereal.Encoder) { e.DedupMinLength = 8 }},
+		{"max_entries", func(e *sereal.Encoder) { e.DedupMaxEntries = 100 }},
+		{"disabled", func(e *sereal.Encoder) { e.DisableDedup = true }},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			enc := sereal.NewEncoderV3()
+			bc.set(enc)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := enc.Marshal(m); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkEncodeStructs(b *testing.B) {
+	type planet struct {
+		Pos        int      `sereal:"pos"`
+		Name       string   `sereal:"name"`
+		Mass       float64  `sereal:"mass_earths"`
+		Ringed     bool     `sereal:"ringed,omitempty"`
+		Satellites []string `sereal:"notable_satellites"`
+	}
+
+	planets := make([]planet, 1000)
+	for i := range planets {
+		planets[i] = planet{Pos: i, Name: "planet" + strconv.Itoa(i), Mass: float64(i) / 3, Ringed: i%2 == 0, Satellites: []string{"Moon"}}
+	}
+
+	enc := sereal.NewEncoderV3()
+	enc.StructAsMap = true
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := enc.Marshal(planets); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
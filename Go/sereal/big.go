@@ -0,0 +1,309 @@
+package sereal
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"reflect"
+)
+
+// A BigFormat is the way an Encoder writes math/big numbers which don't fit
+// the native Sereal ones. A big.Int in the range of int64 or uint64 is always
+// written as an integer, and a big.Float holding an exact float64 as a
+// double. Decoders read all of them back into big.Int and big.Float values.
+type BigFormat int
+
+const (
+	// BigString writes a decimal string, as Perl's Math::BigInt and
+	// Math::BigFloat stringify
+	BigString BigFormat = iota
+
+	// BigFREEZE writes the FREEZE of the decimal string, with the class
+	// math/big.Int or math/big.Float
+	BigFREEZE
+)
+
+func (f BigFormat) String() string {
+	switch f {
+	case BigString:
+		return "string"
+	case BigFREEZE:
+		return "freeze"
+	}
+	return fmt.Sprintf("BigFormat(%d)", int(f))
+}
+
+// parseBigFormat returns the BigFormat named s, BigString if s is empty
+func parseBigFormat(s string) (BigFormat, error) {
+	for f := BigString; f <= BigFREEZE; f++ {
+		if s == f.String() {
+			return f, nil
+		}
+	}
+	if s == "" {
+		return BigString, nil
+	}
+	return 0, fmt.Errorf("sereal: unknown big number format %q", s)
+}
+
+var (
+	bigIntType   = reflect.TypeOf(big.Int{})
+	bigFloatType = reflect.TypeOf(big.Float{})
+)
+
+// isBigType tells whether typ is big.Int or big.Float, or a pointer to one
+func isBigType(typ reflect.Type) bool {
+	if typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	return typ == bigIntType || typ == bigFloatType
+}
+
+// encodeBig appends the big.Int or big.Float rv, which may be a non-nil
+// pointer to one
+func (e *Encoder) encodeBig(by []byte, rv reflect.Value, strTable map[string]int) ([]byte, error) {
+	if rv.Kind() != reflect.Ptr {
+		p := reflect.New(rv.Type())
+		p.Elem().Set(rv)
+		rv = p
+	}
+
+	var s string
+	switch x := rv.Interface().(type) {
+	case *big.Int:
+		if x.IsInt64() {
+			return e.encodeInt(by, x.Int64()), nil
+		}
+		if x.IsUint64() {
+			return e.encodeUint(by, x.Uint64()), nil
+		}
+		s = x.String()
+
+	case *big.Float:
+		if f, acc := x.Float64(); acc == big.Exact {
+			return e.encodeDouble(by, f), nil
+		}
+		s = x.Text('g', -1)
+	}
+
+	switch e.BigFormat {
+	case BigString:
+		return e.encodeString(by, s, false, strTable), nil
+	case BigFREEZE:
+		by = append(by, typeOBJECT_FREEZE)
+		by = e.encodeString(by, concreteName(rv.Elem()), true, strTable)
+		by = append(by, typeREFN, typeARRAY)
+		by = varint(by, uint(1))
+		return e.encodeBytes(by, []byte(s), false, strTable), nil
+	}
+	return nil, fmt.Errorf("sereal: unknown big number format %v", e.BigFormat)
+}
+
+// isBigTag tells whether tag is one of a number or a string, which can be
+// decoded into a big.Int or a big.Float
+func isBigTag(tag byte) bool {
+	return tag <= typeLONG_DOUBLE || isStringishTag(tag)
+}
+
+// decodeBig decodes into the big.Int or big.Float ptr, or a pointer to one,
+// the number or string starting at by[idx], its tag being tag. Varints are
+// read whatever their length, so that integers beyond 64 bits survive.
+func (d *decoder) decodeBig(by []byte, idx int, tag byte, ptr reflect.Value) (int, error) {
+	var x interface{}
+	var err error
+
+	switch {
+	case isStringishTag(tag):
+		var s []byte
+		if s, idx, err = d.decodeStringish(by, idx); err != nil {
+			return 0, err
+		}
+		x = s
+
+	case tag < typeVARINT:
+		x = d.decodeInt(tag)
+		idx++
+
+	case tag == typeVARINT, tag == typeZIGZAG:
+		var n *big.Int
+		if n, idx, err = bigVarint(by, idx+1); err != nil {
+			return 0, err
+		}
+		if tag == typeZIGZAG {
+			n.Rsh(n, 1).Add(n, big.NewInt(1)).Neg(n)
+		}
+		x = n
+
+	case tag == typeFLOAT:
+		var f float32
+		if f, idx, err = d.decodeFloat(by, idx+1); err != nil {
+			return 0, err
+		}
+		x = f
+
+	case tag == typeDOUBLE:
+		if x, idx, err = d.decodeDouble(by, idx+1); err != nil {
+			return 0, err
+		}
+
+	case tag == typeLONG_DOUBLE:
+		if idx+16 >= len(by) {
+			return 0, ErrTruncated
+		}
+		if f, nan := longDouble(by[idx+1:]); nan {
+			x = math.NaN()
+		} else {
+			x = f
+		}
+		idx += 17
+
+	default:
+		return 0, fmt.Errorf("sereal: can't decode tag 0x%x into %v", tag, ptr.Type())
+	}
+
+	if _, err := setBig(ptr, x); err != nil {
+		return 0, fmt.Errorf("sereal: %v", err)
+	}
+	return idx, nil
+}
+
+// bigVarint decodes the varint starting at by[idx], however long it is
+func bigVarint(by []byte, idx int) (*big.Int, int, error) {
+	end := idx
+	for end < len(by) && by[end]&0x80 != 0 {
+		end++
+	}
+	if end >= len(by) {
+		return nil, 0, ErrCorrupt{ErrBadVarint}
+	}
+	end++
+
+	// repack the 7-bit groups into little endian bytes
+	buf := make([]byte, 0, (end-idx)*7/8+1)
+	var acc, bits uint
+	for _, b := range by[idx:end] {
+		acc |= uint(b&0x7f) << bits
+		for bits += 7; bits >= 8; bits -= 8 {
+			buf = append(buf, byte(acc))
+			acc >>= 8
+		}
+	}
+	buf = append(buf, byte(acc))
+
+	for i, j := 0, len(buf)-1; i < j; i, j = i+1, j-1 {
+		buf[i], buf[j] = buf[j], buf[i]
+	}
+
+	return new(big.Int).SetBytes(buf), end, nil
+}
+
+// setBig stores x, a decoded number or string, into the big.Int or
+// big.Float ptr, or a pointer to one, allocating it if it is nil. It reports
+// whether x is of a type it can be stored from. Strings are parsed with the
+// precision of a big.Float, or if it is 0 with enough for their digits.
+func setBig(ptr reflect.Value, x interface{}) (bool, error) {
+	switch x.(type) {
+	case int, uint, float32, float64, string, []byte, *big.Int, *big.Float:
+	default:
+		return false, nil
+	}
+
+	if ptr.Kind() == reflect.Ptr {
+		if ptr.IsNil() {
+			ptr.Set(reflect.New(ptr.Type().Elem()))
+		}
+		ptr = ptr.Elem()
+	}
+
+	switch z := ptr.Addr().Interface().(type) {
+	case *big.Int:
+		return true, setBigInt(z, x)
+	case *big.Float:
+		return true, setBigFloat(z, x)
+	}
+	return false, nil
+}
+
+func setBigInt(z *big.Int, x interface{}) error {
+	switch x := x.(type) {
+	case int:
+		z.SetInt64(int64(x))
+	case uint:
+		z.SetUint64(uint64(x))
+	case *big.Int:
+		z.Set(x)
+	case float32:
+		return setBigInt(z, float64(x))
+	case float64:
+		if math.IsInf(x, 0) || x != math.Trunc(x) {
+			return fmt.Errorf("can't decode %v into big.Int", x)
+		}
+		new(big.Float).SetFloat64(x).Int(z)
+	case *big.Float:
+		if !x.IsInt() {
+			return fmt.Errorf("can't decode %v into big.Int", x)
+		}
+		x.Int(z)
+	case string:
+		if _, ok := z.SetString(x, 10); !ok {
+			return fmt.Errorf("can't decode string %q into big.Int", x)
+		}
+	case []byte:
+		return setBigInt(z, string(x))
+	}
+	return nil
+}
+
+func setBigFloat(z *big.Float, x interface{}) error {
+	switch x := x.(type) {
+	case int:
+		z.SetInt64(int64(x))
+	case uint:
+		z.SetUint64(uint64(x))
+	case *big.Int:
+		z.SetInt(x)
+	case float32:
+		return setBigFloat(z, float64(x))
+	case float64:
+		if math.IsNaN(x) {
+			return fmt.Errorf("can't decode NaN into big.Float")
+		}
+		z.SetFloat64(x)
+	case *big.Float:
+		z.Set(x)
+	case string:
+		if z.Prec() == 0 && 4*len(x) > 64 {
+			// about 3.3 bits a digit
+			z.SetPrec(uint(4 * len(x)))
+		}
+		if _, ok := z.SetString(x); !ok {
+			return fmt.Errorf("can't decode string %q into big.Float", x)
+		}
+	case []byte:
+		return setBigFloat(z, string(x))
+	}
+	return nil
+}
+
+// thawBig stores into ptr the FREEZE of a big.Int or big.Float written with
+// BigFREEZE, when ptr is one of them, a pointer to one or an empty interface.
+// It reports whether it did.
+func thawBig(ptr reflect.Value, className string, data []byte) (bool, error) {
+	switch {
+	case isBigType(ptr.Type()):
+		return setBig(ptr, string(data))
+
+	case ptr.Kind() == reflect.Interface && ptr.IsNil() && ptr.NumMethod() == 0:
+		for _, typ := range []reflect.Type{bigIntType, bigFloatType} {
+			if className == typ.PkgPath()+"."+typ.Name() {
+				v := reflect.New(typ)
+				if _, err := setBig(v.Elem(), string(data)); err != nil {
+					return true, err
+				}
+				ptr.Set(v)
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,76 @@
+package sereal
+
+import (
+	"sort"
+)
+
+// CapabilityReport describes what a build of this package supports, for
+// tooling to log it or for peers to negotiate what they exchange. It is
+// meant to be marshaled to JSON.
+type CapabilityReport struct {
+	// EncodeVersions and DecodeVersions are the protocol versions documents
+	// can be encoded to and decoded from
+	EncodeVersions []int `json:"encode_versions"`
+	DecodeVersions []int `json:"decode_versions"`
+
+	// Compressions are the document types bodies can be compressed with,
+	// named as in DocumentInfo.DocType. zstd is only available in builds
+	// with the clibs tag; the types registered with RegisterCompressor are
+	// named "doctypeN".
+	Compressions []string `json:"compressions"`
+
+	// SnappyCodecs are the names registered with RegisterSnappyCodec
+	SnappyCodecs []string `json:"snappy_codecs"`
+
+	// OptionsVersion is the version of EncoderOptions and DecoderOptions
+	// understood
+	OptionsVersion int `json:"options_version"`
+
+	// DefaultMaxCopyDepth and DefaultCompressionThreshold are the limits
+	// applied by decoders and encoders which don't set their own
+	DefaultMaxCopyDepth         int `json:"default_max_copy_depth"`
+	DefaultCompressionThreshold int `json:"default_compression_threshold"`
+
+	// Features are the optional features of this build
+	Features []string `json:"features"`
+}
+
+// Capabilities returns the capabilities of this build of the package. The
+// compressions and snappy codecs registered so far are included.
+func Capabilities() CapabilityReport {
+	c := CapabilityReport{
+		DecodeVersions:              []int{1, 2, 3, 4},
+		Compressions:                []string{serealSnappy.String(), serealSnappyIncremental.String(), serealZlib.String()},
+		OptionsVersion:              OptionsVersion,
+		DefaultMaxCopyDepth:         DefaultMaxCopyDepth,
+		DefaultCompressionThreshold: NewEncoderV3().CompressionThreshold,
+		Features:                    []string{"dictionaries", "perl_compat", "streams", "zstd_frames"},
+	}
+
+	for v := 1; v <= MaxSupportedVersion; v++ {
+		c.EncodeVersions = append(c.EncodeVersions, v)
+	}
+
+	if zstdCompiled {
+		c.Compressions = append(c.Compressions, serealZstd.String())
+		c.Features = append(c.Features, "clibs")
+	}
+
+	compressors.RLock()
+	for doctype := FirstUnassignedDocType; doctype <= LastUnassignedDocType; doctype++ {
+		if _, ok := compressors.m[byte(doctype)]; ok {
+			c.Compressions = append(c.Compressions, documentType(doctype).String())
+		}
+	}
+	compressors.RUnlock()
+
+	snappyCodecs.RLock()
+	for name := range snappyCodecs.m {
+		c.SnappyCodecs = append(c.SnappyCodecs, name)
+	}
+	snappyCodecs.RUnlock()
+	sort.Strings(c.SnappyCodecs)
+	sort.Strings(c.Features)
+
+	return c
+}
@@ -0,0 +1,451 @@
+// Command sereal-gen generates MarshalSereal and UnmarshalSereal methods for
+// struct types, so that they are encoded and decoded without reflection.
+//
+// Types are selected with the -type flag or by annotating their declaration
+// with a //sereal:generate comment:
+//
+//	//go:generate sereal-gen -type User,Group
+//
+//	//sereal:generate
+//	type User struct {
+//		Name  string `sereal:"name"`
+//		Email string `sereal:",omitempty"`
+//	}
+//
+// Field names and the "sereal" struct tag are honoured in the same way as by
+// the reflection based encoder. Fields of basic types (strings, booleans,
+// integers, floats and byte slices) are handled natively; all other fields
+// fall back to sereal.AppendValue and ValueReader.Decode. As sereal-gen
+// doesn't type-check the package, omitempty is an error on fields of named
+// types other than the predeclared ones, such as time.Duration or a struct.
+//
+// Generated UnmarshalSereal methods match hash keys as a Decoder does with
+// its default settings: the field of that name, or else the one named
+// sereal.FieldNameForKey(key). They aren't given the Decoder, so they ignore
+// Decoder.KeyMatcher and Decoder.DeprecatedTitleMatch.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const annotation = "//sereal:generate"
+
+type field struct {
+	name      string // Go field name
+	key       string // hash key
+	kind      string // basic type name, or "" for the reflection fallback
+	omitEmpty bool
+	emptyTest string // expression true if the field is non-empty, for omitempty
+}
+
+type structType struct {
+	name   string
+	fields []field
+}
+
+func main() {
+	typeNames := flag.String("type", "", "comma-separated list of type names; defaults to types annotated with "+annotation)
+	output := flag.String("output", "", "output file name; defaults to <package>_sereal.go")
+	asMap := flag.Bool("map", false, "encode structs as plain hashes rather than objects, as Encoder.StructAsMap")
+	flag.Parse()
+
+	dir := "."
+	if flag.NArg() > 0 {
+		dir = flag.Arg(0)
+	}
+
+	var names []string
+	if *typeNames != "" {
+		names = strings.Split(*typeNames, ",")
+	}
+
+	pkgName, types, err := parsePackage(dir, names)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if len(types) == 0 {
+		log.Fatalf("no types to generate in %s", dir)
+	}
+
+	src, err := generate(pkgName, types, *asMap)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *output == "" {
+		*output = filepath.Join(dir, pkgName+"_sereal.go")
+	}
+
+	if err := ioutil.WriteFile(*output, src, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// parsePackage returns the struct types of the package in dir which are
+// listed in names, or annotated if names is empty
+func parsePackage(dir string, names []string) (string, []structType, error) {
+	fset := token.NewFileSet()
+	pkgs, err := parser.ParseDir(fset, dir, func(fi os.FileInfo) bool {
+		return !strings.HasSuffix(fi.Name(), "_test.go") && !strings.HasSuffix(fi.Name(), "_sereal.go")
+	}, parser.ParseComments)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if len(pkgs) != 1 {
+		return "", nil, fmt.Errorf("expected exactly one package in %s, found %d", dir, len(pkgs))
+	}
+
+	wanted := make(map[string]bool)
+	for _, n := range names {
+		wanted[strings.TrimSpace(n)] = true
+	}
+
+	var pkgName string
+	var types []structType
+
+	for name, pkg := range pkgs {
+		pkgName = name
+
+		var files []string
+		for fname := range pkg.Files {
+			files = append(files, fname)
+		}
+		sort.Strings(files)
+
+		for _, fname := range files {
+			for _, decl := range pkg.Files[fname].Decls {
+				gd, ok := decl.(*ast.GenDecl)
+				if !ok || gd.Tok != token.TYPE {
+					continue
+				}
+
+				for _, spec := range gd.Specs {
+					ts := spec.(*ast.TypeSpec)
+					st, ok := ts.Type.(*ast.StructType)
+					if !ok {
+						continue
+					}
+
+					if len(wanted) > 0 {
+						if !wanted[ts.Name.Name] {
+							continue
+						}
+						delete(wanted, ts.Name.Name)
+					} else if !annotated(gd.Doc) && !annotated(ts.Doc) {
+						continue
+					}
+
+					fields, err := structFields(ts.Name.Name, st)
+					if err != nil {
+						return "", nil, err
+					}
+					types = append(types, structType{ts.Name.Name, fields})
+				}
+			}
+		}
+	}
+
+	for n := range wanted {
+		return "", nil, fmt.Errorf("struct type %s not found", n)
+	}
+
+	return pkgName, types, nil
+}
+
+func annotated(doc *ast.CommentGroup) bool {
+	if doc == nil {
+		return false
+	}
+
+	for _, c := range doc.List {
+		if strings.TrimSpace(c.Text) == annotation {
+			return true
+		}
+	}
+
+	return false
+}
+
+func structFields(typeName string, st *ast.StructType) ([]field, error) {
+	var fields []field
+
+	for _, f := range st.Fields.List {
+		var tag reflect.StructTag
+		if f.Tag != nil {
+			s, _ := strconv.Unquote(f.Tag.Value)
+			tag = reflect.StructTag(s)
+		}
+
+		key, opts := parseTag(tag.Get("sereal"))
+		if key == "-" {
+			continue
+		}
+
+		// embedded fields are encoded as a single field named after the type,
+		// as the reflection based encoder does
+		names := f.Names
+		if len(names) == 0 {
+			names = []*ast.Ident{embeddedName(f.Type)}
+		}
+
+		for _, n := range names {
+			if n == nil || (!n.IsExported() && key == "") {
+				continue
+			}
+
+			fld := field{name: n.Name, key: key, omitEmpty: opts["omitempty"]}
+			if fld.key == "" {
+				fld.key = n.Name
+			}
+
+			var known bool
+			fld.kind, fld.emptyTest, known = fieldKind(f.Type, "x."+n.Name)
+			if fld.omitEmpty && !known {
+				return nil, fmt.Errorf("%s.%s: omitempty needs the underlying type of %s, which sereal-gen doesn't resolve", typeName, n.Name, types.ExprString(f.Type))
+			}
+			fields = append(fields, fld)
+		}
+	}
+
+	return fields, nil
+}
+
+func embeddedName(expr ast.Expr) *ast.Ident {
+	switch t := expr.(type) {
+	case *ast.Ident:
+		return t
+	case *ast.StarExpr:
+		return embeddedName(t.X)
+	case *ast.SelectorExpr:
+		return t.Sel
+	}
+	return nil
+}
+
+func parseTag(tag string) (string, map[string]bool) {
+	parts := strings.Split(tag, ",")
+	opts := make(map[string]bool)
+	for _, o := range parts[1:] {
+		opts[o] = true
+	}
+	return parts[0], opts
+}
+
+// fieldKind returns the basic type of a field, or "" if it must be handled
+// via reflection, and the expression testing whether it is non-empty, ""
+// for types the reflection based encoder never finds empty. known is false
+// for named types, whose emptiness depends on their underlying type.
+func fieldKind(expr ast.Expr, ref string) (kind, emptyTest string, known bool) {
+	switch t := expr.(type) {
+	case *ast.Ident:
+		switch t.Name {
+		case "string":
+			return t.Name, ref + ` != ""`, true
+		case "bool":
+			return t.Name, ref, true
+		case "int", "int8", "int16", "int32", "int64",
+			"uint", "uint8", "uint16", "uint32", "uint64",
+			"float32", "float64":
+			return t.Name, ref + " != 0", true
+		case "byte", "rune", "uintptr":
+			return "", ref + " != 0", true
+		case "error":
+			return "", ref + " != nil", true
+		case "complex64", "complex128":
+			return "", "", true
+		}
+
+	case *ast.ArrayType:
+		if t.Len == nil {
+			if elt, ok := t.Elt.(*ast.Ident); ok && (elt.Name == "byte" || elt.Name == "uint8") {
+				return "[]byte", "len(" + ref + ") != 0", true
+			}
+		}
+		return "", "len(" + ref + ") != 0", true
+
+	case *ast.MapType:
+		return "", "len(" + ref + ") != 0", true
+
+	case *ast.StarExpr, *ast.InterfaceType:
+		return "", ref + " != nil", true
+
+	case *ast.StructType, *ast.ChanType, *ast.FuncType:
+		return "", "", true
+	}
+
+	return "", "", false
+}
+
+func generate(pkgName string, types []structType, asMap bool) ([]byte, error) {
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "// Code generated by sereal-gen; DO NOT EDIT.\n\n")
+	fmt.Fprintf(&buf, "package %s\n\n", pkgName)
+	fmt.Fprintf(&buf, "import \"github.com/Weborama/Sereal/Go/sereal\"\n\n")
+
+	for _, t := range types {
+		generateMarshal(&buf, t, asMap)
+		generateUnmarshal(&buf, t)
+	}
+
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("formatting generated code: %s\n%s", err, buf.Bytes())
+	}
+
+	return src, nil
+}
+
+func generateMarshal(buf *bytes.Buffer, t structType, asMap bool) {
+	fmt.Fprintf(buf, "\n// MarshalSereal implements sereal.Marshaler\n")
+	fmt.Fprintf(buf, "func (x %s) MarshalSereal() ([]byte, error) {\n", t.name)
+
+	n := 0
+	for _, f := range t.fields {
+		if !f.omitEmpty || f.emptyTest == "" {
+			n++
+		}
+	}
+
+	fmt.Fprintf(buf, "n := %d\n", n)
+	for _, f := range t.fields {
+		if f.omitEmpty && f.emptyTest != "" {
+			fmt.Fprintf(buf, "if %s {\nn++\n}\n", f.emptyTest)
+		}
+	}
+
+	fmt.Fprintf(buf, "b := make([]byte, 0, 64)\n")
+	if !asMap {
+		fmt.Fprintf(buf, "b = sereal.AppendObjectHeader(b, %q)\n", t.name)
+	}
+	fmt.Fprintf(buf, "b = sereal.AppendHashHeader(b, n)\n")
+
+	needErr := false
+	for _, f := range t.fields {
+		if f.kind == "" {
+			needErr = true
+		}
+	}
+	if needErr {
+		fmt.Fprintf(buf, "var err error\n")
+	}
+
+	for _, f := range t.fields {
+		ref := "x." + f.name
+		if f.omitEmpty && f.emptyTest != "" {
+			fmt.Fprintf(buf, "if %s {\n", f.emptyTest)
+		}
+
+		fmt.Fprintf(buf, "b = sereal.AppendString(b, %q)\n", f.key)
+
+		switch f.kind {
+		case "string":
+			fmt.Fprintf(buf, "b = sereal.AppendString(b, %s)\n", ref)
+		case "bool":
+			fmt.Fprintf(buf, "b = sereal.AppendBool(b, %s)\n", ref)
+		case "int", "int8", "int16", "int32", "int64":
+			fmt.Fprintf(buf, "b = sereal.AppendInt(b, int64(%s))\n", ref)
+		case "uint", "uint8", "uint16", "uint32", "uint64":
+			fmt.Fprintf(buf, "b = sereal.AppendUint(b, uint64(%s))\n", ref)
+		case "float32":
+			fmt.Fprintf(buf, "b = sereal.AppendFloat32(b, %s)\n", ref)
+		case "float64":
+			fmt.Fprintf(buf, "b = sereal.AppendFloat64(b, %s)\n", ref)
+		case "[]byte":
+			fmt.Fprintf(buf, "b = sereal.AppendBytes(b, %s)\n", ref)
+		default:
+			fmt.Fprintf(buf, "if b, err = sereal.AppendValue(b, %s); err != nil {\nreturn nil, err\n}\n", ref)
+		}
+
+		if f.omitEmpty && f.emptyTest != "" {
+			fmt.Fprintf(buf, "}\n")
+		}
+	}
+
+	fmt.Fprintf(buf, "return b, nil\n}\n")
+}
+
+func generateUnmarshal(buf *bytes.Buffer, t structType) {
+	fmt.Fprintf(buf, "\n// UnmarshalSereal implements sereal.Unmarshaler. Keys are matched as by\n")
+	fmt.Fprintf(buf, "// a Decoder with neither KeyMatcher nor DeprecatedTitleMatch set.\n")
+	fmt.Fprintf(buf, "func (x *%s) UnmarshalSereal(b []byte) error {\n", t.name)
+	fmt.Fprintf(buf, `r := sereal.NewValueReader(b)
+if r.ReadNil() {
+	return nil
+}
+
+n, err := r.ReadHash()
+if err != nil {
+	return err
+}
+
+for i := 0; i < n; i++ {
+	key, err := r.ReadString()
+	if err != nil {
+		return err
+	}
+
+	found, err := x.unmarshalSerealField(r, key)
+	if !found && err == nil {
+		if name := sereal.FieldNameForKey(key); name != key {
+			found, err = x.unmarshalSerealField(r, name)
+		}
+	}
+	if !found && err == nil {
+		err = r.Skip()
+	}
+	if err != nil {
+		return err
+	}
+}
+
+return nil
+}
+`)
+
+	fmt.Fprintf(buf, "\nfunc (x *%s) unmarshalSerealField(r *sereal.ValueReader, key string) (bool, error) {\n", t.name)
+	fmt.Fprintf(buf, "if r.ReadNil() {\nreturn true, nil\n}\n\n")
+	fmt.Fprintf(buf, "switch key {\n")
+
+	for _, f := range t.fields {
+		ref := "x." + f.name
+		fmt.Fprintf(buf, "case %q:\n", f.key)
+
+		switch f.kind {
+		case "string":
+			fmt.Fprintf(buf, "v, err := r.ReadString()\n%s = v\nreturn true, err\n", ref)
+		case "[]byte":
+			fmt.Fprintf(buf, "v, err := r.ReadBytes()\n%s = v\nreturn true, err\n", ref)
+		case "bool":
+			fmt.Fprintf(buf, "v, err := r.ReadBool()\n%s = v\nreturn true, err\n", ref)
+		case "int", "int8", "int16", "int32", "int64":
+			fmt.Fprintf(buf, "v, err := r.ReadInt()\n%s = %s(v)\nreturn true, err\n", ref, f.kind)
+		case "uint", "uint8", "uint16", "uint32", "uint64":
+			fmt.Fprintf(buf, "v, err := r.ReadUint()\n%s = %s(v)\nreturn true, err\n", ref, f.kind)
+		case "float32", "float64":
+			fmt.Fprintf(buf, "v, err := r.ReadFloat()\n%s = %s(v)\nreturn true, err\n", ref, f.kind)
+		default:
+			fmt.Fprintf(buf, "return true, r.Decode(&%s)\n", ref)
+		}
+	}
+
+	fmt.Fprintf(buf, "}\n\nreturn false, nil\n}\n")
+}
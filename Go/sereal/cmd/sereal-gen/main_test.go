@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Weborama/Sereal/Go/sereal"
+	"github.com/Weborama/Sereal/Go/sereal/cmd/sereal-gen/testdata/parity"
+)
+
+func TestGeneratedUpToDate(t *testing.T) {
+	pkgName, types, err := parsePackage("testdata/parity", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	src, err := generate(pkgName, types, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	old, err := ioutil.ReadFile("testdata/parity/parity_sereal.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(src, old) {
+		t.Errorf("testdata/parity/parity_sereal.go is stale, run go generate ./testdata/parity")
+	}
+}
+
+// reflective has the fields of parity.Account but not its methods
+type reflective parity.Account
+
+func TestGeneratedKeyMatching(t *testing.T) {
+	var tests = []struct {
+		key     string
+		value   interface{}
+		matches bool
+	}{
+		{"UserID", 1, true},
+		{"userID", 1, true},
+		{"userid", 1, false},
+		{"user_id", 1, false},
+		{"name", "a", true},
+		{"Name", "a", false},
+		{"Full Name", "a", true},
+		{"full name", "a", true},
+		{"tags", []string{"a"}, true},
+	}
+
+	for _, tt := range tests {
+		doc, err := sereal.Marshal(map[string]interface{}{tt.key: tt.value})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var gen parity.Account
+		if err := sereal.Unmarshal(doc, &gen); err != nil {
+			t.Errorf("%q: generated: %v", tt.key, err)
+			continue
+		}
+
+		var refl reflective
+		if err := sereal.Unmarshal(doc, &refl); err != nil {
+			t.Errorf("%q: reflective: %v", tt.key, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(parity.Account(refl), gen) {
+			t.Errorf("%q: generated decoded %+v, reflective decoded %+v", tt.key, gen, refl)
+		}
+		if matched := !reflect.DeepEqual(gen, parity.Account{}); matched != tt.matches {
+			t.Errorf("%q: matched=%v, want %v", tt.key, matched, tt.matches)
+		}
+	}
+}
+
+func TestGeneratedIgnoresKeyMatcher(t *testing.T) {
+	doc, err := sereal.Marshal(map[string]interface{}{"userid": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := sereal.NewDecoder()
+	d.KeyMatcher = sereal.CaseInsensitiveKeys
+
+	var refl reflective
+	if err := d.Unmarshal(doc, &refl); err != nil {
+		t.Fatal(err)
+	}
+	if refl.UserID != 1 {
+		t.Errorf("reflective decoding ignored KeyMatcher: %+v", refl)
+	}
+
+	var gen parity.Account
+	if err := d.Unmarshal(doc, &gen); err != nil {
+		t.Fatal(err)
+	}
+	if gen.UserID != 0 {
+		t.Errorf("generated decoding matched %q with KeyMatcher: %+v", "userid", gen)
+	}
+}
+
+func TestOmitEmpty(t *testing.T) {
+	var tests = []struct {
+		field string
+		err   string // part of the error, "" if generated
+		test  string // emptiness test generated
+	}{
+		{"Counts [4]int `sereal:\",omitempty\"`", "", "len(x.Counts) != 0"},
+		{"Initial rune `sereal:\",omitempty\"`", "", "x.Initial != 0"},
+		{"Err error `sereal:\",omitempty\"`", "", "x.Err != nil"},
+		{"Timeout time.Duration `sereal:\",omitempty\"`", "T.Timeout: omitempty needs the underlying type of time.Duration", ""},
+		{"Owner ID `sereal:\",omitempty\"`", "T.Owner: omitempty needs the underlying type of ID", ""},
+		{"Owner ID", "", ""},
+	}
+
+	for _, tt := range tests {
+		dir, err := ioutil.TempDir("", "sereal-gen")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		src := "package p\n\nimport \"time\"\n\ntype ID int\n\nvar _ time.Duration\n\ntype T struct {\n\t" + tt.field + "\n}\n"
+		if err := ioutil.WriteFile(filepath.Join(dir, "p.go"), []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		pkgName, types, err := parsePackage(dir, []string{"T"})
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: expected error %q, got %v", tt.field, tt.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.field, err)
+			continue
+		}
+
+		gen, err := generate(pkgName, types, false)
+		if err != nil {
+			t.Errorf("%s: %v", tt.field, err)
+			continue
+		}
+		if tt.test != "" && !bytes.Contains(gen, []byte("if "+tt.test+" {")) {
+			t.Errorf("%s: %q not generated in\n%s", tt.field, tt.test, gen)
+		}
+	}
+}
@@ -0,0 +1,13 @@
+// Package parity holds a type whose generated methods are tested against
+// reflective decoding.
+package parity
+
+//go:generate go run ../.. -output parity_sereal.go .
+
+//sereal:generate
+type Account struct {
+	UserID   int
+	Name     string `sereal:"name"`
+	FullName string `sereal:"Full Name"`
+	Tags     []string
+}
@@ -0,0 +1,86 @@
+// Code generated by sereal-gen; DO NOT EDIT.
+
+package parity
+
+import "github.com/Weborama/Sereal/Go/sereal"
+
+// MarshalSereal implements sereal.Marshaler
+func (x Account) MarshalSereal() ([]byte, error) {
+	n := 4
+	b := make([]byte, 0, 64)
+	b = sereal.AppendObjectHeader(b, "Account")
+	b = sereal.AppendHashHeader(b, n)
+	var err error
+	b = sereal.AppendString(b, "UserID")
+	b = sereal.AppendInt(b, int64(x.UserID))
+	b = sereal.AppendString(b, "name")
+	b = sereal.AppendString(b, x.Name)
+	b = sereal.AppendString(b, "Full Name")
+	b = sereal.AppendString(b, x.FullName)
+	b = sereal.AppendString(b, "Tags")
+	if b, err = sereal.AppendValue(b, x.Tags); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// UnmarshalSereal implements sereal.Unmarshaler. Keys are matched as by
+// a Decoder with neither KeyMatcher nor DeprecatedTitleMatch set.
+func (x *Account) UnmarshalSereal(b []byte) error {
+	r := sereal.NewValueReader(b)
+	if r.ReadNil() {
+		return nil
+	}
+
+	n, err := r.ReadHash()
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < n; i++ {
+		key, err := r.ReadString()
+		if err != nil {
+			return err
+		}
+
+		found, err := x.unmarshalSerealField(r, key)
+		if !found && err == nil {
+			if name := sereal.FieldNameForKey(key); name != key {
+				found, err = x.unmarshalSerealField(r, name)
+			}
+		}
+		if !found && err == nil {
+			err = r.Skip()
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (x *Account) unmarshalSerealField(r *sereal.ValueReader, key string) (bool, error) {
+	if r.ReadNil() {
+		return true, nil
+	}
+
+	switch key {
+	case "UserID":
+		v, err := r.ReadInt()
+		x.UserID = int(v)
+		return true, err
+	case "name":
+		v, err := r.ReadString()
+		x.Name = v
+		return true, err
+	case "Full Name":
+		v, err := r.ReadString()
+		x.FullName = v
+		return true, err
+	case "Tags":
+		return true, r.Decode(&x.Tags)
+	}
+
+	return false, nil
+}
@@ -0,0 +1,452 @@
+// Command sereal inspects and converts Sereal documents.
+//
+// Usage:
+//
+//	sereal dump [-format json|yaml] [-header] file...
+//	sereal validate file...
+//	sereal tags [-hex] file...
+//	sereal stat file...
+//	sereal tree [-format json|dot] file
+//	sereal query path file...
+//	sereal struct [-name Document] [-package main] [-o output] file...
+//	sereal convert -compression raw|snappy|zlib|zstd [-level n] [-o output] file
+//
+// dump decodes documents and prints their body, or their header with
+// -header. validate reports the documents which can't be decoded. tags prints
+// the tag tree of documents along with the offset of each tag, or with -hex
+// a hex dump annotated with the tags. stat prints what documents hold, one
+// JSON object per line, see sereal.Stat. tree prints the tree of tags of a
+// document as JSON or as a Graphviz digraph. query prints the values of
+// documents selected by a Sereal::Path query such as $.store.book[*].title,
+// one JSON value per line. struct generates Go structs with sereal tags
+// for the hashes of a corpus of documents, along with nil-safe getters,
+// fields missing from some of the hashes or undef being tagged omitempty.
+// convert changes the compression of a document without re-encoding it,
+// raising its version to 3 for zlib and to 4 for zstd if needed, which v1
+// documents can't be.
+//
+// A file name of "-" reads the standard input.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/Weborama/Sereal/Go/sereal"
+)
+
+const usage = `usage:
+	sereal dump [-format json|yaml] [-header] file...
+	sereal validate file...
+	sereal tags [-hex] file...
+	sereal stat file...
+	sereal tree [-format json|dot] file
+	sereal query path file...
+	sereal struct [-name Document] [-package main] [-o output] file...
+	sereal convert -compression raw|snappy|zlib|zstd [-level n] [-o output] file
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch cmd, args := os.Args[1], os.Args[2:]; cmd {
+	case "dump":
+		err = dump(args)
+	case "validate":
+		err = validate(args)
+	case "tags":
+		err = tags(args)
+	case "stat":
+		err = stat(args)
+	case "tree":
+		err = tree(args)
+	case "query":
+		err = query(args)
+	case "struct":
+		err = structs(args)
+	case "convert":
+		err = convert(args)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n%s", cmd, usage)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "sereal:", err)
+		os.Exit(1)
+	}
+}
+
+func readFile(name string) ([]byte, error) {
+	if name == "-" {
+		return ioutil.ReadAll(os.Stdin)
+	}
+	return ioutil.ReadFile(name)
+}
+
+func dump(args []string) error {
+	fs := flag.NewFlagSet("dump", flag.ExitOnError)
+	format := fs.String("format", "json", "output format: json or yaml")
+	header := fs.Bool("header", false, "dump the header instead of the body")
+	fs.Parse(args)
+
+	if *format != "json" && *format != "yaml" {
+		return fmt.Errorf("unknown format %q", *format)
+	}
+
+	for _, name := range fs.Args() {
+		b, err := readFile(name)
+		if err != nil {
+			return err
+		}
+
+		var v interface{}
+		if *header {
+			err = sereal.NewDecoder().UnmarshalHeader(b, &v)
+		} else {
+			err = sereal.NewDecoder().Unmarshal(b, &v)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+
+		v = printable(v)
+
+		if *format == "yaml" {
+			if len(fs.Args()) > 1 {
+				fmt.Println("---")
+			}
+			writeYAML(os.Stdout, v, 0)
+			continue
+		}
+
+		out, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		fmt.Printf("%s\n", out)
+	}
+
+	return nil
+}
+
+// printable replaces byte slices holding valid UTF-8 by strings, so that
+// strings encoded as BINARY aren't printed in base64
+func printable(v interface{}) interface{} {
+	switch v := v.(type) {
+	case []byte:
+		if utf8.Valid(v) {
+			return string(v)
+		}
+	case *interface{}:
+		return printable(*v)
+	case []interface{}:
+		for i := range v {
+			v[i] = printable(v[i])
+		}
+	case map[string]interface{}:
+		for k := range v {
+			v[k] = printable(v[k])
+		}
+	}
+	return v
+}
+
+// writeYAML writes v as a YAML block. Scalars are written in their JSON
+// form, which is valid YAML.
+func writeYAML(w io.Writer, v interface{}, indent int) {
+	pad := strings.Repeat("  ", indent)
+
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if len(v) == 0 {
+			fmt.Fprintf(w, "%s{}\n", pad)
+			return
+		}
+
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			key, _ := json.Marshal(k)
+			if isScalar(v[k]) {
+				fmt.Fprintf(w, "%s%s: %s\n", pad, key, yamlScalar(v[k]))
+			} else {
+				fmt.Fprintf(w, "%s%s:\n", pad, key)
+				writeYAML(w, v[k], indent+1)
+			}
+		}
+
+	case []interface{}:
+		if len(v) == 0 {
+			fmt.Fprintf(w, "%s[]\n", pad)
+			return
+		}
+
+		for _, e := range v {
+			if isScalar(e) {
+				fmt.Fprintf(w, "%s- %s\n", pad, yamlScalar(e))
+			} else {
+				fmt.Fprintf(w, "%s-\n", pad)
+				writeYAML(w, e, indent+1)
+			}
+		}
+
+	default:
+		fmt.Fprintf(w, "%s%s\n", pad, yamlScalar(v))
+	}
+}
+
+func isScalar(v interface{}) bool {
+	switch v.(type) {
+	case map[string]interface{}, []interface{}:
+		return false
+	}
+	return true
+}
+
+func yamlScalar(v interface{}) string {
+	out, err := json.Marshal(v)
+	if err != nil {
+		out, _ = json.Marshal(fmt.Sprint(v))
+	}
+	return string(out)
+}
+
+func validate(args []string) error {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	fs.Parse(args)
+
+	failed := 0
+	for _, name := range fs.Args() {
+		b, err := readFile(name)
+		if err != nil {
+			return err
+		}
+
+		var header, body interface{}
+		if err := sereal.NewDecoder().UnmarshalHeaderBody(b, &header, &body); err != nil {
+			fmt.Printf("%s: %v\n", name, err)
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d invalid documents", failed)
+	}
+
+	return nil
+}
+
+func tags(args []string) error {
+	fs := flag.NewFlagSet("tags", flag.ExitOnError)
+	hex := fs.Bool("hex", false, "print a hex dump annotated with the tags")
+	fs.Parse(args)
+
+	dump := sereal.DumpTags
+	if *hex {
+		dump = sereal.DumpAnnotated
+	}
+
+	for _, name := range fs.Args() {
+		b, err := readFile(name)
+		if err != nil {
+			return err
+		}
+
+		if len(fs.Args()) > 1 {
+			fmt.Printf("%s:\n", name)
+		}
+
+		if err := dump(os.Stdout, b); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+
+	return nil
+}
+
+func stat(args []string) error {
+	fs := flag.NewFlagSet("stat", flag.ExitOnError)
+	fs.Parse(args)
+
+	enc := json.NewEncoder(os.Stdout)
+	for _, name := range fs.Args() {
+		b, err := readFile(name)
+		if err != nil {
+			return err
+		}
+
+		s, err := sereal.Stat(b)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+
+		err = enc.Encode(struct {
+			File string
+			sereal.DocumentStats
+			CompressionRatio float64
+		}{name, s, s.CompressionRatio()})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func tree(args []string) error {
+	fs := flag.NewFlagSet("tree", flag.ExitOnError)
+	format := fs.String("format", "json", "output format: json or dot")
+	fs.Parse(args)
+
+	if *format != "json" && *format != "dot" {
+		return fmt.Errorf("unknown format %q", *format)
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("tree takes a single document")
+	}
+
+	b, err := readFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	t, err := sereal.ParseTree(b)
+	if err != nil {
+		return err
+	}
+
+	if *format == "dot" {
+		return t.WriteDOT(os.Stdout)
+	}
+
+	out, err := json.MarshalIndent(t, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	return nil
+}
+
+func query(args []string) error {
+	fs := flag.NewFlagSet("query", flag.ExitOnError)
+	fs.Parse(args)
+
+	if fs.NArg() < 1 {
+		return fmt.Errorf("query takes a path")
+	}
+	p, err := sereal.CompilePath(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	for _, name := range fs.Args()[1:] {
+		b, err := readFile(name)
+		if err != nil {
+			return err
+		}
+
+		vals, err := p.Query(b)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		for _, v := range vals {
+			if err := enc.Encode(printable(v)); err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func convert(args []string) error {
+	fs := flag.NewFlagSet("convert", flag.ExitOnError)
+	compression := fs.String("compression", "raw", "compression of the output: raw, snappy, zlib or zstd")
+	level := fs.Int("level", 0, "compression level for zlib and zstd")
+	output := fs.String("o", "-", "output file")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return fmt.Errorf("convert takes a single document")
+	}
+
+	b, err := readFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	if v := minVersions[*compression]; v > 0 {
+		if b, err = withVersion(b, v); err != nil {
+			return err
+		}
+	}
+
+	var out []byte
+	switch *compression {
+	case "raw":
+		out, err = sereal.CompressDocument(b, nil)
+	case "snappy":
+		// the non-incremental variant is only valid for v1 documents
+		out, err = sereal.CompressDocument(b, sereal.SnappyCompressor{Incremental: len(b) > 4 && b[4]&0x0f > 1})
+	case "zlib":
+		out, err = sereal.CompressDocument(b, sereal.ZlibCompressor{Level: *level})
+	case "zstd":
+		out, err = sereal.CompressDocument(b, sereal.ZstdCompressor{Level: *level})
+	default:
+		return fmt.Errorf("unknown compression %q", *compression)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if *output == "-" {
+		_, err = os.Stdout.Write(out)
+		return err
+	}
+
+	return ioutil.WriteFile(*output, out, 0644)
+}
+
+// minVersions are the lowest protocol versions of the documents which can
+// be compressed with zlib and zstd
+var minVersions = map[string]int{"zlib": 3, "zstd": 4}
+
+// withVersion returns the document b decompressed and raised to version v
+// if it is older. v2 documents and later only differ by their magic string
+// and version, v1 ones would need their offsets rewritten.
+func withVersion(b []byte, v int) ([]byte, error) {
+	raw, err := sereal.CompressDocument(b, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	switch version := int(raw[4] & 0x0f); {
+	case version >= v:
+		return raw, nil
+	case version == 1:
+		return nil, fmt.Errorf("v1 documents can't be compressed with zlib or zstd without being re-encoded as v%d", v)
+	}
+
+	// the magic string of v3 documents and later
+	copy(raw, "=\xf3rl")
+	raw[4] = byte(v)
+	return raw, nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Weborama/Sereal/Go/sereal"
+)
+
+func TestConvert(t *testing.T) {
+	dir := t.TempDir()
+	in := map[string]interface{}{"name": strings.Repeat("convert ", 50), "n": 1}
+
+	zstd := false
+	for _, c := range sereal.Capabilities().Compressions {
+		zstd = zstd || c == "zstd"
+	}
+
+	for _, tc := range []struct {
+		version     int
+		compression string
+		want        int // version of the output, 0 if it fails
+	}{
+		{1, "snappy", 1},
+		{1, "zlib", 0},
+		{2, "raw", 2},
+		{2, "zlib", 3},
+		{3, "zlib", 3},
+		{2, "zstd", 4},
+		{3, "zstd", 4},
+	} {
+		if tc.compression == "zstd" && !zstd {
+			tc.want = 0
+		}
+
+		e := sereal.NewEncoderV3()
+		if err := e.SetVersion(tc.version); err != nil {
+			t.Fatal(err)
+		}
+		b, err := e.Marshal(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		src := filepath.Join(dir, "in.srl")
+		dst := filepath.Join(dir, "out.srl")
+		if err := ioutil.WriteFile(src, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		err = convert([]string{"-compression", tc.compression, "-o", dst, src})
+		if tc.want == 0 {
+			if err == nil {
+				t.Errorf("v%d to %s: no error", tc.version, tc.compression)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("v%d to %s: %v", tc.version, tc.compression, err)
+			continue
+		}
+
+		out, err := ioutil.ReadFile(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v := int(out[4] & 0x0f); v != tc.want {
+			t.Errorf("v%d to %s: got version %d", tc.version, tc.compression, v)
+		}
+
+		var got map[string]interface{}
+		if err := sereal.Unmarshal(out, &got); err != nil || !reflect.DeepEqual(got, in) {
+			t.Errorf("v%d to %s: got %v, %v", tc.version, tc.compression, got, err)
+		}
+	}
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"go/format"
+	"io/ioutil"
+	"math"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/Weborama/Sereal/Go/sereal"
+)
+
+// kinds of values seen for a shape, as a bit set
+const (
+	kindBool = 1 << iota
+	kindInt
+	kindUint // integers beyond math.MaxInt64
+	kindFloat
+	kindString
+	kindBytes // strings which aren't valid UTF-8
+	kindArray
+	kindHash
+	kindOther // regexps, frozen objects and the like
+)
+
+// A shape sums up the values found at a given place of a corpus of documents
+type shape struct {
+	kinds  int
+	seen   int // number of values, undef included
+	undef  int
+	hashes int // number of hashes, for the fields missing from some of them
+	class  string
+	fields map[string]*shape
+	elem   *shape
+}
+
+func newShape() *shape {
+	return &shape{fields: make(map[string]*shape)}
+}
+
+// add merges the decoded value v into s
+func (s *shape) add(v interface{}) {
+	s.seen++
+
+	switch v := v.(type) {
+	case nil, *sereal.PerlUndef:
+		s.undef++
+	case bool:
+		s.kinds |= kindBool
+	case int, int8, int16, int32, int64:
+		s.kinds |= kindInt
+	case uint, uint8, uint16, uint32, uint64:
+		if reflect.ValueOf(v).Uint() > math.MaxInt64 {
+			s.kinds |= kindUint
+		} else {
+			s.kinds |= kindInt
+		}
+	case float32, float64:
+		s.kinds |= kindFloat
+	case string:
+		s.kinds |= kindString
+	case []byte:
+		if utf8.Valid(v) {
+			s.kinds |= kindString
+		} else {
+			s.kinds |= kindBytes
+		}
+
+	case []interface{}:
+		s.kinds |= kindArray
+		if s.elem == nil {
+			s.elem = newShape()
+		}
+		for _, e := range v {
+			s.elem.add(e)
+		}
+
+	case map[string]interface{}:
+		s.kinds |= kindHash
+		s.hashes++
+		for k, e := range v {
+			s.field(k).add(e)
+		}
+
+	case map[interface{}]interface{}:
+		s.kinds |= kindHash
+		s.hashes++
+		for k, e := range v {
+			s.field(fmt.Sprint(k)).add(e)
+		}
+
+	case *sereal.PerlObject:
+		s.seen--
+		s.class = v.Class
+		s.add(v.Reference)
+
+	default:
+		if rv := reflect.ValueOf(v); rv.Kind() == reflect.Ptr && !rv.IsNil() {
+			// references to scalars
+			s.seen--
+			s.add(rv.Elem().Interface())
+			return
+		}
+		s.kinds |= kindOther
+	}
+}
+
+func (s *shape) field(key string) *shape {
+	f, ok := s.fields[key]
+	if !ok {
+		f = newShape()
+		s.fields[key] = f
+	}
+	return f
+}
+
+// merge adds the values summed up by o to s
+func (s *shape) merge(o *shape) {
+	s.kinds |= o.kinds
+	s.seen += o.seen
+	s.undef += o.undef
+	s.hashes += o.hashes
+	if s.class == "" {
+		s.class = o.class
+	}
+
+	for k, f := range o.fields {
+		s.field(k).merge(f)
+	}
+
+	if o.elem != nil {
+		if s.elem == nil {
+			s.elem = newShape()
+		}
+		s.elem.merge(o.elem)
+	}
+}
+
+// isMap tells whether the hashes of s are maps rather than records, their
+// keys not being usable as field names
+func (s *shape) isMap() bool {
+	for k := range s.fields {
+		if fieldName(k) == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// optional tells whether the values of s may be missing from their hash
+// among n hashes, or undef
+func (s *shape) optional(n int) bool {
+	return s.seen < n || s.undef > 0
+}
+
+// A structGen builds the struct definitions for a shape
+type structGen struct {
+	defs  []*structDef
+	names map[string]bool
+}
+
+type structDef struct {
+	name   string
+	class  string
+	fields []fieldDef
+}
+
+type fieldDef struct {
+	name     string
+	key      string
+	typ      string
+	optional bool // missing from some hashes or undef, tagged omitempty
+}
+
+// goType returns the type of the values of s, defining the structs it
+// needs, which are named after name
+func (g *structGen) goType(s *shape, name string) string {
+	// mixes of kinds, e.g. of integers and floats which the decoder can't
+	// store in a single Go type, are left as interface{}
+	switch kinds := s.kinds; {
+	case kinds == 0:
+		return "interface{}"
+	case kinds == kindBool:
+		return "bool"
+	case kinds == kindInt:
+		return "int64"
+	case kinds == kindUint:
+		return "uint64"
+	case kinds == kindFloat:
+		return "float64"
+	case kinds == kindString:
+		return "string"
+	case kinds&^(kindString|kindBytes) == 0:
+		return "[]byte"
+	case kinds == kindArray:
+		return "[]" + g.goType(s.elem, singular(name))
+	case kinds == kindHash:
+		if s.isMap() {
+			values := newShape()
+			for _, f := range s.fields {
+				values.merge(f)
+			}
+			return "map[string]" + g.goType(values, singular(name))
+		}
+		return "*" + g.define(s, name)
+	}
+
+	return "interface{}"
+}
+
+// define adds a struct for the hashes of s and returns its name
+func (g *structGen) define(s *shape, name string) string {
+	name = g.unique(name)
+	def := &structDef{name: name, class: s.class}
+	g.defs = append(g.defs, def)
+
+	keys := make([]string, 0, len(s.fields))
+	for k := range s.fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	taken := make(map[string]bool)
+	for _, k := range keys {
+		f := s.fields[k]
+
+		fname := fieldName(k)
+		for i := 2; taken[fname]; i++ {
+			fname = fmt.Sprintf("%s%d", fieldName(k), i)
+		}
+		taken[fname] = true
+
+		fd := fieldDef{name: fname, key: k, optional: f.optional(s.hashes)}
+		fd.typ = g.goType(f, fname)
+		def.fields = append(def.fields, fd)
+	}
+
+	return name
+}
+
+func (g *structGen) unique(name string) string {
+	n := name
+	for i := 2; g.names[n]; i++ {
+		n = fmt.Sprintf("%s%d", name, i)
+	}
+	g.names[n] = true
+	return n
+}
+
+// source returns the formatted Go source of the structs and their getters
+func (g *structGen) source(pkg string, docs int) ([]byte, error) {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "// Code generated by \"sereal struct\" from %d documents.\n\n", docs)
+	fmt.Fprintf(&b, "package %s\n", pkg)
+
+	for _, def := range g.defs {
+		b.WriteString("\n")
+		if def.class != "" {
+			fmt.Fprintf(&b, "// %s holds the hashes blessed into %s\n", def.name, def.class)
+		}
+		fmt.Fprintf(&b, "type %s struct {\n", def.name)
+		for _, f := range def.fields {
+			tag := f.key
+			if f.optional {
+				tag += ",omitempty"
+			}
+			fmt.Fprintf(&b, "\t%s %s `sereal:%q`\n", f.name, f.typ, tag)
+		}
+		b.WriteString("}\n")
+
+		// getters in the style of protobuf, safe to call on nil structs
+		for _, f := range def.fields {
+			fmt.Fprintf(&b, "\nfunc (x *%s) Get%s() %s {\n", def.name, f.name, f.typ)
+			fmt.Fprintf(&b, "\tif x != nil {\n\t\treturn x.%s\n\t}\n", f.name)
+			fmt.Fprintf(&b, "\treturn %s\n}\n", zeroValue(f.typ))
+		}
+	}
+
+	return format.Source([]byte(b.String()))
+}
+
+func zeroValue(typ string) string {
+	switch typ {
+	case "bool":
+		return "false"
+	case "int64", "uint64", "float64":
+		return "0"
+	case "string":
+		return `""`
+	}
+	return "nil"
+}
+
+// fieldName returns the exported Go name for the hash key k, or "" if k
+// can't be turned into an identifier
+func fieldName(k string) string {
+	words := strings.FieldsFunc(k, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	if len(words) == 0 {
+		return ""
+	}
+	if r, _ := utf8.DecodeRuneInString(words[0]); !unicode.IsLetter(r) {
+		return ""
+	}
+
+	var name strings.Builder
+	for _, w := range words {
+		if initialisms[strings.ToLower(w)] {
+			name.WriteString(strings.ToUpper(w))
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(w)
+		name.WriteRune(unicode.ToUpper(r))
+		name.WriteString(w[size:])
+	}
+	return name.String()
+}
+
+var initialisms = map[string]bool{
+	"api": true, "html": true, "http": true, "id": true, "ip": true, "json": true,
+	"sql": true, "uid": true, "uri": true, "url": true, "uuid": true, "xml": true,
+}
+
+// singular returns the name of an element of the list called name
+func singular(name string) string {
+	switch {
+	case strings.HasSuffix(name, "ies") && len(name) > 3:
+		return name[:len(name)-3] + "y"
+	case strings.HasSuffix(name, "ss"):
+		return name + "Item"
+	case strings.HasSuffix(name, "s") && len(name) > 1:
+		return name[:len(name)-1]
+	}
+	return name + "Item"
+}
+
+func structs(args []string) error {
+	fs := flag.NewFlagSet("struct", flag.ExitOnError)
+	name := fs.String("name", "Document", "name of the struct of the bodies")
+	pkg := fs.String("package", "main", "package of the generated file")
+	output := fs.String("o", "", "output file; defaults to the standard output")
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		return fmt.Errorf("struct takes at least one document")
+	}
+
+	root := newShape()
+	for _, fname := range fs.Args() {
+		b, err := readFile(fname)
+		if err != nil {
+			return err
+		}
+
+		var v interface{}
+		if err := sereal.NewDecoder().Unmarshal(b, &v); err != nil {
+			return fmt.Errorf("%s: %v", fname, err)
+		}
+		root.add(v)
+	}
+
+	if root.kinds != kindHash || root.isMap() {
+		return fmt.Errorf("the bodies of the documents aren't all hashes with keys usable as field names")
+	}
+
+	g := &structGen{names: make(map[string]bool)}
+	g.define(root, *name)
+
+	src, err := g.source(*pkg, fs.NArg())
+	if err != nil {
+		return err
+	}
+
+	if *output == "" {
+		_, err = os.Stdout.Write(src)
+		return err
+	}
+	return ioutil.WriteFile(*output, src, 0644)
+}
@@ -0,0 +1,310 @@
+package sereal
+
+import (
+	"math"
+	"reflect"
+)
+
+// decodeCommon decodes the value starting at by[idx] into body without
+// reflection when body points to a nil or empty map or slice of one of the
+// shapes most documents have: maps and slices of strings, int64s, ints and
+// interface{} values. Elements of other types than expected, tracked ones
+// included, still go through decodeViaReflection. It reports whether it
+// handled body.
+func (d *decoder) decodeCommon(by []byte, idx int, body interface{}) (bool, error) {
+	if d.report != nil {
+		return false, nil
+	}
+
+	var err error
+	switch p := body.(type) {
+	case *map[string]string:
+		if len(*p) != 0 {
+			return false, nil
+		}
+		start, ln, ok := commonContainer(by, idx, true)
+		if !ok {
+			return false, nil
+		}
+
+		m := make(map[string]string, ln)
+		*p = m
+		v := new(string)
+		err = d.commonHash(by, start, ln, func(key []byte, idx int) (int, error) {
+			*v = ""
+			tracked := len(d.tracked)
+			idx, err := d.decodeCommonString(by, idx, v)
+			m[d.str(key)] = *v
+			if len(d.tracked) != tracked {
+				// REFP and ALIAS tags may refer to v later on
+				v = new(string)
+			}
+			return idx, err
+		})
+
+	case *map[string]int64:
+		if len(*p) != 0 {
+			return false, nil
+		}
+		start, ln, ok := commonContainer(by, idx, true)
+		if !ok {
+			return false, nil
+		}
+
+		m := make(map[string]int64, ln)
+		*p = m
+		v := new(int64)
+		err = d.commonHash(by, start, ln, func(key []byte, idx int) (int, error) {
+			*v = 0
+			tracked := len(d.tracked)
+			idx, err := d.decodeCommonInt64(by, idx, v)
+			m[d.str(key)] = *v
+			if len(d.tracked) != tracked {
+				// REFP and ALIAS tags may refer to v later on
+				v = new(int64)
+			}
+			return idx, err
+		})
+
+	case *map[string]int:
+		if len(*p) != 0 {
+			return false, nil
+		}
+		start, ln, ok := commonContainer(by, idx, true)
+		if !ok {
+			return false, nil
+		}
+
+		m := make(map[string]int, ln)
+		*p = m
+		v := new(int)
+		err = d.commonHash(by, start, ln, func(key []byte, idx int) (int, error) {
+			*v = 0
+			tracked := len(d.tracked)
+			idx, err := d.decodeCommonInt(by, idx, v)
+			m[d.str(key)] = *v
+			if len(d.tracked) != tracked {
+				// REFP and ALIAS tags may refer to v later on
+				v = new(int)
+			}
+			return idx, err
+		})
+
+	case *map[string]interface{}:
+		if len(*p) != 0 {
+			return false, nil
+		}
+		start, ln, ok := commonContainer(by, idx, true)
+		if !ok {
+			return false, nil
+		}
+
+		m := make(map[string]interface{}, ln)
+		*p = m
+		err = d.commonHash(by, start, ln, func(key []byte, idx int) (int, error) {
+			var v interface{}
+			idx, err := d.decode(by, idx, &v)
+			m[d.str(key)] = v
+			return idx, err
+		})
+
+	case *[]string:
+		if len(*p) != 0 {
+			return false, nil
+		}
+		start, ln, ok := commonContainer(by, idx, false)
+		if !ok {
+			return false, nil
+		}
+
+		s := make([]string, ln)
+		*p = s
+		err = d.commonArray(by, start, ln, func(i int, idx int) (int, error) {
+			return d.decodeCommonString(by, idx, &s[i])
+		})
+
+	case *[]int64:
+		if len(*p) != 0 {
+			return false, nil
+		}
+		start, ln, ok := commonContainer(by, idx, false)
+		if !ok {
+			return false, nil
+		}
+
+		s := make([]int64, ln)
+		*p = s
+		err = d.commonArray(by, start, ln, func(i int, idx int) (int, error) {
+			return d.decodeCommonInt64(by, idx, &s[i])
+		})
+
+	case *[]int:
+		if len(*p) != 0 {
+			return false, nil
+		}
+		start, ln, ok := commonContainer(by, idx, false)
+		if !ok {
+			return false, nil
+		}
+
+		s := make([]int, ln)
+		*p = s
+		err = d.commonArray(by, start, ln, func(i int, idx int) (int, error) {
+			return d.decodeCommonInt(by, idx, &s[i])
+		})
+
+	case *[]interface{}:
+		if len(*p) != 0 {
+			return false, nil
+		}
+		start, ln, ok := commonContainer(by, idx, false)
+		if !ok {
+			return false, nil
+		}
+
+		s := make([]interface{}, ln)
+		*p = s
+		err = d.commonArray(by, start, ln, func(i int, idx int) (int, error) {
+			return d.decode(by, idx, &s[i])
+		})
+
+	default:
+		return false, nil
+	}
+
+	if err != nil {
+		err = d.locate(by, idx, err)
+	}
+	return true, err
+}
+
+// commonContainer returns the offset of the first element of the hash or
+// array starting at by[idx], possibly behind REFN tags, and its length. It
+// reports false for anything else, tracked containers included, so that the
+// reflection path decodes them or reports the error.
+func commonContainer(by []byte, idx int, hash bool) (int, int, bool) {
+	for {
+		idx = skipPads(by, idx)
+		if idx >= len(by) || by[idx]&trackFlag != 0 {
+			return 0, 0, false
+		}
+
+		tag := by[idx]
+		idx++
+
+		var ln int
+		switch {
+		case tag == typeREFN:
+			continue
+
+		case hash && tag == typeHASH, !hash && tag == typeARRAY:
+			var sz int
+			var err error
+			if ln, sz, err = varintdecode(by[idx:]); err != nil || ln < 0 || ln > math.MaxInt32 {
+				return 0, 0, false
+			}
+			idx += sz
+
+		case hash && tag >= typeHASHREF_0 && tag < typeHASHREF_0+16:
+			ln = int(tag & 0x0f)
+
+		case !hash && tag >= typeARRAYREF_0 && tag < typeARRAYREF_0+16:
+			ln = int(tag & 0x0f)
+
+		default:
+			return 0, 0, false
+		}
+
+		n := ln
+		if hash {
+			n *= 2
+		}
+		if idx+n > len(by) {
+			return 0, 0, false
+		}
+		return idx, ln, true
+	}
+}
+
+// commonHash decodes the ln entries of the hash starting at by[idx], the
+// values with value
+func (d *decoder) commonHash(by []byte, idx int, ln int, value func(key []byte, idx int) (int, error)) error {
+	var key []byte
+	var err error
+	for i := 0; i < ln; i++ {
+		if key, idx, err = d.decodeStringish(by, idx); err != nil {
+			return err
+		}
+
+		d.pushKey(key)
+		if idx, err = value(key, idx); err != nil {
+			return d.keyError(err, key)
+		}
+		d.popPath()
+	}
+	return nil
+}
+
+// commonArray decodes the ln elements of the array starting at by[idx] with
+// elem
+func (d *decoder) commonArray(by []byte, idx int, ln int, elem func(i int, idx int) (int, error)) error {
+	var err error
+	for i := 0; i < ln; i++ {
+		d.pushIndex(i)
+		if idx, err = elem(i, idx); err != nil {
+			return d.indexError(err, i)
+		}
+		d.popPath()
+	}
+	return nil
+}
+
+func (d *decoder) decodeCommonString(by []byte, idx int, p *string) (int, error) {
+	if i := skipPads(by, idx); i < len(by) && isStringishTag(by[i]) {
+		if b, next, err := d.decodeStringish(by, i); err == nil {
+			*p = d.str(b)
+			return next, nil
+		}
+	}
+	return d.decodeViaReflection(by, idx, reflect.ValueOf(p).Elem())
+}
+
+func (d *decoder) decodeCommonInt64(by []byte, idx int, p *int64) (int, error) {
+	if n, next, ok := d.commonInt(by, idx); ok {
+		*p = int64(n)
+		return next, nil
+	}
+	return d.decodeViaReflection(by, idx, reflect.ValueOf(p).Elem())
+}
+
+func (d *decoder) decodeCommonInt(by []byte, idx int, p *int) (int, error) {
+	if n, next, ok := d.commonInt(by, idx); ok {
+		*p = n
+		return next, nil
+	}
+	return d.decodeViaReflection(by, idx, reflect.ValueOf(p).Elem())
+}
+
+// commonInt decodes the untracked integer starting at by[idx] if it fits an
+// int. It reports false for anything else, errors included, which the
+// reflection path reproduces.
+func (d *decoder) commonInt(by []byte, idx int) (int, int, bool) {
+	idx = skipPads(by, idx)
+	if idx >= len(by) {
+		return 0, 0, false
+	}
+
+	switch tag := by[idx]; {
+	case tag < typeVARINT:
+		return d.decodeInt(tag), idx + 1, true
+
+	case tag == typeVARINT:
+		n, next, err := d.decodeVarint(by, idx+1)
+		return n, next, err == nil && n >= 0
+
+	case tag == typeZIGZAG:
+		n, next, err := d.decodeZigzag(by, idx+1)
+		return n, next, err == nil
+	}
+	return 0, 0, false
+}
@@ -0,0 +1,90 @@
+package sereal
+
+import (
+	"fmt"
+	"sync"
+)
+
+// A Compressor compresses and decompresses document bodies for a document
+// type registered with RegisterCompressor
+type Compressor interface {
+	// Compress returns the compressed form of the body b. It may reuse b.
+	Compress(b []byte) ([]byte, error)
+
+	// Decompress returns the body compressed in b, reusing dst if it is
+	// large enough
+	Decompress(dst, b []byte) ([]byte, error)
+}
+
+// Document types the Sereal specification hasn't assigned yet, which
+// RegisterCompressor accepts. They aren't a range set aside for applications:
+// the maintainers of the protocol assign new types, which may later clash
+// with a registered one. Documents using them are private to the decoders
+// which registered the same Compressor.
+const (
+	FirstUnassignedDocType = 5
+	LastUnassignedDocType  = 15
+)
+
+var compressors = struct {
+	sync.RWMutex
+	m map[byte]Compressor
+}{m: make(map[byte]Compressor)}
+
+// RegisterCompressor makes c compress and decompress the documents of type
+// doctype, which must be between FirstUnassignedDocType and
+// LastUnassignedDocType. Encoders use it once their Compression is a
+// RegisteredCompressor of that DocType; decoders use it for every document of
+// that type.
+func RegisterCompressor(doctype byte, c Compressor) error {
+	if doctype < FirstUnassignedDocType || doctype > LastUnassignedDocType {
+		return fmt.Errorf("sereal: document type %d isn't unassigned, want %d to %d", doctype, FirstUnassignedDocType, LastUnassignedDocType)
+	}
+
+	compressors.Lock()
+	compressors.m[doctype] = c
+	compressors.Unlock()
+	return nil
+}
+
+func registeredCompressor(doctype byte) (Compressor, error) {
+	compressors.RLock()
+	c, ok := compressors.m[doctype]
+	compressors.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("document type '%d' not yet supported", doctype)
+	}
+	return c, nil
+}
+
+// RegisteredCompressor compresses documents with the Compressor registered
+// for DocType
+type RegisteredCompressor struct {
+	DocType byte
+
+	// Always applies the Compressor to every document, whatever
+	// CompressionThreshold, e.g. when it encrypts them
+	Always bool
+}
+
+func (c RegisteredCompressor) compress(b []byte) ([]byte, error) {
+	comp, err := registeredCompressor(c.DocType)
+	if err != nil {
+		return nil, err
+	}
+	return comp.Compress(b)
+}
+
+func (c RegisteredCompressor) decompress(d, b []byte) ([]byte, error) {
+	comp, err := registeredCompressor(c.DocType)
+	if err != nil {
+		return nil, err
+	}
+	return comp.Decompress(d, b)
+}
+
+// compressAlways tells whether c applies to documents of any size
+func compressAlways(c compressor) bool {
+	rc, ok := c.(RegisteredCompressor)
+	return ok && rc.Always
+}
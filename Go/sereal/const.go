@@ -1,8 +1,16 @@
 package sereal
 
-// ProtocolVersion is a maximum version supported by the sereal package.
+import "strconv"
+
+// ProtocolVersion is the version of the documents Encoders write unless
+// told otherwise, the highest which Perl consumers without zstd support read.
 const ProtocolVersion = 3
 
+// MaxSupportedVersion is the highest protocol version Encoder.SetVersion
+// accepts. Version 4 documents are written like version 3 ones, but may be
+// compressed with zstd.
+const MaxSupportedVersion = 4
+
 // magicHeadrBytes is a magic string for header. Every packet in protocol
 // version 1 and 2 starts with this.
 const magicHeaderBytes = uint32(0x6c72733d) // "=srl"
@@ -31,6 +39,22 @@ const (
 	serealZstd
 )
 
+func (t documentType) String() string {
+	switch t {
+	case serealRaw:
+		return "raw"
+	case serealSnappy:
+		return "snappy"
+	case serealSnappyIncremental:
+		return "snappy_incr"
+	case serealZlib:
+		return "zlib"
+	case serealZstd:
+		return "zstd"
+	}
+	return "doctype" + strconv.Itoa(int(t))
+}
+
 const trackFlag = byte(0x80)
 
 const (
@@ -65,3 +89,84 @@ const (
 	typeHASHREF_0       = 0x50
 	typeSHORT_BINARY_0  = 0x60
 )
+
+// tagName returns the name of a tag as used in the Sereal specification
+func tagName(tag byte) string {
+	tag &^= trackFlag
+
+	switch {
+	case tag < 0x10:
+		return "POS_" + strconv.Itoa(int(tag))
+	case tag < typeVARINT:
+		return "NEG_" + strconv.Itoa(32-int(tag))
+	case tag >= typeSHORT_BINARY_0:
+		return "SHORT_BINARY_" + strconv.Itoa(int(tag&0x1f))
+	case tag >= typeHASHREF_0:
+		return "HASHREF_" + strconv.Itoa(int(tag&0x0f))
+	case tag >= typeARRAYREF_0:
+		return "ARRAYREF_" + strconv.Itoa(int(tag&0x0f))
+	}
+
+	switch tag {
+	case typeVARINT:
+		return "VARINT"
+	case typeZIGZAG:
+		return "ZIGZAG"
+	case typeFLOAT:
+		return "FLOAT"
+	case typeDOUBLE:
+		return "DOUBLE"
+	case typeLONG_DOUBLE:
+		return "LONG_DOUBLE"
+	case typeUNDEF:
+		return "UNDEF"
+	case typeBINARY:
+		return "BINARY"
+	case typeSTR_UTF8:
+		return "STR_UTF8"
+	case typeREFN:
+		return "REFN"
+	case typeREFP:
+		return "REFP"
+	case typeHASH:
+		return "HASH"
+	case typeARRAY:
+		return "ARRAY"
+	case typeOBJECT:
+		return "OBJECT"
+	case typeOBJECTV:
+		return "OBJECTV"
+	case typeALIAS:
+		return "ALIAS"
+	case typeCOPY:
+		return "COPY"
+	case typeWEAKEN:
+		return "WEAKEN"
+	case typeREGEXP:
+		return "REGEXP"
+	case typeOBJECT_FREEZE:
+		return "OBJECT_FREEZE"
+	case typeOBJECTV_FREEZE:
+		return "OBJECTV_FREEZE"
+	case typeCANONICAL_UNDEF:
+		return "CANONICAL_UNDEF"
+	case typeFALSE:
+		return "FALSE"
+	case typeTRUE:
+		return "TRUE"
+	case typeMANY:
+		return "MANY"
+	case typePACKET_START:
+		return "PACKET_START"
+	case typeEXTEND:
+		return "EXTEND"
+	case typePAD:
+		return "PAD"
+	}
+
+	return "RESERVED_" + strconv.Itoa(int(tag))
+}
+
+// ClassKey is the map key holding the class name of objects decoded into maps
+// when Decoder.ClassIntoMaps is set
+const ClassKey = "__class"
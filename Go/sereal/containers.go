@@ -0,0 +1,121 @@
+package sereal
+
+import (
+	"container/list"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// sync.Map and list.List keep their content in unexported fields: they are
+// encoded as a hash and an array of their content instead of as structs, and
+// decoded back from them.
+
+var (
+	syncMapType = reflect.TypeOf((*sync.Map)(nil)).Elem()
+	listType    = reflect.TypeOf((*list.List)(nil)).Elem()
+)
+
+// containerAddr returns a pointer to the container rv, copying it first if
+// it isn't addressable
+func containerAddr(rv reflect.Value) interface{} {
+	if !rv.CanAddr() {
+		cp := reflect.New(rv.Type()).Elem()
+		cp.Set(rv)
+		rv = cp
+	}
+	return rv.Addr().Interface()
+}
+
+func (e *Encoder) encodeSyncMap(by []byte, m *sync.Map, isRefNext bool, strTable map[string]int, ptrTable map[uintptr]int) ([]byte, error) {
+	var keys []reflect.Value
+	values := make(map[interface{}]interface{})
+	m.Range(func(k, v interface{}) bool {
+		keys = append(keys, reflect.ValueOf(k))
+		values[k] = v
+		return true
+	})
+	if e.Canonical {
+		sortMapKeys(keys)
+	}
+
+	by = e.containerHead(by, typeHASH, len(keys), isRefNext)
+
+	var err error
+	for _, k := range keys {
+		if e.PerlCompat {
+			by = e.encodeString(by, fmt.Sprint(k.Interface()), true, strTable)
+		} else if by, err = e.encode(by, k.Interface(), true, false, strTable, ptrTable); err != nil {
+			return nil, err
+		}
+
+		if by, err = e.encode(by, values[k.Interface()], false, false, strTable, ptrTable); err != nil {
+			return nil, err
+		}
+	}
+
+	return by, nil
+}
+
+func (e *Encoder) encodeList(by []byte, l *list.List, isRefNext bool, strTable map[string]int, ptrTable map[uintptr]int) ([]byte, error) {
+	by = e.containerHead(by, typeARRAY, l.Len(), isRefNext)
+
+	var err error
+	for el := l.Front(); el != nil; el = el.Next() {
+		if by, err = e.encode(by, el.Value, false, false, strTable, ptrTable); err != nil {
+			return nil, err
+		}
+	}
+
+	return by, nil
+}
+
+// decodeSyncMap stores the ln entries of a hash into m. Keys are decoded
+// generically, binary strings becoming strings.
+func (d *decoder) decodeSyncMap(by []byte, idx int, ln int, m *sync.Map) (int, error) {
+	var err error
+	for i := 0; i < ln; i++ {
+		var key interface{}
+		if idx, err = d.decode(by, idx, &key); err != nil {
+			return 0, err
+		}
+		if b, ok := key.([]byte); ok {
+			key = string(b)
+		}
+		if key != nil && !reflect.TypeOf(key).Comparable() {
+			return 0, fmt.Errorf("sereal: can't use %T as a sync.Map key", key)
+		}
+
+		var value interface{}
+		if d.trackPath {
+			d.pushKey([]byte(fmt.Sprint(key)))
+		}
+		if idx, err = d.decode(by, idx, &value); err != nil {
+			return 0, d.keyError(err, []byte(fmt.Sprint(key)))
+		}
+		d.popPath()
+
+		m.Store(key, value)
+	}
+
+	return idx, nil
+}
+
+// decodeList replaces the content of l with the ln elements of an array
+func (d *decoder) decodeList(by []byte, idx int, ln int, l *list.List) (int, error) {
+	l.Init()
+
+	var err error
+	for i := 0; i < ln; i++ {
+		var value interface{}
+		d.pushIndex(i)
+		if idx, err = d.decode(by, idx, &value); err != nil {
+			return 0, d.indexError(err, i)
+		}
+		d.popPath()
+
+		l.PushBack(value)
+	}
+
+	return idx, nil
+}
@@ -0,0 +1,317 @@
+package sereal
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"runtime"
+)
+
+// Convert stores src, a value obtained by decoding into an interface{}, into
+// the value pointed to by dst. It follows the same rules as Unmarshal does
+// when decoding into dst directly, so that a document can be decoded once and
+// projected into several typed destinations without decoding it again.
+func Convert(src interface{}, dst interface{}) error {
+	d := &Decoder{}
+	return d.Convert(src, dst)
+}
+
+// Convert stores src, a value obtained by decoding into an interface{}, into
+// the value pointed to by dst, using the classes registered on d
+func (d *Decoder) Convert(src interface{}, dst interface{}) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(runtime.Error); ok {
+				panic(r)
+			}
+
+			switch t := r.(type) {
+			case string:
+				err = errors.New(t)
+			case error:
+				err = t
+			}
+		}
+	}()
+
+	ptr := reflect.ValueOf(dst)
+	if ptr.Kind() != reflect.Ptr {
+		return ErrBodyPointer
+	}
+
+	dec := decoder{Decoder: d, section: "body", trackPath: true}
+	return dec.convert(reflect.ValueOf(src), ptr.Elem())
+}
+
+func (d *decoder) convert(src reflect.Value, ptr reflect.Value) error {
+	// at this point the structure of the destination is unknown, keep the
+	// value as it is
+	if ptr.Kind() == reflect.Interface && ptr.IsNil() {
+		if src.IsValid() {
+			ptr.Set(src)
+		}
+		return nil
+	}
+
+	for src.Kind() == reflect.Interface {
+		src = src.Elem()
+	}
+
+	if !src.IsValid() {
+		switch ptr.Kind() {
+		case reflect.Ptr, reflect.Map, reflect.Slice:
+			ptr.Set(reflect.Zero(ptr.Type()))
+		default:
+			if d.UndefAsZero {
+				ptr.Set(reflect.Zero(ptr.Type()))
+			}
+		}
+		return nil
+	}
+
+	if implementsUnmarshaler(ptr) {
+		return d.convertViaUnmarshaler(src, ptr)
+	}
+
+	// values of registered classes are already typed
+	if src.Type().AssignableTo(ptr.Type()) {
+		ptr.Set(src)
+		return nil
+	}
+
+	if isBigType(ptr.Type()) {
+		if ok, err := setBig(ptr, src.Interface()); ok {
+			if err != nil {
+				return fmt.Errorf("sereal: %v at %s", err, d.pathString())
+			}
+			return nil
+		}
+	}
+
+	if ptr.Type() == timeType {
+		if ok, err := convertTime(src.Interface(), ptr); ok {
+			if err != nil {
+				return fmt.Errorf("sereal: %v at %s", err, d.pathString())
+			}
+			return nil
+		}
+	}
+
+	switch v := src.Interface().(type) {
+	case int:
+		return d.setInt(ptr, v, false, -1)
+
+	case uint:
+		return d.setInt(ptr, int(v), true, -1)
+
+	case float32:
+		return d.setFloat(ptr, float64(v), -1)
+
+	case float64:
+		return d.setFloat(ptr, v, -1)
+
+	case bool:
+		d.setBool(ptr, v)
+
+	case string:
+		ptr.SetString(v)
+
+	case []byte:
+		setBinary(ptr, v)
+
+	case map[string]interface{}:
+		return d.convertHash(v, ptr)
+
+	case []interface{}:
+		return d.convertArray(v, ptr)
+
+	case PerlObject:
+		return d.convert(reflect.ValueOf(v.Reference), ptr)
+
+	case *PerlObject:
+		return d.convert(reflect.ValueOf(v.Reference), ptr)
+
+	case *PerlWeakRef:
+		return d.convert(reflect.ValueOf(v.Reference), ptr)
+
+	case *PerlAlias:
+		return d.convert(reflect.ValueOf(v.Alias), ptr)
+
+	case *PerlUndef:
+		return d.convert(reflect.Value{}, ptr)
+
+	case *PerlFreeze:
+		return d.convertFreeze(v, ptr)
+
+	default:
+		switch {
+		case src.Kind() == reflect.Ptr && src.Type().Elem().AssignableTo(ptr.Type()):
+			// REFP to a value decoded via reflection
+			ptr.Set(src.Elem())
+
+		case src.Kind() == reflect.Ptr:
+			// references built by a PerlCompat decoder
+			return d.convert(src.Elem(), ptr)
+
+		default:
+			return fmt.Errorf("can't convert %v into %v", src.Type(), ptr.Type())
+		}
+	}
+
+	return nil
+}
+
+func (d *decoder) convertHash(m map[string]interface{}, ptr reflect.Value) error {
+	switch ptr.Kind() {
+	case reflect.Map:
+		if ptr.IsNil() {
+			ptr.Set(reflect.MakeMap(ptr.Type()))
+		}
+
+		keyType := ptr.Type().Key()
+		for key, value := range m {
+			d.pushKey([]byte(key))
+			riface := reflect.New(ptr.Type().Elem())
+			if err := d.convert(reflect.ValueOf(value), riface.Elem()); err != nil {
+				return err
+			}
+
+			kv, err := parseKey(keyType, key)
+			if err != nil {
+				return fmt.Errorf("sereal: %v at %s", err, d.pathString())
+			}
+			ptr.SetMapIndex(kv, riface.Elem())
+			d.popPath()
+		}
+
+	case reflect.Ptr:
+		if ptr.IsNil() {
+			ptr.Set(reflect.New(ptr.Type().Elem()))
+		}
+
+		return d.convertHash(m, ptr.Elem())
+
+	case reflect.Struct:
+		tags := tcache.Get(ptr)
+		for key, value := range m {
+			fld, found := d.fieldForKey(ptr.Type(), tags, key)
+
+			if !found {
+				if rf, ok := tcache.RemainField(ptr); ok && ptr.Field(rf).CanSet() {
+					if err := d.convertRemain(reflect.ValueOf(value), ptr.Field(rf), key); err != nil {
+						return err
+					}
+					continue
+				}
+
+				if err := d.unknownKey(ptr, []byte(key), -1); err != nil {
+					return err
+				}
+
+				// struct doesn't contain field with key name
+				continue
+			}
+
+			d.pushKey([]byte(key))
+			if s, ok := value.(string); ok && fld.asString {
+				if err := parseNumber(ptr.Field(fld.id), s); err != nil {
+					return fmt.Errorf("sereal: %v at %s", err, d.pathString())
+				}
+			} else if b, ok := value.([]byte); ok && fld.asString {
+				if err := parseNumber(ptr.Field(fld.id), string(b)); err != nil {
+					return fmt.Errorf("sereal: %v at %s", err, d.pathString())
+				}
+			} else if err := d.convert(reflect.ValueOf(value), ptr.Field(fld.id)); err != nil {
+				return err
+			}
+			d.popPath()
+		}
+
+	default:
+		return &reflect.ValueError{Method: "sereal.convertHash", Kind: ptr.Kind()}
+	}
+
+	return nil
+}
+
+// convertRemain stores the value of the hash entry key, matching no field of
+// the struct it is converted into, into the entry of the map field tagged
+// ",remain"
+func (d *decoder) convertRemain(src reflect.Value, remain reflect.Value, key string) error {
+	if remain.IsNil() {
+		remain.Set(reflect.MakeMap(remain.Type()))
+	}
+
+	value := reflect.New(remain.Type().Elem()).Elem()
+	if err := d.convert(src, value); err != nil {
+		return err
+	}
+
+	remain.SetMapIndex(reflect.ValueOf(key).Convert(remain.Type().Key()), value)
+	return nil
+}
+
+func (d *decoder) convertArray(arr []interface{}, ptr reflect.Value) error {
+	switch ptr.Kind() {
+	case reflect.Slice:
+		if ptr.IsNil() || ptr.Len() == 0 {
+			ptr.Set(reflect.MakeSlice(ptr.Type(), len(arr), len(arr)))
+		}
+
+	case reflect.Array:
+		// do nothing
+
+	case reflect.Ptr:
+		if ptr.IsNil() {
+			ptr.Set(reflect.New(ptr.Type().Elem()))
+		}
+
+		return d.convertArray(arr, ptr.Elem())
+
+	default:
+		return &reflect.ValueError{Method: "sereal.convertArray", Kind: ptr.Kind()}
+	}
+
+	// elements beyond the length of the destination are ignored
+	n := len(arr)
+	if ptr.Len() < n {
+		n = ptr.Len()
+	}
+
+	for i := 0; i < n; i++ {
+		d.pushIndex(i)
+		if err := d.convert(reflect.ValueOf(arr[i]), ptr.Index(i)); err != nil {
+			return err
+		}
+		d.popPath()
+	}
+
+	return nil
+}
+
+func (d *decoder) convertFreeze(f *PerlFreeze, ptr reflect.Value) error {
+	if obj, ok := findUnmarshaler(ptr); ok {
+		if err := obj.UnmarshalBinary(f.Data); err != nil {
+			return &ThawError{Class: f.Class, Path: d.pathString(), Offset: -1, Err: err}
+		}
+		return nil
+	}
+
+	if ptr.Kind() == reflect.Slice && ptr.Type().Elem().Kind() == reflect.Uint8 && ptr.IsNil() {
+		ptr.Set(reflect.ValueOf(f.Data))
+		return nil
+	}
+
+	return fmt.Errorf("can't unpack FROZEN object into %v", ptr.Type())
+}
+
+// convertViaUnmarshaler encodes src again and hands it to the UnmarshalSereal
+// method of ptr
+func (d *decoder) convertViaUnmarshaler(src reflect.Value, ptr reflect.Value) error {
+	raw, err := rawEncoder.encodeRaw(nil, src.Interface())
+	if err != nil {
+		return err
+	}
+
+	return unmarshalerOf(ptr).UnmarshalSereal(raw)
+}
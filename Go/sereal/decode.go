@@ -1,21 +1,27 @@
 package sereal
 
 import (
+	"container/list"
 	"encoding"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"math"
 	"reflect"
 	"runtime"
+	"strconv"
 	"strings"
+	"sync"
+	"unicode/utf8"
 )
 
 type serealHeader struct {
 	doctype     documentType
 	version     byte
 	suffixStart int
-	suffixSize  int
+	suffixSize  int // size of the suffix, its length varint included
+	suffixLen   int // length of the suffix data, flag byte included
 	suffixFlags uint8
 }
 
@@ -57,11 +63,22 @@ func readHeader(b []byte) (serealHeader, error) {
 	}
 
 	h.suffixSize = ln + sz
+	h.suffixLen = ln
 	h.suffixStart = headerSize + sz
 
 	return h, nil
 }
 
+// DocumentInfo describes how a document was framed and compressed
+type DocumentInfo struct {
+	Version        int    // protocol version
+	DocType        string // "raw", "snappy", "snappy_incr", "zlib" or "zstd"
+	SuffixFlags    byte   // flag byte of the header suffix, 0 if there is none
+	HeaderSize     int    // size of the header, suffix included
+	BodySize       int    // size of the uncompressed body, -1 if it wasn't decompressed
+	CompressedSize int    // size of the body as stored, equal to BodySize for raw documents
+}
+
 // LooksLikeSereal perofrms a quick and rudimentary check whether the buffer contains a Sereal document
 func LooksLikeSereal(b []byte) bool {
 	if len(b) < 7 {
@@ -73,14 +90,308 @@ func LooksLikeSereal(b []byte) bool {
 	return err == nil
 }
 
-// A Decoder reads and decodes Sereal objects from an input buffer
+// A Decoder reads and decodes Sereal objects from an input buffer.
+//
+// A Decoder may be used concurrently by multiple goroutines once it has been
+// configured; registering names while decoding is not safe.
 type Decoder struct {
-	tracked   map[int]reflect.Value
-	umcache   map[string]reflect.Type
-	tcache    tagsCache
-	copyDepth int
+	umcache    map[string]reflect.Type
+	classcache map[string]reflect.Type
 
 	PerlCompat bool
+
+	// TolerantSnappyLength accepts snappy_incr documents whose compressed
+	// length disagrees with the actual payload, as emitted by some old Perl
+	// encoders. The length is then recovered from the snappy stream.
+	TolerantSnappyLength bool
+
+	// SnappyCodec is the snappy implementation used to decompress snappy
+	// documents, GoSnappy when nil
+	SnappyCodec SnappyCodec
+
+	// Logger, if set, is told about anomalies tolerated while decoding
+	Logger Logger
+
+	// MaxCopyDepth bounds the length of COPY chains, i.e. COPY tags pointing
+	// to values which are themselves COPY tags. The spec allows such chains
+	// but most encoders never emit them. The default, used when it is zero,
+	// is DefaultMaxCopyDepth; a value of 1 rejects any nesting.
+	MaxCopyDepth int
+
+	// DeprecatedTitleMatch matches hash keys which don't name a struct field
+	// to the field named after the key passed through strings.Title, e.g.
+	// "foo-bar" to a field named "Foo-Bar". When it is false only the key
+	// with its first letter upper-cased is tried. nil stands for true in
+	// this release; the default will then change to false. CheckTitleMatch
+	// reports the fields whose matching changes.
+	DeprecatedTitleMatch *bool
+
+	// ClassIntoMaps stores the class name of objects decoded into maps
+	// under ClassKey. Structs capture it into a field tagged ",class".
+	ClassIntoMaps bool
+
+	// DictionaryResolver looks up the dictionaries identified in the header
+	// of documents compressed with a preset dictionary
+	DictionaryResolver DictionaryResolver
+
+	// Dictionary is the preset dictionary of the documents whose header
+	// doesn't identify theirs, compressed with a Dictionary but no
+	// DictionaryID. UnmarshalBodyOnly uses it for all documents.
+	Dictionary []byte
+
+	// PoolMapValues keeps the temporary values used to decode into map
+	// entries in a pool shared by all Unmarshal calls, rather than
+	// allocating one per decoded hash. It pays off when the same map types
+	// are decoded over and over, e.g. when refreshing a cache.
+	PoolMapValues bool
+
+	// UndefAsZero sets the values undef is decoded into to their zero value
+	// whatever their kind, e.g. 0 for an int field. Otherwise only pointers,
+	// maps and slices are set to nil, and other values are left as they
+	// were, e.g. with the value of a previous Unmarshal.
+	UndefAsZero bool
+
+	// AliasInput lets decoded byte slices, i.e. binary strings and the
+	// pattern and modifiers of regular expressions, share memory with the
+	// document, or with its decompressed body, rather than be copies. It
+	// saves allocations when the document outlives the decoded values and
+	// is never modified. Strings are always copies.
+	AliasInput bool
+
+	// Strict returns a StrictError rather than losing data silently when an
+	// integer doesn't fit the integer type it is decoded into, a float is
+	// decoded into an integer, or a hash key matches no field of the struct
+	// it is decoded into
+	Strict bool
+
+	// CoerceBools decodes TRUE and FALSE into numbers as 1 and 0, and into
+	// strings as "1" and "", the values Perl gives them, rather than
+	// failing
+	CoerceBools bool
+
+	// UseNumber decodes numbers into interface{} values as Number, their
+	// decimal text, rather than as int, uint, float32 or float64, as
+	// json.Decoder.UseNumber does. Re-encoding them to JSON then keeps
+	// their exact value.
+	UseNumber bool
+
+	// TranslateRegexps decodes regular expressions into interface{} values
+	// as *regexp.Regexp, as PerlRegexp.Compile translates them, rather than
+	// as *PerlRegexp. Decoding fails with a RegexpError on the patterns
+	// which can't be translated. Regular expressions decoded into
+	// *regexp.Regexp values are always translated.
+	TranslateRegexps bool
+
+	// ValidateUTF8 rejects documents with STR_UTF8 strings which aren't
+	// valid UTF-8, as Perl strings wrongly flagged as UTF-8 are, with an
+	// error wrapping ErrInvalidUTF8. Otherwise they are decoded as they
+	// are, and fail later on, e.g. when marshaled to JSON.
+	ValidateUTF8 bool
+
+	// BinaryAsString decodes binary strings into interface{} values as
+	// strings rather than as []byte, e.g. for Perl text which never needed
+	// the UTF-8 flag. Their bytes are kept as they are: Latin-1 text isn't
+	// converted to UTF-8.
+	BinaryAsString bool
+
+	// ArrayOverflowPolicy chooses what becomes of the elements of an ARRAY
+	// beyond the length of the Go array it is decoded into: they are
+	// dropped by default, and rejected with ArrayError
+	ArrayOverflowPolicy ArrayOverflowPolicy
+
+	// KeyMatcher, if set, matches hash keys naming no struct field to the
+	// field they are decoded into, e.g. SnakeCaseKeys for the keys of Perl
+	// producers. It replaces the upper-casing of DeprecatedTitleMatch. The
+	// folded names of fields are cached by the function of KeyMatcher, so
+	// that it may change between uses, but not for another closure of the
+	// same function literal.
+	KeyMatcher KeyMatcher
+
+	mapValuePools sync.Map // reflect.Type -> *sync.Pool of pointers, used by PoolMapValues
+	keyMatchTags  sync.Map // keyMatchKey -> map[string]tag, used by KeyMatcher
+}
+
+// Logger is the interface used to report anomalies tolerated while decoding.
+// It is implemented by *log.Logger.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// decoder holds the state of a single Unmarshal call
+type decoder struct {
+	*Decoder
+	tracked      map[int]reflect.Value
+	copyDepth    int
+	classes      map[string]reflect.Type    // per-call overlay set by WithClasses
+	report       *DecodeReport              // set by WithReport
+	arena        *Arena                     // set by WithArena
+	section      string                     // "header" or "body"
+	sectionStart int                        // smallest offset inside the section being decoded
+	path         []pathElem                 // logical location of the value being decoded, if trackPath
+	trackPath    bool                       // maintain path while decoding, rather than only add to the paths of errors
+	info         *DocumentInfo              // set by UnmarshalHeaderBodyInfo
+	bodyOnly     bool                       // set by UnmarshalBodyOnly
+	hashSlots    map[*interface{}]hashSlot  // tracked hash values which may be aliased, in PerlCompat mode
+	skipWalk     func(int, byte, int) error // walkTree callback of skip, looking for tracked values in skipBy
+	skipBy       []byte
+	values       *valueDoc // section shared by the Values decoded, see decodeIntoValue
+}
+
+// hashSlot is the entry of a hash a value was decoded for, see decodeAlias
+type hashSlot struct {
+	hash map[string]interface{}
+	key  string
+}
+
+// pathElem is one step of the logical path to a value: either a hash key or
+// an array index
+type pathElem struct {
+	key     []byte
+	index   int
+	isIndex bool
+}
+
+// DefaultMaxCopyDepth is the length of COPY chains followed when
+// Decoder.MaxCopyDepth is not set
+const DefaultMaxCopyDepth = 4
+
+func (d *decoder) maxCopyDepth() int {
+	if d.MaxCopyDepth > 0 {
+		return d.MaxCopyDepth
+	}
+	return DefaultMaxCopyDepth
+}
+
+// checkOffset validates an offset read at idx. Offsets must point backwards,
+// and stay inside the section being decoded: the header and the body are
+// separate coordinate spaces, so data can't be shared between them.
+func (d *decoder) checkOffset(offs, idx int) error {
+	if offs >= 0 && offs < d.sectionStart {
+		return ErrCorrupt{ErrCrossSectionOffset}
+	}
+
+	if offs < 0 || offs >= idx {
+		return ErrCorrupt{ErrBadOffset}
+	}
+
+	return nil
+}
+
+// Paths are only maintained while decoding when trackPath is set, for
+// DecodeReport and Convert: the cost of doing it for every element otherwise
+// shows in BenchmarkPathBookkeeping. Errors instead get the keys and indices
+// of their path as they are returned by each hash and array, see pathError.
+func (d *decoder) pushKey(key []byte) {
+	if d.trackPath {
+		d.path = append(d.path, pathElem{key: key})
+	}
+}
+
+func (d *decoder) pushIndex(i int) {
+	if d.trackPath {
+		d.path = append(d.path, pathElem{index: i, isIndex: true})
+	}
+}
+
+func (d *decoder) popPath() {
+	if d.trackPath {
+		d.path = d.path[:len(d.path)-1]
+	}
+}
+
+// keyError returns err, returned by the value of key, with key in its path
+func (d *decoder) keyError(err error, key []byte) error {
+	return d.pathError(err, pathElem{key: key})
+}
+
+// indexError returns err, returned by the element i, with i in its path
+func (d *decoder) indexError(err error, i int) error {
+	return d.pathError(err, pathElem{index: i, isIndex: true})
+}
+
+// pathError inserts p after the section in the paths of the errors err
+// consists of, unless they already have their whole path. The errors
+// wrapped by a ThawError are the unmarshaler's, and are left as is.
+func (d *decoder) pathError(err error, p pathElem) error {
+	if d.trackPath {
+		return err
+	}
+
+	for e := err; e != nil; e = errors.Unwrap(e) {
+		switch e := e.(type) {
+		case *DecodeError:
+			e.Path = d.insertPath(e.Path, p)
+		case *StrictError:
+			e.Path = d.insertPath(e.Path, p)
+		case *ThawError:
+			e.Path = d.insertPath(e.Path, p)
+			return err
+		}
+	}
+	return err
+}
+
+func (d *decoder) insertPath(path string, p pathElem) string {
+	if !strings.HasPrefix(path, d.section) {
+		return path
+	}
+
+	var sb strings.Builder
+	sb.WriteString(d.section)
+	p.writeTo(&sb)
+	sb.WriteString(path[len(d.section):])
+	return sb.String()
+}
+
+// pathString formats the current path, e.g. "body.users[2].name"
+func (d *decoder) pathString() string {
+	var sb strings.Builder
+	sb.WriteString(d.section)
+	for _, p := range d.path {
+		p.writeTo(&sb)
+	}
+	return sb.String()
+}
+
+func (p pathElem) writeTo(sb *strings.Builder) {
+	if p.isIndex {
+		sb.WriteByte('[')
+		sb.WriteString(strconv.Itoa(p.index))
+		sb.WriteByte(']')
+	} else {
+		sb.WriteByte('.')
+		sb.Write(p.key)
+	}
+}
+
+// An UnmarshalOption alters the behaviour of a single Unmarshal call
+// without modifying the Decoder it is invoked on.
+type UnmarshalOption func(*unmarshalOptions)
+
+type unmarshalOptions struct {
+	classes map[string]reflect.Type
+	report  *DecodeReport
+	arena   *Arena
+}
+
+// WithClasses registers additional classes for a single Unmarshal call. The
+// map is keyed by class name and its values are instances, as accepted by
+// RegisterName. Entries take precedence over the classes registered on the
+// Decoder, which are left untouched.
+func WithClasses(classes map[string]interface{}) UnmarshalOption {
+	types := make(map[string]reflect.Type, len(classes))
+	for name, value := range classes {
+		types[name] = unmarshalerType(value)
+	}
+
+	return func(o *unmarshalOptions) {
+		if o.classes == nil {
+			o.classes = make(map[string]reflect.Type, len(types))
+		}
+		for name, typ := range types {
+			o.classes[name] = typ
+		}
+	}
 }
 
 type decompressor interface {
@@ -93,19 +404,19 @@ func NewDecoder() *Decoder {
 }
 
 // Unmarshal decodes b into body with the default decoder
-func Unmarshal(b []byte, body interface{}) error {
+func Unmarshal(b []byte, body interface{}, opts ...UnmarshalOption) error {
 	decoder := &Decoder{}
-	return decoder.UnmarshalHeaderBody(b, nil, body)
+	return decoder.UnmarshalHeaderBody(b, nil, body, opts...)
 }
 
 // UnmarshalHeader parses the Sereal-v2-encoded buffer b and stores the header data into the variable pointed to by vheader
-func (d *Decoder) UnmarshalHeader(b []byte, vheader interface{}) (err error) {
-	return d.UnmarshalHeaderBody(b, vheader, nil)
+func (d *Decoder) UnmarshalHeader(b []byte, vheader interface{}, opts ...UnmarshalOption) (err error) {
+	return d.UnmarshalHeaderBody(b, vheader, nil, opts...)
 }
 
 // Unmarshal parses the Sereal-encoded buffer b and stores the result in the value pointed to by vbody
-func (d *Decoder) Unmarshal(b []byte, vbody interface{}) (err error) {
-	return d.UnmarshalHeaderBody(b, nil, vbody)
+func (d *Decoder) Unmarshal(b []byte, vbody interface{}, opts ...UnmarshalOption) (err error) {
+	return d.UnmarshalHeaderBody(b, nil, vbody, opts...)
 }
 
 func checkHeader(b []byte) (serealHeader, error) {
@@ -159,14 +470,64 @@ func documentDecompressor(version byte, doctype documentType) (decompressor, err
 		decomp = ZstdCompressor{}
 
 	default:
-		return nil, fmt.Errorf("document type '%d' not yet supported", doctype)
+		if _, err := registeredCompressor(byte(doctype)); err != nil {
+			return nil, err
+		}
+		decomp = RegisteredCompressor{DocType: byte(doctype)}
 	}
 
 	return decomp, nil
 }
 
 // UnmarshalHeaderBody parses the Sereal-encoded buffer b extracts the header and body data into vheader and vbody, respectively
-func (d *Decoder) UnmarshalHeaderBody(b []byte, vheader interface{}, vbody interface{}) (err error) {
+//
+// Like every function of this package reading documents, it only ever reads
+// b[:len(b)] and never modifies b, whatever the capacity of b. Decoded values
+// don't share memory with b, except the encodings handed to UnmarshalSereal
+// and, with AliasInput, byte slices.
+func (d *Decoder) UnmarshalHeaderBody(b []byte, vheader interface{}, vbody interface{}, opts ...UnmarshalOption) (err error) {
+	var o unmarshalOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	dec := decoder{Decoder: d, classes: o.classes, report: o.report, arena: o.arena, trackPath: o.report != nil}
+	return dec.unmarshalHeaderBody(b, vheader, vbody)
+}
+
+// UnmarshalHeaderBodyInfo is UnmarshalHeaderBody also describing the
+// document, so that changes in the way producers encode can be noticed
+// without parsing it a second time. The description is filled in as soon as
+// the header has been read, even if decoding fails later on.
+func (d *Decoder) UnmarshalHeaderBodyInfo(b []byte, vheader interface{}, vbody interface{}, opts ...UnmarshalOption) (DocumentInfo, error) {
+	var o unmarshalOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	var info DocumentInfo
+	dec := decoder{Decoder: d, classes: o.classes, report: o.report, arena: o.arena, trackPath: o.report != nil, info: &info}
+	err := dec.unmarshalHeaderBody(b, vheader, vbody)
+	return info, err
+}
+
+// UnmarshalBodyOnly decodes the body of b into vbody with the default
+// decoder
+func UnmarshalBodyOnly(b []byte, vbody interface{}) error {
+	dec := decoder{Decoder: &Decoder{}, bodyOnly: true}
+	return dec.unmarshalHeaderBody(b, nil, vbody)
+}
+
+// UnmarshalBodyOnly decodes the body of b into vbody for hot paths which
+// never use header user data: the header suffix is only measured, never
+// decoded. Bodies compressed with a dictionary identified in the header
+// can only be decompressed this way with the Dictionary of d.
+func (d *Decoder) UnmarshalBodyOnly(b []byte, vbody interface{}) error {
+	dec := decoder{Decoder: d, bodyOnly: true}
+	return dec.unmarshalHeaderBody(b, nil, vbody)
+}
+
+func (d *decoder) unmarshalHeaderBody(b []byte, vheader interface{}, vbody interface{}) (err error) {
 	defer func() {
 		if r := recover(); r != nil {
 			if _, ok := r.(runtime.Error); ok {
@@ -179,6 +540,10 @@ func (d *Decoder) UnmarshalHeaderBody(b []byte, vheader interface{}, vbody inter
 			case error:
 				err = t
 			}
+
+			if d.section != "" {
+				err = &DecodeError{Path: d.pathString(), Offset: -1, Tag: -1, Err: err}
+			}
 		}
 	}()
 
@@ -192,65 +557,95 @@ func (d *Decoder) UnmarshalHeaderBody(b []byte, vheader interface{}, vbody inter
 		return err
 	}
 
+	if sc, ok := decomp.(SnappyCompressor); ok {
+		sc.Codec = d.SnappyCodec
+		decomp = sc
+	}
+
+	if d.TolerantSnappyLength && header.doctype == serealSnappyIncremental {
+		decomp = tolerantSnappyDecompressor{logger: d.Logger, codec: d.SnappyCodec}
+	}
+
 	bodyStart := headerSize + header.suffixSize
 
 	if bodyStart > len(b) || bodyStart < 0 {
-		return ErrCorrupt{errBadOffset}
+		return ErrCorrupt{ErrBadOffset}
 	}
 
-	if vheader != nil && header.suffixSize != 1 {
-		d.tracked = make(map[int]reflect.Value)
-		defer func() { d.tracked = nil }()
-
-		headerValue := reflect.ValueOf(vheader)
-		if headerValue.Kind() != reflect.Ptr {
-			return ErrHeaderPointer
+	if d.info != nil {
+		*d.info = DocumentInfo{
+			Version:        int(header.version),
+			DocType:        header.doctype.String(),
+			HeaderSize:     bodyStart,
+			BodySize:       -1,
+			CompressedSize: len(b) - bodyStart,
+		}
+		if header.suffixLen > 0 {
+			d.info.SuffixFlags = b[header.suffixStart]
+		}
+		if decomp == nil {
+			d.info.BodySize = d.info.CompressedSize
 		}
+	}
 
-		header.suffixFlags = b[header.suffixStart]
-		if header.suffixFlags&1 == 1 {
-			if ptr, ok := vheader.(*interface{}); ok && *ptr == nil {
-				_, err = d.decode(b[:bodyStart], header.suffixStart+1, ptr)
-			} else {
-				_, err = d.decodeViaReflection(b[:bodyStart], header.suffixStart+1, headerValue.Elem())
-			}
+	if decomp != nil && vbody != nil {
+		if decomp, err = d.dictionaryDecompressor(decomp, b, header, bodyStart); err != nil {
+			return err
 		}
 	}
 
+	if vheader != nil && header.suffixLen > 0 {
+		err = d.decodeUserHeader(b, header, bodyStart, vheader)
+	}
+
 	if err == nil && vbody != nil {
-		/* XXX instead of creating an uncompressed copy of the document,
-		 *     it would be more flexible to use a sort of "Reader" interface */
 		if decomp != nil {
-			decompBody, err := decomp.decompress(nil, b[bodyStart:])
-			if err != nil {
+			// offsets only ever refer to the body, which is decompressed
+			// after the byte preceding it (v2+) or the header (v1)
+			prefix := 1
+			if header.version == 1 {
+				prefix = bodyStart
+			}
+
+			if b, err = decompressBody(decomp, b, header, bodyStart, prefix); err != nil {
 				return err
 			}
+			bodyStart = prefix
 
-			newBody := make([]byte, 0, len(b[:bodyStart])+len(decompBody))
-			newBody = append(newBody, b[:bodyStart]...)
-			newBody = append(newBody, decompBody...)
-			b = newBody
+			if d.info != nil {
+				d.info.BodySize = len(b) - prefix
+			}
 		}
 
 		d.tracked = make(map[int]reflect.Value)
-		defer func() { d.tracked = nil }()
+		d.section, d.path = "body", d.path[:0]
+		d.sectionStart = 1
+		if header.version == 1 {
+			// v1 offsets are relative to the start of the document
+			d.sectionStart = bodyStart
+		}
 
 		bodyValue := reflect.ValueOf(vbody)
 		if bodyValue.Kind() != reflect.Ptr {
 			return ErrBodyPointer
 		}
 
+		// maps and slices of common types are decoded without reflection
+		var handled bool
+
 		if header.version == 1 {
 			if ptr, ok := vbody.(*interface{}); ok && *ptr == nil {
+				d.explain(b, bodyStart, BranchFastPath, bodyValue.Elem())
 				_, err = d.decode(b, bodyStart, ptr)
-			} else {
+			} else if handled, err = d.decodeCommon(b, bodyStart, vbody); !handled {
 				_, err = d.decodeViaReflection(b, bodyStart, bodyValue.Elem())
 			}
 		} else {
 			// serealv2 documents have 1-based offsets :/
 			if ptr, ok := vbody.(*interface{}); ok && *ptr == nil {
+				d.explain(b[bodyStart-1:], 1, BranchFastPath, bodyValue.Elem())
 				_, err = d.decode(b[bodyStart-1:], 1, ptr)
-			} else {
+			} else if handled, err = d.decodeCommon(b[bodyStart-1:], 1, vbody); !handled {
 				_, err = d.decodeViaReflection(b[bodyStart-1:], 1, bodyValue.Elem())
 			}
 		}
@@ -259,10 +654,71 @@ func (d *Decoder) UnmarshalHeaderBody(b []byte, vheader interface{}, vbody inter
 	return err
 }
 
+// decodeUserHeader decodes the header user data of b, if any, into vheader
+func (d *decoder) decodeUserHeader(b []byte, header serealHeader, bodyStart int, vheader interface{}) (err error) {
+	d.tracked = make(map[int]reflect.Value)
+	d.section, d.path = "header", d.path[:0]
+	d.sectionStart = 1
+
+	headerValue := reflect.ValueOf(vheader)
+	if headerValue.Kind() != reflect.Ptr {
+		return ErrHeaderPointer
+	}
+
+	header.suffixFlags = b[header.suffixStart]
+	if header.suffixFlags&1 == 1 {
+		// header offsets are relative to the flag byte
+		userData := b[header.suffixStart:bodyStart]
+		if ptr, ok := vheader.(*interface{}); ok && *ptr == nil {
+			d.explain(userData, 1, BranchFastPath, headerValue.Elem())
+			_, err = d.decode(userData, 1, ptr)
+		} else {
+			_, err = d.decodeViaReflection(userData, 1, headerValue.Elem())
+		}
+	}
+
+	return err
+}
+
+// locate wraps err, returned while decoding the value starting at by[idx],
+// into a DecodeError, unless it was returned by a nested value and already
+// is one
+func (d *decoder) locate(by []byte, idx int, err error) error {
+	if _, ok := err.(*DecodeError); ok {
+		return err
+	}
+
+	for idx >= 0 && idx < len(by) && by[idx]&^trackFlag == typePAD {
+		idx++
+	}
+
+	tag := -1
+	if idx >= 0 && idx < len(by) {
+		tag = int(by[idx] &^ trackFlag)
+	}
+
+	// unknown keys are reported within their struct, which pathError has
+	// already given the key
+	path := d.pathString()
+	var serr *StrictError
+	if !d.trackPath && errors.As(err, &serr) {
+		path = serr.Path
+	}
+	return &DecodeError{Path: path, Offset: idx, Tag: tag, Err: err}
+}
+
 /****************************************************************
  * Decode document of unknown structure (i.e. without reflection)
  ****************************************************************/
-func (d *Decoder) decode(by []byte, idx int, ptr *interface{}) (int, error) {
+func (d *decoder) decode(by []byte, idx int, ptr *interface{}) (int, error) {
+	next, err := d.decodeValue(by, idx, ptr)
+	if err != nil {
+		return next, d.locate(by, idx, err)
+	}
+	return next, nil
+}
+
+func (d *decoder) decodeValue(by []byte, idx int, ptr *interface{}) (int, error) {
 	if idx < 0 || idx >= len(by) {
 		return 0, ErrTruncated
 	}
@@ -290,6 +746,9 @@ func (d *Decoder) decode(by []byte, idx int, ptr *interface{}) (int, error) {
 
 	var err error
 	switch {
+	case d.UseNumber && tag <= typeLONG_DOUBLE:
+		*ptr, idx, err = d.decodeNumber(by, idx, tag)
+
 	case tag < typeVARINT:
 		*ptr = d.decodeInt(tag)
 
@@ -313,6 +772,9 @@ func (d *Decoder) decode(by []byte, idx int, ptr *interface{}) (int, error) {
 	case tag == typeDOUBLE:
 		*ptr, idx, err = d.decodeDouble(by, idx)
 
+	case tag == typeLONG_DOUBLE:
+		*ptr, idx, err = d.decodeLongDouble(by, idx)
+
 	case tag == typeTRUE:
 		*ptr = true
 
@@ -354,29 +816,23 @@ func (d *Decoder) decode(by []byte, idx int, ptr *interface{}) (int, error) {
 
 	case tag == typeSTR_UTF8:
 		var val []byte
-		var ln, sz int
-		ln, sz, err = varintdecode(by[idx:])
-		if err != nil {
-			return 0, err
-		}
-		if val, idx, err = d.decodeBinary(by, idx+sz, ln, false); err != nil {
+		if val, idx, err = d.decodeUTF8(by, idx); err != nil {
 			return 0, err
 		}
-		*ptr = string(val)
+		*ptr = d.str(val)
 
 	case tag == typeBINARY:
-		var ln, sz int
-		ln, sz, err = varintdecode(by[idx:])
-		if err != nil {
+		var start, end int
+		if start, end, err = stringSpan(by, idx); err != nil {
 			return 0, err
 		}
-		*ptr, idx, err = d.decodeBinary(by, idx+sz, ln, true)
+		*ptr, idx, err = d.decodeBinaryValue(by, start, end-start)
 		if err != nil {
 			return 0, err
 		}
 
 	case tag >= typeSHORT_BINARY_0 && tag < typeSHORT_BINARY_0+32:
-		*ptr, idx, err = d.decodeBinary(by, idx, int(tag&0x1f), true)
+		*ptr, idx, err = d.decodeBinaryValue(by, idx, int(tag&0x1f))
 		if err != nil {
 			return 0, err
 		}
@@ -391,8 +847,8 @@ func (d *Decoder) decode(by []byte, idx int, ptr *interface{}) (int, error) {
 		}
 
 	case tag == typeCOPY:
-		if d.copyDepth > 0 {
-			return 0, ErrCorrupt{errNestedCOPY}
+		if d.copyDepth >= d.maxCopyDepth() {
+			return 0, ErrCorrupt{ErrNestedCOPY}
 		}
 
 		var offs, sz int
@@ -400,8 +856,8 @@ func (d *Decoder) decode(by []byte, idx int, ptr *interface{}) (int, error) {
 		if err != nil {
 			return 0, err
 		}
-		if offs < 0 || offs >= idx {
-			return 0, ErrCorrupt{errBadOffset}
+		if err = d.checkOffset(offs, idx); err != nil {
+			return 0, err
 		}
 		idx += sz
 
@@ -428,6 +884,9 @@ func (d *Decoder) decode(by []byte, idx int, ptr *interface{}) (int, error) {
 			idx, err = d.decode(by, idx, ptr)
 		}
 
+	case tag == typeALIAS && d.PerlCompat:
+		*ptr, idx, err = d.decodeAlias(by, idx)
+
 	case tag == typeREFP, tag == typeALIAS:
 		var val reflect.Value
 		if val, idx, err = d.decodeREFP_ALIAS(by, idx, tag == typeREFP); err == nil {
@@ -444,7 +903,10 @@ func (d *Decoder) decode(by []byte, idx int, ptr *interface{}) (int, error) {
 		}
 
 	case tag == typeREGEXP:
-		*ptr, idx, err = d.decodeRegexp(by, idx)
+		var re *PerlRegexp
+		if re, idx, err = d.decodeRegexp(by, idx); err == nil {
+			*ptr, err = d.translateRegexp(re)
+		}
 
 	case tag == typeOBJECT, tag == typeOBJECTV:
 		rvPtr := reflect.ValueOf(ptr)
@@ -455,51 +917,66 @@ func (d *Decoder) decode(by []byte, idx int, ptr *interface{}) (int, error) {
 		idx, err = d.decodeObjectFreezeViaReflection(by, idx, rvPtr.Elem(), tag == typeOBJECTV_FREEZE)
 
 	default:
-		return 0, fmt.Errorf("unknown tag byte: %d (0x%x)", int(tag), int(tag))
+		return 0, fmt.Errorf("%w: %d (0x%x)", ErrUnknownTag, int(tag), int(tag))
 	}
 
 	//fmt.Printf("stop decode: tag %d (0x%x)\n", int(tag), int(tag))
 	return idx, err
 }
 
-func (d *Decoder) decodeInt(tag byte) int {
+func (d *decoder) decodeInt(tag byte) int {
 	if (tag & 0x10) == 0x10 {
 		return int(tag) - 32 // negative number
 	}
 	return int(tag)
 }
 
-func (d *Decoder) decodeVarint(by []byte, idx int) (int, int, error) {
+func (d *decoder) decodeVarint(by []byte, idx int) (int, int, error) {
 	i, sz, err := varintdecode(by[idx:])
 	return i, idx + sz, err
 }
 
-func (d *Decoder) decodeZigzag(by []byte, idx int) (int, int, error) {
+func (d *decoder) decodeZigzag(by []byte, idx int) (int, int, error) {
 	i, sz, err := varintdecode(by[idx:])
 	return int(-(1 + (uint64(i) >> 1))), idx + sz, err
 }
 
-func (d *Decoder) decodeFloat(by []byte, idx int) (float32, int, error) {
+func (d *decoder) decodeFloat(by []byte, idx int) (float32, int, error) {
 	if idx+3 >= len(by) {
 		return 0, 0, ErrTruncated
 	}
 
-	bits := uint32(by[idx]) | uint32(by[idx+1])<<8 | uint32(by[idx+2])<<16 | uint32(by[idx+3])<<24
-	return math.Float32frombits(bits), idx + 4, nil
+	return math.Float32frombits(binary.LittleEndian.Uint32(by[idx:])), idx + 4, nil
 }
 
-func (d *Decoder) decodeDouble(by []byte, idx int) (float64, int, error) {
+func (d *decoder) decodeDouble(by []byte, idx int) (float64, int, error) {
 	if idx+7 >= len(by) {
 		return 0, 0, ErrTruncated
 	}
 
-	bits := uint64(by[idx]) | uint64(by[idx+1])<<8 | uint64(by[idx+2])<<16 | uint64(by[idx+3])<<24 | uint64(by[idx+4])<<32 | uint64(by[idx+5])<<40 | uint64(by[idx+6])<<48 | uint64(by[idx+7])<<56
-	return math.Float64frombits(bits), idx + 8, nil
+	return math.Float64frombits(binary.LittleEndian.Uint64(by[idx:])), idx + 8, nil
 }
 
-func (d *Decoder) decodeHash(by []byte, idx int, ln int, ptr *interface{}, isRef bool) (int, error) {
+// decodeLongDouble rounds the long double starting at by[idx] to the nearest
+// float64, losing the 11 low bits of its mantissa. Values beyond the range
+// of float64 become infinities or zeros. Decoding into a big.Float keeps
+// them exactly instead.
+func (d *decoder) decodeLongDouble(by []byte, idx int) (float64, int, error) {
+	if idx+15 >= len(by) {
+		return 0, 0, ErrTruncated
+	}
+
+	x, nan := longDouble(by[idx:])
+	if nan {
+		return math.NaN(), idx + 16, nil
+	}
+	f, _ := x.Float64()
+	return f, idx + 16, nil
+}
+
+func (d *decoder) decodeHash(by []byte, idx int, ln int, ptr *interface{}, isRef bool) (int, error) {
 	if ln < 0 || ln > math.MaxInt32 {
-		return 0, ErrCorrupt{errBadHashSize}
+		return 0, ErrCorrupt{ErrBadHashSize}
 	}
 
 	if idx+2*ln > len(by) {
@@ -523,20 +1000,30 @@ func (d *Decoder) decodeHash(by []byte, idx int, ln int, ptr *interface{}, isRef
 		}
 
 		var value interface{}
+		if d.PerlCompat && idx < len(by) && by[idx]&trackFlag != 0 {
+			// an ALIAS to the value replaces it in the hash as well
+			if d.hashSlots == nil {
+				d.hashSlots = make(map[*interface{}]hashSlot)
+			}
+			d.hashSlots[&value] = hashSlot{hash, string(key)}
+		}
+
+		d.pushKey(key)
 		idx, err = d.decode(by, idx, &value)
 		if err != nil {
-			return 0, err
+			return 0, d.keyError(err, key)
 		}
+		d.popPath()
 
-		hash[string(key)] = value
+		hash[d.str(key)] = value
 	}
 
 	return idx, nil
 }
 
-func (d *Decoder) decodeArray(by []byte, idx int, ln int, ptr *interface{}, isRef bool) (int, error) {
+func (d *decoder) decodeArray(by []byte, idx int, ln int, ptr *interface{}, isRef bool) (int, error) {
 	if ln < 0 || ln > math.MaxInt32 {
-		return 0, ErrCorrupt{errBadSliceSize}
+		return 0, ErrCorrupt{ErrBadSliceSize}
 	}
 
 	if idx+ln > len(by) {
@@ -545,7 +1032,9 @@ func (d *Decoder) decodeArray(by []byte, idx int, ln int, ptr *interface{}, isRe
 
 	var slice []interface{}
 
-	if ln == 0 {
+	if d.arena != nil {
+		slice = d.arena.slice(ln)
+	} else if ln == 0 {
 		// FIXME this is not optimal
 		slice = make([]interface{}, 0, 1)
 	} else {
@@ -560,34 +1049,114 @@ func (d *Decoder) decodeArray(by []byte, idx int, ln int, ptr *interface{}, isRe
 
 	var err error
 	for i := 0; i < ln; i++ {
+		d.pushIndex(i)
 		idx, err = d.decode(by, idx, &slice[i])
 		if err != nil {
-			return 0, err
+			return 0, d.indexError(err, i)
 		}
+		d.popPath()
 	}
 
 	return idx, nil
 }
 
-func (d *Decoder) decodeBinary(by []byte, idx int, ln int, makeCopy bool) ([]byte, int, error) {
+// decodeBinary returns the ln bytes of by at idx, not a copy
+func (d *decoder) decodeBinary(by []byte, idx int, ln int) ([]byte, int, error) {
 	if ln < 0 || ln > math.MaxInt32 {
-		return nil, 0, ErrCorrupt{errBadStringSize}
+		return nil, 0, ErrCorrupt{ErrBadStringSize}
 	}
 	if idx+ln > len(by) {
 		return nil, 0, ErrTruncated
 	}
 
-	if makeCopy {
-		res := make([]byte, ln)
-		copy(res, by[idx:idx+ln])
-		return res, idx + ln, nil
+	// capped, so that appending to the result never overwrites the document
+	return by[idx : idx+ln : idx+ln], idx + ln, nil
+}
+
+// stringSpan returns the bounds of the payload of the BINARY or STR_UTF8
+// whose length starts at by[idx]. The hot paths read lengths of a single
+// byte, those of most strings, inline before calling it.
+func stringSpan(by []byte, idx int) (int, int, error) {
+	ln, sz, err := varintdecode(by[idx:])
+	if err != nil {
+		return 0, 0, err
+	}
+	if ln < 0 || ln > math.MaxInt32 {
+		return 0, 0, ErrCorrupt{ErrBadStringSize}
+	}
+
+	start := idx + sz
+	if ln > len(by)-start {
+		return 0, 0, ErrTruncated
+	}
+	return start, start + ln, nil
+}
+
+// decodeBinaryValue returns the ln bytes of by at idx as the value of a
+// binary string decoded into an interface{}, a string with BinaryAsString
+func (d *decoder) decodeBinaryValue(by []byte, idx int, ln int) (interface{}, int, error) {
+	if !d.BinaryAsString {
+		return d.decodeBytes(by, idx, ln)
+	}
+
+	val, idx, err := d.decodeBinary(by, idx, ln)
+	if err != nil {
+		return nil, 0, err
+	}
+	return d.str(val), idx, nil
+}
+
+// decodeUTF8 returns the payload of the STR_UTF8 whose length starts at
+// by[idx], a slice of by, checking it with ValidateUTF8
+func (d *decoder) decodeUTF8(by []byte, idx int) ([]byte, int, error) {
+	start, end := idx+1, 0
+	if idx < len(by) && by[idx] < 0x80 {
+		if end = start + int(by[idx]); end > len(by) {
+			return nil, 0, ErrTruncated
+		}
+	} else {
+		var err error
+		if start, end, err = stringSpan(by, idx); err != nil {
+			return nil, 0, err
+		}
 	}
 
-	return by[idx : idx+ln], idx + ln, nil
+	val := by[start:end:end]
+	return val, end, d.checkUTF8(val)
+}
+
+// checkUTF8 rejects the STR_UTF8 payload val with ValidateUTF8 if it isn't
+// valid UTF-8
+func (d *decoder) checkUTF8(val []byte) error {
+	if d.ValidateUTF8 && !utf8.Valid(val) {
+		return ErrInvalidUTF8
+	}
+	return nil
+}
+
+// decodeBytes returns the ln bytes of by at idx as a decoded value, i.e. a
+// copy unless AliasInput is set
+func (d *decoder) decodeBytes(by []byte, idx int, ln int) ([]byte, int, error) {
+	res, idx, err := d.decodeBinary(by, idx, ln)
+	if err != nil {
+		return nil, 0, err
+	}
+	return d.ownBytes(res), idx, nil
+}
+
+// ownBytes returns b, a slice of the document, as a decoded value
+func (d *decoder) ownBytes(b []byte) []byte {
+	if d.AliasInput {
+		return b[:len(b):len(b)]
+	}
+	if d.arena != nil {
+		return d.arena.copyBytes(b)
+	}
+	return append(make([]byte, 0, len(b)), b...)
 }
 
 // decodeStringish() return slice of by, i.e. not a copy
-func (d *Decoder) decodeStringish(by []byte, idx int) ([]byte, int, error) {
+func (d *decoder) decodeStringish(by []byte, idx int) ([]byte, int, error) {
 	if idx < 0 || idx >= len(by) {
 		return nil, 0, ErrTruncated
 	}
@@ -612,20 +1181,26 @@ func (d *Decoder) decodeStringish(by []byte, idx int) ([]byte, int, error) {
 	var res []byte
 	switch {
 	case tag == typeBINARY, tag == typeSTR_UTF8:
-		ln, sz, err := varintdecode(by[idx:])
-		if err != nil {
-			return nil, 0, err
+		start, end := idx+1, 0
+		if idx < len(by) && by[idx] < 0x80 {
+			if end = start + int(by[idx]); end > len(by) {
+				return nil, 0, ErrTruncated
+			}
+		} else {
+			var err error
+			if start, end, err = stringSpan(by, idx); err != nil {
+				return nil, 0, err
+			}
 		}
-		idx += sz
 
-		if ln < 0 || ln > math.MaxInt32 {
-			return nil, 0, ErrCorrupt{errBadStringSize}
-		} else if idx+ln > len(by) {
-			return nil, 0, ErrTruncated
-		}
+		res = by[start:end]
+		idx = end
 
-		res = by[idx : idx+ln]
-		idx += ln
+		if tag == typeSTR_UTF8 {
+			if err := d.checkUTF8(res); err != nil {
+				return nil, 0, err
+			}
+		}
 
 	case tag >= typeSHORT_BINARY_0 && tag < typeSHORT_BINARY_0+32:
 		ln := int(tag & 0x1F) // get length from tag
@@ -637,16 +1212,16 @@ func (d *Decoder) decodeStringish(by []byte, idx int) ([]byte, int, error) {
 		idx += ln
 
 	case tag == typeCOPY:
-		if d.copyDepth > 0 {
-			return nil, 0, ErrCorrupt{errNestedCOPY}
+		if d.copyDepth >= d.maxCopyDepth() {
+			return nil, 0, ErrCorrupt{ErrNestedCOPY}
 		}
 
 		offs, sz, err := varintdecode(by[idx:])
 		if err != nil {
 			return nil, 0, err
 		}
-		if offs < 0 || offs >= idx {
-			return nil, 0, ErrCorrupt{errBadOffset}
+		if err = d.checkOffset(offs, idx); err != nil {
+			return nil, 0, err
 		}
 		idx += sz
 
@@ -658,14 +1233,14 @@ func (d *Decoder) decodeStringish(by []byte, idx int) ([]byte, int, error) {
 		}
 
 	default:
-		return nil, 0, fmt.Errorf("expect stringish at offset %d but got %d (0x%x)", idx, int(tag), int(tag))
+		return nil, 0, fmt.Errorf("%w: got %d (0x%x)", ErrCorrupt{ErrNotStringish}, int(tag), int(tag))
 	}
 
 	//fmt.Printf("decodeStringish res: %s at %d\n", string(res), idx)
 	return res, idx, nil
 }
 
-func (d *Decoder) decodeRegexp(by []byte, idx int) (*PerlRegexp, int, error) {
+func (d *decoder) decodeRegexp(by []byte, idx int) (*PerlRegexp, int, error) {
 	var err error
 	var pattern []byte
 	if pattern, idx, err = d.decodeStringish(by, idx); err != nil {
@@ -677,14 +1252,31 @@ func (d *Decoder) decodeRegexp(by []byte, idx int) (*PerlRegexp, int, error) {
 		return nil, 0, err
 	}
 
-	// TODO perhaps, copy values
-	return &PerlRegexp{pattern, modifiers}, idx, nil
+	flags, err := ParseRegexpFlags(string(modifiers))
+	if err != nil {
+		return nil, 0, err
+	}
+	if s := flags.String(); s != string(modifiers) {
+		modifiers = []byte(s)
+	} else {
+		modifiers = d.ownBytes(modifiers)
+	}
+
+	return &PerlRegexp{d.ownBytes(pattern), modifiers, flags}, idx, nil
 }
 
 /********************************************************************
  * Decode document with predefined structure (have to use reflection)
  ********************************************************************/
-func (d *Decoder) decodeViaReflection(by []byte, idx int, ptr reflect.Value) (int, error) {
+func (d *decoder) decodeViaReflection(by []byte, idx int, ptr reflect.Value) (int, error) {
+	next, err := d.decodeValueViaReflection(by, idx, ptr)
+	if err != nil {
+		return next, d.locate(by, idx, err)
+	}
+	return next, nil
+}
+
+func (d *decoder) decodeValueViaReflection(by []byte, idx int, ptr reflect.Value) (int, error) {
 	if idx < 0 || idx >= len(by) {
 		return 0, ErrTruncated
 	}
@@ -695,6 +1287,7 @@ func (d *Decoder) decodeViaReflection(by []byte, idx int, ptr reflect.Value) (in
 	if ptrKind == reflect.Interface && ptr.IsNil() {
 		var iface interface{}
 		var err error
+		d.explain(by, idx, BranchFastPath, ptr)
 		idx, err = d.decode(by, idx, &iface)
 		if iface != nil {
 			ptr.Set(reflect.ValueOf(iface))
@@ -712,18 +1305,50 @@ func (d *Decoder) decodeViaReflection(by []byte, idx int, ptr reflect.Value) (in
 		tag = by[idx]
 	}
 
+	if ptr.Type() == valueType {
+		return d.decodeIntoValue(by, idx, ptr)
+	}
+
 	if (tag & trackFlag) == trackFlag {
 		tag &^= trackFlag
 		d.tracked[idx] = ptr
 	}
 
+	if tag != typeUNDEF && tag != typeCANONICAL_UNDEF && implementsUnmarshaler(ptr) {
+		d.explain(by, idx, BranchUnmarshaler, ptr)
+		return d.decodeViaUnmarshaler(by, idx, ptr)
+	}
+
+	if ptr.Type() == timeType && isTimeTag(tag) {
+		return d.decodeTime(by, idx, tag, ptr)
+	}
+
+	if ptr.Type() == numberType && tag <= typeLONG_DOUBLE {
+		n, next, err := d.decodeNumber(by, idx+1, tag)
+		if err != nil {
+			return 0, err
+		}
+		ptr.SetString(string(n))
+		return next, nil
+	}
+
+	if isBigType(ptr.Type()) && isBigTag(tag) {
+		return d.decodeBig(by, idx, tag, ptr)
+	}
+
+	if d.report != nil && tag != typeREFN && tag != typeWEAKEN {
+		// REFN and WEAKEN are transparent here, the referenced value is recorded instead
+		d.explain(by, idx, d.classify(tag, ptr), ptr)
+	}
+
 	//fmt.Printf("start decodeViaReflection: tag %d (0x%x) at %d\n", int(tag), int(tag), idx)
+	start := idx // offset of the tag, for errors
 	idx++
 
 	var err error
 	switch {
 	case tag < typeVARINT:
-		setInt(ptr, d.decodeInt(tag))
+		err = d.setInt(ptr, d.decodeInt(tag), false, start)
 
 	case tag == typeVARINT:
 		var val int
@@ -731,7 +1356,7 @@ func (d *Decoder) decodeViaReflection(by []byte, idx int, ptr reflect.Value) (in
 		if err != nil {
 			return 0, err
 		}
-		setInt(ptr, val)
+		err = d.setInt(ptr, val, true, start)
 
 	case tag == typeZIGZAG:
 		var val int
@@ -739,55 +1364,53 @@ func (d *Decoder) decodeViaReflection(by []byte, idx int, ptr reflect.Value) (in
 		if err != nil {
 			return 0, err
 		}
-		setInt(ptr, val)
+		err = d.setInt(ptr, val, false, start)
 
 	case tag == typeFLOAT:
 		var val float32
 		if val, idx, err = d.decodeFloat(by, idx); err != nil {
 			return 0, err
 		}
-		ptr.SetFloat(float64(val))
+		err = d.setFloat(ptr, float64(val), start)
 
 	case tag == typeDOUBLE:
 		var val float64
 		if val, idx, err = d.decodeDouble(by, idx); err != nil {
 			return 0, err
 		}
-		ptr.SetFloat(val)
+		err = d.setFloat(ptr, val, start)
+
+	case tag == typeLONG_DOUBLE:
+		var val float64
+		if val, idx, err = d.decodeLongDouble(by, idx); err != nil {
+			return 0, err
+		}
+		err = d.setFloat(ptr, val, start)
 
 	case tag == typeTRUE, tag == typeFALSE:
-		ptr.SetBool(tag == typeTRUE)
+		d.setBool(ptr, tag == typeTRUE)
 
 	case tag == typeBINARY:
-		var val []byte
-		var ln, sz int
-		ln, sz, err = varintdecode(by[idx:])
-		if err != nil {
-			return 0, err
-		}
-		if val, idx, err = d.decodeBinary(by, idx+sz, ln, false); err != nil {
+		var start, end int
+		if start, end, err = stringSpan(by, idx); err != nil {
 			return 0, err
 		}
-		setBinary(ptr, val)
+		d.setBinary(ptr, by[start:end:end])
+		idx = end
 
 	case tag >= typeSHORT_BINARY_0 && tag < typeSHORT_BINARY_0+32:
 		var val []byte
-		if val, idx, err = d.decodeBinary(by, idx, int(tag&0x1f), false); err != nil {
+		if val, idx, err = d.decodeBinary(by, idx, int(tag&0x1f)); err != nil {
 			return 0, err
 		}
-		setBinary(ptr, val)
+		d.setBinary(ptr, val)
 
 	case tag == typeSTR_UTF8:
 		var val []byte
-		var ln, sz int
-		ln, sz, err = varintdecode(by[idx:])
-		if err != nil {
+		if val, idx, err = d.decodeUTF8(by, idx); err != nil {
 			return 0, err
 		}
-		if val, idx, err = d.decodeBinary(by, idx+sz, ln, false); err != nil {
-			return 0, err
-		}
-		ptr.SetString(string(val))
+		ptr.SetString(d.str(val))
 
 	case tag == typeHASH:
 		var ln, sz int
@@ -812,21 +1435,19 @@ func (d *Decoder) decodeViaReflection(by []byte, idx int, ptr reflect.Value) (in
 		idx, err = d.decodeArrayViaReflection(by, idx, int(tag&0x0f), ptr)
 
 	case tag == typeUNDEF, tag == typeCANONICAL_UNDEF:
-		if d.PerlCompat && tag == typeCANONICAL_UNDEF {
+		perlUndef := d.PerlCompat && (!d.UndefAsZero || reflect.TypeOf(perlCanonicalUndef).AssignableTo(ptr.Type()))
+		if perlUndef && tag == typeCANONICAL_UNDEF {
 			ptr.Set(reflect.ValueOf(perlCanonicalUndef))
-		} else if d.PerlCompat {
+		} else if perlUndef {
 			ptr.Set(reflect.ValueOf(&PerlUndef{}))
-		} else {
-			if ptrKind == reflect.Ptr || ptrKind == reflect.Map || ptrKind == reflect.Slice {
-				ptr.Set(reflect.Zero(ptr.Type()))
-			} else {
-				// maybe panic
-			}
+		} else if d.UndefAsZero || ptrKind == reflect.Ptr || ptrKind == reflect.Map || ptrKind == reflect.Slice {
+			ptr.Set(reflect.Zero(ptr.Type()))
 		}
+		// otherwise the value is left as it is, see UndefAsZero
 
 	case tag == typeCOPY:
-		if d.copyDepth > 0 {
-			return 0, ErrCorrupt{errNestedCOPY}
+		if d.copyDepth >= d.maxCopyDepth() {
+			return 0, ErrCorrupt{ErrNestedCOPY}
 		}
 
 		var offs, sz int
@@ -834,8 +1455,8 @@ func (d *Decoder) decodeViaReflection(by []byte, idx int, ptr reflect.Value) (in
 		if err != nil {
 			return 0, err
 		}
-		if offs < 0 || offs >= idx {
-			return 0, ErrCorrupt{errBadOffset}
+		if err = d.checkOffset(offs, idx); err != nil {
+			return 0, err
 		}
 		idx += sz
 
@@ -852,7 +1473,7 @@ func (d *Decoder) decodeViaReflection(by []byte, idx int, ptr reflect.Value) (in
 			return 0, err
 
 		}
-		ptr.Set(val.Elem())
+		err = d.setShared(ptr, val)
 
 	case tag == typeWEAKEN:
 		if d.PerlCompat {
@@ -868,7 +1489,17 @@ func (d *Decoder) decodeViaReflection(by []byte, idx int, ptr reflect.Value) (in
 		if pregexp, idx, err = d.decodeRegexp(by, idx); err != nil {
 			return 0, err
 		}
-		ptr.Set(reflect.ValueOf(pregexp))
+
+		var re interface{}
+		if ptr.Type() == regexpPtrType {
+			re, err = d.compileRegexp(pregexp)
+		} else {
+			re, err = d.translateRegexp(pregexp)
+		}
+		if err != nil {
+			return 0, err
+		}
+		ptr.Set(reflect.ValueOf(re))
 
 	case tag == typeOBJECT, tag == typeOBJECTV:
 		idx, err = d.decodeObjectViaReflection(by, idx, ptr, tag == typeOBJECTV)
@@ -877,15 +1508,15 @@ func (d *Decoder) decodeViaReflection(by []byte, idx int, ptr reflect.Value) (in
 		idx, err = d.decodeObjectFreezeViaReflection(by, idx, ptr, tag == typeOBJECTV_FREEZE)
 
 	default:
-		return 0, fmt.Errorf("unknown tag byte: %d (0x%x)", int(tag), int(tag))
+		return 0, fmt.Errorf("%w: %d (0x%x)", ErrUnknownTag, int(tag), int(tag))
 	}
 
 	return idx, err
 }
 
-func (d *Decoder) decodeArrayViaReflection(by []byte, idx int, ln int, ptr reflect.Value) (int, error) {
+func (d *decoder) decodeArrayViaReflection(by []byte, idx int, ln int, ptr reflect.Value) (int, error) {
 	if ln < 0 || ln > math.MaxInt32 {
-		return 0, ErrCorrupt{errBadSliceSize}
+		return 0, ErrCorrupt{ErrBadSliceSize}
 	}
 
 	if idx+ln > len(by) {
@@ -899,7 +1530,28 @@ func (d *Decoder) decodeArrayViaReflection(by []byte, idx int, ln int, ptr refle
 		}
 
 	case reflect.Array:
-		// do nothing
+		if ln > ptr.Len() && d.ArrayOverflowPolicy == ArrayError {
+			return 0, fmt.Errorf("%w: %d elements into %v", ErrArrayOverflow, ln, ptr.Type())
+		}
+
+		// elements left over from a previous value are cleared
+		zero := reflect.Zero(ptr.Type().Elem())
+		for i := ln; i < ptr.Len(); i++ {
+			ptr.Index(i).Set(zero)
+		}
+
+	case reflect.Ptr:
+		if ptr.IsNil() {
+			ptr.Set(reflect.New(ptr.Type().Elem()))
+		}
+
+		return d.decodeArrayViaReflection(by, idx, ln, ptr.Elem())
+
+	case reflect.Struct:
+		if ptr.Type() == listType {
+			return d.decodeList(by, idx, ln, ptr.Addr().Interface().(*list.List))
+		}
+		fallthrough
 
 	default:
 		return 0, &reflect.ValueError{Method: "sereal.decodeArrayViaReflection", Kind: ptr.Kind()}
@@ -909,25 +1561,27 @@ func (d *Decoder) decodeArrayViaReflection(by []byte, idx int, ln int, ptr refle
 	ptrLen := ptr.Len()
 
 	for i := 0; i < ln; i++ {
+		d.pushIndex(i)
 		if i < ptrLen {
 			idx, err = d.decodeViaReflection(by, idx, ptr.Index(i))
 		} else {
 			// we went outside of array length, so ignore folowwing content
-			var iface interface{}
-			idx, err = d.decode(by, idx, &iface) // TODO make this process to be efficient
+			d.explain(by, idx, BranchSkipped, reflect.Value{})
+			idx, err = d.skip(by, idx)
 		}
 
 		if err != nil {
-			return 0, err
+			return 0, d.indexError(err, i)
 		}
+		d.popPath()
 	}
 
 	return idx, nil
 }
 
-func (d *Decoder) decodeHashViaReflection(by []byte, idx int, ln int, ptr reflect.Value) (int, error) {
+func (d *decoder) decodeHashViaReflection(by []byte, idx int, ln int, ptr reflect.Value) (int, error) {
 	if ln < 0 || ln > math.MaxInt32 {
-		return 0, ErrCorrupt{errBadHashSize}
+		return 0, ErrCorrupt{ErrBadHashSize}
 	}
 
 	if idx+2*ln > len(by) {
@@ -936,36 +1590,67 @@ func (d *Decoder) decodeHashViaReflection(by []byte, idx int, ln int, ptr reflec
 
 	switch ptr.Kind() {
 	case reflect.Map:
+		if ptr.Type().Elem() == rawMessageType {
+			return d.decodeRawMap(by, idx, ln, ptr)
+		}
+
 		if ptr.IsNil() {
 			ptr.Set(reflect.MakeMap(ptr.Type()))
 		}
 
+		// map entries aren't addressable: values are decoded into tmp
+		// and then copied into the map, so a single tmp serves all keys
+		elemType := ptr.Type().Elem()
+		var tmp reflect.Value
+
 		var err error
 		for i := 0; i < ln; i++ {
 			var key []byte
-			key, idx, err = d.decodeStringish(by, idx)
+			var keyValue reflect.Value
+			key, keyValue, idx, err = d.decodeMapKey(by, idx, ptr.Type().Key())
 			if err != nil {
 				return 0, err
 			}
 
-			keyValue := reflect.ValueOf(string(key))
-			if value := ptr.MapIndex(keyValue); value.IsValid() {
-				// strkey exists in map, replace its content but respect structure
+			d.pushKey(key)
+			value := ptr.MapIndex(keyValue)
+			if value.IsValid() && (value.Kind() == reflect.Ptr || value.Kind() == reflect.Map) && !value.IsNil() {
+				// strkey exists in map and refers to its content, update it in place
 				idx, err = d.decodeViaReflection(by, idx, value)
 			} else {
-				// there is no strkey in map, crete a new one
-				riface := reflect.New(ptr.Type().Elem())
-				idx, err = d.decodeViaReflection(by, idx, riface.Elem())
+				if !tmp.IsValid() {
+					tmp = d.getMapValue(elemType)
+				}
+
+				if value.IsValid() {
+					// strkey exists in map, replace its content but respect structure
+					tmp.Set(value)
+				} else {
+					tmp.Set(reflect.Zero(elemType))
+				}
+
+				tracked := len(d.tracked)
+				idx, err = d.decodeViaReflection(by, idx, tmp)
 				if err != nil {
-					return 0, err
+					return 0, d.keyError(err, key)
 				}
 
-				ptr.SetMapIndex(keyValue, riface.Elem())
+				ptr.SetMapIndex(keyValue, tmp)
+
+				if len(d.tracked) != tracked {
+					// tmp may now be referred to by later REFP or ALIAS tags
+					tmp = reflect.Value{}
+				}
 			}
 
 			if err != nil {
-				return 0, err
+				return 0, d.keyError(err, key)
 			}
+			d.popPath()
+		}
+
+		if tmp.IsValid() {
+			d.putMapValue(tmp)
 		}
 
 	case reflect.Ptr:
@@ -976,7 +1661,14 @@ func (d *Decoder) decodeHashViaReflection(by []byte, idx int, ln int, ptr reflec
 
 		return d.decodeHashViaReflection(by, idx, ln, ptr.Elem())
 	case reflect.Struct:
-		tags := d.tcache.Get(ptr)
+		if ptr.Type() == syncMapType {
+			return d.decodeSyncMap(by, idx, ln, ptr.Addr().Interface().(*sync.Map))
+		}
+		if ptr.Type() == orderedMapType {
+			return d.decodeOrderedMap(by, idx, ln, ptr.Addr().Interface().(*OrderedMap))
+		}
+
+		tags := tcache.Get(ptr)
 		var err error
 		for i := 0; i < ln; i++ {
 			var key []byte
@@ -988,23 +1680,35 @@ func (d *Decoder) decodeHashViaReflection(by []byte, idx int, ln int, ptr reflec
 			var fld tag
 			var found bool
 
+			d.pushKey(key)
 			if tags == nil {
 				// do nothing
-			} else if fld, found = tags[string(key)]; found {
-				idx, err = d.decodeViaReflection(by, idx, ptr.Field(fld.id))
-			} else if fld, found = tags[strings.Title(string(key))]; found {
-				idx, err = d.decodeViaReflection(by, idx, ptr.Field(fld.id))
+			} else if fld, found = d.fieldForKey(ptr.Type(), tags, string(key)); found {
+				if fld.asString {
+					idx, err = d.decodeNumberString(by, idx, ptr.Field(fld.id))
+				} else {
+					idx, err = d.decodeViaReflection(by, idx, ptr.Field(fld.id))
+				}
 			}
 
 			if !found {
-				// struct doesn't contain field with strkey name
-				var iface interface{}
-				idx, err = d.decode(by, idx, &iface) // TODO make this process to be efficient
+				if rf, ok := tcache.RemainField(ptr); ok && ptr.Field(rf).CanSet() {
+					idx, err = d.decodeRemain(by, idx, ptr.Field(rf), string(key))
+				} else {
+					if err = d.unknownKey(ptr, key, idx); err != nil {
+						return 0, d.keyError(err, key)
+					}
+
+					// struct doesn't contain field with strkey name
+					d.explain(by, idx, BranchSkipped, reflect.Value{})
+					idx, err = d.skip(by, idx)
+				}
 			}
 
 			if err != nil {
-				return 0, err
+				return 0, d.keyError(err, key)
 			}
+			d.popPath()
 		}
 
 	default:
@@ -1014,7 +1718,25 @@ func (d *Decoder) decodeHashViaReflection(by []byte, idx int, ln int, ptr reflec
 	return idx, nil
 }
 
-func (d *Decoder) decodeREFP_ALIAS(by []byte, idx int, isREFP bool) (reflect.Value, int, error) {
+// decodeRemain decodes the value of the hash entry key, matching no field of
+// the struct it is decoded into, into the entry of the map field tagged
+// ",remain"
+func (d *decoder) decodeRemain(by []byte, idx int, remain reflect.Value, key string) (int, error) {
+	if remain.IsNil() {
+		remain.Set(reflect.MakeMap(remain.Type()))
+	}
+
+	value := reflect.New(remain.Type().Elem()).Elem()
+	idx, err := d.decodeViaReflection(by, idx, value)
+	if err != nil {
+		return 0, err
+	}
+
+	remain.SetMapIndex(reflect.ValueOf(key).Convert(remain.Type().Key()), value)
+	return idx, nil
+}
+
+func (d *decoder) decodeREFP_ALIAS(by []byte, idx int, isREFP bool) (reflect.Value, int, error) {
 	offs, sz, err := varintdecode(by[idx:])
 	if err != nil {
 		var res reflect.Value
@@ -1022,9 +1744,9 @@ func (d *Decoder) decodeREFP_ALIAS(by []byte, idx int, isREFP bool) (reflect.Val
 	}
 	idx += sz
 
-	if offs < 0 || offs >= idx {
+	if err = d.checkOffset(offs, idx-sz); err != nil {
 		var res reflect.Value
-		return res, 0, ErrCorrupt{errBadOffset}
+		return res, 0, err
 	}
 
 	rv, ok := d.tracked[offs]
@@ -1032,9 +1754,9 @@ func (d *Decoder) decodeREFP_ALIAS(by []byte, idx int, isREFP bool) (reflect.Val
 		var res reflect.Value
 		var corrupt ErrCorrupt
 		if isREFP {
-			corrupt.Err = errUntrackedOffsetREFP
+			corrupt.Err = ErrUntrackedOffsetREFP
 		} else {
-			corrupt.Err = errUntrackedOffsetAlias
+			corrupt.Err = ErrUntrackedOffsetAlias
 		}
 		return res, 0, corrupt
 	}
@@ -1053,9 +1775,13 @@ func (d *Decoder) decodeREFP_ALIAS(by []byte, idx int, isREFP bool) (reflect.Val
 		} else {
 			res = rv.Elem()
 		}
-	} else {
+	} else if rv.CanAddr() {
 		// rv contains original value
 		// i.e. it was saved in decodeViaReflection() path
+		// refer to it rather than to a copy, which is shared even if it is
+		// still being decoded as in cycles
+		res = rv.Addr()
+	} else {
 		res = reflect.New(rv.Type())
 		res.Elem().Set(rv)
 	}
@@ -1063,7 +1789,61 @@ func (d *Decoder) decodeREFP_ALIAS(by []byte, idx int, isREFP bool) (reflect.Val
 	return res, idx, nil
 }
 
-func (d *Decoder) decodeObjectViaReflection(by []byte, idx int, ptr reflect.Value, isObjectV bool) (int, error) {
+// decodeAlias decodes in PerlCompat mode the ALIAS whose offset starts at
+// by[idx] into a PerlAlias. The aliased value is replaced with the same
+// PerlAlias where it was decoded, so that both places share it as they do in
+// Perl, and encoding writes the ALIAS back.
+func (d *decoder) decodeAlias(by []byte, idx int) (*PerlAlias, int, error) {
+	offs, _, _ := varintdecode(by[idx:])
+
+	val, idx, err := d.decodeREFP_ALIAS(by, idx, false)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rv := d.tracked[offs]
+	if !rv.CanInterface() {
+		return &PerlAlias{Alias: val.Interface()}, idx, nil
+	}
+
+	slot, ok := rv.Interface().(*interface{})
+	if !ok {
+		return &PerlAlias{Alias: val.Interface()}, idx, nil
+	}
+
+	if pa, ok := (*slot).(*PerlAlias); ok {
+		// aliased several times
+		return pa, idx, nil
+	}
+
+	pa := &PerlAlias{Alias: *slot}
+	*slot = pa
+	if hs, ok := d.hashSlots[slot]; ok {
+		hs.hash[hs.key] = pa
+	}
+
+	return pa, idx, nil
+}
+
+// setShared stores into ptr the value val refers to, as returned by
+// decodeREFP_ALIAS. Pointers of the type of val are set to val itself, so
+// that they share the value, e.g. to form a cycle, rather than get a copy.
+func (d *decoder) setShared(ptr reflect.Value, val reflect.Value) error {
+	data := val.Elem()
+
+	switch {
+	case ptr.Kind() == reflect.Ptr && val.Kind() == reflect.Ptr && val.Type().AssignableTo(ptr.Type()):
+		ptr.Set(val)
+	case data.Type().AssignableTo(ptr.Type()):
+		ptr.Set(data)
+	default:
+		return d.convert(data, ptr)
+	}
+
+	return nil
+}
+
+func (d *decoder) decodeObjectViaReflection(by []byte, idx int, ptr reflect.Value, isObjectV bool) (int, error) {
 	var err error
 	var className []byte
 
@@ -1077,6 +1857,9 @@ func (d *Decoder) decodeObjectViaReflection(by []byte, idx int, ptr reflect.Valu
 		if err != nil {
 			return 0, err
 		}
+		if err = d.checkOffset(offs, idx); err != nil {
+			return 0, err
+		}
 		idx += sz
 		className, _, err = d.decodeStringish(by, offs)
 	}
@@ -1089,14 +1872,77 @@ func (d *Decoder) decodeObjectViaReflection(by []byte, idx int, ptr reflect.Valu
 		pobj := PerlObject{Class: string(className)}
 		ptr.Set(reflect.ValueOf(&pobj))
 		idx, err = d.decode(by, idx, &pobj.Reference)
+	} else if typ, ok := d.getUnmarshalerType(string(className)); ok && ptr.Kind() == reflect.Interface && ptr.IsNil() && typ.Implements(serealUnmarshalerType) {
+		idx, err = d.decodeViaRegisteredUnmarshaler(by, idx, className, typ, ptr)
+	} else if typ, ok := d.classcache[string(className)]; ok && ptr.Kind() == reflect.Interface && ptr.IsNil() {
+		idx, err = d.decodeRegisteredClass(by, idx, className, typ, ptr)
 	} else {
-		// FIXME: stuff className somewhere if map/struct?
-		idx, err = d.decodeViaReflection(by, idx, ptr)
+		if idx, err = d.decodeViaReflection(by, idx, ptr); err == nil {
+			d.captureClass(ptr, string(className))
+		}
 	}
 
 	return idx, err
 }
-func (d *Decoder) decodeObjectFreezeViaReflection(by []byte, idx int, ptr reflect.Value, isObjectV bool) (int, error) {
+
+// decodeRegisteredClass decodes an object of a class registered with
+// RegisterClass into a new value of the registered type, and stores it into
+// ptr
+func (d *decoder) decodeRegisteredClass(by []byte, idx int, className []byte, typ reflect.Type, ptr reflect.Value) (int, error) {
+	var obj reflect.Value
+	if typ.Kind() == reflect.Ptr {
+		obj = reflect.New(typ.Elem())
+	} else {
+		obj = reflect.New(typ)
+	}
+
+	idx, err := d.decodeViaReflection(by, idx, obj.Elem())
+	if err != nil {
+		return 0, err
+	}
+
+	d.captureClass(obj, string(className))
+
+	if typ.Kind() == reflect.Ptr {
+		ptr.Set(obj)
+	} else {
+		ptr.Set(obj.Elem())
+	}
+
+	return idx, nil
+}
+
+// captureClass stores the class name of an object decoded into ptr into the
+// struct field tagged ",class", or under ClassKey for maps if ClassIntoMaps
+// is set
+func (d *decoder) captureClass(ptr reflect.Value, className string) {
+	for ptr.Kind() == reflect.Interface || ptr.Kind() == reflect.Ptr {
+		if ptr.IsNil() {
+			return
+		}
+		ptr = ptr.Elem()
+	}
+
+	switch ptr.Kind() {
+	case reflect.Struct:
+		if i, ok := tcache.ClassField(ptr); ok && ptr.Field(i).CanSet() {
+			ptr.Field(i).SetString(className)
+		}
+
+	case reflect.Map:
+		if !d.ClassIntoMaps || ptr.IsNil() || ptr.Type().Key().Kind() != reflect.String {
+			return
+		}
+
+		class := reflect.ValueOf(className)
+		if class.Type().AssignableTo(ptr.Type().Elem()) {
+			ptr.SetMapIndex(reflect.ValueOf(ClassKey).Convert(ptr.Type().Key()), class)
+		}
+	}
+}
+
+func (d *decoder) decodeObjectFreezeViaReflection(by []byte, idx int, ptr reflect.Value, isObjectV bool) (int, error) {
+	start := idx - 1 // offset of the tag, for errors
 	var err error
 	var className, classData []byte
 
@@ -1112,6 +1958,9 @@ func (d *Decoder) decodeObjectFreezeViaReflection(by []byte, idx int, ptr reflec
 		if err != nil {
 			return 0, err
 		}
+		if err = d.checkOffset(offs, idx); err != nil {
+			return 0, err
+		}
 		idx += sz
 		className, _, err = d.decodeStringish(by, offs)
 		if err != nil {
@@ -1128,7 +1977,7 @@ func (d *Decoder) decodeObjectFreezeViaReflection(by []byte, idx int, ptr reflec
 	}
 
 	if by[idx] != typeREFN || by[idx+1] != typeARRAY {
-		return 0, ErrCorrupt{errFreezeNotRefnArray}
+		return 0, ErrCorrupt{ErrFreezeNotRefnArray}
 	}
 
 	var iface interface{}
@@ -1138,27 +1987,31 @@ func (d *Decoder) decodeObjectFreezeViaReflection(by []byte, idx int, ptr reflec
 
 	wrapper, ok := iface.([]interface{})
 	if !ok {
-		return 0, ErrCorrupt{errFreezeNotArray}
+		return 0, ErrCorrupt{ErrFreezeNotArray}
 	}
 
 	if len(wrapper) != 1 {
-		return 0, ErrCorrupt{errFreezeMultipleElts}
+		return 0, ErrCorrupt{ErrFreezeMultipleElts}
 	}
 
 	// Expecting a single item in the array ref
 	if classData, ok = wrapper[0].([]byte); !ok {
-		return 0, ErrCorrupt{errFreezeNotByteSlice}
+		return 0, ErrCorrupt{ErrFreezeNotByteSlice}
 	}
 
 	strClassName := string(className)
 
 	if d.PerlCompat {
 		ptr.Set(reflect.ValueOf(&PerlFreeze{strClassName, classData}))
+	} else if thawed, err := thawBig(ptr, strClassName, classData); thawed {
+		if err != nil {
+			return 0, &ThawError{Class: strClassName, Path: d.pathString(), Offset: start, Err: err}
+		}
 	} else {
 		if obj, ok := findUnmarshaler(ptr); ok {
 
 			if err := obj.UnmarshalBinary(classData); err != nil {
-				return 0, err
+				return 0, &ThawError{Class: strClassName, Path: d.pathString(), Offset: start, Err: err}
 			}
 		} else {
 			switch {
@@ -1166,7 +2019,7 @@ func (d *Decoder) decodeObjectFreezeViaReflection(by []byte, idx int, ptr reflec
 				// do we have a registered handler for this type?
 				concreteClass, ok := d.getUnmarshalerType(strClassName)
 
-				if ok {
+				if ok && concreteClass.Implements(binaryUnmarshalerType) {
 					rzero := instantiateZero(concreteClass)
 					obj, ok := findUnmarshaler(rzero)
 
@@ -1176,7 +2029,7 @@ func (d *Decoder) decodeObjectFreezeViaReflection(by []byte, idx int, ptr reflec
 					}
 
 					if err := obj.UnmarshalBinary(classData); err != nil {
-						return 0, err
+						return 0, &ThawError{Class: strClassName, Path: d.pathString(), Offset: start, Err: err}
 					}
 
 					ptr.Set(reflect.ValueOf(obj))
@@ -1209,14 +2062,84 @@ func setInt(ptr reflect.Value, i int) {
 	}
 }
 
+// setBinary stores val, a slice of the document, into ptr
+// setBool stores b into ptr, or with CoerceBools into the number or string
+// ptr as 1 or 0, "1" or ""
+func (d *decoder) setBool(ptr reflect.Value, b bool) {
+	if d.CoerceBools {
+		i := 0
+		if b {
+			i = 1
+		}
+
+		switch ptr.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			ptr.SetInt(int64(i))
+			return
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			ptr.SetUint(uint64(i))
+			return
+		case reflect.Float32, reflect.Float64:
+			ptr.SetFloat(float64(i))
+			return
+		case reflect.String:
+			ptr.SetString(strings.Repeat("1", i))
+			return
+		}
+	}
+
+	ptr.SetBool(b)
+}
+
+// decodeNumberString decodes into the number ptr a value encoded as a
+// string, as fields tagged ",string" are. Numbers are accepted too.
+func (d *decoder) decodeNumberString(by []byte, idx int, ptr reflect.Value) (int, error) {
+	if idx < 0 || idx >= len(by) {
+		return 0, ErrTruncated
+	}
+
+	if isStringishTag(by[idx] &^ trackFlag) {
+		s, idx, err := d.decodeStringish(by, idx)
+		if err != nil {
+			return 0, err
+		}
+		if err := parseNumber(ptr, string(s)); err != nil {
+			return 0, fmt.Errorf("sereal: %v", err)
+		}
+		return idx, nil
+	}
+
+	return d.decodeViaReflection(by, idx, ptr)
+}
+
+func (d *decoder) setBinary(ptr reflect.Value, val []byte) {
+	if d.AliasInput && ptr.Kind() == reflect.Slice && ptr.Type().Elem().Kind() == reflect.Uint8 {
+		ptr.Set(reflect.ValueOf(val[:len(val):len(val)]).Convert(ptr.Type()))
+		return
+	}
+	if d.arena != nil {
+		switch {
+		case ptr.Kind() == reflect.String:
+			ptr.SetString(d.arena.string(val))
+			return
+		case ptr.Kind() == reflect.Slice && ptr.Type().Elem().Kind() == reflect.Uint8 && ptr.IsNil():
+			ptr.Set(reflect.ValueOf(d.arena.copyBytes(val)).Convert(ptr.Type()))
+			return
+		}
+	}
+	setBinary(ptr, val)
+}
+
 func setBinary(ptr reflect.Value, val []byte) {
 	switch ptr.Kind() {
 	case reflect.Slice:
-		if ptr.Type().Elem().Kind() == reflect.Uint8 && ptr.IsNil() {
+		if ptr.Type().Elem().Kind() == reflect.Uint8 && (ptr.IsNil() || ptr.Cap() < len(val)) {
 			slice := make([]byte, len(val))
-			ptr.Set(reflect.ValueOf(slice))
+			ptr.Set(reflect.ValueOf(slice).Convert(ptr.Type()))
 		}
 
+		// reuse the capacity of the existing slice
+		ptr.SetLen(len(val))
 		reflect.Copy(ptr, reflect.ValueOf(val))
 
 	case reflect.Array:
@@ -1230,7 +2153,8 @@ func setBinary(ptr reflect.Value, val []byte) {
 	}
 }
 
-func varintdecode(by []byte) (n int, sz int, err error) {
+// varintdecodePortable is varintdecode reading a byte at a time
+func varintdecodePortable(by []byte) (n int, sz int, err error) {
 	s := uint(0) // shift count
 	for i, b := range by {
 		n |= int(b&0x7f) << s
@@ -1242,12 +2166,12 @@ func varintdecode(by []byte) (n int, sz int, err error) {
 
 		if s > 63 {
 			// too many continuation bits
-			return 0, i + 1, ErrCorrupt{errBadVarint}
+			return 0, i + 1, ErrCorrupt{ErrBadVarint}
 		}
 	}
 
 	// byte without continuation bit
-	return 0, len(by), ErrCorrupt{errBadVarint}
+	return 0, len(by), ErrCorrupt{ErrBadVarint}
 }
 
 func findUnmarshaler(ptr reflect.Value) (encoding.BinaryUnmarshaler, bool) {
@@ -1271,28 +2195,64 @@ func findUnmarshaler(ptr reflect.Value) (encoding.BinaryUnmarshaler, bool) {
 
 // RegisterName registers the named class with an instance of 'value'.  When the
 // decoder finds a FREEZE tag with the given class, the binary data will be
-// passed to value's UnmarshalBinary method.
+// passed to value's UnmarshalBinary method.  When value implements Unmarshaler,
+// objects of the given class decoded into an empty interface are passed to
+// its UnmarshalSereal method.
 func (d *Decoder) RegisterName(name string, value interface{}) {
 	if d.umcache == nil {
 		d.umcache = make(map[string]reflect.Type)
 	}
 
+	d.umcache[name] = unmarshalerType(value)
+}
+
+// RegisterClass registers goType, given as an instance, as the Go type of the
+// objects blessed into perlClass. When the decoder finds such an object while
+// decoding into an empty interface, it decodes it into a new value of that
+// type rather than into a map. Pointer instances yield pointers.
+func (d *Decoder) RegisterClass(perlClass string, goType interface{}) {
+	if d.classcache == nil {
+		d.classcache = make(map[string]reflect.Type)
+	}
+
+	d.classcache[perlClass] = reflect.TypeOf(goType)
+}
+
+// Precompile builds the field lists of the struct types of the given
+// instances, and of the struct types they contain, so that the first decode
+// of those types doesn't have to. It returns an error describing the first
+// problem found with their struct tags, such as two fields sharing a name or
+// an unknown option. Instances may also be given as a reflect.Type.
+func (d *Decoder) Precompile(types ...interface{}) error {
+	return tcache.precompileTypes(types)
+}
+
+// unmarshalerType returns the type implementing encoding.BinaryUnmarshaler or
+// Unmarshaler for value, which is either the type of value itself or a
+// pointer to it.
+func unmarshalerType(value interface{}) reflect.Type {
 	rv := reflect.ValueOf(value)
-	if _, ok := value.(encoding.BinaryUnmarshaler); ok {
-		d.umcache[name] = rv.Type()
-		return
+	if isRegistrable(rv.Type()) {
+		return rv.Type()
 	}
 
 	prv := rv.Addr()
-	if _, ok := prv.Interface().(encoding.BinaryUnmarshaler); ok {
-		d.umcache[name] = prv.Type()
-		return
+	if isRegistrable(prv.Type()) {
+		return prv.Type()
 	}
 
-	panic(fmt.Sprintf("unable to register type %s: not encoding.BinaryUnmarshaler", rv.Type()))
+	panic(fmt.Sprintf("unable to register type %s: neither encoding.BinaryUnmarshaler nor sereal.Unmarshaler", rv.Type()))
 }
 
-func (d *Decoder) getUnmarshalerType(name string) (reflect.Type, bool) {
+func isRegistrable(typ reflect.Type) bool {
+	return typ.Implements(binaryUnmarshalerType) || typ.Implements(serealUnmarshalerType)
+}
+
+func (d *decoder) getUnmarshalerType(name string) (reflect.Type, bool) {
+	if val, ok := d.classes[name]; ok {
+		return val, true
+	}
+
 	if d.umcache == nil {
 		return nil, false
 	}
@@ -1301,6 +2261,36 @@ func (d *Decoder) getUnmarshalerType(name string) (reflect.Type, bool) {
 	return val, ok
 }
 
+// getMapValue returns addressable storage for decoding an element of type
+// typ before it is stored into a map
+func (d *decoder) getMapValue(typ reflect.Type) reflect.Value {
+	if d.PoolMapValues {
+		if p, ok := d.mapValuePools.Load(typ); ok {
+			if v := p.(*sync.Pool).Get(); v != nil {
+				return reflect.ValueOf(v).Elem()
+			}
+		}
+	}
+
+	return reflect.New(typ).Elem()
+}
+
+// putMapValue hands storage obtained from getMapValue back to the pool
+func (d *decoder) putMapValue(v reflect.Value) {
+	if !d.PoolMapValues {
+		return
+	}
+
+	// don't keep the previous entry alive through the pool
+	v.Set(reflect.Zero(v.Type()))
+
+	p, ok := d.mapValuePools.Load(v.Type())
+	if !ok {
+		p, _ = d.mapValuePools.LoadOrStore(v.Type(), &sync.Pool{})
+	}
+	p.(*sync.Pool).Put(v.Addr().Interface())
+}
+
 func instantiateZero(typ reflect.Type) reflect.Value {
 	if typ.Kind() == reflect.Ptr {
 		return reflect.New(typ.Elem())
@@ -1313,6 +2303,8 @@ func instantiateZero(typ reflect.Type) reflect.Value {
 // DecompressDocument changes the compression type of a Sereal document without performing a full re-serialization
 //
 // One use case is to use this before decoding, to avoid the implicit allocation.
+// dst is reused if its length, not its capacity, is at least len(b); it must
+// not overlap b.
 func DecompressDocument(dst, b []byte) (r []byte, err error) {
 	header, err := checkHeader(b)
 	if err != nil {
@@ -1327,31 +2319,28 @@ func DecompressDocument(dst, b []byte) (r []byte, err error) {
 	bodyStart := headerSize + header.suffixSize
 
 	if bodyStart > len(b) || bodyStart < 0 {
-		return nil, ErrCorrupt{errBadOffset}
+		return nil, ErrCorrupt{ErrBadOffset}
 	}
 
 	if decomp != nil {
-		var decompressInto []byte
 		if dst != nil && len(dst) >= len(b) {
-			decompressInto = dst[bodyStart:]
-		} else {
-			decompressInto = nil
-		}
+			decompBody, err := decomp.decompress(dst[bodyStart:], b[bodyStart:])
+			if err != nil {
+				return nil, err
+			}
 
-		decompBody, err := decomp.decompress(decompressInto, b[bodyStart:])
-		if err != nil {
+			if hasSameBuffer(decompBody, dst[bodyStart:]) {
+				copy(dst[0:bodyStart], b[0:bodyStart])
+				dst = dst[0 : bodyStart+len(decompBody)]
+			} else {
+				dst = make([]byte, 0, bodyStart+len(decompBody))
+				dst = append(dst, b[0:bodyStart]...)
+				dst = append(dst, decompBody...)
+			}
+		} else if dst, err = decompressBody(decomp, b, header, bodyStart, bodyStart); err != nil {
 			return nil, err
 		}
 
-		if len(dst) > 0 && hasSameBuffer(decompBody, dst) {
-			copy(dst[0:bodyStart], b[0:bodyStart])
-			dst = dst[0 : bodyStart+len(decompBody)]
-		} else {
-			dst = make([]byte, 0, bodyStart+len(decompBody))
-			dst = append(dst, b[0:bodyStart]...)
-			dst = append(dst, decompBody...)
-		}
-
 		// set type to 0 (not compressed)
 		dst[4] &= 0x0f
 	} else {
@@ -1361,10 +2350,140 @@ func DecompressDocument(dst, b []byte) (r []byte, err error) {
 	return dst, nil
 }
 
-// hasSameBuffer returns true if the two slices share the same array (it only works for slices with capacity > 0)
-func hasSameBuffer(a, b []byte) bool {
-	aCap, bCap := cap(a), cap(b)
-	aExt, bExt := a[:aCap], b[:bCap]
+// decompressBody returns the body of the document b decompressed by decomp,
+// preceded by the prefix bytes which precede it in b. The body is
+// decompressed in place into a single buffer, rather than into one which must
+// then be copied after the prefix. It must still be whole before decoding
+// starts, as offsets may refer to any value before the one being decoded.
+func decompressBody(decomp decompressor, b []byte, header serealHeader, bodyStart int, prefix int) ([]byte, error) {
+	compressed := b[bodyStart:]
+
+	var buf []byte
+	if sd, ok := decomp.(streamDecompressor); ok {
+		r, size, err := sd.bodyReader(compressed)
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+
+		if buf, err = readBody(make([]byte, prefix), r, size, len(compressed)); err != nil {
+			return nil, err
+		}
+	} else {
+		buf = make([]byte, prefix)
+		if size, err := announcedBodySize(header.doctype, compressed); err == nil && size > 0 {
+			buf = make([]byte, prefix+bodyPrealloc(size, len(compressed)))
+		}
+
+		body, err := decomp.decompress(buf[prefix:], compressed)
+		if err != nil {
+			return nil, err
+		}
+
+		if hasSameBuffer(body, buf[prefix:]) {
+			buf = buf[:prefix+len(body)]
+		} else {
+			// the decompressor couldn't use buf: the size wasn't announced,
+			// was wrong or was more than bodyPrealloc trusts
+			buf = append(buf[:prefix], body...)
+		}
+	}
+
+	copy(buf, b[bodyStart-prefix:bodyStart])
+	return buf, nil
+}
+
+// maxBodyPreallocRatio bounds the buffer allocated for a body before it is
+// decompressed, relative to the size of the compressed body. The sizes
+// documents announce are only trusted up to it, so that a few bytes can't
+// make decoding allocate gigabytes before being found corrupt: the buffer
+// grows past it as the body is decompressed.
+const maxBodyPreallocRatio = 8
+
+// bodyPrealloc returns how many bytes to allocate for a body announced to
+// decompress to size bytes, -1 if unknown, out of clen compressed ones
+func bodyPrealloc(size, clen int) int {
+	if limit := maxBodyPreallocRatio * clen; size < 0 || size > limit {
+		return limit
+	}
+	return size
+}
+
+// A streamDecompressor is a decompressor whose bodies can be read as
+// streams, and so decompressed into a buffer grown as they come rather than
+// into one sized after the length they announce
+type streamDecompressor interface {
+	decompressor
+
+	// bodyReader returns a reader of the compressed body b decompressed,
+	// and the length b announces
+	bodyReader(b []byte) (io.ReadCloser, int, error)
+}
+
+// readBody appends the body read from r to buf, which only gets the room
+// bodyPrealloc allows for size bytes out of clen before it is read. Bodies
+// shorter than the size they announce are corrupt.
+func readBody(buf []byte, r io.Reader, size, clen int) ([]byte, error) {
+	if n := bodyPrealloc(size, clen); cap(buf)-len(buf) < n {
+		buf = append(make([]byte, 0, len(buf)+n), buf...)
+	}
 
-	return &aExt[aCap-1] == &bExt[bCap-1]
+	start := len(buf)
+	for {
+		if len(buf) == cap(buf) {
+			buf = append(buf, 0)[:len(buf)]
+		}
+
+		n, err := r.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(buf)-start < size {
+		return nil, ErrCorrupt{ErrShortBody}
+	}
+	return buf, nil
+}
+
+// CompressDocument returns the document b with its body compressed with c,
+// or uncompressed if c is nil, without performing a full re-serialization.
+// The compression must be valid for the version of the document.
+func CompressDocument(b []byte, c compressor) ([]byte, error) {
+	raw, err := DecompressDocument(nil, b)
+	if err != nil {
+		return nil, err
+	}
+
+	if c == nil {
+		return raw, nil
+	}
+
+	header, _ := readHeader(raw)
+	doctype, err := compressionDocType(int(header.version), c)
+	if err != nil {
+		return nil, err
+	}
+
+	bodyStart := headerSize + header.suffixSize
+	body, err := c.compress(append([]byte(nil), raw[bodyStart:]...))
+	if err != nil {
+		return nil, err
+	}
+
+	doc := append(raw[:bodyStart:bodyStart], body...)
+	doc[4] |= byte(doctype) << 4
+
+	return doc, nil
+}
+
+// hasSameBuffer returns true if the two slices start at the same address,
+// i.e. a decompressor wrote into the buffer it was given. Empty slices never
+// share their buffer.
+func hasSameBuffer(a, b []byte) bool {
+	return len(a) > 0 && len(b) > 0 && &a[0] == &b[0]
 }
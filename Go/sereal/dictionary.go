@@ -0,0 +1,215 @@
+package sereal
+
+import (
+	"container/heap"
+	"fmt"
+	"reflect"
+)
+
+// DictionaryKey is the header user-data key holding the identifier of the
+// dictionary a document body was compressed with.
+const DictionaryKey = "__sereal_dictionary"
+
+// A DictionaryResolver returns the compression dictionary identified by id
+type DictionaryResolver func(id string) ([]byte, error)
+
+// dictionaryCompressor is implemented by compressors supporting preset
+// dictionaries
+type dictionaryCompressor interface {
+	dictionaryID() string
+}
+
+// withDictionaryID returns the header user-data with the dictionary
+// identifier added
+func withDictionaryID(header interface{}, id string) (interface{}, error) {
+	return withHeaderEntry(header, DictionaryKey, id)
+}
+
+// documentDictionaryID returns the dictionary identifier stored in the header
+// user-data of b, if any
+func (d *decoder) documentDictionaryID(b []byte, header serealHeader, bodyStart int) (string, error) {
+	if header.suffixLen == 0 || b[header.suffixStart]&1 == 0 {
+		return "", nil
+	}
+
+	// header offsets are relative to the flag byte
+	peek := decoder{Decoder: d.Decoder, tracked: make(map[int]reflect.Value), section: "header", sectionStart: 1}
+
+	var userData interface{}
+	if _, err := peek.decode(b[header.suffixStart:bodyStart], 1, &userData); err != nil {
+		return "", err
+	}
+
+	m, ok := userData.(map[string]interface{})
+	if !ok {
+		return "", nil
+	}
+
+	switch id := m[DictionaryKey].(type) {
+	case string:
+		return id, nil
+	case []byte:
+		return string(id), nil
+	}
+
+	return "", nil
+}
+
+// dictionaryDecompressor returns decomp set up with the dictionary the
+// document was compressed with: the one its header identifies, or else
+// Decoder.Dictionary
+func (d *decoder) dictionaryDecompressor(decomp decompressor, b []byte, header serealHeader, bodyStart int) (decompressor, error) {
+	switch decomp.(type) {
+	case ZlibCompressor, ZstdCompressor:
+	default:
+		return decomp, nil
+	}
+
+	dict := d.Dictionary
+	if !d.bodyOnly {
+		id, err := d.documentDictionaryID(b, header, bodyStart)
+		if err != nil {
+			return decomp, err
+		}
+
+		if id != "" {
+			if d.DictionaryResolver == nil {
+				return nil, fmt.Errorf("sereal: document was compressed with dictionary %q but the decoder has no DictionaryResolver", id)
+			}
+			if dict, err = d.DictionaryResolver(id); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	switch c := decomp.(type) {
+	case ZlibCompressor:
+		c.Dictionary = dict
+		return c, nil
+	case ZstdCompressor:
+		c.Dictionary = dict
+		return c, nil
+	}
+	return decomp, nil
+}
+
+// Parameters of TrainDictionary: dictionaries are made of segments of
+// dictSegmentSize bytes, scored by the number of samples sharing each of
+// their dictGramSize-byte substrings
+const (
+	dictSegmentSize = 32
+	dictGramSize    = 6
+)
+
+// TrainDictionary builds a dictionary of at most size bytes for
+// ZlibCompressor and ZstdCompressor out of sample documents, compressed or
+// not. It is made of the stretches of the bodies the most shared across the
+// samples, the most shared last as compressors reach recent data at a lower
+// cost. The samples should be representative of the documents to compress.
+func TrainDictionary(samples [][]byte, size int) ([]byte, error) {
+	var bodies [][]byte
+	for _, doc := range samples {
+		b, err := DecompressDocument(nil, doc)
+		if err != nil {
+			return nil, err
+		}
+
+		header, _ := readHeader(b)
+		bodies = append(bodies, b[headerSize+header.suffixSize:])
+	}
+
+	// number of samples each substring appears in
+	freq := make(map[string]int)
+	for _, body := range bodies {
+		seen := make(map[string]bool)
+		for i := 0; i+dictGramSize <= len(body); i++ {
+			gram := string(body[i : i+dictGramSize])
+			if !seen[gram] {
+				seen[gram] = true
+				freq[gram]++
+			}
+		}
+	}
+
+	var h segmentHeap
+	for _, body := range bodies {
+		for i := 0; i < len(body); i += dictSegmentSize / 2 {
+			end := i + dictSegmentSize
+			if end > len(body) {
+				end = len(body)
+			}
+			seg := body[i:end]
+			if score := segmentScore(seg, freq); score > 0 {
+				h = append(h, dictSegment{seg, score})
+			}
+		}
+	}
+	heap.Init(&h)
+
+	// pick segments greedily, the substrings of the segments already picked
+	// no longer counting
+	var picked [][]byte
+	total := 0
+	for h.Len() > 0 && total < size {
+		top := h[0]
+		score := segmentScore(top.b, freq)
+		if score == 0 {
+			heap.Pop(&h)
+			continue
+		}
+		if score < top.score {
+			h[0].score = score
+			heap.Fix(&h, 0)
+			continue
+		}
+
+		heap.Pop(&h)
+		seg := top.b
+		if total+len(seg) > size {
+			seg = seg[:size-total]
+		}
+		picked = append(picked, seg)
+		total += len(seg)
+
+		for i := 0; i+dictGramSize <= len(seg); i++ {
+			delete(freq, string(seg[i:i+dictGramSize]))
+		}
+	}
+
+	dict := make([]byte, 0, total)
+	for i := len(picked) - 1; i >= 0; i-- {
+		dict = append(dict, picked[i]...)
+	}
+	return dict, nil
+}
+
+// segmentScore returns the sum of the frequencies of the substrings of seg
+// found in at least two samples
+func segmentScore(seg []byte, freq map[string]int) int {
+	score := 0
+	for i := 0; i+dictGramSize <= len(seg); i++ {
+		if n := freq[string(seg[i:i+dictGramSize])]; n > 1 {
+			score += n
+		}
+	}
+	return score
+}
+
+type dictSegment struct {
+	b     []byte
+	score int
+}
+
+// segmentHeap orders segments by decreasing score
+type segmentHeap []dictSegment
+
+func (h segmentHeap) Len() int            { return len(h) }
+func (h segmentHeap) Less(i, j int) bool  { return h[i].score > h[j].score }
+func (h segmentHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *segmentHeap) Push(x interface{}) { *h = append(*h, x.(dictSegment)) }
+func (h *segmentHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
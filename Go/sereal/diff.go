@@ -0,0 +1,244 @@
+package sereal
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+)
+
+// A DiffEntry describes a difference between two documents.
+type DiffEntry struct {
+	Path   string      // logical location, e.g. "body.users[2].name"
+	A, B   interface{} // the differing values; nil when missing from one side
+	Reason string      // what differs, e.g. "value differs" or "missing in B"
+}
+
+func (e DiffEntry) String() string {
+	return fmt.Sprintf("%s: %s (%#v vs %#v)", e.Path, e.Reason, e.A, e.B)
+}
+
+// Diff decodes the documents a and b and reports the paths at which their
+// header and body differ. Documents which only differ in the order of their
+// hash keys, in their use of COPY and REFP tags, in their compression or in
+// their protocol version have no differences. Strings and binary strings
+// holding the same bytes are equal, as they are to Perl, and references are
+// transparent.
+func Diff(a, b []byte) ([]DiffEntry, error) {
+	d := Decoder{PerlCompat: true}
+
+	var ha, ba interface{}
+	if err := d.UnmarshalHeaderBody(a, &ha, &ba); err != nil {
+		return nil, fmt.Errorf("sereal: decoding A: %v", err)
+	}
+
+	var hb, bb interface{}
+	if err := d.UnmarshalHeaderBody(b, &hb, &bb); err != nil {
+		return nil, fmt.Errorf("sereal: decoding B: %v", err)
+	}
+
+	df := differ{seen: make(map[[2]uintptr]bool)}
+	df.diff("header", reflect.ValueOf(ha), reflect.ValueOf(hb))
+	df.diff("body", reflect.ValueOf(ba), reflect.ValueOf(bb))
+
+	return df.entries, nil
+}
+
+type differ struct {
+	entries []DiffEntry
+	seen    map[[2]uintptr]bool // pairs of maps or pointers already compared, to stop on cycles
+}
+
+func (df *differ) add(path string, a, b reflect.Value, reason string) {
+	df.entries = append(df.entries, DiffEntry{Path: path, A: diffInterface(a), B: diffInterface(b), Reason: reason})
+}
+
+func diffInterface(v reflect.Value) interface{} {
+	if !v.IsValid() || !v.CanInterface() {
+		return nil
+	}
+	return v.Interface()
+}
+
+// indirect strips interfaces and pointers from v
+func (df *differ) indirect(v reflect.Value) reflect.Value {
+	for v.IsValid() && (v.Kind() == reflect.Interface || v.Kind() == reflect.Ptr) {
+		if v.IsNil() {
+			return reflect.Value{}
+		}
+		v = v.Elem()
+	}
+	return v
+}
+
+func (df *differ) diff(path string, a, b reflect.Value) {
+	// compare pointers before following them, so that cycles end
+	if a.IsValid() && b.IsValid() && (a.Kind() == reflect.Ptr || a.Kind() == reflect.Map) && a.Kind() == b.Kind() && !a.IsNil() && !b.IsNil() {
+		key := [2]uintptr{a.Pointer(), b.Pointer()}
+		if df.seen[key] {
+			return
+		}
+		df.seen[key] = true
+	}
+
+	if a.IsValid() && (a.Kind() == reflect.Ptr || a.Kind() == reflect.Interface) || b.IsValid() && (b.Kind() == reflect.Ptr || b.Kind() == reflect.Interface) {
+		df.diff(path, df.indirect(a), df.indirect(b))
+		return
+	}
+
+	if !a.IsValid() || !b.IsValid() {
+		if a.IsValid() != b.IsValid() {
+			df.add(path, a, b, "value differs")
+		}
+		return
+	}
+
+	if sa, ok := diffBytes(a); ok {
+		if sb, ok := diffBytes(b); ok {
+			if sa != sb {
+				df.add(path, a, b, "value differs")
+			}
+			return
+		}
+	}
+
+	if isNumber(a) && isNumber(b) {
+		if !numbersEqual(a, b) {
+			df.add(path, a, b, "value differs")
+		}
+		return
+	}
+
+	if a.Type() != b.Type() {
+		df.add(path, a, b, "type differs")
+		return
+	}
+
+	switch a.Kind() {
+	case reflect.Map:
+		df.diffMap(path, a, b)
+
+	case reflect.Slice, reflect.Array:
+		n := a.Len()
+		if b.Len() > n {
+			n = b.Len()
+		}
+		for i := 0; i < n; i++ {
+			p := path + "[" + strconv.Itoa(i) + "]"
+			switch {
+			case i >= a.Len():
+				df.add(p, reflect.Value{}, b.Index(i), "missing in A")
+			case i >= b.Len():
+				df.add(p, a.Index(i), reflect.Value{}, "missing in B")
+			default:
+				df.diff(p, a.Index(i), b.Index(i))
+			}
+		}
+
+	case reflect.Struct:
+		if oa, ok := a.Interface().(PerlObject); ok {
+			ob := b.Interface().(PerlObject)
+			if oa.Class != ob.Class {
+				df.add(path, a, b, "class differs")
+				return
+			}
+			df.diff(path, reflect.ValueOf(oa.Reference), reflect.ValueOf(ob.Reference))
+			return
+		}
+
+		for i := 0; i < a.NumField(); i++ {
+			if f := a.Type().Field(i); f.PkgPath == "" {
+				df.diff(path+"."+f.Name, a.Field(i), b.Field(i))
+			}
+		}
+
+	default:
+		if !reflect.DeepEqual(a.Interface(), b.Interface()) {
+			df.add(path, a, b, "value differs")
+		}
+	}
+}
+
+func (df *differ) diffMap(path string, a, b reflect.Value) {
+	keys := a.MapKeys()
+	for _, k := range b.MapKeys() {
+		if !a.MapIndex(k).IsValid() {
+			keys = append(keys, k)
+		}
+	}
+	sortMapKeys(keys)
+
+	for _, k := range keys {
+		p := path + "." + fmt.Sprint(k.Interface())
+		va, vb := a.MapIndex(k), b.MapIndex(k)
+		switch {
+		case !va.IsValid():
+			df.add(p, reflect.Value{}, vb, "missing in A")
+		case !vb.IsValid():
+			df.add(p, va, reflect.Value{}, "missing in B")
+		default:
+			df.diff(p, va, vb)
+		}
+	}
+}
+
+// diffBytes returns the content of strings and byte slices
+func diffBytes(v reflect.Value) (string, bool) {
+	switch {
+	case v.Kind() == reflect.String:
+		return v.String(), true
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8:
+		return string(v.Bytes()), true
+	}
+	return "", false
+}
+
+func isNumber(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+// numbersEqual compares numbers by value: the same integer may be decoded as
+// int or uint depending on its tag, and FLOAT and DOUBLE are compared as with
+// FloatEqual. Integers and floats are never equal.
+func numbersEqual(a, b reflect.Value) bool {
+	isFloat := func(v reflect.Value) bool { return v.Kind() == reflect.Float32 || v.Kind() == reflect.Float64 }
+
+	switch {
+	case isFloat(a) && isFloat(b):
+		return FloatEqual(a.Interface(), b.Interface())
+	case isFloat(a) || isFloat(b):
+		return false
+	}
+
+	ia, aNeg := diffInt(a)
+	ib, bNeg := diffInt(b)
+	return ia == ib && aNeg == bNeg
+}
+
+// diffInt returns the magnitude and sign of an integer
+func diffInt(v reflect.Value) (uint64, bool) {
+	switch v.Kind() {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return v.Uint(), false
+	}
+
+	if i := v.Int(); i < 0 {
+		return uint64(-i), true
+	}
+	return uint64(v.Int()), false
+}
+
+// Equal reports whether the documents a and b hold the same header and body,
+// with the same tolerances as Diff.
+func Equal(a, b []byte) (bool, error) {
+	entries, err := Diff(a, b)
+	if err != nil {
+		return false, err
+	}
+	return len(entries) == 0, nil
+}
@@ -3,6 +3,18 @@ Package sereal implements the Sereal serialization format
 
 It follows the standard Go Marshal/Unmarshal interface.
 
+Types may take control of their encoding by implementing Marshaler and
+Unmarshaler. MarshalSereal returns the encoding of a single value, built with
+the Append functions or AppendValue, and UnmarshalSereal receives the same,
+typically read with a ValueReader. Unlike encoding.BinaryMarshaler, which is
+stored as an opaque FREEZE blob, these encodings are native Sereal values
+readable by any implementation. The sereal-gen command generates both methods
+for struct types.
+
+Encodings that start with an object (see AppendObjectHeader) can be decoded
+into an interface{} as the concrete type registered for the class with
+Decoder.RegisterName.
+
 For more information on Sereal, please see
 http://blog.booking.com/sereal-a-binary-data-serialization-format.html
 and
@@ -0,0 +1,268 @@
+package sereal
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// DumpTags writes the tags of the document b to w, one per line and
+// indented by nesting depth. Each line starts with the offset of the tag as
+// used by COPY and REFP tags in its section. Compressed bodies are
+// decompressed first.
+func DumpTags(w io.Writer, b []byte) error {
+	b, err := DecompressDocument(nil, b)
+	if err != nil {
+		return err
+	}
+
+	header, err := readHeader(b)
+	if err != nil {
+		return err
+	}
+	bodyStart := headerSize + header.suffixSize
+
+	if _, err := fmt.Fprintf(w, "version %d\n", header.version); err != nil {
+		return err
+	}
+
+	dump := func(by []byte, idx int) error {
+		_, err := walkTree(by, idx, 0, func(idx int, tag byte, depth int) error {
+			tracked := ""
+			if by[idx]&trackFlag == trackFlag {
+				tracked = " (tracked)"
+			}
+			_, err := fmt.Fprintf(w, "%6d %s%s%s%s\n", idx, strings.Repeat("  ", depth+1), tagName(tag), tagDetail(by, idx, tag), tracked)
+			return err
+		})
+		return err
+	}
+
+	if header.suffixLen > 0 && b[header.suffixStart]&1 == 1 {
+		fmt.Fprintln(w, "header:")
+		// header offsets are relative to the flag byte
+		if err := dump(b[header.suffixStart:bodyStart], 1); err != nil {
+			return err
+		}
+	}
+
+	fmt.Fprintln(w, "body:")
+	if header.version == 1 {
+		return dump(b, bodyStart)
+	}
+	return dump(b[bodyStart-1:], 1)
+}
+
+// tagDetail describes the operand of the tag at by[idx]
+func tagDetail(by []byte, idx int, tag byte) string {
+	idx++
+
+	switch {
+	case tag == typeVARINT, tag == typeZIGZAG:
+		n, _, err := varintdecode(by[idx:])
+		if err != nil {
+			return ""
+		}
+		if tag == typeZIGZAG {
+			return " " + strconv.FormatInt(int64(uint(n)>>1)^-int64(n&1), 10)
+		}
+		return " " + strconv.FormatUint(uint64(uint(n)), 10)
+
+	case tag == typeCOPY, tag == typeREFP, tag == typeALIAS, tag == typeOBJECTV, tag == typeOBJECTV_FREEZE:
+		n, _, err := varintdecode(by[idx:])
+		if err != nil {
+			return ""
+		}
+		return " -> " + strconv.Itoa(n)
+
+	case tag == typeARRAY, tag == typeHASH:
+		n, _, err := varintdecode(by[idx:])
+		if err != nil {
+			return ""
+		}
+		return " (" + strconv.Itoa(n) + ")"
+
+	case tag == typeFLOAT && idx+4 <= len(by):
+		u := uint32(by[idx]) | uint32(by[idx+1])<<8 | uint32(by[idx+2])<<16 | uint32(by[idx+3])<<24
+		return " " + strconv.FormatFloat(float64(math.Float32frombits(u)), 'g', -1, 32)
+
+	case tag == typeDOUBLE && idx+8 <= len(by):
+		var u uint64
+		for i := 7; i >= 0; i-- {
+			u = u<<8 | uint64(by[idx+i])
+		}
+		return " " + strconv.FormatFloat(math.Float64frombits(u), 'g', -1, 64)
+
+	case tag == typeLONG_DOUBLE && idx+16 <= len(by):
+		if x, nan := longDouble(by[idx:]); !nan {
+			return " " + x.Text('g', -1)
+		}
+		return " NaN"
+
+	case tag == typeBINARY, tag == typeSTR_UTF8:
+		ln, sz, err := varintdecode(by[idx:])
+		if err != nil || ln < 0 || idx+sz+ln > len(by) {
+			return ""
+		}
+		return " " + strconv.Quote(string(by[idx+sz:idx+sz+ln]))
+
+	case tag >= typeSHORT_BINARY_0 && tag < typeSHORT_BINARY_0+32:
+		ln := int(tag & 0x1f)
+		if idx+ln > len(by) {
+			return ""
+		}
+		return " " + strconv.Quote(string(by[idx:idx+ln]))
+	}
+
+	return ""
+}
+
+// DumpAnnotated writes a hex dump of the document b to w, each range of
+// bytes being followed by what it holds: the parts of the header, then the
+// tags of the header user data and of the body with their length or value,
+// indented by nesting depth and preceded by their offset as used by COPY and
+// REFP tags in their section. Compressed bodies are dumped decompressed. The
+// dump goes on with the raw bytes past a structural error, which is
+// returned.
+func DumpAnnotated(w io.Writer, b []byte) error {
+	header, err := checkHeader(b)
+	if err != nil {
+		return err
+	}
+
+	bodyStart := headerSize + header.suffixSize
+	if bodyStart > len(b) || bodyStart < 0 {
+		return ErrCorrupt{ErrBadOffset}
+	}
+
+	a := annotator{w: w}
+	a.line(b, 0, 0, 4, "magic")
+	a.line(b, 0, 4, headerSize, fmt.Sprintf("version %d, %s", header.version, header.doctype))
+	a.line(b, 0, headerSize, header.suffixStart, fmt.Sprintf("header suffix of %d bytes", bodyStart-header.suffixStart))
+
+	if header.suffixStart < bodyStart {
+		flags := b[header.suffixStart]
+		a.line(b, 0, header.suffixStart, header.suffixStart+1, fmt.Sprintf("flags 0x%02x", flags))
+		if flags&1 == 1 {
+			a.printf("header user data:")
+			// header offsets are relative to the flag byte
+			err = a.section(b[header.suffixStart:bodyStart], header.suffixStart, 1)
+		} else {
+			a.line(b, 0, header.suffixStart+1, bodyStart, "header suffix data")
+		}
+	}
+
+	if err == nil && header.doctype != serealRaw {
+		compressed := len(b) - bodyStart
+		if b, err = DecompressDocument(nil, b); err == nil {
+			a.printf("body, decompressed from %d bytes:", compressed)
+		}
+	} else if err == nil {
+		a.printf("body:")
+	}
+
+	if err == nil {
+		if header.version == 1 {
+			err = a.section(b, 0, bodyStart)
+		} else {
+			err = a.section(b[bodyStart-1:], bodyStart-1, 1)
+		}
+	}
+
+	if a.err != nil {
+		return a.err
+	}
+	return err
+}
+
+// annotator writes the lines of DumpAnnotated, remembering the first write
+// error
+type annotator struct {
+	w   io.Writer
+	err error
+}
+
+func (a *annotator) printf(format string, args ...interface{}) {
+	if a.err == nil {
+		_, a.err = fmt.Fprintf(a.w, format+"\n", args...)
+	}
+}
+
+// line dumps by[from:to], whose first byte lies at offset base of the
+// document, followed by note. Long ranges span several lines.
+func (a *annotator) line(by []byte, base int, from, to int, note string) {
+	for from < to && a.err == nil {
+		n := to - from
+		if n > 8 {
+			n = 8
+		}
+		l := fmt.Sprintf("%6d  %-23s  %s", base+from, fmt.Sprintf("% x", by[from:from+n]), note)
+		a.printf("%s", strings.TrimRight(l, " "))
+		from += n
+		note = ""
+	}
+}
+
+// section dumps the section by, whose first byte lies at offset base of the
+// document and whose root value starts at by[idx]
+func (a *annotator) section(by []byte, base int, idx int) error {
+	next := idx
+	end, err := walkTree(by, idx, 0, func(idx int, tag byte, depth int) error {
+		a.line(by, base, next, idx, "PAD")
+
+		tracked := ""
+		if by[idx]&trackFlag == trackFlag {
+			tracked = " (tracked)"
+		}
+		next = idx + tagSize(by, idx, tag)
+		a.line(by, base, idx, next, fmt.Sprintf("%-7s %s%s%s%s", "@"+strconv.Itoa(idx), strings.Repeat("  ", depth), tagName(tag), tagDetail(by, idx, tag), tracked))
+		return a.err
+	})
+
+	if err != nil {
+		a.line(by, base, next, len(by), "unparsed")
+		a.printf("error: %v", err)
+		return err
+	}
+	a.line(by, base, end, len(by), "trailing bytes")
+	return nil
+}
+
+// tagSize returns the number of bytes taken by the tag at by[idx] and its
+// operands, without the values nested in it, within the bounds of by
+func tagSize(by []byte, idx int, tag byte) int {
+	n := 1
+
+	switch {
+	case tag == typeVARINT, tag == typeZIGZAG, tag == typeCOPY, tag == typeREFP, tag == typeALIAS,
+		tag == typeARRAY, tag == typeHASH, tag == typeOBJECTV, tag == typeOBJECTV_FREEZE:
+		_, sz, _ := varintdecode(by[idx+1:])
+		n += sz
+
+	case tag == typeFLOAT:
+		n += 4
+
+	case tag == typeDOUBLE:
+		n += 8
+
+	case tag == typeLONG_DOUBLE:
+		n += 16
+
+	case tag == typeBINARY, tag == typeSTR_UTF8:
+		ln, sz, err := varintdecode(by[idx+1:])
+		n += sz
+		if err == nil && ln > 0 && ln <= len(by) {
+			n += ln
+		}
+
+	case tag >= typeSHORT_BINARY_0 && tag < typeSHORT_BINARY_0+32:
+		n += int(tag & 0x1f)
+	}
+
+	if idx+n > len(by) {
+		return len(by) - idx
+	}
+	return n
+}
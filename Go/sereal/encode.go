@@ -1,6 +1,7 @@
 package sereal
 
 import (
+	"container/list"
 	"encoding"
 	"encoding/binary"
 	"encoding/json"
@@ -9,21 +10,35 @@ import (
 	"math"
 	"reflect"
 	"runtime"
+	"sort"
 	"strconv"
+	"sync"
+	"time"
 	"unsafe"
 )
 
 // An Encoder encodes Go data structures into Sereal byte streams
 type Encoder struct {
 	PerlCompat           bool       // try to mimic Perl's structure as much as possible
-	Compression          compressor // optionally compress the main payload of the document using SnappyCompressor or ZlibCompressor
+	Compression          compressor // optionally compress the main payload of the document using SnappyCompressor, ZlibCompressor or a RegisteredCompressor
 	CompressionThreshold int        // threshold in bytes above which compression is attempted: 1024 bytes by default
 	DisableDedup         bool       // should we disable deduping of class names and hash keys
+	DedupMinLength       int        // hash keys and class names shorter than this are always written out, not deduped
+	DedupMaxEntries      int        // maximum number of distinct strings remembered for deduping per document, 0 meaning no limit
 	DisableFREEZE        bool       // should we disable the FREEZE tag, which calls MarshalBinary
 	ExpectedSize         uint       // give a hint to encoder about expected size of encoded data
 	StructAsMap          bool       // convert struct as map
+	CanonicalFloats      bool       // encode float32 as the DOUBLE Perl would produce for the same decimal value
+	Canonical            bool       // sort hash keys so that equal values always produce identical documents
+	KeyEncoder           KeyEncoder // stringify the keys of maps whose keys aren't strings, FormatKey by default in PerlCompat mode
+	BoolsAsInts          bool       // encode bools as the integers 1 and 0 rather than as TRUE and FALSE, for Perl code testing them as numbers
+	ValidateUTF8         bool       // encode strings which aren't valid UTF-8 as BINARY rather than STR_UTF8
+	StringMode           StringMode // whether strings are encoded as STR_UTF8 or BINARY, STR_UTF8 by default
+	TimeFormat           TimeFormat // how time.Time values are encoded, FREEZE of MarshalBinary by default
+	BigFormat            BigFormat  // how math/big numbers out of the range of native ones are encoded, strings by default
 	version              int        // default version to encode
-	tcache               tagsCache
+	profile              Profile    // preset the encoder emulates, see Profile
+	classes              map[reflect.Type]string
 }
 
 type compressor interface {
@@ -60,17 +75,35 @@ func NewEncoderV3() *Encoder {
 var defaultEncoder = NewEncoderV3()
 
 // Marshal encodes body with the default encoder
-func Marshal(body interface{}) ([]byte, error) {
-	return defaultEncoder.MarshalWithHeader(nil, body)
+func Marshal(body interface{}, opts ...MarshalOption) ([]byte, error) {
+	return defaultEncoder.MarshalWithHeader(nil, body, opts...)
+}
+
+// MarshalWithHeader encodes header and body with the default encoder
+func MarshalWithHeader(header interface{}, body interface{}, opts ...MarshalOption) ([]byte, error) {
+	return defaultEncoder.MarshalWithHeader(header, body, opts...)
 }
 
 // Marshal returns the Sereal encoding of body
-func (e *Encoder) Marshal(body interface{}) (b []byte, err error) {
-	return e.MarshalWithHeader(nil, body)
+func (e *Encoder) Marshal(body interface{}, opts ...MarshalOption) (b []byte, err error) {
+	return e.MarshalWithHeader(nil, body, opts...)
 }
 
 // MarshalWithHeader returns the Sereal encoding of body with header data
-func (e *Encoder) MarshalWithHeader(header interface{}, body interface{}) (b []byte, err error) {
+func (e *Encoder) MarshalWithHeader(header interface{}, body interface{}, opts ...MarshalOption) (b []byte, err error) {
+	var o marshalOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return e.marshal(header, o, func(b []byte, strTable map[string]int, ptrTable map[uintptr]int) ([]byte, error) {
+		return e.encode(b, body, false, false, strTable, ptrTable)
+	})
+}
+
+// marshal builds a document with header data, whose body is appended by
+// encodeBody
+func (e *Encoder) marshal(header interface{}, o marshalOptions, encodeBody func(b []byte, strTable map[string]int, ptrTable map[uintptr]int) ([]byte, error)) (b []byte, err error) {
 	defer func() {
 		//return
 		if r := recover(); r != nil {
@@ -91,6 +124,14 @@ func (e *Encoder) MarshalWithHeader(header interface{}, body interface{}) (b []b
 		e.version = ProtocolVersion
 	}
 
+	if err := e.Validate(); err != nil {
+		return nil, err
+	}
+
+	if o.offsets != nil {
+		o.offsets.reset()
+	}
+
 	encHeader := make([]byte, headerSize, 32)
 
 	if e.version < 3 {
@@ -102,6 +143,12 @@ func (e *Encoder) MarshalWithHeader(header interface{}, body interface{}) (b []b
 	// Set the <version-type> component in the header
 	encHeader[4] = byte(e.version) | byte(serealRaw)<<4
 
+	if dc, ok := e.Compression.(dictionaryCompressor); ok && dc.dictionaryID() != "" {
+		if header, err = withDictionaryID(header, dc.dictionaryID()); err != nil {
+			return nil, err
+		}
+	}
+
 	if header != nil && e.version >= 2 {
 		strTable := make(map[string]int)
 		ptrTable := make(map[uintptr]int)
@@ -114,6 +161,14 @@ func (e *Encoder) MarshalWithHeader(header interface{}, body interface{}) (b []b
 		}
 
 		encHeader = varint(encHeader, uint(len(encHeaderSuffix)))
+
+		if o.offsets != nil {
+			// header offsets are relative to the flag byte
+			if err := o.offsets.record(encHeaderSuffix, 1, len(encHeader), "header"); err != nil {
+				return nil, err
+			}
+		}
+
 		encHeader = append(encHeader, encHeaderSuffix...)
 	} else {
 		/* header size */
@@ -127,10 +182,16 @@ func (e *Encoder) MarshalWithHeader(header interface{}, body interface{}) (b []b
 
 	switch e.version {
 	case 1:
-		encBody, err = e.encode(encBody, body, false, false, strTable, ptrTable)
-	case 2, 3:
+		encBody, err = encodeBody(encBody, strTable, ptrTable)
+		if err == nil && o.offsets != nil {
+			err = o.offsets.recordBody(encBody, 0, len(encHeader), ptrTable)
+		}
+	case 2, 3, 4:
 		encBody = append(encBody, 0) // hack for 1-based offsets
-		encBody, err = e.encode(encBody, body, false, false, strTable, ptrTable)
+		encBody, err = encodeBody(encBody, strTable, ptrTable)
+		if err == nil && o.offsets != nil {
+			err = o.offsets.recordBody(encBody, 1, len(encHeader), ptrTable)
+		}
 		if len(encBody) >= 1 {
 			encBody = encBody[1:] // trim hacky first byte
 		}
@@ -140,37 +201,15 @@ func (e *Encoder) MarshalWithHeader(header interface{}, body interface{}) (b []b
 		return nil, err
 	}
 
-	if e.Compression != nil && (e.CompressionThreshold == 0 || len(encBody) >= e.CompressionThreshold) {
+	if e.Compression != nil && (e.CompressionThreshold == 0 || len(encBody) >= e.CompressionThreshold || compressAlways(e.Compression)) {
 		encBody, err = e.Compression.compress(encBody)
 		if err != nil {
 			return nil, err
 		}
 
-		var doctype documentType
-
-		switch c := e.Compression.(type) {
-		case SnappyCompressor:
-			if e.version > 1 && !c.Incremental {
-				return nil, errors.New("non-incremental snappy compression only valid for v1 documents")
-			}
-			if e.version == 1 {
-				doctype = serealSnappy
-			} else {
-				doctype = serealSnappyIncremental
-			}
-		case ZlibCompressor:
-			if e.version < 3 {
-				return nil, errors.New("zlib compression only valid for v3 documents and up")
-			}
-			doctype = serealZlib
-		default:
-			// Defensive programming: this point should never be
-			// reached in production code because the compressor
-			// interface is not exported, hence no way to pass in
-			// an unknown thing. But it may happen during
-			// development when a new compressor is implemented,
-			// but a relevant document type is not defined.
-			panic("undefined compression")
+		doctype, err := compressionDocType(e.version, e.Compression)
+		if err != nil {
+			return nil, err
 		}
 
 		encHeader[4] |= byte(doctype) << 4
@@ -179,6 +218,161 @@ func (e *Encoder) MarshalWithHeader(header interface{}, body interface{}) (b []b
 	return append(encHeader, encBody...), nil
 }
 
+// compressionDocType returns the document type of documents of the given
+// version compressed with c
+func compressionDocType(version int, c compressor) (documentType, error) {
+	switch c := c.(type) {
+	case SnappyCompressor:
+		if version > 1 && !c.Incremental {
+			return 0, errors.New("non-incremental snappy compression only valid for v1 documents")
+		}
+		// compress frames incremental bodies with their length, which
+		// only the snappy_incr type announces, valid for v1 too
+		if !c.Incremental {
+			return serealSnappy, nil
+		}
+		return serealSnappyIncremental, nil
+	case ZlibCompressor:
+		if version < 3 {
+			return 0, errors.New("zlib compression only valid for v3 documents and up")
+		}
+		return serealZlib, nil
+	case ZstdCompressor:
+		if version < 4 {
+			return 0, errors.New("zstd compression only valid for v4 documents and up")
+		}
+		return serealZstd, nil
+	case RegisteredCompressor:
+		if _, err := registeredCompressor(c.DocType); err != nil {
+			return 0, err
+		}
+		return documentType(c.DocType), nil
+	}
+
+	// Defensive programming: this point should never be
+	// reached in production code because the compressor
+	// interface is not exported, hence no way to pass in
+	// an unknown thing. But it may happen during
+	// development when a new compressor is implemented,
+	// but a relevant document type is not defined.
+	panic("undefined compression")
+}
+
+// Validate reports in a single OptionsError every conflict between the
+// settings of e, such as a compression its protocol version doesn't support.
+// Marshal calls it before encoding anything, rather than failing once the
+// body is written.
+func (e *Encoder) Validate() error {
+	var p problems
+
+	version := e.version
+	if version == 0 {
+		version = ProtocolVersion
+	}
+
+	if version < 1 || version > MaxSupportedVersion {
+		p.add(fmt.Errorf("sereal: unsupported protocol version %d", version))
+	} else if e.Compression != nil {
+		_, err := compressionDocType(version, e.Compression)
+		p.add(err)
+	}
+
+	if dc, ok := e.Compression.(dictionaryCompressor); ok && dc.dictionaryID() != "" && version < 2 {
+		p.add(errors.New("dictionary identifiers are only valid for v2 documents and up"))
+	}
+
+	// the names of unknown formats don't parse back
+	_, err := parseTimeFormat(e.TimeFormat.String())
+	p.add(err)
+
+	_, err = parseBigFormat(e.BigFormat.String())
+	p.add(err)
+
+	_, err = parseStringMode(e.StringMode.String())
+	p.add(err)
+
+	return p.err()
+}
+
+// SetVersion pins the protocol version of the documents e writes, e.g. 1 for
+// consumers running Perl releases older than Sereal 2. It fails, leaving e
+// unchanged, for versions outside 1 to MaxSupportedVersion and for those the
+// compression of e isn't valid for.
+func (e *Encoder) SetVersion(v int) error {
+	if v < 1 || v > MaxSupportedVersion {
+		return fmt.Errorf("sereal: unsupported protocol version %d (want 1 to %d)", v, MaxSupportedVersion)
+	}
+	if e.Compression != nil {
+		if _, err := compressionDocType(v, e.Compression); err != nil {
+			return err
+		}
+	}
+
+	e.version = v
+	return nil
+}
+
+// Version returns the protocol version of the documents e writes
+func (e *Encoder) Version() int {
+	if e.version == 0 {
+		return ProtocolVersion
+	}
+	return e.version
+}
+
+// SetCompressionLevel sets the level of the compressor of e, trading CPU for
+// compression ratio. Only ZlibCompressor and ZstdCompressor have levels.
+func (e *Encoder) SetCompressionLevel(level int) error {
+	switch c := e.Compression.(type) {
+	case ZlibCompressor:
+		if level < ZlibDefaultCompression || level > ZlibBestCompression {
+			return fmt.Errorf("sereal: bad zlib compression level %d", level)
+		}
+		c.Level = level
+		e.Compression = c
+
+	case ZstdCompressor:
+		if level < ZstdBestSpeed || level > ZstdBestCompression {
+			return fmt.Errorf("sereal: bad zstd compression level %d", level)
+		}
+		c.Level = level
+		e.Compression = c
+
+	case nil:
+		return errors.New("sereal: no compression to set the level of")
+
+	default:
+		return fmt.Errorf("sereal: %T has no compression level", c)
+	}
+
+	return nil
+}
+
+// RegisterClass makes the encoder emit the struct type of goType, given as an
+// instance, as an object blessed into perlClassName. Registered types are
+// encoded as objects even if StructAsMap is set.
+func (e *Encoder) RegisterClass(goType interface{}, perlClassName string) {
+	typ := reflect.TypeOf(goType)
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+
+	if e.classes == nil {
+		e.classes = make(map[reflect.Type]string)
+	}
+
+	e.classes[typ] = perlClassName
+}
+
+// Precompile builds the field lists and encoding plans of the struct types
+// of the given instances, and of the struct types they contain, so that the
+// first encode of those types doesn't have to. It returns an error describing
+// the first problem found with their struct tags, such as two fields sharing
+// a name or an unknown option. Instances may also be given as a reflect.Type.
+func (e *Encoder) Precompile(types ...interface{}) error {
+	return tcache.precompileTypes(types)
+}
+
 /*************************************
  * Encode via static types - fast path
  *************************************/
@@ -190,33 +384,29 @@ func (e *Encoder) encode(b []byte, v interface{}, isKeyOrClass bool, isRefNext b
 		b = append(b, typeUNDEF)
 
 	case bool:
-		if value {
-			b = append(b, typeTRUE)
-		} else {
-			b = append(b, typeFALSE)
-		}
+		b = e.encodeBool(b, value)
 
 	case int:
-		b = e.encodeInt(b, reflect.Int, int64(value))
+		b = e.encodeInt(b, int64(value))
 	case int8:
-		b = e.encodeInt(b, reflect.Int, int64(value))
+		b = e.encodeInt(b, int64(value))
 	case int16:
-		b = e.encodeInt(b, reflect.Int, int64(value))
+		b = e.encodeInt(b, int64(value))
 	case int32:
-		b = e.encodeInt(b, reflect.Int, int64(value))
+		b = e.encodeInt(b, int64(value))
 	case int64:
-		b = e.encodeInt(b, reflect.Int, value)
+		b = e.encodeInt(b, value)
 
 	case uint:
-		b = e.encodeInt(b, reflect.Uint, int64(value))
+		b = e.encodeUint(b, uint64(value))
 	case uint8:
-		b = e.encodeInt(b, reflect.Uint, int64(value))
+		b = e.encodeUint(b, uint64(value))
 	case uint16:
-		b = e.encodeInt(b, reflect.Uint, int64(value))
+		b = e.encodeUint(b, uint64(value))
 	case uint32:
-		b = e.encodeInt(b, reflect.Uint, int64(value))
+		b = e.encodeUint(b, uint64(value))
 	case uint64:
-		b = e.encodeInt(b, reflect.Uint, int64(value))
+		b = e.encodeUint(b, value)
 
 	case float32:
 		b = e.encodeFloat(b, value)
@@ -226,6 +416,9 @@ func (e *Encoder) encode(b []byte, v interface{}, isKeyOrClass bool, isRefNext b
 	case json.Number:
 		b = e.encodeJsonNumber(b, value, isKeyOrClass, strTable)
 
+	case Number:
+		b = e.encodeJsonNumber(b, json.Number(value), isKeyOrClass, strTable)
+
 	case string:
 		b = e.encodeString(b, value, isKeyOrClass, strTable)
 
@@ -238,6 +431,9 @@ func (e *Encoder) encode(b []byte, v interface{}, isKeyOrClass bool, isRefNext b
 	case map[string]interface{}:
 		b, err = e.encodeStrMap(b, value, isRefNext, strTable, ptrTable)
 
+	case map[string]RawMessage:
+		b, err = e.encodeRawMap(b, value, isRefNext, strTable)
+
 	case reflect.Value:
 		if value.Kind() == reflect.Invalid {
 			b = append(b, typeUNDEF)
@@ -254,19 +450,28 @@ func (e *Encoder) encode(b []byte, v interface{}, isKeyOrClass bool, isRefNext b
 		}
 
 	case PerlObject:
-		b = append(b, typeOBJECT)
-		b = e.encodeBytes(b, []byte(value.Class), true, strTable)
+		b = e.encodeClass(b, value.Class, strTable)
 		b, err = e.encode(b, value.Reference, false, false, strTable, ptrTable)
 
 	case PerlRegexp:
+		var modifiers []byte
+		if modifiers, err = value.modifiers(); err != nil {
+			return nil, err
+		}
 		b = append(b, typeREGEXP)
 		b = e.encodeBytes(b, value.Pattern, false, strTable)
-		b = e.encodeBytes(b, value.Modifiers, false, strTable)
+		b = e.encodeBytes(b, modifiers, false, strTable)
 
 	case PerlWeakRef:
 		b = append(b, typeWEAKEN)
 		b, err = e.encode(b, value.Reference, false, false, strTable, ptrTable)
 
+	case *PerlAlias:
+		b, err = e.encodeAlias(b, value, strTable, ptrTable)
+
+	case PerlAlias:
+		b, err = e.encode(b, value.Alias, false, false, strTable, ptrTable)
+
 	//case *interface{}:
 	//TODO handle here if easy
 
@@ -288,44 +493,69 @@ func (e *Encoder) encode(b []byte, v interface{}, isKeyOrClass bool, isRefNext b
 	return b, err
 }
 
-func (e *Encoder) encodeInt(by []byte, k reflect.Kind, i int64) []byte {
+func (e *Encoder) encodeBool(by []byte, v bool) []byte {
 	switch {
-	case 0 <= i && i <= 15:
-		by = append(by, byte(i)&0x0f)
-	case -16 <= i && i < 0 && k == reflect.Int:
-		by = append(by, 0x010|(byte(i)&0x0f))
-	case i > 15:
-		by = append(by, typeVARINT)
-		by = varint(by, uint(i))
-	case i < 0:
-		n := uint(i)
-		if k == reflect.Int {
-			by = append(by, typeZIGZAG)
-			n = uint((i << 1) ^ (i >> 63))
-		} else {
-			by = append(by, typeVARINT)
-		}
+	case e.BoolsAsInts && v:
+		return append(by, 1)
+	case e.BoolsAsInts:
+		return append(by, 0)
+	case v:
+		return append(by, typeTRUE)
+	}
+	return append(by, typeFALSE)
+}
 
-		by = varint(by, n)
+// encodeInt appends i in its most compact form: POS or NEG for -16 to 15,
+// VARINT for other positive numbers and ZIGZAG for other negative ones
+func (e *Encoder) encodeInt(by []byte, i int64) []byte {
+	switch {
+	case i >= 0:
+		return e.encodeUint(by, uint64(i))
+	case i >= -16:
+		return append(by, 0x10|byte(i)&0x0f)
 	}
 
-	return by
+	by = append(by, typeZIGZAG)
+	return varint(by, uint((i<<1)^(i>>63)))
+}
+
+// encodeUint appends u as POS for 0 to 15, as VARINT otherwise, including
+// beyond math.MaxInt64
+func (e *Encoder) encodeUint(by []byte, u uint64) []byte {
+	if u <= 15 {
+		return append(by, byte(u))
+	}
+
+	by = append(by, typeVARINT)
+	return varint(by, uint(u))
 }
 
 func (e *Encoder) encodeFloat(by []byte, f float32) []byte {
+	if e.CanonicalFloats {
+		return e.encodeDouble(by, canonicalFloat32(f))
+	}
+
 	u := math.Float32bits(f)
 	return append(by, typeFLOAT, byte(u), byte(u>>8), byte(u>>16), byte(u>>24))
 }
 
 func (e *Encoder) encodeDouble(by []byte, f float64) []byte {
 	u := math.Float64bits(f)
+	if e.CanonicalFloats && f != f {
+		u = canonicalNaN
+	}
+
 	return append(by, typeDOUBLE, byte(u), byte(u>>8), byte(u>>16), byte(u>>24), byte(u>>32), byte(u>>40), byte(u>>48), byte(u>>56))
 }
 
 func (e *Encoder) encodeJsonNumber(by []byte, n json.Number, isKeyOrClass bool, strTable map[string]int) []byte {
 	int64Value, err := n.Int64()
 	if err == nil {
-		return e.encodeInt(by, reflect.Int, int64Value)
+		if int64Value == 0 && n[0] == '-' {
+			// only floats have a negative zero, as decoded from one
+			return e.encodeDouble(by, math.Copysign(0, -1))
+		}
+		return e.encodeInt(by, int64Value)
 	} else {
 
 		// we do not want to lose precision for large integers, as those are often IDs or hashsums of things
@@ -346,13 +576,25 @@ func (e *Encoder) encodeJsonNumber(by []byte, n json.Number, isKeyOrClass bool,
 }
 
 func (e *Encoder) encodeString(by []byte, s string, isKeyOrClass bool, strTable map[string]int) []byte {
-	if !e.DisableDedup && isKeyOrClass {
+	if isKeyOrClass && e.dedups(len(s)) {
 		if copyOffs, ok := strTable[s]; ok {
 			by = append(by, typeCOPY)
 			by = varint(by, uint(copyOffs))
 			return by
 		}
-		strTable[s] = len(by)
+		if e.remembers(strTable) {
+			strTable[s] = len(by)
+		}
+	}
+
+	if e.stringIsBinary(s) {
+		if len(s) < 32 {
+			by = append(by, typeSHORT_BINARY_0+byte(len(s)))
+		} else {
+			by = append(by, typeBINARY)
+			by = varint(by, uint(len(s)))
+		}
+		return append(by, s...)
 	}
 
 	by = append(by, typeSTR_UTF8)
@@ -360,15 +602,27 @@ func (e *Encoder) encodeString(by []byte, s string, isKeyOrClass bool, strTable
 	return append(by, s...)
 }
 
+// dedups tells whether hash keys and class names of n bytes are deduped
+func (e *Encoder) dedups(n int) bool {
+	return !e.DisableDedup && n >= e.DedupMinLength
+}
+
+// remembers tells whether strTable has room for another string
+func (e *Encoder) remembers(strTable map[string]int) bool {
+	return e.DedupMaxEntries <= 0 || len(strTable) < e.DedupMaxEntries
+}
+
 func (e *Encoder) encodeBytes(by []byte, byt []byte, isKeyOrClass bool, strTable map[string]int) []byte {
-	if !e.DisableDedup && isKeyOrClass {
+	if isKeyOrClass && e.dedups(len(byt)) {
 		if copyOffs, ok := strTable[string(byt)]; ok {
 			by = append(by, typeCOPY)
 			by = varint(by, uint(copyOffs))
 			return by
 		}
 		// save for later
-		strTable[string(byt)] = len(by)
+		if e.remembers(strTable) {
+			strTable[string(byt)] = len(by)
+		}
 	}
 
 	if l := len(byt); l < 32 {
@@ -382,17 +636,15 @@ func (e *Encoder) encodeBytes(by []byte, byt []byte, isKeyOrClass bool, strTable
 }
 
 func (e *Encoder) encodeIntfArray(by []byte, arr []interface{}, isRefNext bool, strTable map[string]int, ptrTable map[uintptr]int) ([]byte, error) {
-	if e.PerlCompat && !isRefNext {
-		by = append(by, typeREFN)
+	key, err := enterContainer(reflect.ValueOf(arr), ptrTable)
+	if err != nil {
+		return nil, err
 	}
-
-	// TODO implement ARRAYREF for small arrays
+	defer delete(ptrTable, key)
 
 	l := len(arr)
-	by = append(by, typeARRAY)
-	by = varint(by, uint(l))
+	by = e.containerHead(by, typeARRAY, l, isRefNext)
 
-	var err error
 	for i := 0; i < l; i++ {
 		if by, err = e.encode(by, arr[i], false, false, strTable, ptrTable); err != nil {
 			return nil, err
@@ -403,16 +655,31 @@ func (e *Encoder) encodeIntfArray(by []byte, arr []interface{}, isRefNext bool,
 }
 
 func (e *Encoder) encodeStrMap(by []byte, m map[string]interface{}, isRefNext bool, strTable map[string]int, ptrTable map[uintptr]int) ([]byte, error) {
-	if e.PerlCompat && !isRefNext {
-		by = append(by, typeREFN)
+	key, err := enterContainer(reflect.ValueOf(m), ptrTable)
+	if err != nil {
+		return nil, err
 	}
+	defer delete(ptrTable, key)
 
-	// TODO implement HASHREF for small maps
+	by = e.containerHead(by, typeHASH, len(m), isRefNext)
 
-	by = append(by, typeHASH)
-	by = varint(by, uint(len(m)))
+	if e.Canonical {
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			by = e.encodeString(by, k, true, strTable)
+			if by, err = e.encode(by, m[k], false, false, strTable, ptrTable); err != nil {
+				return by, err
+			}
+		}
+
+		return by, nil
+	}
 
-	var err error
 	for k, v := range m {
 		by = e.encodeString(by, k, true, strTable)
 		if by, err = e.encode(by, v, false, false, strTable, ptrTable); err != nil {
@@ -427,6 +694,29 @@ func (e *Encoder) encodeStrMap(by []byte, m map[string]interface{}, isRefNext bo
  * Encode via reflection
  *************************************/
 func (e *Encoder) encodeViaReflection(b []byte, rv reflect.Value, isKeyOrClass bool, isRefNext bool, strTable map[string]int, ptrTable map[uintptr]int) ([]byte, error) {
+	if rv.Kind() != reflect.Invalid && !(rv.Kind() == reflect.Ptr && rv.IsNil()) {
+		if m, ok := rv.Interface().(Marshaler); ok {
+			by, err := m.MarshalSereal()
+			if err != nil {
+				return nil, &MarshalerError{rv.Type(), err}
+			}
+
+			if err := checkRawValue(by); err != nil {
+				return nil, &MarshalerError{rv.Type(), err}
+			}
+
+			return append(b, by...), nil
+		}
+	}
+
+	if rv.IsValid() && isBigType(rv.Type()) && !(rv.Kind() == reflect.Ptr && rv.IsNil()) {
+		return e.encodeBig(b, rv, strTable)
+	}
+
+	if e.TimeFormat != TimeFREEZE && rv.IsValid() && rv.Type() == timeType {
+		return e.encodeTime(b, rv.Interface().(time.Time), strTable)
+	}
+
 	if !e.DisableFREEZE && rv.Kind() != reflect.Invalid && rv.Kind() != reflect.Ptr {
 		if m, ok := rv.Interface().(encoding.BinaryMarshaler); ok {
 			by, err := m.MarshalBinary()
@@ -443,6 +733,12 @@ func (e *Encoder) encodeViaReflection(b []byte, rv reflect.Value, isKeyOrClass b
 		}
 	}
 
+	if rv.Kind() != reflect.Invalid && rv.Kind() != reflect.Ptr {
+		if h, ok := rv.Interface().(OrderedHash); ok {
+			return e.encodeOrderedHash(b, h, isRefNext, strTable, ptrTable)
+		}
+	}
+
 	// make sure we're looking at a real type and not an interface
 	for rv.Kind() == reflect.Interface {
 		rv = rv.Elem()
@@ -461,21 +757,26 @@ func (e *Encoder) encodeViaReflection(b []byte, rv reflect.Value, isKeyOrClass b
 		b, err = e.encodeMap(b, rv, isRefNext, strTable, ptrTable)
 
 	case reflect.Struct:
-		b, err = e.encodeStruct(b, rv, strTable, ptrTable)
+		switch rv.Type() {
+		case syncMapType:
+			b, err = e.encodeSyncMap(b, containerAddr(rv).(*sync.Map), isRefNext, strTable, ptrTable)
+		case listType:
+			b, err = e.encodeList(b, containerAddr(rv).(*list.List), isRefNext, strTable, ptrTable)
+		default:
+			b, err = e.encodeStruct(b, rv, strTable, ptrTable)
+		}
 
 	case reflect.Ptr:
 		b, err = e.encodePointer(b, rv, strTable, ptrTable)
 
 	case reflect.Bool:
-		if rv.Bool() {
-			b = append(b, typeTRUE)
-		} else {
-			b = append(b, typeFALSE)
-		}
+		b = e.encodeBool(b, rv.Bool())
 
-	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
-		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
-		b = e.encodeInt(b, rk, rv.Int())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		b = e.encodeInt(b, rv.Int())
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		b = e.encodeUint(b, rv.Uint())
 
 	case reflect.Float32:
 		b = e.encodeFloat(b, float32(rv.Float()))
@@ -494,15 +795,15 @@ func (e *Encoder) encodeViaReflection(b []byte, rv reflect.Value, isKeyOrClass b
 }
 
 func (e *Encoder) encodeArray(by []byte, arr reflect.Value, isRefNext bool, strTable map[string]int, ptrTable map[uintptr]int) ([]byte, error) {
-	if e.PerlCompat && !isRefNext {
-		by = append(by, typeREFN)
+	key, err := enterContainer(arr, ptrTable)
+	if err != nil {
+		return nil, err
 	}
+	defer delete(ptrTable, key)
 
 	l := arr.Len()
-	by = append(by, typeARRAY)
-	by = varint(by, uint(l))
+	by = e.containerHead(by, typeARRAY, l, isRefNext)
 
-	var err error
 	for i := 0; i < l; i++ {
 		if by, err = e.encode(by, arr.Index(i), false, false, strTable, ptrTable); err != nil {
 			return nil, err
@@ -513,18 +814,25 @@ func (e *Encoder) encodeArray(by []byte, arr reflect.Value, isRefNext bool, strT
 }
 
 func (e *Encoder) encodeMap(by []byte, m reflect.Value, isRefNext bool, strTable map[string]int, ptrTable map[uintptr]int) ([]byte, error) {
-	if e.PerlCompat && !isRefNext {
-		by = append(by, typeREFN)
+	key, err := enterContainer(m, ptrTable)
+	if err != nil {
+		return nil, err
 	}
+	defer delete(ptrTable, key)
 
 	keys := m.MapKeys()
-	by = append(by, typeHASH)
-	by = varint(by, uint(len(keys)))
+	if e.Canonical {
+		sortMapKeys(keys)
+	}
+
+	by = e.containerHead(by, typeHASH, len(keys), isRefNext)
 
-	if e.PerlCompat {
+	if e.PerlCompat || e.KeyEncoder != nil {
 		var err error
 		for _, k := range keys {
-			by = e.encodeString(by, k.String(), true, strTable)
+			if by, err = e.encodeKey(by, k, strTable); err != nil {
+				return by, err
+			}
 			if by, err = e.encode(by, m.MapIndex(k), false, false, strTable, ptrTable); err != nil {
 				return by, err
 			}
@@ -546,29 +854,87 @@ func (e *Encoder) encodeMap(by []byte, m reflect.Value, isRefNext bool, strTable
 }
 
 func (e *Encoder) encodeStruct(by []byte, st reflect.Value, strTable map[string]int, ptrTable map[uintptr]int) ([]byte, error) {
+	if i, ok := tcache.RemainField(st); ok && st.Field(i).Len() > 0 {
+		return e.encodeStructRemain(by, st, i, strTable, ptrTable)
+	}
+
+	by = e.encodeStructClass(by, st, strTable)
+
+	plan := tcache.plan(st.Type())
+	n := 0
+	for i := range plan.fields {
+		if f := &plan.fields[i]; !f.omitEmpty || !isEmptyValue(st.Field(f.index)) {
+			n++
+		}
+	}
+
+	// must be a reference in PerlCompat mode
+	by = e.containerHead(by, typeHASH, n, false)
+
+	var err error
+	for i := range plan.fields {
+		f := &plan.fields[i]
+		fv := st.Field(f.index)
+		if f.omitEmpty && isEmptyValue(fv) {
+			continue
+		}
+
+		by = e.encodeString(by, f.name, true, strTable)
+		switch {
+		case f.asString:
+			by = e.encodeString(by, formatNumber(fv), false, strTable)
+		case f.encode != nil:
+			by = f.encode(e, by, fv, strTable)
+		default:
+			if by, err = e.encode(by, fv, false, false, strTable, ptrTable); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return by, nil
+}
+
+// encodeStructRemain is encodeStruct for structs whose field tagged
+// ",remain", the remain-th, holds entries
+func (e *Encoder) encodeStructRemain(by []byte, st reflect.Value, remain int, strTable map[string]int, ptrTable map[uintptr]int) ([]byte, error) {
+	fields := tcache.Get(st)
 	tags := make(map[string]reflect.Value)
-	for f, i := range e.tcache.Get(st) {
+	for f, i := range fields {
 		fv := st.Field(i.id)
-		if !(i.omitEmpty && isEmptyValue(fv)) {
-			tags[f] = fv
+		if i.omitEmpty && isEmptyValue(fv) {
+			continue
 		}
+		if i.asString {
+			fv = reflect.ValueOf(formatNumber(fv))
+		}
+		tags[f] = fv
 	}
 
-	if !e.StructAsMap {
-		by = append(by, typeOBJECT)
-		by = e.encodeBytes(by, []byte(st.Type().Name()), true, strTable)
+	// the entries matching no field when decoded, fields win over them
+	iter := st.Field(remain).MapRange()
+	for iter.Next() {
+		if _, ok := fields[iter.Key().String()]; !ok {
+			tags[iter.Key().String()] = iter.Value()
+		}
 	}
 
-	if e.PerlCompat {
-		// must be a reference
-		by = append(by, typeREFN)
-	}
+	by = e.encodeStructClass(by, st, strTable)
 
-	by = append(by, typeHASH)
-	by = varint(by, uint(len(tags)))
+	// must be a reference in PerlCompat mode
+	by = e.containerHead(by, typeHASH, len(tags), false)
+
+	names := make([]string, 0, len(tags))
+	for f := range tags {
+		names = append(names, f)
+	}
+	if e.Canonical {
+		sort.Strings(names)
+	}
 
 	var err error
-	for f, fv := range tags {
+	for _, f := range names {
+		fv := tags[f]
 		by = e.encodeString(by, f, true, strTable)
 		if by, err = e.encode(by, fv, false, false, strTable, ptrTable); err != nil {
 			return nil, err
@@ -578,6 +944,55 @@ func (e *Encoder) encodeStruct(by []byte, st reflect.Value, strTable map[string]
 	return by, nil
 }
 
+// encodeStructClass starts the object st is encoded as, unless it is
+// encoded as a plain hash
+func (e *Encoder) encodeStructClass(by []byte, st reflect.Value, strTable map[string]int) []byte {
+	registered, isRegistered := e.classes[st.Type()]
+
+	if !e.StructAsMap || isRegistered {
+		className := st.Type().Name()
+		if isRegistered {
+			className = registered
+		}
+		if i, ok := tcache.ClassField(st); ok && st.Field(i).String() != "" {
+			className = st.Field(i).String()
+		}
+
+		by = e.encodeClass(by, className, strTable)
+	}
+
+	return by
+}
+
+// encodeClass starts an object of the given class. Class names already
+// present in the document are referred to with OBJECTV.
+func (e *Encoder) encodeClass(by []byte, className string, strTable map[string]int) []byte {
+	if !e.DisableDedup {
+		if offs, ok := strTable[className]; ok {
+			by = append(by, typeOBJECTV)
+			return varint(by, uint(offs))
+		}
+	}
+
+	by = append(by, typeOBJECT)
+	return e.encodeBytes(by, []byte(className), true, strTable)
+}
+
+// encodeAlias appends the value a is an alias of the first time a is seen,
+// and an ALIAS tag referring to it afterwards
+func (e *Encoder) encodeAlias(by []byte, a *PerlAlias, strTable map[string]int, ptrTable map[uintptr]int) ([]byte, error) {
+	p := uintptr(unsafe.Pointer(a))
+	if offs, ok := ptrTable[p]; ok {
+		by = append(by, typeALIAS)
+		by = varint(by, uint(offs))
+		by[offs] |= trackFlag
+		return by, nil
+	}
+
+	ptrTable[p] = len(by)
+	return e.encode(by, a.Alias, false, false, strTable, ptrTable)
+}
+
 func (e *Encoder) encodePointer(by []byte, rv reflect.Value, strTable map[string]int, ptrTable map[uintptr]int) ([]byte, error) {
 	// ikruglov
 	// I don't fully understand this logic, so leave it as is :-)
@@ -597,6 +1012,12 @@ func (e *Encoder) encodePointer(by []byte, rv reflect.Value, strTable map[string
 
 	rvptr := rv.Pointer()
 	rvptr2 := getPointer(rv.Elem())
+	if rv.Elem().Kind() == reflect.Ptr {
+		// a reference to a reference is a new reference even if the one it
+		// refers to was seen: REFN followed by the REFP encodePointer of
+		// the inner one writes, as Perl does
+		rvptr2 = 0
+	}
 
 	offs, ok := ptrTable[rvptr]
 
@@ -617,7 +1038,12 @@ func (e *Encoder) encodePointer(by []byte, rv reflect.Value, strTable map[string
 		by = append(by, typeREFN)
 
 		if rvptr != 0 {
-			ptrTable[rvptr] = lenbOrig
+			if e.profile == ProfilePerl3x {
+				// Perl's REFP tags refer to the referenced value
+				ptrTable[rvptr] = lenbOrig + 1
+			} else {
+				ptrTable[rvptr] = lenbOrig
+			}
 		}
 
 		var err error
@@ -635,6 +1061,38 @@ func (e *Encoder) encodePointer(by []byte, rv reflect.Value, strTable map[string
 	return by, nil
 }
 
+// sortMapKeys sorts keys by value, so that maps are encoded in a stable order
+func sortMapKeys(keys []reflect.Value) {
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		for a.Kind() == reflect.Interface {
+			a = a.Elem()
+		}
+		for b.Kind() == reflect.Interface {
+			b = b.Elem()
+		}
+
+		if a.Kind() != b.Kind() {
+			return a.Kind() < b.Kind()
+		}
+
+		switch a.Kind() {
+		case reflect.String:
+			return a.String() < b.String()
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return a.Int() < b.Int()
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			return a.Uint() < b.Uint()
+		case reflect.Float32, reflect.Float64:
+			return a.Float() < b.Float()
+		case reflect.Bool:
+			return !a.Bool() && b.Bool()
+		}
+
+		return fmt.Sprint(a.Interface()) < fmt.Sprint(b.Interface())
+	})
+}
+
 func varint(by []byte, n uint) []uint8 {
 	for n >= 0x80 {
 		b := byte(n) | 0x80
@@ -645,6 +1103,50 @@ func varint(by []byte, n uint) []uint8 {
 	return append(by, byte(n))
 }
 
+// enterContainer marks the map or slice rv as being encoded, so that one
+// containing itself is reported rather than recursed into until the stack
+// overflows. Pointers need no such care: encodePointer records them before
+// encoding what they point to, and writes REFP tags back to them.
+//
+// Marks are kept in ptrTable under the complement of the data pointer, which
+// no pointer ptrTable records can take. Subslices share their data pointer, so
+// the mark of a slice holds its length, and the next keys are probed for other
+// views of the same array: the elements of a slice able to refer back to it
+// are pointer aligned, so no view starting elsewhere takes them. It returns
+// the key to delete once rv is encoded.
+func enterContainer(rv reflect.Value, ptrTable map[uintptr]int) (uintptr, error) {
+	n := -1
+	switch rv.Kind() {
+	case reflect.Array:
+		// arrays are values, and can't contain themselves
+		return 0, nil
+	case reflect.Slice:
+		if rv.Len() == 0 || rv.Type().Elem().Size() == 0 {
+			return 0, nil
+		}
+		n = rv.Len()
+	}
+
+	p := rv.Pointer()
+	if p == 0 {
+		return 0, nil
+	}
+
+	for i := uintptr(0); i < unsafe.Alignof(p); i++ {
+		key := ^(p + i)
+		l, ok := ptrTable[key]
+		if !ok {
+			ptrTable[key] = n
+			return key, nil
+		}
+		if l == n {
+			return 0, fmt.Errorf("%w: %v", ErrCircular, rv.Type())
+		}
+	}
+
+	return 0, nil
+}
+
 func getPointer(rv reflect.Value) uintptr {
 	var rvptr uintptr
 
@@ -1,6 +1,10 @@
 package sereal
 
-import "errors"
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
 
 // Errors
 var (
@@ -12,30 +16,173 @@ var (
 
 	ErrHeaderPointer = errors.New("expected pointer for header")
 	ErrBodyPointer   = errors.New("expected pointer for body")
+	ErrNoHeader      = errors.New("sereal: document has no header user data")
 
 	ErrTruncated  = errors.New("truncated document")
 	ErrUnknownTag = errors.New("unknown tag byte")
 
 	ErrTooLarge = errors.New("sereal: document too large to be compressed with snappy")
+
+	// ErrInvalidUTF8 is wrapped by the error returned by a Decoder with
+	// ValidateUTF8 on a STR_UTF8 string which isn't valid UTF-8
+	ErrInvalidUTF8 = errors.New("sereal: STR_UTF8 string isn't valid UTF-8")
+
+	// ErrCircular is wrapped by the error returned when encoding a map or a
+	// slice containing itself, which unlike pointers can't be written as
+	// REFP tags the decoder makes the same Go values of
+	ErrCircular = errors.New("sereal: map or slice contains itself")
+
+	// ErrArrayOverflow is wrapped by the error returned by a Decoder whose
+	// ArrayOverflowPolicy is ArrayError on an ARRAY longer than the Go
+	// array it is decoded into
+	ErrArrayOverflow = errors.New("sereal: too many elements for the array")
 )
 
-// ErrCorrupt is returned if the sereal document was corrupt
-type ErrCorrupt struct{ Err string }
+// An OptionsError lists every problem found with the configuration of an
+// Encoder or a Decoder, rather than only the first one
+type OptionsError struct {
+	Problems []error
+}
+
+func (e *OptionsError) Error() string {
+	if len(e.Problems) == 1 {
+		return e.Problems[0].Error()
+	}
+
+	msgs := make([]string, len(e.Problems))
+	for i, err := range e.Problems {
+		msgs[i] = strings.TrimPrefix(err.Error(), "sereal: ")
+	}
+	return "sereal: " + strconv.Itoa(len(msgs)) + " problems with the options: " + strings.Join(msgs, "; ")
+}
 
-// internal constants used for corrupt
+// Is reports whether one of the problems is target, so that errors.Is finds
+// each of them
+func (e *OptionsError) Is(target error) bool {
+	for _, err := range e.Problems {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// ErrCorrupt is returned if the sereal document was corrupt. Err is the
+// cause of the corruption, one of the errors below, so that errors.Is tells
+// them apart and errors.As tells corruption from truncation.
+type ErrCorrupt struct{ Err error }
+
+// Causes of corruption, wrapped by ErrCorrupt
 var (
-	errBadSliceSize         = "bad size for slice"
-	errBadStringSize        = "bad size for string"
-	errBadOffset            = "bad offset"
-	errUntrackedOffsetREFP  = "untracked offset for REFP"
-	errBadHashSize          = "bad size for hash"
-	errUntrackedOffsetAlias = "untracked offset for alias"
-	errNestedCOPY           = "bad nested copy tag"
-	errBadVarint            = "bad varint"
-	errFreezeNotRefnArray   = "OBJECT_FREEZE value not REFN+ARRAY"
-	errFreezeNotArray       = "OBJECT_FREEZE value not an array"
-	errFreezeMultipleElts   = "OBJECT_FREEZE array contains multiple elements"
-	errFreezeNotByteSlice   = "OBJECT_FREEZE array not []byte"
+	ErrBadSliceSize         = errors.New("bad size for slice")
+	ErrBadStringSize        = errors.New("bad size for string")
+	ErrBadOffset            = errors.New("bad offset")
+	ErrUntrackedOffsetREFP  = errors.New("untracked offset for REFP")
+	ErrBadHashSize          = errors.New("bad size for hash")
+	ErrUntrackedOffsetAlias = errors.New("untracked offset for alias")
+	ErrNestedCOPY           = errors.New("bad nested copy tag")
+	ErrCrossSectionOffset   = errors.New("offset refers to another section (the header and the body can't share data)")
+	ErrBadVarint            = errors.New("bad varint")
+	ErrFreezeNotRefnArray   = errors.New("OBJECT_FREEZE value not REFN+ARRAY")
+	ErrFreezeNotArray       = errors.New("OBJECT_FREEZE value not an array")
+	ErrFreezeMultipleElts   = errors.New("OBJECT_FREEZE array contains multiple elements")
+	ErrFreezeNotByteSlice   = errors.New("OBJECT_FREEZE array not []byte")
+	ErrOffsetNotValue       = errors.New("offset doesn't point to the start of a value")
+	ErrTrailingBytes        = errors.New("bytes after the root value")
+	ErrTooDeep              = errors.New("values nested too deep")
+	ErrNotStringish         = errors.New("value not a string where one is expected")
+	ErrShortBody            = errors.New("body shorter than announced once decompressed")
+	ErrBadSnappyLength      = errors.New("snappy_incr length prefix runs past the body")
+	ErrBadSnappyBlock       = errors.New("snappy block doesn't match its announced decoded length")
 )
 
-func (c ErrCorrupt) Error() string { return "sereal: corrupt document:" + c.Err }
+func (c ErrCorrupt) Error() string { return "sereal: corrupt document: " + c.Err.Error() }
+
+// Unwrap returns the cause of the corruption
+func (c ErrCorrupt) Unwrap() error { return c.Err }
+
+// A DecodeError locates the failure of the decoding of a document. It wraps
+// every error returned while decoding values, so that the underlying error
+// is still found by errors.Is and errors.As.
+type DecodeError struct {
+	Path   string // logical location of the value, e.g. "body.users[2].name"
+	Offset int    // offset of the value's tag in its section, as used by COPY and REFP, or -1 if unknown
+	Tag    int    // tag of the value without its track flag, -1 if unknown
+	Err    error
+}
+
+func (e *DecodeError) Error() string {
+	switch e.Err.(type) {
+	case *StrictError, *ThawError:
+		// they already tell where they happened
+		return e.Err.Error()
+	}
+
+	s := "sereal: " + strings.TrimPrefix(e.Err.Error(), "sereal: ")
+	if e.Path != "" {
+		s += " at " + e.Path
+	}
+	switch {
+	case e.Offset >= 0 && e.Tag >= 0:
+		s += " (offset " + strconv.Itoa(e.Offset) + ", " + tagName(byte(e.Tag)) + ")"
+	case e.Offset >= 0:
+		s += " (offset " + strconv.Itoa(e.Offset) + ")"
+	}
+	return s
+}
+
+func (e *DecodeError) Unwrap() error { return e.Err }
+
+// A ValidationError is the first structural violation Validate finds in a
+// document
+type ValidationError struct {
+	Section string // "document" for the framing, "header" or "body"
+	Offset  int    // offset in the document, decompressed if it is compressed
+	Tag     int    // tag of the value at fault without its track flag, -1 if there is none
+	Err     error
+}
+
+func (e *ValidationError) Error() string {
+	at := e.Section + " at " + strconv.Itoa(e.Offset)
+	if e.Tag >= 0 {
+		at += " (" + tagName(byte(e.Tag)) + ")"
+	}
+	return "sereal: invalid document: " + at + ": " + e.Err.Error()
+}
+
+func (e *ValidationError) Unwrap() error { return e.Err }
+
+// A ThawError is returned when the UnmarshalBinary method of the type an
+// OBJECT_FREEZE value is decoded into fails
+type ThawError struct {
+	Class  string // class of the frozen object
+	Path   string // logical location of the object, e.g. "body.items[7]"
+	Offset int    // offset of the OBJECT_FREEZE tag in its section, or -1 if unknown
+	Err    error
+}
+
+func (e *ThawError) Error() string {
+	s := "sereal: thaw " + e.Class + " at " + e.Path
+	if e.Offset >= 0 {
+		s += " (offset " + strconv.Itoa(e.Offset) + ")"
+	}
+	return s + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error
+func (e *ThawError) Unwrap() error { return e.Err }
+
+// A RegexpError is returned when a PerlRegexp can't be translated into a Go
+// regexp.Regexp, see PerlRegexp.Compile
+type RegexpError struct {
+	Pattern   string
+	Modifiers string
+	Err       error
+}
+
+func (e *RegexpError) Error() string {
+	return "sereal: can't translate regexp /" + e.Pattern + "/" + e.Modifiers + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error
+func (e *RegexpError) Unwrap() error { return e.Err }
@@ -0,0 +1,144 @@
+package sereal
+
+import (
+	"encoding"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// DecodeBranch identifies the strategy the decoder used for a value
+type DecodeBranch int
+
+// Decode branches recorded in a DecodeReport
+const (
+	BranchFastPath    DecodeBranch = iota // decoded without reflection into an interface{}
+	BranchReflection                      // decoded via reflection into a value of matching kind
+	BranchCoercion                        // decoded via reflection, converting between kinds
+	BranchUnmarshaler                     // handed over to a registered or implemented unmarshaler
+	BranchSkipped                         // decoded and discarded: no matching field or array slot
+)
+
+func (b DecodeBranch) String() string {
+	switch b {
+	case BranchFastPath:
+		return "fast path"
+	case BranchReflection:
+		return "reflection"
+	case BranchCoercion:
+		return "coercion"
+	case BranchUnmarshaler:
+		return "unmarshaler"
+	case BranchSkipped:
+		return "skipped"
+	}
+	return fmt.Sprintf("DecodeBranch(%d)", int(b))
+}
+
+// A DecodeReportEntry describes how the value at Path was decoded.
+type DecodeReportEntry struct {
+	Path   string       // logical location, e.g. "body.users[2].name"
+	Offset int          // offset of the tag, relative to the start of the section as used by COPY and REFP
+	Tag    string       // name of the tag, e.g. "STR_UTF8"
+	Type   string       // type of the destination, empty for skipped values
+	Branch DecodeBranch // strategy used to decode the value
+}
+
+func (e DecodeReportEntry) String() string {
+	if e.Type == "" {
+		return fmt.Sprintf("%s: %s at %d: %s", e.Path, e.Tag, e.Offset, e.Branch)
+	}
+	return fmt.Sprintf("%s: %s at %d into %s: %s", e.Path, e.Tag, e.Offset, e.Type, e.Branch)
+}
+
+// A DecodeReport records the decisions taken while decoding a document. It is
+// filled in when passed to an Unmarshal call via WithReport.
+//
+// Values decoded via the fast path are recorded once, the values nested
+// inside them are not.
+type DecodeReport struct {
+	Entries []DecodeReportEntry
+}
+
+func (r *DecodeReport) String() string {
+	var sb strings.Builder
+	for _, e := range r.Entries {
+		sb.WriteString(e.String())
+		sb.WriteByte('\n')
+	}
+	return sb.String()
+}
+
+// WithReport records into r which decoding branch was taken for every value of
+// the document. Recording slows decoding down considerably and is meant for
+// debugging.
+func WithReport(r *DecodeReport) UnmarshalOption {
+	return func(o *unmarshalOptions) {
+		o.report = r
+	}
+}
+
+// explain records the decoding of the value at by[idx] into ptr
+func (d *decoder) explain(by []byte, idx int, branch DecodeBranch, ptr reflect.Value) {
+	if d.report == nil || idx < 0 || idx >= len(by) {
+		return
+	}
+
+	entry := DecodeReportEntry{
+		Path:   d.pathString(),
+		Offset: idx,
+		Tag:    tagName(by[idx]),
+		Branch: branch,
+	}
+
+	if ptr.IsValid() {
+		entry.Type = ptr.Type().String()
+	}
+
+	d.report.Entries = append(d.report.Entries, entry)
+}
+
+var binaryUnmarshalerType = reflect.TypeOf((*encoding.BinaryUnmarshaler)(nil)).Elem()
+
+// classify predicts the branch decodeViaReflection takes for tag and ptr
+func (d *decoder) classify(tag byte, ptr reflect.Value) DecodeBranch {
+	kind := ptr.Kind()
+
+	switch {
+	case tag == typeOBJECT_FREEZE, tag == typeOBJECTV_FREEZE:
+		if d.PerlCompat {
+			break
+		}
+
+		typ := ptr.Type()
+		if typ.Implements(binaryUnmarshalerType) || reflect.PtrTo(typ).Implements(binaryUnmarshalerType) {
+			return BranchUnmarshaler
+		}
+
+	case tag == typeBINARY, tag >= typeSHORT_BINARY_0 && tag < typeSHORT_BINARY_0+32:
+		if kind == reflect.String {
+			return BranchCoercion
+		}
+
+	case tag == typeSTR_UTF8:
+		if kind != reflect.String {
+			return BranchCoercion
+		}
+
+	case tag == typeFLOAT:
+		if kind != reflect.Float32 {
+			return BranchCoercion
+		}
+
+	case tag == typeDOUBLE:
+		if kind != reflect.Float64 {
+			return BranchCoercion
+		}
+
+	case tag == typeLONG_DOUBLE:
+		// rounded to a float64 whatever the kind
+		return BranchCoercion
+	}
+
+	return BranchReflection
+}
@@ -0,0 +1,87 @@
+package sereal
+
+import (
+	"encoding/binary"
+	"math"
+	"math/big"
+	"strconv"
+)
+
+// canonicalNaN is the quiet NaN written by Perl on most platforms
+const canonicalNaN = 0x7ff8000000000000
+
+// canonicalFloat32 widens f to the float64 nearest to its shortest decimal
+// representation, i.e. the value Perl holds after parsing the same decimal
+// number. Plain conversion would keep the binary error of float32: 0.1 would
+// become 0.10000000149011612.
+func canonicalFloat32(f float32) float64 {
+	if math.IsNaN(float64(f)) || math.IsInf(float64(f), 0) {
+		return float64(f)
+	}
+
+	d, err := strconv.ParseFloat(strconv.FormatFloat(float64(f), 'g', -1, 32), 64)
+	if err != nil {
+		return float64(f)
+	}
+
+	return d
+}
+
+// longDouble returns the value of the 16 bytes following a LONG_DOUBLE tag.
+// Perl writes its long doubles as they are in memory, which for the builds
+// using them, on x86 and x86-64, is the 80 bit extended precision format,
+// little endian and padded to 16 bytes. The value is returned exactly, its
+// mantissa being 64 bits, unless it is a NaN, which big.Float can't hold.
+func longDouble(b []byte) (x *big.Float, nan bool) {
+	mant := binary.LittleEndian.Uint64(b)
+	se := binary.LittleEndian.Uint16(b[8:])
+	neg, exp := se&0x8000 != 0, int(se&0x7fff)
+
+	switch {
+	case exp == 0x7fff && mant<<1 == 0:
+		return new(big.Float).SetInf(neg), false
+	case exp == 0x7fff:
+		return nil, true
+	case exp == 0:
+		// denormals have the exponent of the smallest normal numbers
+		exp = 1
+	}
+
+	// the integer bit of the mantissa is explicit, the binary point
+	// following it
+	x = new(big.Float).SetUint64(mant)
+	x.SetMantExp(x, exp-16383-63)
+	if neg {
+		x.Neg(x)
+	}
+	return x, false
+}
+
+// FloatEqual reports whether a and b are floating point numbers with the
+// same value once canonicalized, so that a value decoded from a FLOAT and
+// one decoded from a DOUBLE compare equal when they were encoded from the
+// same decimal number. NaNs are equal to each other. It returns false if
+// either argument is not a float32 or float64.
+func FloatEqual(a, b interface{}) bool {
+	fa, ok := canonicalFloat(a)
+	if !ok {
+		return false
+	}
+
+	fb, ok := canonicalFloat(b)
+	if !ok {
+		return false
+	}
+
+	return fa == fb || (fa != fa && fb != fb)
+}
+
+func canonicalFloat(v interface{}) (float64, bool) {
+	switch f := v.(type) {
+	case float32:
+		return canonicalFloat32(f), true
+	case float64:
+		return f, true
+	}
+	return 0, false
+}
@@ -0,0 +1,29 @@
+//go:build go1.18
+// +build go1.18
+
+package sereal
+
+// UnmarshalAs decodes the body of b with the default decoder into a new
+// value of type T. Maps and slices of strings, int64s, ints and interface{}
+// values are decoded without reflection.
+func UnmarshalAs[T any](b []byte, opts ...UnmarshalOption) (T, error) {
+	return DecodeAs[T](&Decoder{}, b, opts...)
+}
+
+// DecodeAs decodes the body of b with d into a new value of type T
+func DecodeAs[T any](d *Decoder, b []byte, opts ...UnmarshalOption) (T, error) {
+	var v T
+	err := d.Unmarshal(b, &v, opts...)
+	return v, err
+}
+
+// UnmarshalMap decodes a hash with the default decoder, its values into V
+func UnmarshalMap[V any](b []byte, opts ...UnmarshalOption) (map[string]V, error) {
+	return UnmarshalAs[map[string]V](b, opts...)
+}
+
+// UnmarshalSlice decodes an array with the default decoder, its elements
+// into E
+func UnmarshalSlice[E any](b []byte, opts ...UnmarshalOption) ([]E, error) {
+	return UnmarshalAs[[]E](b, opts...)
+}
@@ -0,0 +1,51 @@
+//go:build go1.18
+// +build go1.18
+
+package sereal
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestUnmarshalAs(t *testing.T) {
+	b, err := Marshal(map[string]interface{}{"a": "x", "b": "y"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := UnmarshalAs[map[string]string](b)
+	if err != nil || !reflect.DeepEqual(m, map[string]string{"a": "x", "b": "y"}) {
+		t.Errorf("got %#v, %v", m, err)
+	}
+
+	m, err = UnmarshalMap[string](b)
+	if err != nil || !reflect.DeepEqual(m, map[string]string{"a": "x", "b": "y"}) {
+		t.Errorf("map: got %#v, %v", m, err)
+	}
+
+	if _, err := UnmarshalSlice[string](b); err == nil {
+		t.Error("no error decoding a hash into a slice")
+	}
+
+	b, err = Marshal([]int{1, -2, 300})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := UnmarshalSlice[int64](b)
+	if err != nil || !reflect.DeepEqual(s, []int64{1, -2, 300}) {
+		t.Errorf("slice: got %#v, %v", s, err)
+	}
+
+	type point struct{ X, Y int }
+	b, err = Marshal(point{1, 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := DecodeAs[point](&Decoder{Strict: true}, b)
+	if err != nil || p != (point{1, 2}) {
+		t.Errorf("struct: got %#v, %v", p, err)
+	}
+}
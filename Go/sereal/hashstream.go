@@ -0,0 +1,211 @@
+package sereal
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"runtime"
+	"sort"
+)
+
+// DecodeHashStream calls fn for each entry of the hash at the root of the
+// body of the document b with the default decoder
+func DecodeHashStream(b []byte, fn func(key string, value RawMessage) error) error {
+	return NewDecoder().DecodeHashStream(b, fn)
+}
+
+// DecodeHashStream calls fn for each entry of the hash at the root of the
+// body of the document b, in document order, as the hash is parsed. Only the
+// entry being handed to fn is decoded, so that hashes much larger than their
+// decoded form would fit in memory can be processed.
+//
+// The value is only valid until fn returns. Values referring to data
+// elsewhere in the document are resolved and re-encoded, as for
+// Unmarshaler. The first error returned by fn stops the iteration and is
+// returned.
+func (d *Decoder) DecodeHashStream(b []byte, fn func(key string, value RawMessage) error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(runtime.Error); ok {
+				panic(r)
+			}
+
+			switch t := r.(type) {
+			case string:
+				err = errors.New(t)
+			case error:
+				err = t
+			}
+		}
+	}()
+
+	dec, by, idx, err := d.bodyDecoder(b)
+	if err != nil {
+		return err
+	}
+
+	idx = skipPads(by, idx)
+	if idx < len(by) && by[idx]&^trackFlag == typeREFN {
+		idx = skipPads(by, idx+1)
+	}
+	if idx >= len(by) {
+		return ErrTruncated
+	}
+
+	var n int
+	switch tag := by[idx] &^ trackFlag; {
+	case tag == typeHASH:
+		ln, sz, err := varintdecode(by[idx+1:])
+		if err != nil {
+			return err
+		}
+		if ln < 0 || ln > math.MaxInt32 {
+			return ErrCorrupt{ErrBadHashSize}
+		}
+		n = ln
+		idx += 1 + sz
+
+	case tag >= typeHASHREF_0 && tag < typeHASHREF_0+16:
+		n = int(tag & 0x0f)
+		idx++
+
+	default:
+		return fmt.Errorf("sereal: can't stream a document whose body is %s", tagName(tag))
+	}
+
+	for i := 0; i < n; i++ {
+		var key interface{}
+		if idx, err = dec.decode(by, idx, &key); err != nil {
+			return err
+		}
+
+		var k string
+		switch key := key.(type) {
+		case string:
+			k = key
+		case []byte:
+			k = string(key)
+		default:
+			return fmt.Errorf("sereal: unexpected hash key of type %T", key)
+		}
+
+		end, err := skipValue(by, idx)
+		if err != nil {
+			return err
+		}
+
+		value := by[idx:end:end]
+		if !isPositionIndependent(value) {
+			if value, err = dec.resolveValue(by, idx); err != nil {
+				return err
+			}
+		}
+
+		if err := fn(k, RawMessage(value)); err != nil {
+			return err
+		}
+
+		idx = end
+	}
+
+	return nil
+}
+
+// bodyDecoder decompresses the document b and returns a decoder set up to
+// decode its body, along with the body as offsets refer to it and the offset
+// of its root value
+func (d *Decoder) bodyDecoder(b []byte) (*decoder, []byte, int, error) {
+	b, err := DecompressDocument(nil, b)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	header, _ := readHeader(b)
+	bodyStart := headerSize + header.suffixSize
+
+	dec := &decoder{Decoder: d, tracked: make(map[int]reflect.Value), section: "body", sectionStart: 1}
+
+	if header.version == 1 {
+		// v1 offsets are relative to the start of the document
+		dec.sectionStart = bodyStart
+		return dec, b, bodyStart, nil
+	}
+	return dec, b[bodyStart-1:], 1, nil
+}
+
+// resolveValue returns a self-contained encoding of the value starting at
+// by[idx]
+func (d *decoder) resolveValue(by []byte, idx int) ([]byte, error) {
+	v, err := d.decodeAt(by, idx)
+	if err != nil {
+		return nil, err
+	}
+	return rawEncoder.encodeRaw(nil, v)
+}
+
+// decodeAt decodes the value starting at by[idx] into an interface{}. The
+// tracked values it refers to which lie before it are decoded first, in
+// document order, so that their own references are resolved too.
+func (d *decoder) decodeAt(by []byte, idx int) (interface{}, error) {
+	var targets []int
+	seen := make(map[int]bool)
+
+	todo := []int{idx}
+	for len(todo) > 0 {
+		start := todo[len(todo)-1]
+		todo = todo[:len(todo)-1]
+
+		_, err := walkValue(by, start, func(i int, tag byte) error {
+			if !isOffsetTag(tag) {
+				return nil
+			}
+
+			offs, _, err := varintdecode(by[i+1:])
+			if err != nil {
+				return err
+			}
+			if offs >= start || seen[offs] {
+				return nil
+			}
+			if err := d.checkOffset(offs, i); err != nil {
+				return err
+			}
+
+			seen[offs] = true
+			todo = append(todo, offs)
+			if by[offs]&trackFlag != 0 {
+				targets = append(targets, offs)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Ints(targets)
+	for _, offs := range targets {
+		if _, ok := d.tracked[offs]; ok {
+			continue
+		}
+
+		var v interface{}
+		if _, err := d.decode(by, offs, &v); err != nil {
+			return nil, err
+		}
+	}
+
+	var v interface{}
+	if _, err := d.decode(by, idx, &v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func skipPads(by []byte, idx int) int {
+	for idx < len(by) && by[idx]&^trackFlag == typePAD {
+		idx++
+	}
+	return idx
+}
@@ -0,0 +1,194 @@
+package sereal
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"runtime"
+)
+
+// ReadHeaderOnly decodes the header user data of b into vheader with the
+// default decoder
+func ReadHeaderOnly(b []byte, vheader interface{}) error {
+	return NewDecoder().ReadHeaderOnly(b, vheader)
+}
+
+// ReadHeaderOnly decodes the header user data of b into vheader without
+// looking at the body at all: it is neither decompressed nor validated, so
+// that documents can be routed on their metadata at little cost. It returns
+// ErrNoHeader if the document has no header user data.
+func (d *Decoder) ReadHeaderOnly(b []byte, vheader interface{}) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(runtime.Error); ok {
+				panic(r)
+			}
+
+			switch t := r.(type) {
+			case string:
+				err = errors.New(t)
+			case error:
+				err = t
+			}
+		}
+	}()
+
+	header, err := checkHeader(b)
+	if err != nil {
+		return err
+	}
+
+	bodyStart := headerSize + header.suffixSize
+	if bodyStart > len(b) || bodyStart < 0 {
+		return ErrCorrupt{ErrBadOffset}
+	}
+
+	if header.suffixLen == 0 || b[header.suffixStart]&1 == 0 {
+		return ErrNoHeader
+	}
+
+	dec := decoder{Decoder: d}
+	return dec.decodeUserHeader(b, header, bodyStart, vheader)
+}
+
+// HeaderField decodes the entry key of the header user data of b into v
+// with the default decoder
+func HeaderField(b []byte, key string, v interface{}) (bool, error) {
+	return NewDecoder().HeaderField(b, key, v)
+}
+
+// HeaderField decodes the entry key of the header user data of b, which
+// must be a hash, into v. Only that entry is decoded, and the body is left
+// untouched as with ReadHeaderOnly. It returns false if the document has no
+// header user data or if the entry doesn't exist.
+func (d *Decoder) HeaderField(b []byte, key string, v interface{}) (bool, error) {
+	var fields map[string]RawMessage
+	if err := d.ReadHeaderOnly(b, &fields); err != nil {
+		if err == ErrNoHeader {
+			return false, nil
+		}
+		return false, err
+	}
+
+	raw, ok := fields[key]
+	if !ok {
+		return false, nil
+	}
+
+	if err := d.unmarshalRaw(raw, v); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// unmarshalRaw decodes the encoded value raw into v
+func (d *Decoder) unmarshalRaw(raw []byte, v interface{}) error {
+	// wrap it in a v2 document without header user data
+	doc := []byte{'=', 's', 'r', 'l', 2, 0}
+	return d.Unmarshal(append(doc, raw...), v)
+}
+
+// HeaderInfo is what PeekHeader finds out about a document
+type HeaderInfo struct {
+	DocumentInfo
+
+	// Header is the header user data decoded generically, nil if there is
+	// none
+	Header interface{}
+}
+
+// PeekHeader describes b and decodes its header user data with the default
+// decoder
+func PeekHeader(b []byte) (HeaderInfo, error) {
+	return NewDecoder().PeekHeader(b)
+}
+
+// PeekHeader describes b and decodes its header user data, without looking
+// at the body beyond the lengths at its start. BodySize is the size of the
+// uncompressed body announced by the compressed one, -1 if it doesn't
+// announce it, and isn't checked.
+func (d *Decoder) PeekHeader(b []byte) (HeaderInfo, error) {
+	header, err := checkHeader(b)
+	if err != nil {
+		return HeaderInfo{}, err
+	}
+
+	bodyStart := headerSize + header.suffixSize
+	if bodyStart > len(b) || bodyStart < 0 {
+		return HeaderInfo{}, ErrCorrupt{ErrBadOffset}
+	}
+
+	info := HeaderInfo{
+		DocumentInfo: DocumentInfo{
+			Version:        int(header.version),
+			DocType:        header.doctype.String(),
+			HeaderSize:     bodyStart,
+			BodySize:       -1,
+			CompressedSize: len(b) - bodyStart,
+		},
+	}
+	if header.suffixSize > header.suffixStart-headerSize {
+		info.SuffixFlags = b[header.suffixStart]
+	}
+
+	if info.BodySize, err = announcedBodySize(header.doctype, b[bodyStart:]); err != nil {
+		return HeaderInfo{}, err
+	}
+
+	if info.SuffixFlags&1 == 1 {
+		if err := d.ReadHeaderOnly(b, &info.Header); err != nil {
+			return HeaderInfo{}, err
+		}
+	}
+
+	return info, nil
+}
+
+// announcedBodySize returns the size of the uncompressed body announced at
+// the start of the body b of a document of the given type, or -1
+func announcedBodySize(doctype documentType, b []byte) (int, error) {
+	switch doctype {
+	case serealRaw:
+		return len(b), nil
+
+	case serealSnappy, serealSnappyIncremental:
+		if doctype == serealSnappyIncremental {
+			_, sz, err := varintdecode(b)
+			if err != nil {
+				return 0, err
+			}
+			b = b[sz:]
+		}
+		// the snappy block starts with the decoded length
+		ln, _, err := varintdecode(b)
+		return ln, err
+
+	case serealZlib:
+		ln, _, err := varintdecode(b)
+		return ln, err
+	}
+
+	return -1, nil
+}
+
+// withHeaderEntry returns the header user-data with the entry key added.
+// Only headers which are maps with string keys can carry it.
+func withHeaderEntry(header interface{}, key string, value interface{}) (interface{}, error) {
+	h := map[string]interface{}{key: value}
+	if header == nil {
+		return h, nil
+	}
+
+	rv := reflect.ValueOf(header)
+	if rv.Kind() != reflect.Map || rv.Type().Key().Kind() != reflect.String {
+		return nil, fmt.Errorf("sereal: header of type %T can't carry %s, expected a map with string keys", header, key)
+	}
+
+	iter := rv.MapRange()
+	for iter.Next() {
+		h[iter.Key().String()] = iter.Value().Interface()
+	}
+	h[key] = value
+
+	return h, nil
+}
@@ -0,0 +1,217 @@
+package sereal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"unicode/utf8"
+)
+
+var errJSONNonFinite = errors.New("sereal: NaN and infinite numbers can't be represented in JSON")
+
+// ToJSON writes the body of the Sereal document doc to dst as JSON, tag by
+// tag, without decoding it into Go values first. Objects are written as
+// their data, without their class, and regular expressions as their
+// pattern. Binary strings are written as strings, invalid UTF-8 being
+// replaced by U+FFFD as encoding/json does.
+func ToJSON(dst io.Writer, doc []byte) error {
+	b, err := Transcode(nil, doc, FormatJSON)
+	if err != nil {
+		return err
+	}
+
+	_, err = dst.Write(b)
+	return err
+}
+
+// jsonSink writes JSON for a tagTranscoder
+type jsonSink struct {
+	buf []byte
+}
+
+func (j *jsonSink) null()            { j.buf = append(j.buf, "null"...) }
+func (j *jsonSink) int(n int64)      { j.buf = strconv.AppendInt(j.buf, n, 10) }
+func (j *jsonSink) uint(n uint64)    { j.buf = strconv.AppendUint(j.buf, n, 10) }
+func (j *jsonSink) beginArray(n int) { j.buf = append(j.buf, '[') }
+func (j *jsonSink) beginMap(n int)   { j.buf = append(j.buf, '{') }
+func (j *jsonSink) stringKeys() bool { return true }
+func (j *jsonSink) bytes() []byte    { return j.buf }
+
+func (j *jsonSink) bool(b bool) {
+	if b {
+		j.buf = append(j.buf, "true"...)
+	} else {
+		j.buf = append(j.buf, "false"...)
+	}
+}
+
+func (j *jsonSink) float(f float64, bits int) error {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return errJSONNonFinite
+	}
+	j.buf = strconv.AppendFloat(j.buf, f, 'g', -1, bits)
+	return nil
+}
+
+func (j *jsonSink) elem(i int, isMap bool) {
+	if i > 0 {
+		j.buf = append(j.buf, ',')
+	}
+}
+
+func (j *jsonSink) key() { j.buf = append(j.buf, ':') }
+
+func (j *jsonSink) end(isMap bool) {
+	if isMap {
+		j.buf = append(j.buf, '}')
+	} else {
+		j.buf = append(j.buf, ']')
+	}
+}
+
+// string writes s as a JSON string
+func (j *jsonSink) string(s []byte, isUTF8 bool) {
+	const hex = "0123456789abcdef"
+
+	b := append(j.buf, '"')
+	for i := 0; i < len(s); {
+		c := s[i]
+		if c < utf8.RuneSelf {
+			switch {
+			case c == '"' || c == '\\':
+				b = append(b, '\\', c)
+			case c == '\n':
+				b = append(b, `\n`...)
+			case c == '\r':
+				b = append(b, `\r`...)
+			case c == '\t':
+				b = append(b, `\t`...)
+			case c < 0x20:
+				b = append(b, `\u00`...)
+				b = append(b, hex[c>>4], hex[c&0xf])
+			default:
+				b = append(b, c)
+			}
+			i++
+			continue
+		}
+
+		r, size := utf8.DecodeRune(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			b = append(b, `\ufffd`...)
+		} else {
+			b = append(b, s[i:i+size]...)
+		}
+		i += size
+	}
+	j.buf = append(b, '"')
+}
+
+// FromJSON returns the Sereal encoding of the JSON document src, produced
+// token by token with the default encoder. See Encoder.FromJSON.
+func FromJSON(src []byte) ([]byte, error) {
+	return defaultEncoder.FromJSON(src)
+}
+
+// FromJSON returns the Sereal encoding of the JSON document src, produced
+// token by token without decoding it into Go values first. Numbers are
+// encoded as with json.Number values. As the size of arrays and objects is
+// only known once they have been read, each one is preceded by a few PAD
+// bytes.
+func (e *Encoder) FromJSON(src []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(src))
+	dec.UseNumber()
+
+	doc, err := e.marshal(nil, marshalOptions{}, func(b []byte, strTable map[string]int, ptrTable map[uintptr]int) ([]byte, error) {
+		return e.encodeJSON(b, dec, strTable)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("sereal: trailing data after JSON document")
+	}
+
+	return doc, nil
+}
+
+// containerPlaceholder is the room reserved for the REFN tag, the tag and
+// the size of an array or hash whose size isn't known yet
+const containerPlaceholder = 2 + binary.MaxVarintLen32
+
+func (e *Encoder) encodeJSON(by []byte, dec *json.Decoder, strTable map[string]int) ([]byte, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch t := tok.(type) {
+	case nil:
+		return append(by, typeUNDEF), nil
+
+	case bool:
+		if t {
+			return append(by, typeTRUE), nil
+		}
+		return append(by, typeFALSE), nil
+
+	case json.Number:
+		return e.encodeJsonNumber(by, t, false, strTable), nil
+
+	case string:
+		return e.encodeString(by, t, false, strTable), nil
+
+	case json.Delim:
+		start := len(by)
+		for i := 0; i < containerPlaceholder; i++ {
+			by = append(by, typePAD)
+		}
+
+		n := 0
+		for dec.More() {
+			if t == '{' {
+				key, err := dec.Token()
+				if err != nil {
+					return nil, err
+				}
+				by = e.encodeString(by, key.(string), true, strTable)
+			}
+
+			if by, err = e.encodeJSON(by, dec, strTable); err != nil {
+				return nil, err
+			}
+			n++
+		}
+
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+
+		tag := byte(typeARRAY)
+		if t == '{' {
+			tag = typeHASH
+		}
+
+		// write the tag and the size at the end of the placeholder, the
+		// decoder skips the PAD bytes before them
+		var size [binary.MaxVarintLen32]byte
+		sz := binary.PutUvarint(size[:], uint64(n))
+		at := start + containerPlaceholder - sz - 1
+		by[at] = tag
+		copy(by[at+1:], size[:sz])
+
+		if e.PerlCompat {
+			by[at-1] = typeREFN
+		}
+
+		return by, nil
+	}
+
+	return nil, fmt.Errorf("sereal: unexpected JSON token %v", tok)
+}
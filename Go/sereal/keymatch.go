@@ -0,0 +1,63 @@
+package sereal
+
+import (
+	"reflect"
+	"strings"
+)
+
+// A KeyMatcher folds hash keys and the names of struct fields, as given by
+// their tag or else by the field name: a key which names no field is decoded
+// into the field whose folded name is the folded key. Folding must be
+// deterministic.
+type KeyMatcher func(name string) string
+
+// ExactKeys only matches keys naming a field exactly
+func ExactKeys(name string) string {
+	return name
+}
+
+// CaseInsensitiveKeys matches keys to fields whatever their case, e.g.
+// "userid" to UserID
+func CaseInsensitiveKeys(name string) string {
+	return strings.ToLower(name)
+}
+
+// SnakeCaseKeys matches snake_case keys to CamelCase fields, whatever their
+// case, e.g. "user_id" to UserID
+func SnakeCaseKeys(name string) string {
+	return strings.ToLower(strings.Replace(name, "_", "", -1))
+}
+
+// keyMatchers are the KeyMatchers named in DecoderOptions
+var keyMatchers = map[string]KeyMatcher{
+	"exact":            ExactKeys,
+	"case_insensitive": CaseInsensitiveKeys,
+	"snake_case":       SnakeCaseKeys,
+}
+
+// keyMatchKey identifies the folded names of a type under a KeyMatcher,
+// told apart by its code
+type keyMatchKey struct {
+	typ     reflect.Type
+	matcher uintptr
+}
+
+// foldedTags returns the fields of typ by their name folded by KeyMatcher.
+// When several fields have the same folded name the first one is kept.
+func (d *Decoder) foldedTags(typ reflect.Type, tags map[string]tag) map[string]tag {
+	key := keyMatchKey{typ, reflect.ValueOf(d.KeyMatcher).Pointer()}
+	if folded, ok := d.keyMatchTags.Load(key); ok {
+		return folded.(map[string]tag)
+	}
+
+	folded := make(map[string]tag, len(tags))
+	for name, fld := range tags {
+		k := d.KeyMatcher(name)
+		if prev, ok := folded[k]; !ok || fld.id < prev.id {
+			folded[k] = fld
+		}
+	}
+
+	d.keyMatchTags.Store(key, folded)
+	return folded
+}
@@ -0,0 +1,139 @@
+package sereal
+
+import (
+	"encoding"
+	"fmt"
+	"reflect"
+	"strconv"
+)
+
+// A KeyEncoder returns the hash key a map key is encoded as. Decoders parse
+// keys back with UnmarshalText for key types implementing
+// encoding.TextUnmarshaler, or else with FormatKey's rules.
+type KeyEncoder func(key interface{}) (string, error)
+
+var textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+
+// FormatKey is the default KeyEncoder: strings are kept, encoding.TextMarshaler
+// keys are marshaled, numbers written in decimal and booleans as "true" or
+// "false"
+func FormatKey(key interface{}) (string, error) {
+	v := reflect.ValueOf(key)
+
+	switch v.Kind() {
+	case reflect.String:
+		return v.String(), nil
+	}
+
+	if m, ok := key.(encoding.TextMarshaler); ok {
+		b, err := m.MarshalText()
+		return string(b), err
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64:
+		return formatNumber(v), nil
+	}
+
+	return "", fmt.Errorf("sereal: can't use %T as a hash key", key)
+}
+
+// encodeKey appends the map key k as a hash key
+func (e *Encoder) encodeKey(by []byte, k reflect.Value, strTable map[string]int) ([]byte, error) {
+	for k.Kind() == reflect.Interface && !k.IsNil() {
+		k = k.Elem()
+	}
+	if k.Kind() == reflect.String {
+		return e.encodeString(by, k.String(), true, strTable), nil
+	}
+	if !k.IsValid() || k.Kind() == reflect.Interface {
+		return nil, fmt.Errorf("sereal: can't use nil as a hash key")
+	}
+
+	encodeKey := e.KeyEncoder
+	if encodeKey == nil {
+		encodeKey = FormatKey
+	}
+
+	s, err := encodeKey(k.Interface())
+	if err != nil {
+		return nil, err
+	}
+	return e.encodeString(by, s, true, strTable), nil
+}
+
+// parseKey returns the map key of type typ the hash key s is decoded into
+func parseKey(typ reflect.Type, s string) (reflect.Value, error) {
+	key := reflect.New(typ).Elem()
+
+	// as in encoding/json, UnmarshalText wins over the kind of the key
+	switch {
+	case reflect.PtrTo(typ).Implements(textUnmarshalerType):
+		if err := key.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(s)); err != nil {
+			return reflect.Value{}, err
+		}
+
+	case typ.Kind() == reflect.String:
+		key.SetString(s)
+
+	case typ.Kind() == reflect.Interface && typ.NumMethod() == 0:
+		key.Set(reflect.ValueOf(s))
+
+	case typ.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return reflect.Value{}, fmt.Errorf("can't decode key %q into %v", s, typ)
+		}
+		key.SetBool(b)
+
+	case isNumberKind(typ.Kind()):
+		if err := parseNumber(key, s); err != nil {
+			return reflect.Value{}, err
+		}
+
+	default:
+		return reflect.Value{}, fmt.Errorf("can't decode key %q into %v", s, typ)
+	}
+
+	return key, nil
+}
+
+// decodeMapKey decodes the key of a hash entry into a key of the map type
+// typ. Keys which aren't strings, as written for maps with scalar keys by
+// encoders without PerlCompat or KeyEncoder, are decoded as they are.
+func (d *decoder) decodeMapKey(by []byte, idx int, typ reflect.Type) ([]byte, reflect.Value, int, error) {
+	if idx < len(by) && !isStringishTag(by[idx]&^trackFlag) && typ.Kind() != reflect.String && typ.Kind() != reflect.Interface {
+		key := reflect.New(typ).Elem()
+		idx, err := d.decodeViaReflection(by, idx, key)
+		if err != nil {
+			return nil, reflect.Value{}, 0, err
+		}
+		return []byte(fmt.Sprint(key.Interface())), key, idx, nil
+	}
+
+	key, idx, err := d.decodeStringish(by, idx)
+	if err != nil {
+		return nil, reflect.Value{}, 0, err
+	}
+
+	if typ == stringType {
+		return key, reflect.ValueOf(string(key)), idx, nil
+	}
+
+	kv, err := parseKey(typ, string(key))
+	if err != nil {
+		return nil, reflect.Value{}, 0, fmt.Errorf("sereal: %v", err)
+	}
+	return key, kv, idx, nil
+}
+
+var stringType = reflect.TypeOf("")
+
+func isStringishTag(tag byte) bool {
+	return tag == typeBINARY || tag == typeSTR_UTF8 || tag == typeCOPY ||
+		tag >= typeSHORT_BINARY_0 && tag < typeSHORT_BINARY_0+32
+}
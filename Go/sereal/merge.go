@@ -27,6 +27,7 @@ type Merger struct {
 	objTable   map[string]int
 	version    int
 	length     int
+	documents  int
 	lenOffset  int
 	bodyOffset int // 1-based
 
@@ -115,7 +116,7 @@ func (m *Merger) initMerger() error {
 	}
 
 	switch {
-	case m.version > ProtocolVersion:
+	case m.version > MaxSupportedVersion:
 		return fmt.Errorf("protocol version '%v' not yet supported", m.version)
 	case m.version < 3:
 		binary.LittleEndian.PutUint32(m.buf[:4], magicHeaderBytes)
@@ -195,12 +196,47 @@ func (m *Merger) Append(b []byte) (int, error) {
 	// second pass: do the work
 	if err := m.mergeItems(&doc); err != nil {
 		m.buf = m.buf[0:lastElementOffset] // remove appended stuff
+		m.forgetStrings(lastElementOffset - m.bodyOffset)
 		return 0, err
 	}
 
+	m.documents++
+
 	return m.length - oldLength, nil
 }
 
+// AppendAll adds the sereal documents docs in order. If one of them is
+// invalid, it stops there and returns the number of documents merged
+// before it along with the error; merging can go on with the next ones.
+func (m *Merger) AppendAll(docs [][]byte) (int, error) {
+	for i, b := range docs {
+		if _, err := m.Append(b); err != nil {
+			return i, err
+		}
+	}
+	return len(docs), nil
+}
+
+// ElementsMerged returns the number of documents merged so far
+func (m *Merger) ElementsMerged() int {
+	return m.documents
+}
+
+// forgetStrings drops the strings and class names found at or after the
+// offset from, when the data they were found in is removed
+func (m *Merger) forgetStrings(from int) {
+	for s, offs := range m.strTable {
+		if offs >= from {
+			delete(m.strTable, s)
+		}
+	}
+	for s, offs := range m.objTable {
+		if offs >= from {
+			delete(m.objTable, s)
+		}
+	}
+}
+
 // Finish is called to terminate the merging process
 func (m *Merger) Finish() ([]byte, error) {
 	if err := m.initMerger(); err != nil {
@@ -211,15 +247,15 @@ func (m *Merger) Finish() ([]byte, error) {
 		m.finished = true
 		binary.PutUvarint(m.buf[m.lenOffset:], uint64(m.length))
 
-		if m.Compression != nil && (m.CompressionThreshold == 0 || len(m.buf) >= m.CompressionThreshold) {
+		if m.Compression != nil && (m.CompressionThreshold == 0 || len(m.buf) >= m.CompressionThreshold || compressAlways(m.Compression)) {
 			compressed, err := m.Compression.compress(m.buf[m.bodyOffset+1:])
 			if err != nil {
 				return m.buf, err
 			}
 
-			// TODO think about some optimizations here
-			copy(m.buf[m.bodyOffset+1:], compressed)
-			m.buf = m.buf[:len(compressed)+m.bodyOffset+1]
+			// compressed may be longer than the body, e.g. for incompressible
+			// data
+			m.buf = append(m.buf[:m.bodyOffset+1], compressed...)
 
 			// verify compressor, there was little point in veryfing compressor in initMerger()
 			// because use can change it meanwhile
@@ -238,6 +274,9 @@ func (m *Merger) Finish() ([]byte, error) {
 
 				m.buf[4] |= byte(serealZlib) << 4
 
+			case RegisteredCompressor:
+				m.buf[4] |= comp.DocType << 4
+
 			default:
 				return nil, errors.New("unknown compressor")
 			}
@@ -299,9 +338,9 @@ func (m *Merger) buildTrackTable(doc *mergerDoc) error {
 			idx += sz + ln + 1
 
 			if ln < 0 || ln > math.MaxUint32 {
-				return fmt.Errorf("bad size for string: %d", ln)
+				return fmt.Errorf("%w: %d", ErrCorrupt{ErrBadStringSize}, ln)
 			} else if idx > len(buf) {
-				return fmt.Errorf("truncated document, expect %d bytes", len(buf)-idx)
+				return fmt.Errorf("%w, expect %d bytes", ErrTruncated, len(buf)-idx)
 			}
 
 		case tag == typeARRAY, tag == typeHASH:
@@ -319,7 +358,7 @@ func (m *Merger) buildTrackTable(doc *mergerDoc) error {
 				return err
 			}
 			if offset < 0 || offset >= idx {
-				return fmt.Errorf("tag %d refers to invalid offset: %d", tag, offset)
+				return fmt.Errorf("%w: tag %d refers to %d", ErrCorrupt{ErrBadOffset}, tag, offset)
 			}
 
 			doc.trackTable[offset] = -1
@@ -339,7 +378,7 @@ func (m *Merger) buildTrackTable(doc *mergerDoc) error {
 			return errors.New("unexpected start of new document")
 
 		default:
-			return fmt.Errorf("unknown tag: %d (0x%x) at offset %d", tag, tag, idx)
+			return fmt.Errorf("%w: %d (0x%x) at offset %d", ErrUnknownTag, tag, tag, idx)
 		}
 	}
 
@@ -456,9 +495,9 @@ LOOP:
 
 			length := sz + ln + 1
 			if ln < 0 || ln > math.MaxUint32 {
-				return fmt.Errorf("bad size for string: %d", ln)
+				return fmt.Errorf("%w: %d", ErrCorrupt{ErrBadStringSize}, ln)
 			} else if didx+length > len(dbuf) {
-				return fmt.Errorf("truncated document, expect %d bytes", len(dbuf)-didx-length)
+				return fmt.Errorf("%w, expect %d bytes", ErrTruncated, len(dbuf)-didx-length)
 			}
 
 			if dedupString {
@@ -486,7 +525,7 @@ LOOP:
 			targetOffset, ok := doc.trackTable[offset]
 
 			if !ok || targetOffset < 0 {
-				return errors.New("bad target offset at COPY, ALIAS or REFP tag")
+				return fmt.Errorf("%w at COPY, ALIAS or REFP tag", ErrCorrupt{ErrBadOffset})
 			}
 
 			mbuf = appendTagVarint(mbuf, dbuf[didx], uint(targetOffset))
@@ -504,8 +543,11 @@ LOOP:
 				return err
 
 			}
+			if ln < 0 && tag == typeHASH {
+				return ErrCorrupt{ErrBadHashSize}
+			}
 			if ln < 0 {
-				return errors.New("bad array or hash length")
+				return ErrCorrupt{ErrBadSliceSize}
 			}
 
 			mbuf = append(mbuf, dbuf[didx:didx+sz+1]...)
@@ -576,7 +618,7 @@ LOOP:
 
 		default:
 			// TODO typeMANY
-			return fmt.Errorf("unknown tag: %d (0x%x) at offset %d", tag, tag, didx)
+			return fmt.Errorf("%w: %d (0x%x) at offset %d", ErrUnknownTag, tag, tag, didx)
 		}
 
 		stack[level]--
@@ -627,7 +669,7 @@ func readString(buf []byte) (int, []byte, error) {
 	tag &^= trackFlag
 
 	if !isShallowStringish(tag) {
-		return 0, nil, fmt.Errorf("expected stringish but found %d (0x%x)", int(tag), int(tag))
+		return 0, nil, fmt.Errorf("%w: found %d (0x%x)", ErrCorrupt{ErrNotStringish}, int(tag), int(tag))
 	}
 
 	var ln, offset int
@@ -643,9 +685,9 @@ func readString(buf []byte) (int, []byte, error) {
 
 	offset++ // respect tag itself
 	if ln < 0 || ln > math.MaxUint32 {
-		return 0, nil, fmt.Errorf("bad size for string: %d", ln)
+		return 0, nil, fmt.Errorf("%w: %d", ErrCorrupt{ErrBadStringSize}, ln)
 	} else if offset+ln > len(buf) {
-		return 0, nil, fmt.Errorf("truncated document, expect %d bytes", len(buf)-ln-offset)
+		return 0, nil, fmt.Errorf("%w, expect %d bytes", ErrTruncated, len(buf)-ln-offset)
 	}
 
 	return offset, buf[offset : offset+ln], nil
@@ -4,6 +4,7 @@ import (
 	"io/ioutil"
 	"math/rand"
 	"path/filepath"
+	"reflect"
 	"testing"
 	"time"
 )
@@ -37,3 +38,74 @@ func BenchmarkMerger(b *testing.B) {
 		}
 	}
 }
+
+func TestMergerAppendAll(t *testing.T) {
+	var docs [][]byte
+	for _, v := range []interface{}{"first", map[string]interface{}{"zzzz": 1}} {
+		b, err := NewEncoderV3().Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		docs = append(docs, b)
+	}
+
+	// ["yyyy", COPY into the middle of "yyyy"]: fails once "yyyy" was seen
+	bad := []byte{0x3d, 0xf3, 0x72, 0x6c, 0x03, 0x00, 0x42, 0x64, 'y', 'y', 'y', 'y', 0x2f, 0x03}
+	last, _ := NewEncoderV3().Marshal([]interface{}{"yyyy", "yyyy"})
+
+	m := NewMergerV3()
+	m.DedupeStrings = true
+
+	n, err := m.AppendAll(append(docs, bad, last))
+	if err == nil || n != 2 || m.ElementsMerged() != 2 {
+		t.Fatalf("got %d merged (%d), %v", n, m.ElementsMerged(), err)
+	}
+
+	if n, err := m.AppendAll([][]byte{last}); err != nil || n != 1 || m.ElementsMerged() != 3 {
+		t.Fatalf("got %d merged (%d), %v", n, m.ElementsMerged(), err)
+	}
+
+	b, err := m.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []interface{}
+	if err := Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []interface{}{"first", map[string]interface{}{"zzzz": 1}, []interface{}{"yyyy", "yyyy"}}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("got %#v, expected %#v", got, expected)
+	}
+}
+
+func TestMergerRegisteredCompressor(t *testing.T) {
+	if err := RegisterCompressor(12, xorCompressor{}); err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewMergerV3()
+	m.Compression = RegisteredCompressor{DocType: 12}
+	m.CompressionThreshold = 0
+	for _, v := range []string{"foo", "bar"} {
+		b, _ := Marshal(v)
+		if _, err := m.Append(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b, err := m.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doctype := b[4] >> 4; doctype != 12 {
+		t.Errorf("unexpected document type %d", doctype)
+	}
+
+	var got []string
+	if err := Unmarshal(b, &got); err != nil || !reflect.DeepEqual(got, []string{"foo", "bar"}) {
+		t.Errorf("unexpected merged document %v (%v)", got, err)
+	}
+}
@@ -0,0 +1,197 @@
+package sereal
+
+import (
+	"reflect"
+)
+
+// Normalize returns v, a value decoded in PerlCompat mode, in the form it
+// would have been decoded into without PerlCompat: references to hashes and
+// arrays become the maps and slices themselves, references to scalars the
+// scalars, PerlUndef becomes nil, and objects, weak references and aliases
+// the values they hold. Regular expressions and frozen objects are kept.
+// The references Go-native decoding leaves as pointers are collapsed too.
+// Shared and cyclic data stays shared.
+func Normalize(v interface{}) interface{} {
+	n := normalizer{seen: make(map[uintptr]interface{})}
+	return n.normalize(reflect.ValueOf(v))
+}
+
+type normalizer struct {
+	seen map[uintptr]interface{} // references and containers already normalized
+}
+
+func (n *normalizer) normalize(v reflect.Value) interface{} {
+	for v.Kind() == reflect.Interface && !v.IsNil() {
+		v = v.Elem()
+	}
+
+	if !v.IsValid() {
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Interface:
+		return nil
+
+	case reflect.Ptr:
+		if v.IsNil() {
+			return nil
+		}
+
+		switch p := v.Interface().(type) {
+		case *PerlUndef:
+			return nil
+		case *PerlRegexp, *PerlFreeze:
+			return p
+		}
+
+		if r, ok := n.seen[v.Pointer()]; ok {
+			return r
+		}
+
+		switch p := v.Interface().(type) {
+		case *PerlObject:
+			r := n.normalize(reflect.ValueOf(p.Reference))
+			n.seen[v.Pointer()] = r
+			return r
+		case *PerlWeakRef:
+			r := n.normalize(reflect.ValueOf(p.Reference))
+			n.seen[v.Pointer()] = r
+			return r
+		case *PerlAlias:
+			r := n.normalize(reflect.ValueOf(p.Alias))
+			n.seen[v.Pointer()] = r
+			return r
+		}
+
+		// maps and slices register themselves before their elements, which
+		// ends the cycles going through the reference
+		r := n.normalize(v.Elem())
+		n.seen[v.Pointer()] = r
+		return r
+
+	case reflect.Map:
+		if v.IsNil() {
+			return v.Interface()
+		}
+		if r, ok := n.seen[v.Pointer()]; ok {
+			return r
+		}
+		if v.Type().Key().Kind() != reflect.String {
+			return v.Interface()
+		}
+
+		m := make(map[string]interface{}, v.Len())
+		n.seen[v.Pointer()] = m
+		iter := v.MapRange()
+		for iter.Next() {
+			m[iter.Key().String()] = n.normalize(iter.Value())
+		}
+		return m
+
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 || v.IsNil() {
+			return v.Interface()
+		}
+		// a slice of the same array as another is only the same if it has
+		// the same length
+		if r, ok := n.seen[v.Pointer()].([]interface{}); ok && len(r) == v.Len() {
+			return r
+		}
+
+		s := make([]interface{}, v.Len())
+		if v.Len() > 0 {
+			n.seen[v.Pointer()] = s
+		}
+		for i := range s {
+			s[i] = n.normalize(v.Index(i))
+		}
+		return s
+
+	case reflect.Struct:
+		switch s := v.Interface().(type) {
+		case PerlUndef:
+			return nil
+		case PerlObject:
+			return n.normalize(reflect.ValueOf(s.Reference))
+		case PerlWeakRef:
+			return n.normalize(reflect.ValueOf(s.Reference))
+		case PerlAlias:
+			return n.normalize(reflect.ValueOf(s.Alias))
+		}
+	}
+
+	return v.Interface()
+}
+
+// Perlify returns v, a value in the Go-native form Normalize returns, in the
+// form decoding in PerlCompat mode produces: maps and slices become
+// references to hashes and arrays, and nil becomes a PerlUndef. Encoding the
+// result with a PerlCompat encoder writes the same structure Perl would have.
+// Shared and cyclic data stays shared.
+func Perlify(v interface{}) interface{} {
+	p := perlifier{seen: make(map[uintptr]interface{})}
+	return p.perlify(reflect.ValueOf(v))
+}
+
+type perlifier struct {
+	seen map[uintptr]interface{} // containers already perlified
+}
+
+func (p *perlifier) perlify(v reflect.Value) interface{} {
+	for v.Kind() == reflect.Interface && !v.IsNil() {
+		v = v.Elem()
+	}
+
+	if !v.IsValid() || v.Kind() == reflect.Interface {
+		return &PerlUndef{}
+	}
+
+	switch v.Kind() {
+	case reflect.Map:
+		if v.IsNil() {
+			return &PerlUndef{}
+		}
+		if v.Type().Key().Kind() != reflect.String {
+			return v.Interface()
+		}
+		if r, ok := p.seen[v.Pointer()]; ok {
+			return r
+		}
+
+		m := make(map[string]interface{}, v.Len())
+		p.seen[v.Pointer()] = &m
+		iter := v.MapRange()
+		for iter.Next() {
+			m[iter.Key().String()] = p.perlify(iter.Value())
+		}
+		return &m
+
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return v.Interface()
+		}
+		if v.IsNil() {
+			return &PerlUndef{}
+		}
+		if r, ok := p.seen[v.Pointer()].(*[]interface{}); ok && len(*r) == v.Len() {
+			return r
+		}
+
+		s := make([]interface{}, v.Len())
+		if v.Len() > 0 {
+			p.seen[v.Pointer()] = &s
+		}
+		for i := range s {
+			s[i] = p.perlify(v.Index(i))
+		}
+		return &s
+
+	case reflect.Ptr:
+		if v.IsNil() {
+			return &PerlUndef{}
+		}
+	}
+
+	return v.Interface()
+}
@@ -0,0 +1,78 @@
+package sereal
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+)
+
+// A Number is a number decoded as its decimal text, as with
+// Decoder.UseNumber, so that its exact value survives until it is needed.
+// It is encoded back as json.Number is, both by Encoders and by
+// encoding/json.
+type Number string
+
+// String returns the text of n
+func (n Number) String() string { return string(n) }
+
+// Float64 returns n as a float64
+func (n Number) Float64() (float64, error) {
+	return strconv.ParseFloat(string(n), 64)
+}
+
+// Int64 returns n as an int64
+func (n Number) Int64() (int64, error) {
+	return strconv.ParseInt(string(n), 10, 64)
+}
+
+// Uint64 returns n as a uint64, for the integers beyond the range of int64
+// Sereal varints can hold
+func (n Number) Uint64() (uint64, error) {
+	return strconv.ParseUint(string(n), 10, 64)
+}
+
+// MarshalJSON writes n as a JSON number literal, failing if it isn't one
+func (n Number) MarshalJSON() ([]byte, error) {
+	return json.Marshal(json.Number(n))
+}
+
+var numberType = reflect.TypeOf(Number(""))
+
+// decodeNumber decodes the number whose tag is tag, its payload starting at
+// by[idx], into its decimal text. Floats are written with as few digits as
+// read back the same float.
+func (d *decoder) decodeNumber(by []byte, idx int, tag byte) (Number, int, error) {
+	switch {
+	case tag < typeVARINT:
+		return Number(strconv.Itoa(d.decodeInt(tag))), idx, nil
+
+	case tag == typeVARINT:
+		i, idx, err := d.decodeVarint(by, idx)
+		return Number(strconv.FormatUint(uint64(uint(i)), 10)), idx, err
+
+	case tag == typeZIGZAG:
+		i, idx, err := d.decodeZigzag(by, idx)
+		return Number(strconv.Itoa(i)), idx, err
+
+	case tag == typeFLOAT:
+		f, idx, err := d.decodeFloat(by, idx)
+		return Number(strconv.FormatFloat(float64(f), 'g', -1, 32)), idx, err
+
+	case tag == typeDOUBLE:
+		f, idx, err := d.decodeDouble(by, idx)
+		return Number(strconv.FormatFloat(f, 'g', -1, 64)), idx, err
+
+	case tag == typeLONG_DOUBLE:
+		if idx+15 >= len(by) {
+			return "", 0, ErrTruncated
+		}
+		x, nan := longDouble(by[idx:])
+		if nan {
+			return "NaN", idx + 16, nil
+		}
+		return Number(x.Text('g', -1)), idx + 16, nil
+	}
+
+	return "", 0, fmt.Errorf("sereal: can't decode tag 0x%x into a Number", tag)
+}
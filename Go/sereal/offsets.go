@@ -0,0 +1,170 @@
+package sereal
+
+import (
+	"math"
+	"reflect"
+	"strconv"
+)
+
+// A MarshalOption alters the behaviour of a single Marshal call without
+// modifying the Encoder it is invoked on.
+type MarshalOption func(*marshalOptions)
+
+type marshalOptions struct {
+	offsets *OffsetTable
+}
+
+// WithOffsets records into t where the values of the document landed, so
+// that it can be indexed or patched later on without being walked again.
+// Recording costs memory in proportion to the number of values.
+func WithOffsets(t *OffsetTable) MarshalOption {
+	return func(o *marshalOptions) {
+		o.offsets = t
+	}
+}
+
+// An OffsetTable records where the values of a document landed. It is
+// filled in when passed to a Marshal call via WithOffsets.
+//
+// Offsets are those of the tags in the document, or in the document as
+// DecompressDocument returns it if its body is compressed. REFN and WEAKEN
+// tags are transparent: the offset of the value they refer to is recorded
+// instead, as in DecodeReport.
+type OffsetTable struct {
+	// BodyStart is the offset of the body, which converts the offsets of
+	// the body into those COPY and REFP tags use: offset - BodyStart + 1
+	// for documents of version 2 and up, offset for version 1.
+	BodyStart int
+
+	paths    map[string]int
+	pointers map[uintptr]int
+}
+
+// Path returns the offset of the value at path, in the form of
+// DecodeReport, e.g. "body.users[2].name" or "header"
+func (t *OffsetTable) Path(path string) (int, bool) {
+	offs, ok := t.paths[path]
+	return offs, ok
+}
+
+// Pointer returns the offset of the value p refers to, a pointer the body
+// was encoded from
+func (t *OffsetTable) Pointer(p interface{}) (int, bool) {
+	rv := reflect.ValueOf(p)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return 0, false
+	}
+
+	offs, ok := t.pointers[rv.Pointer()]
+	return offs, ok
+}
+
+// Len returns the number of values recorded by path
+func (t *OffsetTable) Len() int { return len(t.paths) }
+
+// reset prepares t for a new document
+func (t *OffsetTable) reset() {
+	t.BodyStart = 0
+	t.paths = make(map[string]int)
+	t.pointers = make(map[uintptr]int)
+}
+
+// record walks the section by, whose root value starts at by[idx] and whose
+// first byte lies at offset base of the document, recording the offset of
+// every value under its path
+func (t *OffsetTable) record(by []byte, idx int, base int, section string) error {
+	dec := &decoder{Decoder: &Decoder{}, sectionStart: idx}
+	_, err := t.walk(dec, by, idx, base, section)
+	return err
+}
+
+// recordBody records the offsets of the body by, whose root value starts at
+// by[idx] and at offset bodyStart of the document, and of the pointers of
+// ptrTable it was encoded from
+func (t *OffsetTable) recordBody(by []byte, idx int, bodyStart int, ptrTable map[uintptr]int) error {
+	t.BodyStart = bodyStart
+	t.recordPointers(by, bodyStart-idx, ptrTable)
+	return t.record(by, idx, bodyStart-idx, "body")
+}
+
+// recordPointers records the offsets of ptrTable, relative to the section
+// by whose first byte lies at offset base of the document
+func (t *OffsetTable) recordPointers(by []byte, base int, ptrTable map[uintptr]int) {
+	for p, offs := range ptrTable {
+		for offs < len(by) && (by[offs]&^trackFlag == typeREFN || by[offs]&^trackFlag == typeWEAKEN) {
+			offs++
+		}
+		t.pointers[p] = base + offs
+	}
+}
+
+func (t *OffsetTable) walk(dec *decoder, by []byte, idx int, base int, path string) (int, error) {
+	idx = skipPads(by, idx)
+	if idx >= len(by) {
+		return 0, ErrTruncated
+	}
+
+	tag := by[idx] &^ trackFlag
+	if tag == typeREFN || tag == typeWEAKEN {
+		return t.walk(dec, by, idx+1, base, path)
+	}
+
+	start := idx
+	defer func() { t.paths[path] = base + start }()
+
+	var n int
+	switch {
+	case tag == typeARRAY, tag == typeHASH:
+		ln, sz, err := varintdecode(by[idx+1:])
+		if err != nil {
+			return 0, err
+		}
+		if ln < 0 || ln > math.MaxInt32 {
+			if tag == typeHASH {
+				return 0, ErrCorrupt{ErrBadHashSize}
+			}
+			return 0, ErrCorrupt{ErrBadSliceSize}
+		}
+		n, idx = ln, idx+1+sz
+
+	case tag >= typeARRAYREF_0 && tag < typeARRAYREF_0+16, tag >= typeHASHREF_0 && tag < typeHASHREF_0+16:
+		n, idx = int(tag&0x0f), idx+1
+
+	case tag == typeOBJECT, tag == typeOBJECT_FREEZE:
+		end, err := skipValue(by, idx+1)
+		if err != nil {
+			return 0, err
+		}
+		return t.walk(dec, by, end, base, path)
+
+	case tag == typeOBJECTV, tag == typeOBJECTV_FREEZE:
+		_, sz, err := varintdecode(by[idx+1:])
+		if err != nil {
+			return 0, err
+		}
+		return t.walk(dec, by, idx+1+sz, base, path)
+
+	default:
+		return skipValue(by, idx)
+	}
+
+	isHash := tag == typeHASH || tag >= typeHASHREF_0 && tag < typeHASHREF_0+16
+
+	var err error
+	for i := 0; i < n; i++ {
+		p := path + "[" + strconv.Itoa(i) + "]"
+		if isHash {
+			var key []byte
+			if key, idx, err = dec.decodeStringish(by, idx); err != nil {
+				return 0, err
+			}
+			p = path + "." + string(key)
+		}
+
+		if idx, err = t.walk(dec, by, idx, base, p); err != nil {
+			return 0, err
+		}
+	}
+
+	return idx, nil
+}
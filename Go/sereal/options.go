@@ -0,0 +1,257 @@
+package sereal
+
+import (
+	"errors"
+	"fmt"
+)
+
+// OptionsVersion is the version of the EncoderOptions and DecoderOptions
+// layout understood by this package. Options with a higher version were
+// written for a newer release and are rejected rather than half-applied.
+const OptionsVersion = 1
+
+// EncoderOptions describes the configuration of an Encoder in a form that
+// can be stored in configuration files. The zero value of every field but
+// Version selects the default of NewEncoderV3.
+type EncoderOptions struct {
+	Version              int    `json:"version" yaml:"version"`
+	ProtocolVersion      int    `json:"protocol_version,omitempty" yaml:"protocol_version,omitempty"`
+	PerlCompat           bool   `json:"perl_compat,omitempty" yaml:"perl_compat,omitempty"`
+	Compression          string `json:"compression,omitempty" yaml:"compression,omitempty"` // "", "snappy", "snappy_incr", "zlib" or "zstd"
+	CompressionLevel     int    `json:"compression_level,omitempty" yaml:"compression_level,omitempty"`
+	SnappyCodec          string `json:"snappy_codec,omitempty" yaml:"snappy_codec,omitempty"` // name given to RegisterSnappyCodec, "go" by default
+	CompressionThreshold *int   `json:"compression_threshold,omitempty" yaml:"compression_threshold,omitempty"`
+	DisableDedup         bool   `json:"disable_dedup,omitempty" yaml:"disable_dedup,omitempty"`
+	DedupMinLength       int    `json:"dedup_min_length,omitempty" yaml:"dedup_min_length,omitempty"`
+	DedupMaxEntries      int    `json:"dedup_max_entries,omitempty" yaml:"dedup_max_entries,omitempty"`
+	DisableFREEZE        bool   `json:"disable_freeze,omitempty" yaml:"disable_freeze,omitempty"`
+	ExpectedSize         uint   `json:"expected_size,omitempty" yaml:"expected_size,omitempty"`
+	StructAsMap          bool   `json:"struct_as_map,omitempty" yaml:"struct_as_map,omitempty"`
+	CanonicalFloats      bool   `json:"canonical_floats,omitempty" yaml:"canonical_floats,omitempty"`
+	Canonical            bool   `json:"canonical,omitempty" yaml:"canonical,omitempty"`
+	BoolsAsInts          bool   `json:"bools_as_ints,omitempty" yaml:"bools_as_ints,omitempty"`
+	ValidateUTF8         bool   `json:"validate_utf8,omitempty" yaml:"validate_utf8,omitempty"`
+	TimeFormat           string `json:"time_format,omitempty" yaml:"time_format,omitempty"` // "", "freeze", "epoch" or "rfc3339"
+	BigFormat            string `json:"big_format,omitempty" yaml:"big_format,omitempty"`   // "", "string" or "freeze"
+	StringMode           string `json:"string_mode,omitempty" yaml:"string_mode,omitempty"` // "", "utf8", "binary" or "auto"
+}
+
+// DecoderOptions describes the configuration of a Decoder in a form that can
+// be stored in configuration files. Settings which can't be serialized, such
+// as Logger or DictionaryResolver, must still be set on the Decoder.
+type DecoderOptions struct {
+	Version              int    `json:"version" yaml:"version"`
+	PerlCompat           bool   `json:"perl_compat,omitempty" yaml:"perl_compat,omitempty"`
+	TolerantSnappyLength bool   `json:"tolerant_snappy_length,omitempty" yaml:"tolerant_snappy_length,omitempty"`
+	SnappyCodec          string `json:"snappy_codec,omitempty" yaml:"snappy_codec,omitempty"` // name given to RegisterSnappyCodec, "go" by default
+	MaxCopyDepth         int    `json:"max_copy_depth,omitempty" yaml:"max_copy_depth,omitempty"`
+	ClassIntoMaps        bool   `json:"class_into_maps,omitempty" yaml:"class_into_maps,omitempty"`
+	PoolMapValues        bool   `json:"pool_map_values,omitempty" yaml:"pool_map_values,omitempty"`
+	DeprecatedTitleMatch *bool  `json:"deprecated_title_match,omitempty" yaml:"deprecated_title_match,omitempty"`
+	UndefAsZero          bool   `json:"undef_as_zero,omitempty" yaml:"undef_as_zero,omitempty"`
+	AliasInput           bool   `json:"alias_input,omitempty" yaml:"alias_input,omitempty"`
+	Strict               bool   `json:"strict,omitempty" yaml:"strict,omitempty"`
+	KeyMatch             string `json:"key_match,omitempty" yaml:"key_match,omitempty"` // "", "exact", "case_insensitive" or "snake_case"
+	CoerceBools          bool   `json:"coerce_bools,omitempty" yaml:"coerce_bools,omitempty"`
+	UseNumber            bool   `json:"use_number,omitempty" yaml:"use_number,omitempty"`
+	TranslateRegexps     bool   `json:"translate_regexps,omitempty" yaml:"translate_regexps,omitempty"`
+	ValidateUTF8         bool   `json:"validate_utf8,omitempty" yaml:"validate_utf8,omitempty"`
+	BinaryAsString       bool   `json:"binary_as_string,omitempty" yaml:"binary_as_string,omitempty"`
+	ArrayOverflowPolicy  string `json:"array_overflow_policy,omitempty" yaml:"array_overflow_policy,omitempty"` // "", "discard" or "error"
+}
+
+func checkOptionsVersion(v int) error {
+	if v < 1 || v > OptionsVersion {
+		return fmt.Errorf("sereal: unsupported options version %d (want 1 to %d)", v, OptionsVersion)
+	}
+	return nil
+}
+
+// problems collects the problems found with a configuration, so that they
+// are all reported at once
+type problems []error
+
+func (p *problems) add(err error) {
+	if err != nil {
+		*p = append(*p, err)
+	}
+}
+
+// err returns an OptionsError listing the problems, nil if there are none
+func (p problems) err() error {
+	if len(p) == 0 {
+		return nil
+	}
+	return &OptionsError{Problems: p}
+}
+
+// Validate reports every problem found with the options in a single
+// OptionsError
+func (o EncoderOptions) Validate() error {
+	var p problems
+	p.add(checkOptionsVersion(o.Version))
+
+	protocol := o.ProtocolVersion
+	if protocol < 0 || protocol > MaxSupportedVersion {
+		p.add(fmt.Errorf("sereal: unsupported protocol version %d", protocol))
+	}
+	if protocol == 0 {
+		protocol = ProtocolVersion
+	}
+
+	switch o.Compression {
+	case "":
+	case "snappy":
+		if protocol > 1 {
+			p.add(ErrBadSnappy)
+		}
+	case "snappy_incr":
+	case "zlib":
+		if protocol < 3 {
+			p.add(ErrBadZlibV3)
+		}
+		if o.CompressionLevel != 0 && (o.CompressionLevel < ZlibDefaultCompression || o.CompressionLevel > ZlibBestCompression) {
+			p.add(fmt.Errorf("sereal: bad zlib compression level %d", o.CompressionLevel))
+		}
+	case "zstd":
+		if protocol < 4 {
+			p.add(ErrBadZstdV4)
+		}
+		if o.CompressionLevel != 0 && (o.CompressionLevel < ZstdBestSpeed || o.CompressionLevel > ZstdBestCompression) {
+			p.add(fmt.Errorf("sereal: bad zstd compression level %d", o.CompressionLevel))
+		}
+	default:
+		p.add(fmt.Errorf("sereal: unknown compression %q", o.Compression))
+	}
+
+	if o.CompressionLevel != 0 && o.Compression != "zlib" && o.Compression != "zstd" {
+		p.add(errors.New("sereal: compression level is only valid for zlib and zstd"))
+	}
+
+	if o.SnappyCodec != "" && o.Compression != "snappy" && o.Compression != "snappy_incr" {
+		p.add(errors.New("sereal: snappy codec is only valid for snappy compression"))
+	}
+
+	_, err := LookupSnappyCodec(o.SnappyCodec)
+	p.add(err)
+
+	if o.CompressionThreshold != nil && *o.CompressionThreshold < 0 {
+		p.add(fmt.Errorf("sereal: negative compression threshold %d", *o.CompressionThreshold))
+	}
+
+	if o.DedupMinLength < 0 {
+		p.add(fmt.Errorf("sereal: negative dedup min length %d", o.DedupMinLength))
+	}
+
+	if o.DedupMaxEntries < 0 {
+		p.add(fmt.Errorf("sereal: negative dedup max entries %d", o.DedupMaxEntries))
+	}
+
+	_, err = parseTimeFormat(o.TimeFormat)
+	p.add(err)
+
+	_, err = parseBigFormat(o.BigFormat)
+	p.add(err)
+
+	_, err = parseStringMode(o.StringMode)
+	p.add(err)
+
+	return p.err()
+}
+
+// NewEncoder validates the options and returns an Encoder configured with them
+func (o EncoderOptions) NewEncoder() (*Encoder, error) {
+	if err := o.Validate(); err != nil {
+		return nil, err
+	}
+
+	e := NewEncoderV3()
+	if o.ProtocolVersion != 0 {
+		e.version = o.ProtocolVersion
+	}
+
+	codec, _ := LookupSnappyCodec(o.SnappyCodec)
+
+	switch o.Compression {
+	case "snappy":
+		e.Compression = SnappyCompressor{Incremental: false, Codec: codec}
+	case "snappy_incr":
+		e.Compression = SnappyCompressor{Incremental: true, Codec: codec}
+	case "zlib":
+		e.Compression = ZlibCompressor{Level: o.CompressionLevel}
+	case "zstd":
+		e.Compression = ZstdCompressor{Level: o.CompressionLevel}
+	}
+
+	if o.CompressionThreshold != nil {
+		e.CompressionThreshold = *o.CompressionThreshold
+	}
+
+	e.PerlCompat = o.PerlCompat
+	e.DisableDedup = o.DisableDedup
+	e.DedupMinLength = o.DedupMinLength
+	e.DedupMaxEntries = o.DedupMaxEntries
+	e.DisableFREEZE = o.DisableFREEZE
+	e.ExpectedSize = o.ExpectedSize
+	e.StructAsMap = o.StructAsMap
+	e.CanonicalFloats = o.CanonicalFloats
+	e.Canonical = o.Canonical
+	e.BoolsAsInts = o.BoolsAsInts
+	e.ValidateUTF8 = o.ValidateUTF8
+	e.TimeFormat, _ = parseTimeFormat(o.TimeFormat)
+	e.BigFormat, _ = parseBigFormat(o.BigFormat)
+	e.StringMode, _ = parseStringMode(o.StringMode)
+
+	return e, nil
+}
+
+// Validate reports every problem found with the options in a single
+// OptionsError
+func (o DecoderOptions) Validate() error {
+	var p problems
+	p.add(checkOptionsVersion(o.Version))
+
+	if o.MaxCopyDepth < 0 {
+		p.add(fmt.Errorf("sereal: negative max copy depth %d", o.MaxCopyDepth))
+	}
+
+	_, err := LookupSnappyCodec(o.SnappyCodec)
+	p.add(err)
+
+	if _, ok := keyMatchers[o.KeyMatch]; o.KeyMatch != "" && !ok {
+		p.add(fmt.Errorf("sereal: unknown key match %q", o.KeyMatch))
+	}
+
+	_, err = parseArrayOverflowPolicy(o.ArrayOverflowPolicy)
+	p.add(err)
+
+	return p.err()
+}
+
+// NewDecoder validates the options and returns a Decoder configured with them
+func (o DecoderOptions) NewDecoder() (*Decoder, error) {
+	if err := o.Validate(); err != nil {
+		return nil, err
+	}
+
+	d := NewDecoder()
+	d.PerlCompat = o.PerlCompat
+	d.TolerantSnappyLength = o.TolerantSnappyLength
+	d.SnappyCodec, _ = LookupSnappyCodec(o.SnappyCodec)
+	d.MaxCopyDepth = o.MaxCopyDepth
+	d.ClassIntoMaps = o.ClassIntoMaps
+	d.PoolMapValues = o.PoolMapValues
+	d.DeprecatedTitleMatch = o.DeprecatedTitleMatch
+	d.UndefAsZero = o.UndefAsZero
+	d.AliasInput = o.AliasInput
+	d.Strict = o.Strict
+	d.KeyMatcher = keyMatchers[o.KeyMatch]
+	d.CoerceBools = o.CoerceBools
+	d.UseNumber = o.UseNumber
+	d.TranslateRegexps = o.TranslateRegexps
+	d.ValidateUTF8 = o.ValidateUTF8
+	d.BinaryAsString = o.BinaryAsString
+	d.ArrayOverflowPolicy, _ = parseArrayOverflowPolicy(o.ArrayOverflowPolicy)
+
+	return d, nil
+}
@@ -0,0 +1,127 @@
+package sereal
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// An OrderedHash is a hash whose entries are encoded in the order Range
+// visits them, whether the Encoder is Canonical or not
+type OrderedHash interface {
+	Len() int
+	Range(f func(key string, value interface{}) bool)
+}
+
+// OrderedMap is a map from strings which keeps its keys in insertion order.
+// It is an OrderedHash, and hashes decoded into it keep the order of the
+// document. The zero value is an empty map ready to use.
+type OrderedMap struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+var orderedMapType = reflect.TypeOf(OrderedMap{})
+
+// NewOrderedMap returns an empty OrderedMap
+func NewOrderedMap() *OrderedMap {
+	return &OrderedMap{}
+}
+
+// Set sets the value of key. New keys are added after the existing ones,
+// existing keys keep their position.
+func (m *OrderedMap) Set(key string, value interface{}) {
+	if m.values == nil {
+		m.values = make(map[string]interface{})
+	}
+	if _, ok := m.values[key]; !ok {
+		m.keys = append(m.keys, key)
+	}
+	m.values[key] = value
+}
+
+// Get returns the value of key, and whether it is set
+func (m OrderedMap) Get(key string) (interface{}, bool) {
+	v, ok := m.values[key]
+	return v, ok
+}
+
+// Delete removes key
+func (m *OrderedMap) Delete(key string) {
+	if _, ok := m.values[key]; !ok {
+		return
+	}
+	delete(m.values, key)
+	for i, k := range m.keys {
+		if k == key {
+			m.keys = append(m.keys[:i], m.keys[i+1:]...)
+			break
+		}
+	}
+}
+
+// Keys returns the keys in insertion order
+func (m OrderedMap) Keys() []string {
+	return append([]string(nil), m.keys...)
+}
+
+// Len returns the number of keys
+func (m OrderedMap) Len() int {
+	return len(m.keys)
+}
+
+// Range calls f for each key and value in insertion order, until f returns
+// false
+func (m OrderedMap) Range(f func(key string, value interface{}) bool) {
+	for _, k := range m.keys {
+		if !f(k, m.values[k]) {
+			return
+		}
+	}
+}
+
+func (e *Encoder) encodeOrderedHash(by []byte, h OrderedHash, isRefNext bool, strTable map[string]int, ptrTable map[uintptr]int) ([]byte, error) {
+	n := h.Len()
+	by = e.containerHead(by, typeHASH, n, isRefNext)
+
+	var err error
+	i := 0
+	h.Range(func(key string, value interface{}) bool {
+		if i++; i > n {
+			return false
+		}
+		by = e.encodeString(by, key, true, strTable)
+		by, err = e.encode(by, value, false, false, strTable, ptrTable)
+		return err == nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	if i != n {
+		return nil, fmt.Errorf("sereal: %T ranged over %d entries, want %d", h, i, n)
+	}
+
+	return by, nil
+}
+
+// decodeOrderedMap appends the ln entries of a hash to m in document order
+func (d *decoder) decodeOrderedMap(by []byte, idx int, ln int, m *OrderedMap) (int, error) {
+	var err error
+	for i := 0; i < ln; i++ {
+		var key []byte
+		if key, idx, err = d.decodeStringish(by, idx); err != nil {
+			return 0, err
+		}
+
+		var value interface{}
+		d.pushKey(key)
+		if idx, err = d.decode(by, idx, &value); err != nil {
+			return 0, d.keyError(err, key)
+		}
+		d.popPath()
+
+		m.Set(string(key), value)
+	}
+
+	return idx, nil
+}
@@ -0,0 +1,505 @@
+package sereal
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// A Path is a query selecting values of the body of a document, in the
+// syntax of Perl's Sereal::Path:
+//
+//	$                  the root value
+//	.key or ['key']    the value of a hash entry, keys being quoted with ' or "
+//	[n]                an array element, negative indices counting from the end
+//	.* or [*]          every element of an array or value of a hash
+//	['a','b'] or [1,3] several entries or elements
+//	[start:end:step]   a slice of an array, as in Python
+//	..key or ..[...]   recursive descent: the subscript applied to the value
+//	                   and to every array and hash it contains
+//
+// Queries go through references, blessed objects and the values shared with
+// COPY, REFP and ALIAS tags. Recursive descent goes into each shared value
+// once, which also ends cycles.
+type Path struct {
+	expr  string
+	steps []pathStep
+}
+
+// pathStep is a subscript of a Path. A step with keys and indices selects
+// the former in hashes and the latter in arrays.
+type pathStep struct {
+	recursive bool
+	wildcard  bool
+	keys      []string
+	indices   []int
+	slice     *pathSlice
+}
+
+type pathSlice struct {
+	start, end, step int
+	hasStart, hasEnd bool
+}
+
+// CompilePath parses a Sereal::Path query
+func CompilePath(expr string) (*Path, error) {
+	p := &Path{expr: expr}
+	if !strings.HasPrefix(expr, "$") {
+		return nil, p.errorf(0, "expected $")
+	}
+
+	for i := 1; i < len(expr); {
+		switch expr[i] {
+		case '.':
+			i++
+			recursive := i < len(expr) && expr[i] == '.'
+			if recursive {
+				i++
+			}
+
+			switch {
+			case recursive && i < len(expr) && expr[i] == '[':
+				step, next, err := p.subscript(i + 1)
+				if err != nil {
+					return nil, err
+				}
+				step.recursive = true
+				p.steps = append(p.steps, step)
+				i = next
+				continue
+			case i < len(expr) && expr[i] == '*':
+				p.steps = append(p.steps, pathStep{recursive: recursive, wildcard: true})
+				i++
+				continue
+			}
+
+			j := i
+			for j < len(expr) && expr[j] != '.' && expr[j] != '[' && expr[j] != ']' {
+				j++
+			}
+			if j == i {
+				return nil, p.errorf(i, "expected a key")
+			}
+			p.steps = append(p.steps, pathStep{recursive: recursive, keys: []string{expr[i:j]}})
+			i = j
+
+		case '[':
+			step, next, err := p.subscript(i + 1)
+			if err != nil {
+				return nil, err
+			}
+			p.steps = append(p.steps, step)
+			i = next
+
+		default:
+			return nil, p.errorf(i, "unexpected %q", expr[i])
+		}
+	}
+
+	return p, nil
+}
+
+// MustCompilePath is CompilePath panicking if expr can't be parsed, for
+// the initialization of global variables
+func MustCompilePath(expr string) *Path {
+	p, err := CompilePath(expr)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+func (p *Path) String() string { return p.expr }
+
+func (p *Path) errorf(pos int, format string, args ...interface{}) error {
+	return fmt.Errorf("sereal: bad path %q at %d: %s", p.expr, pos, fmt.Sprintf(format, args...))
+}
+
+// subscript parses the subscript starting at expr[i], after its opening
+// bracket, and returns the offset following its closing bracket
+func (p *Path) subscript(i int) (pathStep, int, error) {
+	var step pathStep
+	expr := p.expr
+
+	skipSpaces := func() {
+		for i < len(expr) && expr[i] == ' ' {
+			i++
+		}
+	}
+
+	skipSpaces()
+	if i < len(expr) && expr[i] == '*' {
+		i++
+		skipSpaces()
+		if i >= len(expr) || expr[i] != ']' {
+			return step, 0, p.errorf(i, "expected ]")
+		}
+		return pathStep{wildcard: true}, i + 1, nil
+	}
+
+	for {
+		skipSpaces()
+		if i >= len(expr) {
+			return step, 0, p.errorf(i, "unterminated subscript")
+		}
+
+		switch c := expr[i]; {
+		case c == '\'' || c == '"':
+			var key strings.Builder
+			for i++; i < len(expr) && expr[i] != c; i++ {
+				if expr[i] == '\\' && i+1 < len(expr) {
+					i++
+				}
+				key.WriteByte(expr[i])
+			}
+			if i >= len(expr) {
+				return step, 0, p.errorf(i, "unterminated key")
+			}
+			step.keys = append(step.keys, key.String())
+			i++
+
+		default:
+			j := i
+			for j < len(expr) && expr[j] != ',' && expr[j] != ']' {
+				j++
+			}
+			item := strings.TrimSpace(expr[i:j])
+
+			if strings.Contains(item, ":") {
+				if len(step.keys) > 0 || len(step.indices) > 0 || (j < len(expr) && expr[j] == ',') {
+					return step, 0, p.errorf(i, "slices can't be part of a union")
+				}
+				slice, err := parseSlice(item)
+				if err != nil {
+					return step, 0, p.errorf(i, "%v", err)
+				}
+				step.slice = slice
+			} else {
+				n, err := strconv.Atoi(item)
+				if err != nil {
+					return step, 0, p.errorf(i, "bad index %q", item)
+				}
+				step.indices = append(step.indices, n)
+			}
+			i = j
+		}
+
+		skipSpaces()
+		if i >= len(expr) {
+			return step, 0, p.errorf(i, "unterminated subscript")
+		}
+		if expr[i] == ']' {
+			return step, i + 1, nil
+		}
+		if expr[i] != ',' {
+			return step, 0, p.errorf(i, "expected , or ]")
+		}
+		i++
+	}
+}
+
+// parseSlice parses start:end:step, every part being optional
+func parseSlice(s string) (*pathSlice, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) > 3 {
+		return nil, fmt.Errorf("bad slice %q", s)
+	}
+
+	slice := &pathSlice{step: 1}
+	for i, part := range parts {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return nil, fmt.Errorf("bad slice %q", s)
+		}
+
+		switch i {
+		case 0:
+			slice.start, slice.hasStart = n, true
+		case 1:
+			slice.end, slice.hasEnd = n, true
+		case 2:
+			if n == 0 {
+				return nil, fmt.Errorf("slice step can't be 0")
+			}
+			slice.step = n
+		}
+	}
+
+	return slice, nil
+}
+
+// indices returns the indices of the slice of an array of n elements
+func (s *pathSlice) indices(n int) []int {
+	clamp := func(i int, lo, hi int) int {
+		if i < 0 {
+			i += n
+		}
+		if i < lo {
+			return lo
+		}
+		if i > hi {
+			return hi
+		}
+		return i
+	}
+
+	var res []int
+	if s.step > 0 {
+		start, end := 0, n
+		if s.hasStart {
+			start = clamp(s.start, 0, n)
+		}
+		if s.hasEnd {
+			end = clamp(s.end, 0, n)
+		}
+		for i := start; i < end; i += s.step {
+			res = append(res, i)
+		}
+		return res
+	}
+
+	start, end := n-1, -1
+	if s.hasStart {
+		start = clamp(s.start, -1, n-1)
+	}
+	if s.hasEnd {
+		end = clamp(s.end, -1, n-1)
+	}
+	for i := start; i > end; i += s.step {
+		res = append(res, i)
+	}
+	return res
+}
+
+// Query returns the values of the body of b selected by p, decoded with the
+// default decoder
+func (p *Path) Query(b []byte) ([]interface{}, error) {
+	return NewDecoder().Query(b, p)
+}
+
+// Query returns the values of the body of b selected by p, in document order
+// for wildcards and slices and in the order of the subscript for unions.
+// Only the values selected are decoded, as by Unmarshal into an
+// interface{}, along with the tracked values they refer to.
+func (d *Decoder) Query(b []byte, p *Path) (vals []interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(runtime.Error); ok {
+				panic(r)
+			}
+
+			switch t := r.(type) {
+			case string:
+				err = errors.New(t)
+			case error:
+				err = t
+			}
+		}
+	}()
+
+	dec, by, idx, err := d.bodyDecoder(b)
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := []int{idx}
+	for _, step := range p.steps {
+		if step.recursive {
+			if nodes, err = dec.descendants(by, nodes); err != nil {
+				return nil, err
+			}
+		}
+
+		var next []int
+		for _, idx := range nodes {
+			if next, err = dec.selectPath(by, idx, step, next); err != nil {
+				return nil, err
+			}
+		}
+		nodes = next
+	}
+
+	for _, idx := range nodes {
+		v, err := dec.decodeAt(by, idx)
+		if err != nil {
+			return nil, err
+		}
+		vals = append(vals, v)
+	}
+
+	return vals, nil
+}
+
+// selectPath appends to res the offsets of the values selected by step in
+// the array or hash the value at by[idx] stands for. Other values have
+// nothing to select.
+func (d *decoder) selectPath(by []byte, idx int, step pathStep, res []int) ([]int, error) {
+	idx, err := d.container(by, idx)
+	if err != nil {
+		return nil, err
+	}
+
+	tag := by[idx] &^ trackFlag
+	var n int
+	switch {
+	case tag == typeARRAY, tag == typeHASH:
+		ln, sz, err := varintdecode(by[idx+1:])
+		if err != nil {
+			return nil, err
+		}
+		if ln < 0 || ln > math.MaxInt32 {
+			if tag == typeHASH {
+				return nil, ErrCorrupt{ErrBadHashSize}
+			}
+			return nil, ErrCorrupt{ErrBadSliceSize}
+		}
+		n, idx = ln, idx+1+sz
+
+	case tag >= typeARRAYREF_0 && tag < typeARRAYREF_0+16, tag >= typeHASHREF_0 && tag < typeHASHREF_0+16:
+		n, idx = int(tag&0x0f), idx+1
+
+	default:
+		return res, nil
+	}
+
+	if tag == typeHASH || tag >= typeHASHREF_0 && tag < typeHASHREF_0+16 {
+		keys := make([]string, n)
+		values := make([]int, n)
+		for i := 0; i < n; i++ {
+			key, next, err := d.decodeStringish(by, idx)
+			if err != nil {
+				return nil, err
+			}
+			keys[i], values[i] = string(key), next
+			if idx, err = skipValue(by, next); err != nil {
+				return nil, err
+			}
+		}
+
+		if step.wildcard {
+			return append(res, values...), nil
+		}
+		for _, k := range step.keys {
+			for i := n - 1; i >= 0; i-- {
+				if keys[i] == k {
+					res = append(res, values[i])
+					break
+				}
+			}
+		}
+		return res, nil
+	}
+
+	elems := make([]int, n)
+	for i := 0; i < n; i++ {
+		elems[i] = idx
+		if idx, err = skipValue(by, idx); err != nil {
+			return nil, err
+		}
+	}
+
+	switch {
+	case step.wildcard:
+		return append(res, elems...), nil
+	case step.slice != nil:
+		for _, i := range step.slice.indices(n) {
+			res = append(res, elems[i])
+		}
+	}
+	for _, i := range step.indices {
+		if i < 0 {
+			i += n
+		}
+		if i >= 0 && i < n {
+			res = append(res, elems[i])
+		}
+	}
+	return res, nil
+}
+
+// descendants returns the offsets of the values at by[idx] for each idx of
+// nodes and of the values they contain, in document order. Values reached
+// several times, through shared values or cycles, are only returned once.
+func (d *decoder) descendants(by []byte, nodes []int) ([]int, error) {
+	var res []int
+	seen := make(map[int]bool)
+	for _, root := range nodes {
+		stack := []int{root}
+		for len(stack) > 0 {
+			idx, err := d.container(by, stack[len(stack)-1])
+			stack = stack[:len(stack)-1]
+			if err != nil {
+				return nil, err
+			}
+			if seen[idx] {
+				continue
+			}
+			seen[idx] = true
+			res = append(res, idx)
+
+			elems, err := d.selectPath(by, idx, pathStep{wildcard: true}, nil)
+			if err != nil {
+				return nil, err
+			}
+			for i := len(elems) - 1; i >= 0; i-- {
+				stack = append(stack, elems[i])
+			}
+		}
+	}
+	return res, nil
+}
+
+// container returns the offset of the value the value at by[idx] stands for
+// once references, objects and copies have been gone through
+func (d *decoder) container(by []byte, idx int) (int, error) {
+	// references can form cycles: stop once there have been more hops than
+	// bytes
+	for hops := 0; hops <= len(by); hops++ {
+		idx = skipPads(by, idx)
+		if idx >= len(by) {
+			return 0, ErrTruncated
+		}
+
+		switch tag := by[idx] &^ trackFlag; tag {
+		case typeREFN, typeWEAKEN:
+			idx++
+
+		case typeCOPY, typeREFP, typeALIAS:
+			offs, _, err := varintdecode(by[idx+1:])
+			if err != nil {
+				return 0, err
+			}
+			if err := d.checkOffset(offs, idx); err != nil {
+				return 0, err
+			}
+			idx = offs
+
+		case typeOBJECT, typeOBJECT_FREEZE:
+			end, err := skipValue(by, idx+1)
+			if err != nil {
+				return 0, err
+			}
+			idx = end
+
+		case typeOBJECTV, typeOBJECTV_FREEZE:
+			_, sz, err := varintdecode(by[idx+1:])
+			if err != nil {
+				return 0, err
+			}
+			idx += 1 + sz
+
+		default:
+			return idx, nil
+		}
+	}
+
+	return idx, nil
+}
@@ -8,7 +8,9 @@ type PerlObject struct {
 	Reference interface{}
 }
 
-// PerlAlias represents an aliased value
+// PerlAlias represents an aliased value. Decoding in PerlCompat mode gives
+// the aliased value and its ALIAS tags the same *PerlAlias, which encodes
+// back into the value followed by ALIAS tags referring to it.
 type PerlAlias struct {
 	Alias interface{}
 }
@@ -36,10 +38,14 @@ func PerlCanonicalUndef() *PerlUndef {
 	return perlCanonicalUndef
 }
 
-// PerlRegexp represents a perl regular expression
+// PerlRegexp represents a perl regular expression. Decoded regular
+// expressions have their Modifiers in the order Perl writes them, and the
+// same modifiers as Flags. When encoding, Flags is only used if Modifiers is
+// nil.
 type PerlRegexp struct {
 	Pattern   []byte
 	Modifiers []byte
+	Flags     RegexpFlags
 }
 
 // PerlFreeze represents an object's custom Freeze implementation
@@ -0,0 +1,299 @@
+package sereal
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// DumpPerl writes v, typically decoded in PerlCompat mode, to w in the
+// notation of Perl's Data::Dumper: references are rendered as anonymous
+// arrays and hashes, PerlObject as bless(), PerlUndef as undef, and so on.
+// Data reached more than once, including through cycles, is rendered the
+// first time only, and then as the expression reaching it, e.g.
+// $VAR1->{'self'}.
+func DumpPerl(w io.Writer, v interface{}) error {
+	_, err := io.WriteString(w, "$VAR1 = "+SprintPerl(v, "$VAR1")+";\n")
+	return err
+}
+
+// SprintPerl returns the rendering of v by DumpPerl, without the assignment.
+// name is the expression the value is reached by, used to render the data
+// reached more than once.
+func SprintPerl(v interface{}, name string) string {
+	p := perlDumper{seen: make(map[uintptr]string)}
+	p.dump(reflect.ValueOf(v), name, 0)
+	return p.sb.String()
+}
+
+type perlDumper struct {
+	sb   strings.Builder
+	seen map[uintptr]string // references already rendered, and the expression reaching them
+}
+
+var (
+	perlObjectType  = reflect.TypeOf(PerlObject{})
+	perlWeakRefType = reflect.TypeOf(PerlWeakRef{})
+	perlAliasType   = reflect.TypeOf(PerlAlias{})
+	perlUndefType   = reflect.TypeOf(PerlUndef{})
+	perlRegexpType  = reflect.TypeOf(PerlRegexp{})
+	perlFreezeType  = reflect.TypeOf(PerlFreeze{})
+)
+
+func (p *perlDumper) indent(depth int) {
+	p.sb.WriteString("\n")
+	p.sb.WriteString(strings.Repeat("  ", depth))
+}
+
+// dump renders v, reached by the expression path
+func (p *perlDumper) dump(v reflect.Value, path string, depth int) {
+	for v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			p.sb.WriteString("undef")
+			return
+		}
+		v = v.Elem()
+	}
+
+	switch v.Kind() {
+	case reflect.Invalid:
+		p.sb.WriteString("undef")
+		return
+
+	case reflect.Ptr, reflect.Map:
+		if v.IsNil() || (v.Kind() == reflect.Ptr && v.Type().Elem() == perlUndefType) {
+			// the canonical undef is shared by all the undefs
+			p.sb.WriteString("undef")
+			return
+		}
+		if prev, ok := p.seen[v.Pointer()]; ok {
+			p.sb.WriteString(prev)
+			return
+		}
+		p.seen[v.Pointer()] = path
+	}
+
+	if v.Kind() == reflect.Ptr {
+		elem := v.Elem()
+		switch elem.Type() {
+		case perlUndefType, perlObjectType, perlWeakRefType, perlAliasType, perlRegexpType, perlFreezeType:
+			v = elem
+		default:
+			// a reference: to a container, rendered as an anonymous one,
+			// or to a scalar
+			for elem.Kind() == reflect.Interface && !elem.IsNil() {
+				elem = elem.Elem()
+			}
+			switch elem.Kind() {
+			case reflect.Slice, reflect.Array, reflect.Map, reflect.Struct:
+				if elem.Kind() != reflect.Slice || elem.Type().Elem().Kind() != reflect.Uint8 {
+					p.dump(elem, path, depth)
+					return
+				}
+			}
+			p.sb.WriteString("\\")
+			p.dump(elem, "${"+path+"}", depth)
+			return
+		}
+	}
+
+	switch v.Type() {
+	case perlUndefType:
+		p.sb.WriteString("undef")
+		return
+
+	case perlObjectType:
+		obj := v.Interface().(PerlObject)
+		p.sb.WriteString("bless( ")
+		p.dump(reflect.ValueOf(obj.Reference), path, depth)
+		p.sb.WriteString(", " + perlQuote([]byte(obj.Class)) + " )")
+		return
+
+	case perlWeakRefType:
+		p.sb.WriteString("weaken( ")
+		p.dump(reflect.ValueOf(v.Interface().(PerlWeakRef).Reference), path, depth)
+		p.sb.WriteString(" )")
+		return
+
+	case perlAliasType:
+		p.dump(reflect.ValueOf(v.Interface().(PerlAlias).Alias), path, depth)
+		return
+
+	case perlRegexpType:
+		re := v.Interface().(PerlRegexp)
+		modifiers, err := re.modifiers()
+		if err != nil {
+			modifiers = re.Modifiers
+		}
+		p.sb.WriteString("qr/" + strings.Replace(string(re.Pattern), "/", "\\/", -1) + "/" + string(modifiers))
+		return
+
+	case perlFreezeType:
+		f := v.Interface().(PerlFreeze)
+		p.sb.WriteString("FREEZE( " + perlQuote([]byte(f.Class)) + ", " + perlQuote(f.Data) + " )")
+		return
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			p.sb.WriteString("!!1")
+		} else {
+			p.sb.WriteString("!!0")
+		}
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		p.sb.WriteString(strconv.FormatInt(v.Int(), 10))
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		p.sb.WriteString(strconv.FormatUint(v.Uint(), 10))
+
+	case reflect.Float32, reflect.Float64:
+		p.sb.WriteString("'" + strconv.FormatFloat(v.Float(), 'g', -1, v.Type().Bits()) + "'")
+
+	case reflect.String:
+		p.sb.WriteString(perlQuote([]byte(v.String())))
+
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(b), v)
+			p.sb.WriteString(perlQuote(b))
+			return
+		}
+
+		if v.Len() == 0 {
+			p.sb.WriteString("[]")
+			return
+		}
+		p.sb.WriteString("[")
+		for i := 0; i < v.Len(); i++ {
+			if i > 0 {
+				p.sb.WriteString(",")
+			}
+			p.indent(depth + 1)
+			p.dump(v.Index(i), path+"->["+strconv.Itoa(i)+"]", depth+1)
+		}
+		p.indent(depth)
+		p.sb.WriteString("]")
+
+	case reflect.Map:
+		keys := v.MapKeys()
+		names := make([]string, len(keys))
+		for i, k := range keys {
+			names[i] = fmt.Sprint(k.Interface())
+			if b, ok := k.Interface().([]byte); ok {
+				names[i] = string(b)
+			}
+		}
+		sort.Sort(byName{names, keys})
+		p.hash(names, func(i int) reflect.Value { return v.MapIndex(keys[i]) }, path, depth)
+
+	case reflect.Struct:
+		var names []string
+		var fields []int
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).PkgPath == "" {
+				names = append(names, v.Type().Field(i).Name)
+				fields = append(fields, i)
+			}
+		}
+		p.hash(names, func(i int) reflect.Value { return v.Field(fields[i]) }, path, depth)
+
+	default:
+		p.sb.WriteString(perlQuote([]byte(fmt.Sprint(v.Interface()))))
+	}
+}
+
+// hash renders the entries of a hash, whose values are returned by value
+func (p *perlDumper) hash(names []string, value func(i int) reflect.Value, path string, depth int) {
+	if len(names) == 0 {
+		p.sb.WriteString("{}")
+		return
+	}
+
+	p.sb.WriteString("{")
+	for i, name := range names {
+		if i > 0 {
+			p.sb.WriteString(",")
+		}
+		key := perlQuote([]byte(name))
+		p.indent(depth + 1)
+		p.sb.WriteString(key + " => ")
+		p.dump(value(i), path+"->{"+key+"}", depth+1)
+	}
+	p.indent(depth)
+	p.sb.WriteString("}")
+}
+
+// byName sorts map keys by their rendering
+type byName struct {
+	names []string
+	keys  []reflect.Value
+}
+
+func (s byName) Len() int           { return len(s.names) }
+func (s byName) Less(i, j int) bool { return s.names[i] < s.names[j] }
+func (s byName) Swap(i, j int) {
+	s.names[i], s.names[j] = s.names[j], s.names[i]
+	s.keys[i], s.keys[j] = s.keys[j], s.keys[i]
+}
+
+// perlQuote returns b as a Perl string literal: single-quoted if it is
+// printable UTF-8, double-quoted with escapes otherwise
+func perlQuote(b []byte) string {
+	printable := utf8.Valid(b)
+	for _, r := range string(b) {
+		if !unicode.IsPrint(r) {
+			printable = false
+			break
+		}
+	}
+
+	if printable {
+		s := strings.Replace(string(b), "\\", "\\\\", -1)
+		return "'" + strings.Replace(s, "'", "\\'", -1) + "'"
+	}
+
+	var sb strings.Builder
+	sb.WriteString("\"")
+	for _, c := range b {
+		switch {
+		case c == '"', c == '\\', c == '$', c == '@':
+			sb.WriteString("\\" + string(c))
+		case c == '\n':
+			sb.WriteString("\\n")
+		case c == '\t':
+			sb.WriteString("\\t")
+		case c >= 0x20 && c < 0x7f:
+			sb.WriteByte(c)
+		default:
+			fmt.Fprintf(&sb, "\\x{%x}", c)
+		}
+	}
+	sb.WriteString("\"")
+	return sb.String()
+}
+
+// String returns the object in the notation of DumpPerl
+func (o PerlObject) String() string { return SprintPerl(o, "$obj") }
+
+// String returns the weak reference in the notation of DumpPerl
+func (w PerlWeakRef) String() string { return SprintPerl(w, "$ref") }
+
+// String returns the alias in the notation of DumpPerl
+func (a PerlAlias) String() string { return SprintPerl(a, "$alias") }
+
+// String returns "undef"
+func (u PerlUndef) String() string { return "undef" }
+
+// String returns the regular expression in the notation of DumpPerl
+func (r PerlRegexp) String() string { return SprintPerl(r, "$re") }
+
+// String returns the frozen object in the notation of DumpPerl
+func (f PerlFreeze) String() string { return SprintPerl(f, "$obj") }
@@ -0,0 +1,61 @@
+package sereal
+
+// The presets below configure encoders and decoders for the most common
+// uses of Sereal. They return ordinary values, which can be adjusted before
+// their first use.
+
+// NewCacheEncoder returns an encoder for values stored in a cache: snappy
+// compresses the larger documents at little CPU cost.
+func NewCacheEncoder() *Encoder {
+	e := NewEncoderV3()
+	e.Compression = SnappyCompressor{Incremental: true}
+	return e
+}
+
+// NewCacheDecoder returns a decoder for values read from a cache, the same
+// types being decoded over and over: the values used to decode map entries
+// are pooled.
+func NewCacheDecoder() *Decoder {
+	d := NewDecoder()
+	d.PoolMapValues = true
+	return d
+}
+
+// NewRPCEncoder returns an encoder for requests and responses exchanged with
+// peers, which are mostly small: only documents above 4096 bytes are
+// compressed, with snappy.
+func NewRPCEncoder() *Encoder {
+	e := NewEncoderV3()
+	e.Compression = SnappyCompressor{Incremental: true}
+	e.CompressionThreshold = 4096
+	return e
+}
+
+// NewRPCDecoder returns a decoder for documents received from peers, which
+// may not be trusted: chains of COPY tags, which no common encoder emits,
+// are rejected.
+func NewRPCDecoder() *Decoder {
+	d := NewDecoder()
+	d.MaxCopyDepth = 1
+	return d
+}
+
+// NewArchiveEncoder returns an encoder for documents kept for a long time:
+// they are as small as zlib can make them, available in every build unlike
+// zstd, and canonical so that equal values are stored as identical
+// documents.
+func NewArchiveEncoder() *Encoder {
+	e := NewEncoderV3()
+	e.Compression = ZlibCompressor{Level: ZlibBestCompression}
+	e.Canonical = true
+	return e
+}
+
+// NewArchiveDecoder returns a decoder for documents kept for a long time,
+// possibly written by old Perl encoders: snappy_incr documents with a wrong
+// compressed length are accepted.
+func NewArchiveDecoder() *Decoder {
+	d := NewDecoder()
+	d.TolerantSnappyLength = true
+	return d
+}
@@ -0,0 +1,96 @@
+package sereal
+
+import "fmt"
+
+// A Profile is a preset Encoder configuration, applied with Encoder.Profile
+type Profile int
+
+const (
+	// ProfileDefault is the configuration of NewEncoderV3
+	ProfileDefault Profile = iota
+
+	// ProfilePerl3x produces the bytes Sereal::Encoder 3.x produces with its
+	// default options for the Perl data Go values are decoded to in
+	// PerlCompat mode: protocol version 3 without compression, hash keys
+	// and class names deduplicated, ARRAYREF and HASHREF tags for arrays and
+	// hashes with less than 16 entries, ASCII strings as binary strings,
+	// floats as doubles and no FREEZE. Values behind pointers are encoded
+	// as references which may be shared: they keep their REFN tag, and
+	// REFP tags refer to the value rather than to the REFN, as Perl does.
+	//
+	// As Perl's hash order isn't deterministic either, only documents
+	// without hashes of more than one key can be compared byte for byte.
+	ProfilePerl3x
+)
+
+func (p Profile) String() string {
+	switch p {
+	case ProfileDefault:
+		return "default"
+	case ProfilePerl3x:
+		return "perl3x"
+	}
+	return fmt.Sprintf("Profile(%d)", int(p))
+}
+
+// Profile resets the configuration of e to the preset p. Classes registered
+// with RegisterClass are kept.
+func (e *Encoder) Profile(p Profile) error {
+	switch p {
+	case ProfileDefault, ProfilePerl3x:
+	default:
+		return fmt.Errorf("sereal: unknown encoder profile %v", p)
+	}
+
+	e.PerlCompat = p == ProfilePerl3x
+	e.Compression = nil
+	e.CompressionThreshold = 1024
+	e.DisableDedup = false
+	e.DedupMinLength = 0
+	e.DedupMaxEntries = 0
+	e.DisableFREEZE = p == ProfilePerl3x
+	e.ExpectedSize = 0
+	e.StructAsMap = false
+	e.CanonicalFloats = p == ProfilePerl3x
+	e.Canonical = false
+	e.KeyEncoder = nil
+	e.BoolsAsInts = false
+	e.ValidateUTF8 = false
+	e.StringMode = StringUTF8
+	if p == ProfilePerl3x {
+		e.StringMode = StringAuto
+	}
+	e.TimeFormat = TimeFREEZE
+	e.BigFormat = BigString
+	e.version = 3
+	e.profile = p
+
+	return nil
+}
+
+// containerHead appends the tag and size of an array or hash of n entries.
+// In PerlCompat mode they are references, unless isRefNext tells the REFN
+// was already written.
+func (e *Encoder) containerHead(by []byte, tag byte, n int, isRefNext bool) []byte {
+	if e.PerlCompat && !isRefNext {
+		if e.profile == ProfilePerl3x && n < 16 {
+			if tag == typeARRAY {
+				return append(by, typeARRAYREF_0+byte(n))
+			}
+			return append(by, typeHASHREF_0+byte(n))
+		}
+		by = append(by, typeREFN)
+	}
+
+	by = append(by, tag)
+	return varint(by, uint(n))
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
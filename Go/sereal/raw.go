@@ -0,0 +1,669 @@
+package sereal
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"runtime"
+	"sort"
+)
+
+// Marshaler is the interface implemented by types that produce their own
+// Sereal encoding.
+//
+// MarshalSereal returns the encoding of exactly one value, without a document
+// header. The encoding must not contain tags referring to other offsets of
+// the document (COPY, REFP, ALIAS, OBJECTV and OBJECTV_FREEZE) because it is
+// spliced verbatim into the surrounding document.
+type Marshaler interface {
+	MarshalSereal() ([]byte, error)
+}
+
+// Unmarshaler is the interface implemented by types that decode their own
+// Sereal encoding.
+//
+// UnmarshalSereal receives the encoding of exactly one value, following the
+// same rules as the output of MarshalSereal. It must copy the data if it
+// wishes to retain it after returning.
+type Unmarshaler interface {
+	UnmarshalSereal([]byte) error
+}
+
+var serealUnmarshalerType = reflect.TypeOf((*Unmarshaler)(nil)).Elem()
+
+// RawMessage is the encoding of exactly one value, following the rules of
+// MarshalSereal. It can be used to delay the decoding of part of a document,
+// or to splice an already encoded value into one.
+type RawMessage []byte
+
+// MarshalSereal returns m, or the encoding of undef if m is empty
+func (m RawMessage) MarshalSereal() ([]byte, error) {
+	if len(m) == 0 {
+		return AppendUndef(nil), nil
+	}
+	return m, nil
+}
+
+// UnmarshalSereal sets *m to a copy of b
+func (m *RawMessage) UnmarshalSereal(b []byte) error {
+	*m = append((*m)[:0], b...)
+	return nil
+}
+
+var rawMessageType = reflect.TypeOf(RawMessage(nil))
+
+// encodeRawMap encodes a hash of already encoded values, checking each of
+// them but without going through MarshalSereal
+func (e *Encoder) encodeRawMap(by []byte, m map[string]RawMessage, isRefNext bool, strTable map[string]int) ([]byte, error) {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	if e.Canonical {
+		sort.Strings(keys)
+	}
+
+	by = e.containerHead(by, typeHASH, len(keys), isRefNext)
+
+	for _, k := range keys {
+		v := m[k]
+		if len(v) == 0 {
+			v = RawMessage{typeUNDEF}
+		} else if err := checkRawValue(v); err != nil {
+			return nil, &MarshalerError{rawMessageType, err}
+		}
+
+		by = e.encodeString(by, k, true, strTable)
+		by = append(by, v...)
+	}
+
+	return by, nil
+}
+
+// decodeRawMap decodes the ln entries of a hash starting at by[idx] into
+// ptr, a map of RawMessage values. The values are copied into a single
+// buffer, each capped so that appending to one can't overwrite the next.
+func (d *decoder) decodeRawMap(by []byte, idx int, ln int, ptr reflect.Value) (int, error) {
+	if ptr.IsNil() {
+		ptr.Set(reflect.MakeMapWithSize(ptr.Type(), ln))
+	}
+
+	keys := make([]reflect.Value, ln)
+	ends := make([]int, ln)
+	var buf []byte
+
+	for i := 0; i < ln; i++ {
+		var key []byte
+		var err error
+		key, keys[i], idx, err = d.decodeMapKey(by, idx, ptr.Type().Key())
+		if err != nil {
+			return 0, err
+		}
+
+		d.pushKey(key)
+		end, err := skipValue(by, idx)
+		if err != nil {
+			return 0, d.keyError(err, key)
+		}
+
+		value := by[idx:end]
+		if !isPositionIndependent(value) {
+			if value, err = d.resolveValue(by, idx); err != nil {
+				return 0, d.keyError(err, key)
+			}
+		}
+		d.popPath()
+
+		buf = append(buf, value...)
+		ends[i] = len(buf)
+		idx = end
+	}
+
+	start := 0
+	for i, key := range keys {
+		ptr.SetMapIndex(key, reflect.ValueOf(RawMessage(buf[start:ends[i]:ends[i]])))
+		start = ends[i]
+	}
+
+	return idx, nil
+}
+
+// rawEncoder produces encodings which can be spliced into any document
+var rawEncoder = &Encoder{DisableDedup: true}
+
+var (
+	errNotPositionIndependent = errors.New("sereal: encoding refers to other offsets of the document")
+	errTrailingData           = errors.New("sereal: encoding holds more than one value")
+)
+
+// AppendUndef appends the encoding of undef to b
+func AppendUndef(b []byte) []byte {
+	return append(b, typeUNDEF)
+}
+
+// AppendBool appends the encoding of v to b
+func AppendBool(b []byte, v bool) []byte {
+	if v {
+		return append(b, typeTRUE)
+	}
+	return append(b, typeFALSE)
+}
+
+// AppendInt appends the encoding of v to b
+func AppendInt(b []byte, v int64) []byte {
+	return rawEncoder.encodeInt(b, v)
+}
+
+// AppendUint appends the encoding of v to b
+func AppendUint(b []byte, v uint64) []byte {
+	return rawEncoder.encodeUint(b, v)
+}
+
+// AppendFloat32 appends the encoding of v to b
+func AppendFloat32(b []byte, v float32) []byte {
+	return rawEncoder.encodeFloat(b, v)
+}
+
+// AppendFloat64 appends the encoding of v to b
+func AppendFloat64(b []byte, v float64) []byte {
+	return rawEncoder.encodeDouble(b, v)
+}
+
+// AppendString appends the encoding of v to b as a UTF-8 string
+func AppendString(b []byte, v string) []byte {
+	return rawEncoder.encodeString(b, v, false, nil)
+}
+
+// AppendBytes appends the encoding of v to b as a binary string
+func AppendBytes(b []byte, v []byte) []byte {
+	return rawEncoder.encodeBytes(b, v, false, nil)
+}
+
+// AppendArrayHeader appends the start of an array of n elements to b. It must
+// be followed by the encoding of the n elements.
+func AppendArrayHeader(b []byte, n int) []byte {
+	b = append(b, typeARRAY)
+	return varint(b, uint(n))
+}
+
+// AppendHashHeader appends the start of a hash of n entries to b. It must be
+// followed by the encoding of n key/value pairs.
+func AppendHashHeader(b []byte, n int) []byte {
+	b = append(b, typeHASH)
+	return varint(b, uint(n))
+}
+
+// AppendObjectHeader appends the start of an object blessed into class to b.
+// It must be followed by the encoding of the object's value.
+func AppendObjectHeader(b []byte, class string) []byte {
+	b = append(b, typeOBJECT)
+	return rawEncoder.encodeBytes(b, []byte(class), true, nil)
+}
+
+// AppendValue appends the encoding of an arbitrary value to b. The value is
+// encoded via reflection without deduplication, and an error is returned if
+// the result would refer to other offsets of the document, e.g. because v
+// contains the same pointer twice.
+func AppendValue(b []byte, v interface{}) ([]byte, error) {
+	start := len(b)
+
+	b, err := rawEncoder.encodeRaw(b, v)
+	if err != nil {
+		return nil, err
+	}
+
+	if !isPositionIndependent(b[start:]) {
+		return nil, errNotPositionIndependent
+	}
+
+	return b, nil
+}
+
+// encodeRaw encodes v without any document context
+func (e *Encoder) encodeRaw(b []byte, v interface{}) (by []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(runtime.Error); ok {
+				panic(r)
+			}
+
+			switch t := r.(type) {
+			case string:
+				err = errors.New(t)
+			case error:
+				err = t
+			}
+		}
+	}()
+
+	return e.encode(b, v, false, false, make(map[string]int), make(map[uintptr]int))
+}
+
+// isPositionIndependent reports whether the encoded value b can be moved to
+// another offset, i.e. it contains no tags referring to other offsets
+func isPositionIndependent(b []byte) bool {
+	_, err := walkValue(b, 0, func(idx int, tag byte) error {
+		if isOffsetTag(tag) {
+			return errNotPositionIndependent
+		}
+		return nil
+	})
+
+	return err == nil
+}
+
+// implementsUnmarshaler reports whether the value ptr is decoded into
+// implements Unmarshaler, either directly if it is a pointer or through its
+// address
+func implementsUnmarshaler(ptr reflect.Value) bool {
+	if ptr.Kind() == reflect.Ptr {
+		return ptr.Type().Implements(serealUnmarshalerType)
+	}
+	return ptr.CanAddr() && reflect.PtrTo(ptr.Type()).Implements(serealUnmarshalerType)
+}
+
+// unmarshalerOf returns the Unmarshaler of a value for which
+// implementsUnmarshaler is true, allocating it if it is a nil pointer
+func unmarshalerOf(ptr reflect.Value) Unmarshaler {
+	if ptr.Kind() == reflect.Ptr {
+		if ptr.IsNil() {
+			ptr.Set(reflect.New(ptr.Type().Elem()))
+		}
+		return ptr.Interface().(Unmarshaler)
+	}
+	return ptr.Addr().Interface().(Unmarshaler)
+}
+
+// decodeViaUnmarshaler hands the encoded value starting at by[idx] to the
+// UnmarshalSereal method of ptr. Values referring to other offsets of the
+// document are resolved first and re-encoded, so that UnmarshalSereal always
+// sees a self-contained encoding.
+func (d *decoder) decodeViaUnmarshaler(by []byte, idx int, ptr reflect.Value) (int, error) {
+	end, err := skipValue(by, idx)
+	if err != nil {
+		return 0, err
+	}
+
+	raw := by[idx:end:end]
+	if !isPositionIndependent(raw) {
+		var iface interface{}
+		if _, err = d.decode(by, idx, &iface); err != nil {
+			return 0, err
+		}
+
+		if raw, err = rawEncoder.encodeRaw(nil, iface); err != nil {
+			return 0, err
+		}
+	}
+
+	if err = unmarshalerOf(ptr).UnmarshalSereal(raw); err != nil {
+		return 0, err
+	}
+
+	return end, nil
+}
+
+// decodeViaRegisteredUnmarshaler instantiates the registered type typ for an
+// object of class className whose value starts at by[idx], and stores it into
+// ptr. UnmarshalSereal sees the object including its class name.
+func (d *decoder) decodeViaRegisteredUnmarshaler(by []byte, idx int, className []byte, typ reflect.Type, ptr reflect.Value) (int, error) {
+	end, err := skipValue(by, idx)
+	if err != nil {
+		return 0, err
+	}
+
+	raw := AppendObjectHeader(nil, string(className))
+	if isPositionIndependent(by[idx:end]) {
+		raw = append(raw, by[idx:end]...)
+	} else {
+		var iface interface{}
+		if _, err = d.decode(by, idx, &iface); err != nil {
+			return 0, err
+		}
+
+		if raw, err = rawEncoder.encodeRaw(raw, iface); err != nil {
+			return 0, err
+		}
+	}
+
+	obj := instantiateZero(typ)
+	if err = obj.Interface().(Unmarshaler).UnmarshalSereal(raw); err != nil {
+		return 0, err
+	}
+
+	ptr.Set(obj)
+	return end, nil
+}
+
+// checkRawValue verifies that b holds exactly one well formed value which can
+// be spliced into any document
+func checkRawValue(b []byte) error {
+	end, err := walkValue(b, 0, func(idx int, tag byte) error {
+		if isOffsetTag(tag) {
+			return errNotPositionIndependent
+		}
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if end != len(b) {
+		return errTrailingData
+	}
+
+	return nil
+}
+
+// A MarshalerError is returned when the MarshalSereal method of a type fails
+// or returns an invalid encoding
+type MarshalerError struct {
+	Type reflect.Type
+	Err  error
+}
+
+func (e *MarshalerError) Error() string {
+	return "sereal: error calling MarshalSereal for type " + e.Type.String() + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error
+func (e *MarshalerError) Unwrap() error { return e.Err }
+
+// A ValueReader reads an encoded value as produced by Marshaler
+// implementations, without using reflection. It is primarily meant for
+// generated Unmarshaler implementations.
+type ValueReader struct {
+	b   []byte
+	idx int
+}
+
+// NewValueReader returns a ValueReader reading the encoded value b
+func NewValueReader(b []byte) *ValueReader {
+	return &ValueReader{b: b}
+}
+
+// next returns the next tag, skipping padding and references to hashes and
+// arrays
+func (r *ValueReader) next() (byte, error) {
+	for r.idx < len(r.b) {
+		tag := r.b[r.idx] &^ trackFlag
+		if tag != typePAD && tag != typeREFN && tag != typeWEAKEN {
+			return tag, nil
+		}
+		r.idx++
+	}
+
+	return 0, ErrTruncated
+}
+
+func (r *ValueReader) unexpected(tag byte, what string) error {
+	return fmt.Errorf("sereal: expected %s at offset %d but got %s", what, r.idx, tagName(tag))
+}
+
+// ReadNil consumes an undef and returns true if it is the next value,
+// otherwise it returns false and leaves the reader untouched
+func (r *ValueReader) ReadNil() bool {
+	tag, err := r.next()
+	if err != nil || (tag != typeUNDEF && tag != typeCANONICAL_UNDEF) {
+		return false
+	}
+
+	r.idx++
+	return true
+}
+
+// ReadHash reads the start of a hash and returns its number of entries. Hashes
+// blessed into a class are accepted, the class name is ignored.
+func (r *ValueReader) ReadHash() (int, error) {
+	tag, err := r.next()
+	if err != nil {
+		return 0, err
+	}
+
+	if tag == typeOBJECT {
+		r.idx++
+		if _, err = r.ReadString(); err != nil {
+			return 0, err
+		}
+		if tag, err = r.next(); err != nil {
+			return 0, err
+		}
+	}
+
+	switch {
+	case tag == typeHASH:
+		return r.readLength(ErrBadHashSize, 2)
+
+	case tag >= typeHASHREF_0 && tag < typeHASHREF_0+16:
+		r.idx++
+		return int(tag & 0x0f), nil
+	}
+
+	return 0, r.unexpected(tag, "hash")
+}
+
+// ReadArray reads the start of an array and returns its number of elements
+func (r *ValueReader) ReadArray() (int, error) {
+	tag, err := r.next()
+	if err != nil {
+		return 0, err
+	}
+
+	switch {
+	case tag == typeARRAY:
+		return r.readLength(ErrBadSliceSize, 1)
+
+	case tag >= typeARRAYREF_0 && tag < typeARRAYREF_0+16:
+		r.idx++
+		return int(tag & 0x0f), nil
+	}
+
+	return 0, r.unexpected(tag, "array")
+}
+
+// readLength reads the varint following a container tag
+func (r *ValueReader) readLength(corrupt error, itemSize int) (int, error) {
+	ln, sz, err := varintdecode(r.b[r.idx+1:])
+	if err != nil {
+		return 0, err
+	}
+
+	if ln < 0 || ln > math.MaxInt32 {
+		return 0, ErrCorrupt{corrupt}
+	}
+
+	r.idx += 1 + sz
+	if ln*itemSize > len(r.b)-r.idx {
+		return 0, ErrTruncated
+	}
+
+	return ln, nil
+}
+
+// readStringish reads a binary or UTF-8 string without copying it
+func (r *ValueReader) readStringish() ([]byte, error) {
+	tag, err := r.next()
+	if err != nil {
+		return nil, err
+	}
+
+	idx := r.idx + 1
+	var ln int
+
+	switch {
+	case tag == typeBINARY, tag == typeSTR_UTF8:
+		var sz int
+		if ln, sz, err = varintdecode(r.b[idx:]); err != nil {
+			return nil, err
+		}
+		idx += sz
+
+		if ln < 0 || ln > math.MaxInt32 {
+			return nil, ErrCorrupt{ErrBadStringSize}
+		}
+
+	case tag >= typeSHORT_BINARY_0 && tag < typeSHORT_BINARY_0+32:
+		ln = int(tag & 0x1f)
+
+	default:
+		return nil, r.unexpected(tag, "string")
+	}
+
+	if idx+ln > len(r.b) {
+		return nil, ErrTruncated
+	}
+
+	r.idx = idx + ln
+	return r.b[idx:r.idx], nil
+}
+
+// ReadString reads a binary or UTF-8 string
+func (r *ValueReader) ReadString() (string, error) {
+	s, err := r.readStringish()
+	return string(s), err
+}
+
+// ReadBytes reads a binary or UTF-8 string into a newly allocated slice
+func (r *ValueReader) ReadBytes() ([]byte, error) {
+	s, err := r.readStringish()
+	if err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, len(s))
+	copy(b, s)
+	return b, nil
+}
+
+// ReadInt reads an integer
+func (r *ValueReader) ReadInt() (int64, error) {
+	tag, err := r.next()
+	if err != nil {
+		return 0, err
+	}
+
+	switch {
+	case tag < typeVARINT:
+		r.idx++
+		if tag&0x10 == 0x10 {
+			return int64(tag) - 32, nil
+		}
+		return int64(tag), nil
+
+	case tag == typeVARINT, tag == typeZIGZAG:
+		i, sz, err := varintdecode(r.b[r.idx+1:])
+		if err != nil {
+			return 0, err
+		}
+		r.idx += 1 + sz
+
+		if tag == typeZIGZAG {
+			return -(1 + int64(uint64(i)>>1)), nil
+		}
+		return int64(i), nil
+	}
+
+	return 0, r.unexpected(tag, "integer")
+}
+
+// ReadUint reads an unsigned integer
+func (r *ValueReader) ReadUint() (uint64, error) {
+	i, err := r.ReadInt()
+	return uint64(i), err
+}
+
+// ReadFloat reads a floating point number or an integer
+func (r *ValueReader) ReadFloat() (float64, error) {
+	tag, err := r.next()
+	if err != nil {
+		return 0, err
+	}
+
+	switch tag {
+	case typeFLOAT:
+		f, idx, err := (*decoder)(nil).decodeFloat(r.b, r.idx+1)
+		if err != nil {
+			return 0, err
+		}
+		r.idx = idx
+		return float64(f), nil
+
+	case typeDOUBLE:
+		f, idx, err := (*decoder)(nil).decodeDouble(r.b, r.idx+1)
+		if err != nil {
+			return 0, err
+		}
+		r.idx = idx
+		return f, nil
+
+	case typeLONG_DOUBLE:
+		f, idx, err := (*decoder)(nil).decodeLongDouble(r.b, r.idx+1)
+		if err != nil {
+			return 0, err
+		}
+		r.idx = idx
+		return f, nil
+	}
+
+	i, err := r.ReadInt()
+	return float64(i), err
+}
+
+// ReadBool reads a boolean. Integers are accepted as in Perl: any non-zero
+// value is true.
+func (r *ValueReader) ReadBool() (bool, error) {
+	tag, err := r.next()
+	if err != nil {
+		return false, err
+	}
+
+	switch tag {
+	case typeTRUE, typeFALSE:
+		r.idx++
+		return tag == typeTRUE, nil
+	}
+
+	i, err := r.ReadInt()
+	return i != 0, err
+}
+
+// Skip skips the next value
+func (r *ValueReader) Skip() error {
+	idx, err := skipValue(r.b, r.idx)
+	if err != nil {
+		return err
+	}
+
+	r.idx = idx
+	return nil
+}
+
+// Decode decodes the next value into the value pointed to by v via
+// reflection, with the same rules as Decoder.Unmarshal
+func (r *ValueReader) Decode(v interface{}) (err error) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr {
+		return ErrBodyPointer
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(runtime.Error); ok {
+				panic(r)
+			}
+
+			switch t := r.(type) {
+			case string:
+				err = errors.New(t)
+			case error:
+				err = t
+			}
+		}
+	}()
+
+	d := decoder{Decoder: &Decoder{}, tracked: make(map[int]reflect.Value), section: "body"}
+	r.idx, err = d.decodeViaReflection(r.b, r.idx, rv.Elem())
+	return err
+}
@@ -0,0 +1,284 @@
+package sereal
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// RegexpFlags are the modifiers of a Perl regular expression. At most one of
+// the character set flags RegexpASCII, RegexpASCIIStrict, RegexpLocale and
+// RegexpUnicode may be set; none stands for the default set, /d.
+type RegexpFlags uint16
+
+const (
+	RegexpMultiline    RegexpFlags = 1 << iota // m
+	RegexpSingleLine                           // s
+	RegexpIgnoreCase                           // i
+	RegexpExtended                             // x
+	RegexpExtendedMore                         // xx, set together with RegexpExtended
+	RegexpNoCapture                            // n
+	RegexpKeepCopy                             // p
+	RegexpASCII                                // a
+	RegexpASCIIStrict                          // aa
+	RegexpLocale                               // l
+	RegexpUnicode                              // u
+)
+
+const regexpCharsets = RegexpASCII | RegexpASCIIStrict | RegexpLocale | RegexpUnicode
+
+// ParseRegexpFlags parses the modifiers of a Perl regular expression, in any
+// order
+func ParseRegexpFlags(modifiers string) (RegexpFlags, error) {
+	var f RegexpFlags
+	var xs, as int
+
+	for i := 0; i < len(modifiers); i++ {
+		switch c := modifiers[i]; c {
+		case 'm':
+			f |= RegexpMultiline
+		case 's':
+			f |= RegexpSingleLine
+		case 'i':
+			f |= RegexpIgnoreCase
+		case 'x':
+			xs++
+		case 'n':
+			f |= RegexpNoCapture
+		case 'p':
+			f |= RegexpKeepCopy
+		case 'a':
+			as++
+		case 'l':
+			f |= RegexpLocale
+		case 'u':
+			f |= RegexpUnicode
+		case 'd':
+			// the default character set
+		default:
+			return 0, fmt.Errorf("sereal: invalid regexp modifier %q in %q", c, modifiers)
+		}
+	}
+
+	switch xs {
+	case 0:
+	case 1:
+		f |= RegexpExtended
+	case 2:
+		f |= RegexpExtended | RegexpExtendedMore
+	default:
+		return 0, fmt.Errorf("sereal: invalid regexp modifiers %q: too many x", modifiers)
+	}
+
+	switch as {
+	case 0:
+	case 1:
+		f |= RegexpASCII
+	case 2:
+		f |= RegexpASCIIStrict
+	default:
+		return 0, fmt.Errorf("sereal: invalid regexp modifiers %q: too many a", modifiers)
+	}
+
+	if err := f.validate(); err != nil {
+		return 0, fmt.Errorf("sereal: invalid regexp modifiers %q: %v", modifiers, err)
+	}
+
+	return f, nil
+}
+
+func (f RegexpFlags) validate() error {
+	if f >= RegexpUnicode<<1 {
+		return fmt.Errorf("unknown flags %#x", uint16(f&^(RegexpUnicode<<1-1)))
+	}
+	if cs := f & regexpCharsets; cs&(cs-1) != 0 {
+		return fmt.Errorf("several character sets")
+	}
+	return nil
+}
+
+// String returns the modifiers in the order Perl writes them: the character
+// set, then "msixxnp". The default character set isn't written.
+func (f RegexpFlags) String() string {
+	var sb strings.Builder
+
+	switch f & regexpCharsets {
+	case RegexpASCII:
+		sb.WriteString("a")
+	case RegexpASCIIStrict:
+		sb.WriteString("aa")
+	case RegexpLocale:
+		sb.WriteString("l")
+	case RegexpUnicode:
+		sb.WriteString("u")
+	}
+
+	if f&RegexpMultiline != 0 {
+		sb.WriteByte('m')
+	}
+	if f&RegexpSingleLine != 0 {
+		sb.WriteByte('s')
+	}
+	if f&RegexpIgnoreCase != 0 {
+		sb.WriteByte('i')
+	}
+	if f&RegexpExtendedMore != 0 {
+		sb.WriteString("xx")
+	} else if f&RegexpExtended != 0 {
+		sb.WriteByte('x')
+	}
+	if f&RegexpNoCapture != 0 {
+		sb.WriteByte('n')
+	}
+	if f&RegexpKeepCopy != 0 {
+		sb.WriteByte('p')
+	}
+
+	return sb.String()
+}
+
+// modifiers returns the normalized modifiers of r, those of Modifiers or, if
+// it is nil, of Flags
+func (r PerlRegexp) modifiers() ([]byte, error) {
+	if r.Modifiers == nil {
+		if err := r.Flags.validate(); err != nil {
+			return nil, fmt.Errorf("sereal: invalid regexp flags: %v", err)
+		}
+		return []byte(r.Flags.String()), nil
+	}
+
+	f, err := ParseRegexpFlags(string(r.Modifiers))
+	if err != nil {
+		return nil, err
+	}
+	if s := f.String(); s != string(r.Modifiers) {
+		return []byte(s), nil
+	}
+	return r.Modifiers, nil
+}
+
+var regexpPtrType = reflect.TypeOf((*regexp.Regexp)(nil))
+
+// Compile translates r into a Go regexp.Regexp. The m, s and i modifiers
+// become the flags of the same name, x and xx drop whitespace and comments
+// from the pattern, n makes groups non-capturing and p is ignored. Named
+// groups (?<name>...) are written (?P<name>...).
+//
+// The translation fails with a RegexpError for the l modifier, whose
+// character classes depend on the locale, and for syntax RE2 lacks, such as
+// backreferences, lookarounds, possessive quantifiers and \Z. Otherwise the
+// semantics differ in a few corners: \d, \w, \s and \b only match ASCII
+// characters, whatever the character set modifier, and $ without m only
+// matches at the very end of the text, not before a final newline.
+func (r PerlRegexp) Compile() (*regexp.Regexp, error) {
+	modifiers, err := r.modifiers()
+	if err != nil {
+		return nil, &RegexpError{Pattern: string(r.Pattern), Modifiers: string(r.Modifiers), Err: err}
+	}
+
+	fail := func(err error) (*regexp.Regexp, error) {
+		return nil, &RegexpError{Pattern: string(r.Pattern), Modifiers: string(modifiers), Err: err}
+	}
+
+	f, _ := ParseRegexpFlags(string(modifiers))
+	if f&RegexpLocale != 0 {
+		return fail(errors.New("locale dependent character classes (/l)"))
+	}
+
+	var sb strings.Builder
+	if goFlags := (f & (RegexpMultiline | RegexpSingleLine | RegexpIgnoreCase)).String(); goFlags != "" {
+		sb.WriteString("(?" + goFlags + ")")
+	}
+	translatePattern(&sb, string(r.Pattern), f)
+
+	re, err := regexp.Compile(sb.String())
+	if err != nil {
+		return fail(err)
+	}
+	return re, nil
+}
+
+// translatePattern appends to sb the Perl pattern p with the modifiers f in
+// the syntax of package regexp
+func translatePattern(sb *strings.Builder, p string, f RegexpFlags) {
+	extended := f&RegexpExtended != 0
+	inClass := false
+
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+
+		switch {
+		case c == '\\' && i+1 < len(p):
+			sb.WriteString(p[i : i+2])
+			i++
+
+		case inClass:
+			switch {
+			case c == '[' && i+1 < len(p) && p[i+1] == ':':
+				// POSIX class, e.g. [:alpha:]
+				end := strings.Index(p[i:], ":]")
+				if end < 0 {
+					sb.WriteByte(c)
+					continue
+				}
+				sb.WriteString(p[i : i+end+2])
+				i += end + 1
+			case c == ']':
+				inClass = false
+				sb.WriteByte(c)
+			case (c == ' ' || c == '\t') && f&RegexpExtendedMore != 0:
+			default:
+				sb.WriteByte(c)
+			}
+
+		case c == '[':
+			inClass = true
+			sb.WriteByte(c)
+			if i+1 < len(p) && p[i+1] == '^' {
+				sb.WriteByte('^')
+				i++
+			}
+			if i+1 < len(p) && p[i+1] == ']' {
+				// a leading ] is literal
+				sb.WriteByte(']')
+				i++
+			}
+
+		case extended && (c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v'):
+
+		case extended && c == '#':
+			for i+1 < len(p) && p[i+1] != '\n' {
+				i++
+			}
+
+		case c == '(' && strings.HasPrefix(p[i:], "(?<") && !strings.HasPrefix(p[i:], "(?<=") && !strings.HasPrefix(p[i:], "(?<!"):
+			sb.WriteString("(?P<")
+			i += 2
+
+		case c == '(' && f&RegexpNoCapture != 0 && (i+1 == len(p) || p[i+1] != '?'):
+			sb.WriteString("(?:")
+
+		default:
+			sb.WriteByte(c)
+		}
+	}
+}
+
+// translateRegexp returns the decoded regular expression r as the Decoder
+// options say, a *regexp.Regexp with TranslateRegexps
+func (d *decoder) translateRegexp(r *PerlRegexp) (interface{}, error) {
+	if !d.TranslateRegexps {
+		return r, nil
+	}
+	return d.compileRegexp(r)
+}
+
+func (d *decoder) compileRegexp(r *PerlRegexp) (*regexp.Regexp, error) {
+	re, err := r.Compile()
+	if err != nil {
+		return nil, err
+	}
+	return re, nil
+}
@@ -0,0 +1,341 @@
+// Package replay replays recorded Sereal documents against a handler, under
+// several decoder configurations and levels of concurrency, and reports the
+// throughput, latencies and classes of errors of each run. It is meant for
+// checking changes to decoders against production traffic before deploying
+// them.
+package replay
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Weborama/Sereal/Go/sereal"
+)
+
+// A Document is a recorded document
+type Document struct {
+	Name string
+	Data []byte
+}
+
+// Load reads all documents of src into memory, so that they can be replayed
+// several times
+func Load(src sereal.BatchSource) ([]Document, error) {
+	var docs []Document
+	for {
+		name, b, err := src.Next()
+		if err == io.EOF {
+			return docs, nil
+		}
+		if err != nil {
+			return docs, err
+		}
+		docs = append(docs, Document{name, b})
+	}
+}
+
+// LoadDir reads all regular files below dir, as sereal.DirSource does
+func LoadDir(dir string) ([]Document, error) {
+	src, err := sereal.DirSource(dir)
+	if err != nil {
+		return nil, err
+	}
+	return Load(src)
+}
+
+// LoadStream reads the documents of a stream written by a
+// sereal.StreamEncoder with the given framing. They are named after their
+// position in the stream, from "0".
+func LoadStream(r io.Reader, framing sereal.Framing) ([]Document, error) {
+	s := sereal.NewStreamDecoder(r, nil)
+	s.Framing = framing
+
+	var docs []Document
+	for {
+		b, err := s.NextDocument()
+		if err == io.EOF {
+			return docs, nil
+		}
+		if err != nil {
+			return docs, err
+		}
+		docs = append(docs, Document{fmt.Sprint(len(docs)), append([]byte(nil), b...)})
+	}
+}
+
+// A Handler processes a replayed document with d. It is called from several
+// goroutines at once.
+type Handler func(d *sereal.Decoder, doc Document) error
+
+// DecodeHandler decodes the header and the body of documents into empty
+// interfaces, failing on those d can't decode
+func DecodeHandler(d *sereal.Decoder, doc Document) error {
+	var header, body interface{}
+	return d.UnmarshalHeaderBody(doc.Data, &header, &body)
+}
+
+// A Variant is a decoder configuration documents are replayed with
+type Variant struct {
+	Name    string
+	Options sereal.DecoderOptions
+}
+
+// Options configures Run
+type Options struct {
+	// Variants are the decoder configurations to replay the documents
+	// with. The default is a single one named "default" with the default
+	// options.
+	Variants []Variant
+
+	// Workers are the levels of concurrency to replay the documents at,
+	// each variant being run once with each of them. The default is a
+	// single worker.
+	Workers []int
+
+	// Rate is the number of documents per second replayed by each run, 0
+	// replaying them as fast as the workers go
+	Rate float64
+
+	// Progress, if set, is given each result as soon as its run is over
+	Progress func(r *Result)
+}
+
+// Latencies sums up how long the handler took over the documents of a run
+type Latencies struct {
+	Min, Median, P90, P99, Max time.Duration
+}
+
+// A Result is the outcome of replaying the documents with a variant and a
+// number of workers
+type Result struct {
+	Variant   string
+	Workers   int
+	Documents int   // documents replayed
+	Failed    int   // documents the handler failed on
+	Bytes     int64 // size of the documents replayed
+	Elapsed   time.Duration
+	Latencies Latencies
+
+	// Errors counts the failures by class, see ErrorClass, and Examples
+	// holds the first failure of each class
+	Errors   map[string]int
+	Examples map[string]Failure
+}
+
+// A Failure is a document the handler failed on
+type Failure struct {
+	Name string
+	Err  error
+}
+
+// DocsPerSecond returns the throughput of the run in documents per second
+func (r *Result) DocsPerSecond() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(r.Documents) / r.Elapsed.Seconds()
+}
+
+// BytesPerSecond returns the throughput of the run in bytes per second
+func (r *Result) BytesPerSecond() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(r.Bytes) / r.Elapsed.Seconds()
+}
+
+// A Report holds the results of all runs, in the order of the variants then
+// of the numbers of workers
+type Report struct {
+	Results []*Result
+}
+
+// String formats the report as a table, followed by an example of each
+// class of errors
+func (r *Report) String() string {
+	var sb strings.Builder
+
+	fmt.Fprintf(&sb, "%-20s %7s %9s %7s %12s %10s %10s %10s\n", "variant", "workers", "docs", "failed", "docs/s", "p50", "p99", "max")
+	for _, res := range r.Results {
+		fmt.Fprintf(&sb, "%-20s %7d %9d %7d %12.1f %10v %10v %10v\n", res.Variant, res.Workers, res.Documents, res.Failed,
+			res.DocsPerSecond(), res.Latencies.Median, res.Latencies.P99, res.Latencies.Max)
+	}
+
+	for _, res := range r.Results {
+		classes := make([]string, 0, len(res.Errors))
+		for class := range res.Errors {
+			classes = append(classes, class)
+		}
+		sort.Strings(classes)
+
+		for _, class := range classes {
+			ex := res.Examples[class]
+			fmt.Fprintf(&sb, "%s/%d: %d %s, e.g. %s: %v\n", res.Variant, res.Workers, res.Errors[class], class, ex.Name, ex.Err)
+		}
+	}
+
+	return sb.String()
+}
+
+// ErrorClass returns the class of the error err of a handler: "corrupt",
+// "truncated", "bad header", "unknown tag", "snappy", "thaw", "strict" or
+// "other"
+func ErrorClass(err error) string {
+	var corrupt sereal.ErrCorrupt
+	var snappy *sereal.SnappyError
+	var thaw *sereal.ThawError
+	var strict *sereal.StrictError
+
+	switch {
+	case errors.As(err, &corrupt):
+		return "corrupt"
+	case errors.Is(err, sereal.ErrTruncated), errors.Is(err, io.ErrUnexpectedEOF):
+		return "truncated"
+	case errors.Is(err, sereal.ErrBadHeader), errors.Is(err, sereal.ErrBadHeaderUTF8):
+		return "bad header"
+	case errors.Is(err, sereal.ErrUnknownTag):
+		return "unknown tag"
+	case errors.As(err, &snappy):
+		return "snappy"
+	case errors.As(err, &thaw):
+		return "thaw"
+	case errors.As(err, &strict):
+		return "strict"
+	}
+	return "other"
+}
+
+// Run replays docs against h, with every variant and number of workers of
+// opts. A nil h stands for DecodeHandler. It fails without replaying anything
+// if the options of a variant or a number of workers are invalid.
+func Run(docs []Document, h Handler, opts Options) (*Report, error) {
+	if h == nil {
+		h = DecodeHandler
+	}
+
+	variants := opts.Variants
+	if len(variants) == 0 {
+		variants = []Variant{{Name: "default", Options: sereal.DecoderOptions{Version: sereal.OptionsVersion}}}
+	}
+
+	workers := opts.Workers
+	if len(workers) == 0 {
+		workers = []int{1}
+	}
+	for _, n := range workers {
+		if n < 1 {
+			return nil, fmt.Errorf("replay: bad number of workers %d", n)
+		}
+	}
+
+	decoders := make([]*sereal.Decoder, len(variants))
+	for i, v := range variants {
+		d, err := v.Options.NewDecoder()
+		if err != nil {
+			return nil, fmt.Errorf("replay: variant %s: %v", v.Name, err)
+		}
+		decoders[i] = d
+	}
+
+	report := &Report{}
+	for i, v := range variants {
+		for _, n := range workers {
+			res := run(docs, h, decoders[i], n, opts.Rate)
+			res.Variant = v.Name
+			report.Results = append(report.Results, res)
+
+			if opts.Progress != nil {
+				opts.Progress(res)
+			}
+		}
+	}
+
+	return report, nil
+}
+
+// run replays docs against h with d and n workers
+func run(docs []Document, h Handler, d *sereal.Decoder, n int, rate float64) *Result {
+	res := &Result{
+		Workers:  n,
+		Errors:   make(map[string]int),
+		Examples: make(map[string]Failure),
+	}
+
+	var (
+		mu        sync.Mutex // protects res
+		wg        sync.WaitGroup
+		latencies = make([]time.Duration, len(docs))
+	)
+
+	jobs := make(chan int)
+	for w := 0; w < n; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				start := time.Now()
+				err := h(d, docs[i])
+				latencies[i] = time.Since(start)
+
+				mu.Lock()
+				res.Documents++
+				res.Bytes += int64(len(docs[i].Data))
+				if err != nil {
+					res.Failed++
+					class := ErrorClass(err)
+					if res.Errors[class] == 0 {
+						res.Examples[class] = Failure{docs[i].Name, err}
+					}
+					res.Errors[class]++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	var tick <-chan time.Time
+	if rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / rate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	start := time.Now()
+	for i := range docs {
+		if tick != nil && i > 0 {
+			<-tick
+		}
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	res.Elapsed = time.Since(start)
+
+	res.Latencies = summarize(latencies)
+	return res
+}
+
+// summarize sorts the latencies l and sums them up
+func summarize(l []time.Duration) Latencies {
+	if len(l) == 0 {
+		return Latencies{}
+	}
+
+	sort.Slice(l, func(i, j int) bool { return l[i] < l[j] })
+	at := func(q float64) time.Duration {
+		return l[int(q*float64(len(l)-1))]
+	}
+
+	return Latencies{
+		Min:    l[0],
+		Median: at(0.5),
+		P90:    at(0.9),
+		P99:    at(0.99),
+		Max:    l[len(l)-1],
+	}
+}
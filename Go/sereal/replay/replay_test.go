@@ -0,0 +1,74 @@
+package replay
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/Weborama/Sereal/Go/sereal"
+)
+
+func TestRun(t *testing.T) {
+	var buf bytes.Buffer
+	s := sereal.NewStreamEncoder(&buf, nil)
+	for i := 0; i < 10; i++ {
+		if err := s.Encode(map[string]interface{}{"id": i, "name": "doc"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	docs, err := LoadStream(&buf, sereal.FramingConcatenated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(docs) != 10 || docs[3].Name != "3" {
+		t.Fatalf("expected 10 documents, got %d", len(docs))
+	}
+
+	docs[5].Data = docs[5].Data[:len(docs[5].Data)-2]
+	docs = append(docs, Document{"garbage", []byte("not sereal")})
+
+	opts := Options{
+		Variants: []Variant{
+			{Name: "default", Options: sereal.DecoderOptions{Version: 1}},
+			{Name: "strict", Options: sereal.DecoderOptions{Version: 1, Strict: true}},
+		},
+		Workers: []int{1, 4},
+	}
+
+	var progress int
+	opts.Progress = func(r *Result) { progress++ }
+
+	report, err := Run(docs, nil, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Results) != 4 || progress != 4 {
+		t.Fatalf("expected 4 results, got %d and %d progress calls", len(report.Results), progress)
+	}
+
+	for _, r := range report.Results {
+		if r.Documents != 11 || r.Failed != 2 || r.Errors["truncated"] != 1 || r.Errors["bad header"] != 1 {
+			t.Errorf("%s/%d: unexpected result %+v", r.Variant, r.Workers, r)
+		}
+		if r.Examples["bad header"].Name != "garbage" {
+			t.Errorf("%s/%d: unexpected examples %+v", r.Variant, r.Workers, r.Examples)
+		}
+		if r.Latencies.Min > r.Latencies.Median || r.Latencies.Median > r.Latencies.Max {
+			t.Errorf("%s/%d: unordered latencies %+v", r.Variant, r.Workers, r.Latencies)
+		}
+	}
+
+	if report.String() == "" {
+		t.Errorf("empty report")
+	}
+
+	if _, err := Run(docs, nil, Options{Variants: []Variant{{Name: "bad"}}}); err == nil {
+		t.Errorf("expected error for invalid options")
+	}
+	if _, err := Run(docs, nil, Options{Workers: []int{0}}); err == nil {
+		t.Errorf("expected error for no workers")
+	}
+}
@@ -0,0 +1,125 @@
+package sereal
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"runtime"
+)
+
+// RootsKey is the header user-data key flagging documents whose body is a
+// sequence of root values, as written by EncodeRoots. It holds the number of
+// values.
+const RootsKey = "__sereal_roots"
+
+// EncodeRoots encodes vals as a sequence of root values with the default
+// encoder
+func EncodeRoots(vals ...interface{}) ([]byte, error) {
+	return defaultEncoder.EncodeRoots(vals...)
+}
+
+// EncodeRoots returns a document holding the sequence of root values vals,
+// to be decoded with DecodeRoots. The body is an array of the values and
+// the header user data flags it under RootsKey, so that the document can
+// still be decoded by any decoder. Values may share data, as the elements of
+// an array do.
+func (e *Encoder) EncodeRoots(vals ...interface{}) ([]byte, error) {
+	header, err := withHeaderEntry(nil, RootsKey, len(vals))
+	if err != nil {
+		return nil, err
+	}
+	return e.MarshalWithHeader(header, vals)
+}
+
+// DecodeRoots decodes the root values of b into ptrs with the default
+// decoder
+func DecodeRoots(b []byte, ptrs ...interface{}) error {
+	return NewDecoder().DecodeRoots(b, ptrs...)
+}
+
+// DecodeRoots decodes the sequence of root values of the document b,
+// written by EncodeRoots, into the values pointed to by ptrs. There must be
+// as many pointers as values; a nil pointer skips its value.
+func (d *Decoder) DecodeRoots(b []byte, ptrs ...interface{}) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(runtime.Error); ok {
+				panic(r)
+			}
+
+			switch t := r.(type) {
+			case string:
+				err = errors.New(t)
+			case error:
+				err = t
+			}
+		}
+	}()
+
+	var n int
+	ok, err := d.HeaderField(b, RootsKey, &n)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("sereal: document doesn't hold a sequence of root values")
+	}
+	if n != len(ptrs) {
+		return fmt.Errorf("sereal: document holds %d root values, got %d pointers", n, len(ptrs))
+	}
+
+	dec, by, idx, err := d.bodyDecoder(b)
+	if err != nil {
+		return err
+	}
+
+	idx = skipPads(by, idx)
+	if idx < len(by) && by[idx]&^trackFlag == typeREFN {
+		idx = skipPads(by, idx+1)
+	}
+	if idx >= len(by) {
+		return ErrTruncated
+	}
+
+	ln := -1
+	switch tag := by[idx] &^ trackFlag; {
+	case tag == typeARRAY:
+		var sz int
+		if ln, sz, err = varintdecode(by[idx+1:]); err != nil {
+			return err
+		}
+		if ln < 0 || ln > math.MaxInt32 {
+			return ErrCorrupt{ErrBadSliceSize}
+		}
+		idx += 1 + sz
+
+	case tag >= typeARRAYREF_0 && tag < typeARRAYREF_0+16:
+		ln = int(tag & 0x0f)
+		idx++
+	}
+	if ln != n {
+		return errors.New("sereal: body doesn't match the number of root values of the header")
+	}
+
+	for i, ptr := range ptrs {
+		dec.pushIndex(i)
+		if ptr == nil {
+			// decoded all the same, later values may refer to it
+			var discard interface{}
+			idx, err = dec.decode(by, idx, &discard)
+		} else {
+			rv := reflect.ValueOf(ptr)
+			if rv.Kind() != reflect.Ptr || rv.IsNil() {
+				return fmt.Errorf("sereal: expected pointer for root value %d, got %T", i, ptr)
+			}
+			idx, err = dec.decodeViaReflection(by, idx, rv.Elem())
+		}
+		if err != nil {
+			return dec.indexError(err, i)
+		}
+		dec.popPath()
+	}
+
+	return nil
+}
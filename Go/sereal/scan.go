@@ -0,0 +1,353 @@
+package sereal
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// A ScanIssue is a structural violation found by ScanReport
+type ScanIssue struct {
+	Section string // "document" for the framing, "header" or "body"
+	Offset  int    // offset in the document, decompressed if it is compressed
+	Tag     int    // tag of the value at fault without its track flag, -1 if there is none
+	Err     error
+}
+
+func (i ScanIssue) String() string {
+	return fmt.Sprintf("%s at %d: %v", i.Section, i.Offset, i.Err)
+}
+
+// A RecoveryReport is what ScanReport finds out about a document
+type RecoveryReport struct {
+	Issues      []ScanIssue
+	Values      int // number of values scanned, including those inside containers
+	TruncatedAt int // offset of the value cut short by the end of the document, -1 if none is
+}
+
+// OK reports whether the scan found no violation
+func (r *RecoveryReport) OK() bool {
+	return len(r.Issues) == 0 && r.TruncatedAt < 0
+}
+
+func (r *RecoveryReport) String() string {
+	var sb strings.Builder
+	for _, i := range r.Issues {
+		sb.WriteString(i.String())
+		sb.WriteByte('\n')
+	}
+	return sb.String()
+}
+
+// ScanReport walks the document b as far as it can and reports every
+// structural violation it finds: bad varints, unknown tags, offsets not
+// referring to an earlier value of their section, REFP and ALIAS tags
+// referring to values without the track flag, class names which aren't
+// strings, counts larger than what is left of the document, values nested
+// too deep, bytes after the root value, and where the document is cut
+// short. It carries on past each violation where it can tell where the next
+// value starts, e.g. after an unknown tag byte or a bad offset, so that a
+// single pass gives the full picture of a damaged document. Values are never
+// decoded.
+func ScanReport(b []byte) *RecoveryReport {
+	return scanDocument(b, false)
+}
+
+// Validate checks the structure of the document b as ScanReport does,
+// without decoding any value. It stops at the first violation and returns it
+// as a *ValidationError, so that untrusted documents can be turned away
+// cheaply before they are decoded.
+func Validate(b []byte) error {
+	r := scanDocument(b, true)
+	if len(r.Issues) == 0 {
+		return nil
+	}
+	i := r.Issues[0]
+	return &ValidationError{Section: i.Section, Offset: i.Offset, Tag: i.Tag, Err: i.Err}
+}
+
+// maxScanDepth bounds the nesting of the values scanned, so that a document
+// made of nothing but REFN tags can't exhaust the stack
+const maxScanDepth = 10000
+
+// scanDocument walks b for ScanReport and Validate, stopping at the first
+// issue if first is set
+func scanDocument(b []byte, first bool) *RecoveryReport {
+	r := &RecoveryReport{TruncatedAt: -1}
+
+	header, err := readHeader(b)
+	if err != nil {
+		if len(b) <= headerSize && err == ErrBadHeader {
+			err = ErrTruncated
+		}
+		r.Issues = append(r.Issues, ScanIssue{"document", 0, -1, err})
+		return r
+	}
+
+	bodyStart := headerSize + header.suffixSize
+	if bodyStart >= len(b) {
+		r.Issues = append(r.Issues, ScanIssue{"document", len(b), -1, ErrTruncated})
+		r.TruncatedAt = 0
+		return r
+	}
+
+	if header.version >= 2 && bodyStart > header.suffixStart && b[header.suffixStart]&1 == 1 {
+		// header offsets are relative to the flag byte
+		s := scanner{r: r, by: b[header.suffixStart:bodyStart], base: header.suffixStart, section: "header", sectionStart: 1, first: first}
+		s.scan(1)
+		if s.stopped {
+			return r
+		}
+	}
+
+	b, err = DecompressDocument(nil, b)
+	if err != nil {
+		r.Issues = append(r.Issues, ScanIssue{"body", bodyStart, -1, err})
+		return r
+	}
+
+	s := scanner{r: r, by: b[bodyStart-1:], base: bodyStart - 1, section: "body", sectionStart: 1, first: first}
+	if header.version == 1 {
+		// v1 offsets are relative to the start of the document
+		s.by, s.base, s.sectionStart = b, 0, bodyStart
+	}
+	s.scan(bodyStart - s.base)
+
+	return r
+}
+
+// scanner walks a section of a document for ScanReport
+type scanner struct {
+	r            *RecoveryReport
+	by           []byte
+	base         int // offset of by in the document
+	section      string
+	sectionStart int          // first offset values of the section can refer to
+	starts       map[int]bool // offsets of the values scanned so far
+	depth        int
+	first        bool // stop at the first issue
+	stopped      bool
+	truncated    bool
+}
+
+// scan walks the root value starting at by[idx] and checks that nothing but
+// padding follows it
+func (s *scanner) scan(idx int) {
+	s.starts = make(map[int]bool)
+	idx = s.value(idx)
+
+	for idx < len(s.by) && s.by[idx]&^trackFlag == typePAD {
+		idx++
+	}
+	if !s.truncated && !s.stopped && idx < len(s.by) {
+		s.issue(idx, idx, ErrCorrupt{ErrTrailingBytes})
+	}
+}
+
+// issue records the violation err found at by[idx], part of the value
+// starting at by[start]
+func (s *scanner) issue(start, idx int, err error) {
+	tag := -1
+	if start < len(s.by) {
+		tag = int(s.by[start] &^ trackFlag)
+	}
+	s.r.Issues = append(s.r.Issues, ScanIssue{s.section, s.base + idx, tag, err})
+	s.stopped = s.stopped || s.first
+}
+
+// truncate records that the value starting at by[start] is cut short. The
+// scan stops there.
+func (s *scanner) truncate(start int) {
+	if !s.truncated {
+		s.truncated = true
+		s.r.TruncatedAt = s.base + start
+		s.issue(start, len(s.by), ErrTruncated)
+	}
+}
+
+// value walks the value starting at by[idx] and returns the offset following
+// it, or the end of the section if it is cut short
+func (s *scanner) value(idx int) int {
+	for idx < len(s.by) && s.by[idx]&^trackFlag == typePAD {
+		idx++
+	}
+	if s.stopped {
+		return len(s.by)
+	}
+	if s.truncated || idx >= len(s.by) {
+		s.truncate(idx)
+		return len(s.by)
+	}
+	if s.depth >= maxScanDepth {
+		s.issue(idx, idx, ErrCorrupt{ErrTooDeep})
+		s.stopped = true
+		return len(s.by)
+	}
+	s.depth++
+	defer func() { s.depth-- }()
+
+	start := idx
+	tag := s.by[idx] &^ trackFlag
+	s.starts[idx] = true
+	s.r.Values++
+	idx++
+
+	switch {
+	case tag < typeVARINT, tag == typeUNDEF, tag == typeCANONICAL_UNDEF, tag == typeTRUE, tag == typeFALSE:
+		return idx
+
+	case tag == typeVARINT, tag == typeZIGZAG:
+		_, idx, _ = s.varint(start, idx)
+		return idx
+
+	case tag == typeCOPY, tag == typeREFP, tag == typeALIAS:
+		offs, idx, ok := s.varint(start, idx)
+		if ok && s.offset(start, offs) && tag != typeCOPY && s.by[offs]&trackFlag == 0 {
+			// the decoder only remembers the values with the track flag
+			corrupt := ErrUntrackedOffsetREFP
+			if tag == typeALIAS {
+				corrupt = ErrUntrackedOffsetAlias
+			}
+			s.issue(start, start, ErrCorrupt{corrupt})
+		}
+		return idx
+
+	case tag == typeFLOAT:
+		return s.fixed(start, idx, 4)
+
+	case tag == typeDOUBLE:
+		return s.fixed(start, idx, 8)
+
+	case tag == typeLONG_DOUBLE:
+		return s.fixed(start, idx, 16)
+
+	case tag == typeBINARY, tag == typeSTR_UTF8:
+		ln, idx, ok := s.varint(start, idx)
+		if !ok {
+			return idx
+		}
+		if ln < 0 || ln > math.MaxInt32 {
+			s.issue(start, start, ErrCorrupt{ErrBadStringSize})
+			s.truncate(start)
+			return len(s.by)
+		}
+		return s.fixed(start, idx, ln)
+
+	case tag >= typeSHORT_BINARY_0 && tag < typeSHORT_BINARY_0+32:
+		return s.fixed(start, idx, int(tag&0x1f))
+
+	case tag == typeREFN, tag == typeWEAKEN:
+		return s.value(idx)
+
+	case tag == typeARRAY, tag == typeHASH:
+		ln, idx, ok := s.varint(start, idx)
+		if !ok {
+			return idx
+		}
+
+		corrupt := ErrBadSliceSize
+		if tag == typeHASH {
+			corrupt = ErrBadHashSize
+			if ln <= math.MaxInt32 {
+				ln *= 2
+			}
+		}
+		if ln < 0 || ln > len(s.by)-idx {
+			// every value takes at least one byte: scan what is there
+			s.issue(start, start, ErrCorrupt{corrupt})
+			ln = len(s.by) - idx
+		}
+
+		return s.values(idx, ln)
+
+	case tag >= typeARRAYREF_0 && tag < typeARRAYREF_0+16:
+		return s.values(idx, int(tag&0x0f))
+
+	case tag >= typeHASHREF_0 && tag < typeHASHREF_0+16:
+		return s.values(idx, 2*int(tag&0x0f))
+
+	case tag == typeOBJECT, tag == typeOBJECT_FREEZE:
+		return s.value(s.stringish(idx))
+
+	case tag == typeREGEXP:
+		return s.stringish(s.stringish(idx))
+
+	case tag == typeOBJECTV, tag == typeOBJECTV_FREEZE:
+		offs, idx, ok := s.varint(start, idx)
+		if !ok {
+			return idx
+		}
+		if s.offset(start, offs) && !isStringishTag(s.by[offs]&^trackFlag) {
+			s.issue(start, start, ErrCorrupt{ErrNotStringish})
+		}
+		return s.value(idx)
+	}
+
+	s.issue(start, start, ErrUnknownTag)
+	return idx
+}
+
+// stringish walks the value starting at by[idx], which must be a string as
+// are class names and the parts of regexps
+func (s *scanner) stringish(idx int) int {
+	for idx < len(s.by) && s.by[idx]&^trackFlag == typePAD {
+		idx++
+	}
+	if idx < len(s.by) && !s.stopped && !isStringishTag(s.by[idx]&^trackFlag) {
+		s.issue(idx, idx, ErrCorrupt{ErrNotStringish})
+	}
+	return s.value(idx)
+}
+
+func (s *scanner) values(idx int, n int) int {
+	for i := 0; i < n && !s.truncated && !s.stopped; i++ {
+		idx = s.value(idx)
+	}
+	return idx
+}
+
+// varint reads the varint starting at by[idx], part of the value starting at
+// by[start]. Bad varints are skipped.
+func (s *scanner) varint(start, idx int) (int, int, bool) {
+	n, sz, err := varintdecodePortable(s.by[idx:])
+	if err == nil {
+		return n, idx + sz, true
+	}
+
+	if idx+sz >= len(s.by) && (sz == 0 || s.by[idx+sz-1]&0x80 != 0) {
+		s.truncate(start)
+		return 0, len(s.by), false
+	}
+
+	// carry on after the last byte of the varint
+	s.issue(start, idx, err)
+	for idx += sz; idx < len(s.by) && s.by[idx-1]&0x80 != 0; idx++ {
+	}
+	return 0, idx, false
+}
+
+// fixed skips the ln bytes starting at by[idx], part of the value starting
+// at by[start]
+func (s *scanner) fixed(start, idx int, ln int) int {
+	if idx+ln > len(s.by) {
+		s.truncate(start)
+		return len(s.by)
+	}
+	return idx + ln
+}
+
+// offset checks the offset offs of the tag at by[start] and reports
+// whether it refers to an earlier value
+func (s *scanner) offset(start, offs int) bool {
+	switch {
+	case offs >= 0 && offs < s.sectionStart:
+		s.issue(start, start, ErrCorrupt{ErrCrossSectionOffset})
+	case offs < 0 || offs >= start:
+		s.issue(start, start, ErrCorrupt{ErrBadOffset})
+	case !s.starts[offs]:
+		s.issue(start, start, ErrCorrupt{ErrOffsetNotValue})
+	default:
+		return true
+	}
+	return false
+}
@@ -1,17 +1,29 @@
 package sereal
 
 import (
+	"bufio"
 	"bytes"
+	"container/list"
+	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
+	"math/big"
+	"math/rand"
 	"os"
 	"path/filepath"
 	"reflect"
+	"regexp"
+	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"testing/iotest"
 	"time"
 
 	"github.com/davecgh/go-spew/spew"
@@ -181,6 +193,8 @@ func TestRoundtripCompat(t *testing.T) {
  *
  * If you pass a file as parameter it will do the same but do more detailed logging.
  *
+ * Test vectors of Go values in every protocol version and compression are
+ * written by testcorpus.Generate and checked by testcorpus.Verify instead.
  */
 func TestCorpus(t *testing.T) {
 
@@ -214,7 +228,11 @@ func TestCorpus(t *testing.T) {
 
 		if debug {
 			t.Log("unmarshalling..")
-			t.Log(hex.Dump(contents))
+			var dump strings.Builder
+			if err := DumpAnnotated(&dump, contents); err != nil {
+				t.Logf("dumping: %v", err)
+			}
+			t.Log(dump.String())
 		}
 		err = d.Unmarshal(contents, &value)
 
@@ -248,8 +266,10 @@ func TestCorpus(t *testing.T) {
 	}
 }
 
-func TestSnappyArray(t *testing.T) { testCompressedArray(t, "snappy", SnappyCompressor{true}) }
-func TestZlibArray(t *testing.T)   { testCompressedArray(t, "zlib", ZlibCompressor{}) }
+func TestSnappyArray(t *testing.T) {
+	testCompressedArray(t, "snappy", SnappyCompressor{Incremental: true})
+}
+func TestZlibArray(t *testing.T) { testCompressedArray(t, "zlib", ZlibCompressor{}) }
 
 func testCompressedArray(t *testing.T, name string, compression compressor) {
 	defer func() {
@@ -710,11 +730,63 @@ func TestBinaryMarshaller(t *testing.T) {
 	var eintf interface{}
 
 	err = d.Unmarshal(x, &eintf)
-	if err != errUnmarshaler {
+	if !errors.Is(err, errUnmarshaler) {
 		t.Errorf("failed to error unpacking registered error type: %s", err)
 	}
 }
 
+func TestWithClasses(t *testing.T) {
+	now := time.Now()
+
+	x, err := Marshal(now)
+	if err != nil {
+		t.Fatalf("error marshalling %s", err)
+	}
+
+	d := &Decoder{}
+
+	// per-call registration
+	var tm time.Time
+	var intf interface{}
+	err = d.Unmarshal(x, &intf, WithClasses(map[string]interface{}{"time.Time": &tm}))
+	if err != nil {
+		t.Fatalf("error unpacking with per-call classes: %s", err)
+	}
+
+	if rtime, ok := intf.(*time.Time); !ok || !now.Equal(*rtime) {
+		t.Errorf("failed unpacking with per-call classes: got=%#v", intf)
+	}
+
+	// the decoder's own registry must be unaffected
+	intf = nil
+	if err = d.Unmarshal(x, &intf); err != nil {
+		t.Fatalf("error unpacking: %s", err)
+	}
+
+	if _, ok := intf.(*PerlFreeze); !ok {
+		t.Errorf("per-call classes leaked into decoder: got=%#v", intf)
+	}
+
+	// per-call registration takes precedence over the decoder's registry
+	var errunmarshaler ErrorBinaryUnmarshaler
+	d.RegisterName("time.Time", &errunmarshaler)
+
+	intf = nil
+	err = d.Unmarshal(x, &intf, WithClasses(map[string]interface{}{"time.Time": &tm}))
+	if err != nil {
+		t.Fatalf("error unpacking with overridden class: %s", err)
+	}
+
+	if _, ok := intf.(*time.Time); !ok {
+		t.Errorf("per-call classes did not override decoder: got=%#v", intf)
+	}
+
+	intf = nil
+	if err = d.Unmarshal(x, &intf); !errors.Is(err, errUnmarshaler) {
+		t.Errorf("decoder registry not used after per-call override: %v", err)
+	}
+}
+
 func TestUnmarshalHeaderError(t *testing.T) {
 
 	testcases := []struct {
@@ -1299,3 +1371,5796 @@ func TestDoubleUnmarshal(t *testing.T) {
 		}
 	}
 }
+
+// withGarbageCapacity returns a copy of b followed, beyond its length, by
+// extra bytes of garbage
+func withGarbageCapacity(b []byte, extra int) []byte {
+	buf := make([]byte, len(b)+extra)
+	copy(buf, b)
+	for i := len(b); i < len(buf); i++ {
+		buf[i] = 0xff
+	}
+	return buf[:len(b)]
+}
+
+func TestCapacityBeyondLength(t *testing.T) {
+	zlib := NewEncoderV3()
+	zlib.Compression = ZlibCompressor{}
+	zlib.CompressionThreshold = 0
+
+	snappy := NewEncoderV3()
+	snappy.Compression = SnappyCompressor{Incremental: true}
+	snappy.CompressionThreshold = 0
+
+	legacy := NewEncoder()
+	legacy.Compression = SnappyCompressor{}
+	legacy.CompressionThreshold = 0
+
+	body := []interface{}{"a string", []byte("some bytes"), map[string]interface{}{"key": "value"}, 42}
+
+	for _, e := range []*Encoder{NewEncoder(), NewEncoderV2(), NewEncoderV3(), zlib, snappy, legacy} {
+		exact, err := e.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var want interface{}
+		if err := Unmarshal(exact, &want); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, extra := range []int{1, 16, 4096} {
+			b := withGarbageCapacity(exact, extra)
+			full := b[:cap(b)]
+			check := func(what string) {
+				if !bytes.Equal(b, exact) {
+					t.Errorf("version %d, extra %d: %s modified the document", e.version, extra, what)
+				}
+				for i := len(b); i < len(full); i++ {
+					if full[i] != 0xff {
+						t.Errorf("version %d, extra %d: %s wrote beyond the document", e.version, extra, what)
+						break
+					}
+				}
+			}
+
+			var got interface{}
+			if err := Unmarshal(b, &got); err != nil || !reflect.DeepEqual(got, want) {
+				t.Errorf("version %d, extra %d: unexpected body %v (%v)", e.version, extra, got, err)
+			}
+			check("Unmarshal")
+
+			// appending to decoded byte slices must not reach the document
+			var typed []interface{}
+			if err := Unmarshal(b, &typed); err != nil {
+				t.Fatal(err)
+			}
+			for _, v := range typed {
+				if bs, ok := v.([]byte); ok {
+					_ = append(bs, "overflow"...)
+				}
+			}
+			var raw []RawMessage
+			if err := Unmarshal(b, &raw); err != nil {
+				t.Fatal(err)
+			}
+			for _, m := range raw {
+				_ = append(m, "overflow"...)
+			}
+			check("appending to decoded values")
+
+			if _, err := DecompressDocument(nil, b); err != nil {
+				t.Error(err)
+			}
+			check("DecompressDocument")
+
+			if _, err := PeekHeader(b); err != nil {
+				t.Error(err)
+			}
+			check("PeekHeader")
+
+			if e.version > 1 {
+				m := NewMergerV3()
+				if _, err := m.Append(b); err != nil {
+					t.Error(err)
+				}
+				if _, err := m.Finish(); err != nil {
+					t.Error(err)
+				}
+				check("Merger")
+			}
+		}
+	}
+
+	// decoding into byte slices with more or less room than needed
+	b, _ := Marshal([]byte("12345"))
+	for _, dst := range [][]byte{nil, []byte("ab"), []byte("abcdefgh"), make([]byte, 1, 100)} {
+		if err := Unmarshal(b, &dst); err != nil || string(dst) != "12345" {
+			t.Errorf("unexpected byte slice %q (%v)", dst, err)
+		}
+	}
+}
+
+func TestConcurrentDecoder(t *testing.T) {
+	type A struct {
+		Name  string
+		Items []string
+	}
+
+	// shared references exercise the per-call tracked offsets
+	shared := &A{Name: "shared"}
+	input := []interface{}{shared, shared, A{Name: "plain", Items: []string{"x", "y"}}}
+
+	b, err := Marshal(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &Decoder{}
+
+	var expected interface{}
+	if err := d.Unmarshal(b, &expected); err != nil {
+		t.Fatal(err)
+	}
+
+	var typed []A
+	if err := d.Unmarshal(b, &typed); err != nil {
+		t.Fatal(err)
+	}
+
+	const workers = 8
+	errs := make(chan error, workers)
+
+	for i := 0; i < workers; i++ {
+		go func() {
+			for j := 0; j < 100; j++ {
+				var got interface{}
+				if err := d.Unmarshal(b, &got); err != nil {
+					errs <- err
+					return
+				}
+
+				if !reflect.DeepEqual(expected, got) {
+					errs <- errors.New("concurrent decode mismatch")
+					return
+				}
+
+				var gotTyped []A
+				if err := d.Unmarshal(b, &gotTyped); err != nil {
+					errs <- err
+					return
+				}
+
+				if !reflect.DeepEqual(typed, gotTyped) {
+					errs <- errors.New("concurrent typed decode mismatch")
+					return
+				}
+			}
+			errs <- nil
+		}()
+	}
+
+	for i := 0; i < workers; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestWithReport(t *testing.T) {
+	type In struct {
+		Name    []byte
+		Created time.Time
+		Extra   string
+		Tags    []string
+		Any     map[string]interface{}
+	}
+
+	type Out struct {
+		Name    string
+		Created time.Time
+		Tags    [1]string
+		Any     interface{}
+	}
+
+	in := In{
+		Name:    []byte("foo"),
+		Created: time.Now(),
+		Extra:   "dropped",
+		Tags:    []string{"a", "b"},
+		Any:     map[string]interface{}{"x": 1},
+	}
+
+	b, err := Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var report DecodeReport
+	var out Out
+	if err := Unmarshal(b, &out, WithReport(&report)); err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(map[string]DecodeBranch)
+	for _, e := range report.Entries {
+		got[e.Path] = e.Branch
+	}
+
+	expected := map[string]DecodeBranch{
+		"body":         BranchReflection,
+		"body.Name":    BranchCoercion,
+		"body.Created": BranchUnmarshaler,
+		"body.Extra":   BranchSkipped,
+		"body.Tags":    BranchReflection,
+		"body.Tags[0]": BranchReflection,
+		"body.Tags[1]": BranchSkipped,
+		"body.Any":     BranchFastPath,
+	}
+
+	if !reflect.DeepEqual(expected, got) {
+		t.Errorf("unexpected report:\n%s", report.String())
+	}
+}
+
+// point is coded by hand the way sereal-gen generates codecs
+type point struct {
+	X, Y int
+	Name string
+}
+
+func (p point) MarshalSereal() ([]byte, error) {
+	b := AppendHashHeader(nil, 3)
+	b = AppendString(b, "X")
+	b = AppendInt(b, int64(p.X))
+	b = AppendString(b, "Y")
+	b = AppendInt(b, int64(p.Y))
+	b = AppendString(b, "Name")
+	return AppendString(b, p.Name), nil
+}
+
+func (p *point) UnmarshalSereal(b []byte) error {
+	r := NewValueReader(b)
+	n, err := r.ReadHash()
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < n; i++ {
+		key, err := r.ReadString()
+		if err != nil {
+			return err
+		}
+
+		var v int64
+		switch key {
+		case "X":
+			v, err = r.ReadInt()
+			p.X = int(v)
+		case "Y":
+			v, err = r.ReadInt()
+			p.Y = int(v)
+		case "Name":
+			p.Name, err = r.ReadString()
+		default:
+			err = r.Skip()
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func TestMarshalerUnmarshaler(t *testing.T) {
+	in := []point{{1, -2, "a"}, {300, -400, "b"}}
+
+	b, err := Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out []point
+	if err := Unmarshal(b, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("roundtrip mismatch: got %v, expected %v", out, in)
+	}
+
+	// keys deduplicated by the reflection encoder are resolved before the
+	// value reaches UnmarshalSereal
+	maps := []map[string]interface{}{{"X": 1, "Y": 2, "Extra": []int{1}}, {"X": 3, "Y": 4}}
+	if b, err = NewEncoderV3().Marshal(maps); err != nil {
+		t.Fatal(err)
+	}
+
+	out = nil
+	if err := Unmarshal(b, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := []point{{1, 2, ""}, {3, 4, ""}}; !reflect.DeepEqual(expected, out) {
+		t.Errorf("got %v, expected %v", out, expected)
+	}
+}
+
+func TestAppendValue(t *testing.T) {
+	b, err := AppendValue(nil, map[string]interface{}{"foo": []int{1, 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var v map[string][]int
+	if err := NewValueReader(b).Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(v, map[string][]int{"foo": {1, 2}}) {
+		t.Errorf("unexpected value %v", v)
+	}
+
+	p := &point{}
+	if _, err := AppendValue(nil, []*point{p, p}); err != nil {
+		t.Errorf("shared pointer to a Marshaler should not be deduplicated: %s", err)
+	}
+}
+
+type logRecorder []string
+
+func (l *logRecorder) Printf(format string, v ...interface{}) {
+	*l = append(*l, fmt.Sprintf(format, v...))
+}
+
+func TestTolerantSnappyLength(t *testing.T) {
+	e := NewEncoderV3()
+	e.Compression = SnappyCompressor{Incremental: true}
+	e.CompressionThreshold = 0
+
+	in := strings.Repeat("Sereal ", 10)
+	b, err := e.Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bodyStart := headerSize + 1
+	if b[bodyStart] >= 0x7c {
+		t.Fatalf("test expects a single byte length prefix, got 0x%x", b[bodyStart])
+	}
+
+	tooLong := append([]byte(nil), b...)
+	tooLong[bodyStart] += 3
+	tooLong = append(tooLong, 0xde, 0xad, 0xbe)
+
+	tooShort := append([]byte(nil), b...)
+	tooShort[bodyStart] -= 2
+
+	for _, doc := range [][]byte{tooLong, tooShort} {
+		var out string
+		if err := Unmarshal(doc, &out); err == nil {
+			t.Errorf("inconsistent length should fail without TolerantSnappyLength")
+		}
+
+		var logs logRecorder
+		d := &Decoder{TolerantSnappyLength: true, Logger: &logs}
+		if err := d.Unmarshal(doc, &out); err != nil {
+			t.Errorf("tolerant decoding failed: %s", err)
+			continue
+		}
+
+		if out != in {
+			t.Errorf("got %q, expected %q", out, in)
+		}
+
+		if len(logs) != 1 {
+			t.Errorf("expected the anomaly to be logged once, got %q", logs)
+		}
+	}
+
+	// a length prefix running past the body, and a block whose literal
+	// produces more than the decoded length it announces, so that its
+	// length can't be recovered either
+	pastBody := append(append([]byte(nil), b[:bodyStart]...), 0x7f, 1, 0)
+	overrun := append(append([]byte(nil), b[:bodyStart]...), 0, 1, 3<<2, 'a', 'b', 'c', 'd')
+
+	for _, tt := range []struct {
+		doc      []byte
+		tolerant bool
+		cause    error
+	}{
+		{pastBody, false, ErrBadSnappyLength},
+		{overrun, true, ErrBadSnappyBlock},
+	} {
+		var out string
+		var serr *SnappyError
+		err := (&Decoder{TolerantSnappyLength: tt.tolerant}).Unmarshal(tt.doc, &out)
+		if !errors.As(err, &serr) || !serr.Incremental || !errors.Is(err, tt.cause) {
+			t.Errorf("expected an incremental SnappyError caused by %q, got %v", tt.cause, err)
+		}
+	}
+}
+
+func TestSnappyIncrementalV1(t *testing.T) {
+	e := NewEncoderV3()
+	e.Compression = SnappyCompressor{Incremental: true}
+	e.CompressionThreshold = 0
+	if err := e.SetVersion(1); err != nil {
+		t.Fatal(err)
+	}
+
+	in := strings.Repeat("Sereal ", 10)
+	b, err := e.Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if documentType(b[4]>>4) != serealSnappyIncremental {
+		t.Errorf("got document type %d", b[4]>>4)
+	}
+
+	var out string
+	if err := Unmarshal(b, &out); err != nil || out != in {
+		t.Errorf("got %q, %v", out, err)
+	}
+
+	// v1 Encoders used to label these bodies snappy, which no decoder reads
+	old := append([]byte(nil), b...)
+	old[4] = old[4]&0x0f | byte(serealSnappy)<<4
+	if err := Unmarshal(old, &out); err == nil {
+		t.Errorf("decoded a length-prefixed body labelled snappy")
+	}
+
+	// non-incremental compressors still write the snappy type
+	e.Compression = SnappyCompressor{}
+	if b, err = e.Marshal(in); err != nil {
+		t.Fatal(err)
+	}
+	if documentType(b[4]>>4) != serealSnappy {
+		t.Errorf("got document type %d", b[4]>>4)
+	}
+	if err := Unmarshal(b, &out); err != nil || out != in {
+		t.Errorf("got %q, %v", out, err)
+	}
+}
+
+func TestConvert(t *testing.T) {
+	type Inner struct {
+		Weight float32
+		Blob   string
+	}
+
+	type Out struct {
+		Name   string
+		Count  int8
+		Tags   [2]string
+		Inner  *Inner
+		ByName map[string]Inner
+		Pt     point
+		Any    interface{}
+	}
+
+	in := map[string]interface{}{
+		"name":   "foo",
+		"count":  -3,
+		"tags":   []string{"a", "b", "c"},
+		"inner":  map[string]interface{}{"weight": 1.5, "blob": []byte("xyz")},
+		"byName": map[string]interface{}{"x": map[string]interface{}{"Weight": 2.5}},
+		"pt":     map[string]interface{}{"X": 1, "Y": 2},
+		"any":    []interface{}{1, "two"},
+		"extra":  true,
+	}
+
+	b, err := Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var direct Out
+	if err := Unmarshal(b, &direct); err != nil {
+		t.Fatal(err)
+	}
+
+	var untyped interface{}
+	if err := Unmarshal(b, &untyped); err != nil {
+		t.Fatal(err)
+	}
+
+	var converted Out
+	if err := Convert(untyped, &converted); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(direct, converted) {
+		t.Errorf("Convert differs from Unmarshal:\n%s\n%s", spew.Sdump(converted), spew.Sdump(direct))
+	}
+
+	var wrong []int
+	if err := Convert(untyped, &wrong); err == nil {
+		t.Errorf("converting a hash into a slice should fail")
+	}
+}
+
+// shape is encoded as an object so that it can be decoded polymorphically
+type shape struct {
+	Sides int
+}
+
+func (s shape) MarshalSereal() ([]byte, error) {
+	b := AppendObjectHeader(nil, "Shape")
+	b = AppendHashHeader(b, 1)
+	b = AppendString(b, "sides")
+	return AppendInt(b, int64(s.Sides)), nil
+}
+
+func (s *shape) UnmarshalSereal(b []byte) error {
+	r := NewValueReader(b)
+	if _, err := r.ReadHash(); err != nil {
+		return err
+	}
+
+	if _, err := r.ReadString(); err != nil {
+		return err
+	}
+
+	v, err := r.ReadInt()
+	s.Sides = int(v)
+	return err
+}
+
+type badMarshaler struct{}
+
+func (badMarshaler) MarshalSereal() ([]byte, error) {
+	return []byte{typeTRUE, typeFALSE}, nil
+}
+
+func TestMarshalerRegistered(t *testing.T) {
+	b, err := Marshal([]interface{}{shape{3}, shape{4}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &Decoder{}
+	d.RegisterName("Shape", &shape{})
+
+	var out []interface{}
+	if err := d.Unmarshal(b, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []interface{}{&shape{3}, &shape{4}}
+	if !reflect.DeepEqual(out, expected) {
+		t.Errorf("got %s, expected %s", spew.Sdump(out), spew.Sdump(expected))
+	}
+
+	// without registration the object decodes as its contents
+	out = nil
+	if err := Unmarshal(b, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := out[0].(map[string]interface{}); !ok {
+		t.Errorf("unregistered class decoded into %T", out[0])
+	}
+}
+
+func TestMarshalerError(t *testing.T) {
+	_, err := Marshal(map[string]interface{}{"bad": badMarshaler{}})
+
+	var merr *MarshalerError
+	if !errors.As(err, &merr) {
+		t.Fatalf("expected a MarshalerError, got %v", err)
+	}
+
+	if merr.Type != reflect.TypeOf(badMarshaler{}) || merr.Err != errTrailingData {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestPrecompile(t *testing.T) {
+	type Leaf struct {
+		Name string `sereal:"name,omitempty"`
+	}
+
+	type Root struct {
+		Leaves map[string][]*Leaf
+		Count  int
+	}
+
+	d := &Decoder{}
+	if err := d.Precompile(Root{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := tcache.fields.Load(reflect.TypeOf(Leaf{})); !ok {
+		t.Errorf("nested struct type was not precompiled")
+	}
+
+	type Duplicate struct {
+		A string `sereal:"x"`
+		B string `sereal:"x"`
+	}
+
+	type BadOption struct {
+		A string `sereal:"a,omitnothing"`
+	}
+
+	e := NewEncoder()
+	for _, v := range []interface{}{Duplicate{}, &[]BadOption{}, reflect.TypeOf(Leaf{})} {
+		err := e.Precompile(v)
+		if _, ok := v.(reflect.Type); ok == (err != nil) {
+			t.Errorf("Precompile(%T) returned %v", v, err)
+		}
+	}
+}
+
+func TestZlibDictionary(t *testing.T) {
+	dict := []byte(strings.Repeat("sereal dictionary ", 8))
+
+	e := NewEncoderV3()
+	e.Compression = ZlibCompressor{Dictionary: dict, DictionaryID: "v1"}
+	e.CompressionThreshold = 0
+
+	body := strings.Repeat("sereal dictionary ", 4)
+	b, err := e.MarshalWithHeader(map[string]int{"user": 1}, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resolved := 0
+	d := &Decoder{DictionaryResolver: func(id string) ([]byte, error) {
+		resolved++
+		if id != "v1" {
+			return nil, fmt.Errorf("unknown dictionary %q", id)
+		}
+		return dict, nil
+	}}
+
+	var header map[string]interface{}
+	var out string
+	if err := d.UnmarshalHeaderBody(b, &header, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	if out != body || resolved != 1 {
+		t.Errorf("got %q after %d lookups", out, resolved)
+	}
+
+	if header["user"] != 1 || header[DictionaryKey] != "v1" {
+		t.Errorf("unexpected header %v", header)
+	}
+
+	if err := Unmarshal(b, &out); err == nil {
+		t.Errorf("decoding without a resolver should fail")
+	}
+
+	if _, err := e.MarshalWithHeader(struct{ A int }{1}, body); err == nil {
+		t.Errorf("struct headers can't carry a dictionary identifier")
+	}
+}
+
+func TestDecoderDictionary(t *testing.T) {
+	dict := []byte(strings.Repeat("sereal dictionary ", 8))
+
+	e := NewEncoderV3()
+	e.Compression = ZlibCompressor{Dictionary: dict}
+	e.CompressionThreshold = 0
+
+	body := strings.Repeat("sereal dictionary ", 4)
+	b, err := e.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out string
+	if err := Unmarshal(b, &out); err == nil {
+		t.Errorf("decoding without the dictionary should fail")
+	}
+
+	d := &Decoder{Dictionary: dict}
+	if err := d.Unmarshal(b, &out); err != nil || out != body {
+		t.Errorf("got %q, %v", out, err)
+	}
+
+	out = ""
+	if err := d.UnmarshalBodyOnly(b, &out); err != nil || out != body {
+		t.Errorf("body only: got %q, %v", out, err)
+	}
+}
+
+func TestCanonicalFloats(t *testing.T) {
+	// DOUBLE encodings produced by Perl for the same decimal literals
+	tests := []struct {
+		decimal string
+		perl    string
+	}{
+		{"0.1", "239a9999999999b93f"},
+		{"1.5", "23000000000000f83f"},
+		{"-2.75", "2300000000000006c0"},
+		{"3.14159", "236e861bf0f9210940"},
+		{"1e10", "23000000205fa00242"},
+	}
+
+	e := NewEncoderV3()
+	e.CanonicalFloats = true
+
+	for _, tc := range tests {
+		f64, _ := strconv.ParseFloat(tc.decimal, 64)
+		f32, _ := strconv.ParseFloat(tc.decimal, 32)
+
+		for _, v := range []interface{}{f64, float32(f32)} {
+			b, err := e.Marshal(v)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if body := hex.EncodeToString(b[headerSize+1:]); body != tc.perl {
+				t.Errorf("%s as %T: got %s, expected %s", tc.decimal, v, body, tc.perl)
+			}
+		}
+
+		if !FloatEqual(f64, float32(f32)) {
+			t.Errorf("FloatEqual(%v, float32(%v)) = false", f64, f32)
+		}
+	}
+
+	nan32, nan64 := float32(math.NaN()), math.Float64frombits(0x7ff0000000000001)
+	for _, v := range []interface{}{nan32, nan64} {
+		b, err := e.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if body := hex.EncodeToString(b[headerSize+1:]); body != "23000000000000f87f" {
+			t.Errorf("NaN as %T: got %s", v, body)
+		}
+	}
+
+	if !FloatEqual(nan32, nan64) || FloatEqual(1.0, 1) || FloatEqual(float32(0.1), 0.10000001) {
+		t.Errorf("unexpected FloatEqual results")
+	}
+}
+
+func TestCaptureClass(t *testing.T) {
+	type Blessed struct {
+		Class string `sereal:",class"`
+		Name  string
+	}
+
+	b, err := Marshal(Blessed{Class: "My::Class", Name: "foo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var s Blessed
+	if err := Unmarshal(b, &s); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.Class != "My::Class" || s.Name != "foo" {
+		t.Errorf("unexpected struct %+v", s)
+	}
+
+	var m map[string]interface{}
+	if err := Unmarshal(b, &m); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := m[ClassKey]; ok || len(m) != 1 {
+		t.Errorf("class should only be captured into maps on request, got %v", m)
+	}
+
+	m = nil
+	d := &Decoder{ClassIntoMaps: true}
+	for _, v := range []interface{}{&m, new(interface{})} {
+		if err := d.Unmarshal(b, v); err != nil {
+			t.Fatal(err)
+		}
+
+		got := reflect.ValueOf(v).Elem().Interface()
+		if !reflect.DeepEqual(got, map[string]interface{}{"Name": "foo", ClassKey: "My::Class"}) {
+			t.Errorf("unexpected map %v", got)
+		}
+	}
+
+	// without a class name the type name is used
+	if b, err = Marshal(Blessed{Name: "bar"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Unmarshal(b, &s); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.Class != "Blessed" {
+		t.Errorf("got class %q", s.Class)
+	}
+}
+
+func TestRegisterClass(t *testing.T) {
+	type User struct {
+		Class string `sereal:",class"`
+		Name  string
+		Age   int
+	}
+
+	type Group struct {
+		Name string
+	}
+
+	b, err := Marshal([]interface{}{
+		User{Class: "My::User", Name: "foo", Age: 42},
+		Group{Name: "admins"},
+		User{Class: "My::Other", Name: "bar"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &Decoder{}
+	d.RegisterClass("My::User", &User{})
+	d.RegisterClass("Group", Group{})
+
+	var out []interface{}
+	if err := d.Unmarshal(b, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []interface{}{
+		&User{Class: "My::User", Name: "foo", Age: 42},
+		Group{Name: "admins"},
+		map[string]interface{}{"Name": "bar", "Age": 0},
+	}
+
+	if !reflect.DeepEqual(out, expected) {
+		t.Errorf("got %s, expected %s", spew.Sdump(out), spew.Sdump(expected))
+	}
+}
+
+func TestHeaderOffsets(t *testing.T) {
+	header := []interface{}{
+		map[string]interface{}{"key": "first"},
+		map[string]interface{}{"key": "second"}, // key is encoded as a COPY
+	}
+
+	b, err := NewEncoderV3().MarshalWithHeader(header, "body")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Contains(b, []byte{typeCOPY}) {
+		t.Fatal("expected the header to use COPY")
+	}
+
+	var got []interface{}
+	if err := NewDecoder().UnmarshalHeader(b, &got); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(got, header) {
+		t.Errorf("got header %v, expected %v", got, header)
+	}
+}
+
+func TestCrossSectionOffsets(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  string
+	}{
+		// v3: the root of the body is a REFP to the last byte of the header
+		{"refp", "3df3726c03" + "020101" + "29" + "00"},
+		// v1: a COPY of the header
+		{"copy", "3d73726c01" + "00" + "2f" + "04"},
+		// v3: the header user data refers to the flag byte
+		{"header", "3df3726c03" + "03" + "01" + "2f00" + "01"},
+	}
+
+	for _, tc := range tests {
+		doc, _ := hex.DecodeString(tc.doc)
+
+		var header, body interface{}
+		err := NewDecoder().UnmarshalHeaderBody(doc, &header, &body)
+		if !errors.Is(err, ErrCorrupt{ErrCrossSectionOffset}) {
+			t.Errorf("%s: expected a cross section error, got %v", tc.name, err)
+		}
+	}
+}
+
+func TestEncoderRegisterClass(t *testing.T) {
+	type Item struct {
+		ID int
+	}
+
+	type Plain struct {
+		ID int
+	}
+
+	e := NewEncoderV3()
+	e.StructAsMap = true
+	e.RegisterClass(&Item{}, "My::Item")
+
+	b, err := e.Marshal([]interface{}{Item{1}, Item{2}, Plain{3}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Contains(b, []byte{typeOBJECTV}) {
+		t.Errorf("expected the second object to use OBJECTV")
+	}
+
+	var perl []interface{}
+	if err := (&Decoder{PerlCompat: true}).Unmarshal(b, &perl); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, v := range perl[:2] {
+		if obj, ok := v.(*PerlObject); !ok || obj.Class != "My::Item" {
+			t.Errorf("element %d: expected a My::Item object, got %s", i, spew.Sdump(v))
+		}
+	}
+
+	d := &Decoder{}
+	d.RegisterClass("My::Item", Item{})
+
+	var out []interface{}
+	if err := d.Unmarshal(b, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []interface{}{Item{1}, Item{2}, map[string]interface{}{"ID": 3}}
+	if !reflect.DeepEqual(out, expected) {
+		t.Errorf("got %s, expected %s", spew.Sdump(out), spew.Sdump(expected))
+	}
+}
+
+func TestNestedCopy(t *testing.T) {
+	// ["foo", COPY of "foo", COPY of the COPY]
+	doc, _ := hex.DecodeString("3df3726c0300" + "2b03" + "63666f6f" + "2f03" + "2f07")
+
+	var out []string
+	if err := Unmarshal(doc, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(out, []string{"foo", "foo", "foo"}) {
+		t.Errorf("unexpected value %v", out)
+	}
+
+	var iface interface{}
+	if err := Unmarshal(doc, &iface); err != nil {
+		t.Fatal(err)
+	}
+
+	d := &Decoder{MaxCopyDepth: 1}
+	for _, v := range []interface{}{new([]string), new(interface{})} {
+		err := d.Unmarshal(doc, v)
+		if !errors.Is(err, ErrCorrupt{ErrNestedCOPY}) {
+			t.Errorf("expected a nested COPY error, got %v", err)
+		}
+	}
+}
+
+func TestDecodeError(t *testing.T) {
+	v := map[string]interface{}{"users": []interface{}{
+		map[string]interface{}{"name": "a"},
+		map[string]interface{}{"name": "b"},
+		map[string]interface{}{"name": "xyzzy"},
+	}}
+	b, err := Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// turn the STR_UTF8 tag of "xyzzy" into an unknown one
+	at := bytes.Index(b, []byte("xyzzy")) - 2
+	if b[at] != typeSTR_UTF8 {
+		t.Fatalf("unexpected tag 0x%x at %d", b[at], at)
+	}
+	corrupt := append([]byte(nil), b...)
+	corrupt[at] = 0x34
+
+	type users struct {
+		Users []struct{ Name string }
+	}
+	for _, tt := range []struct {
+		doc    []byte
+		v      interface{}
+		offset int
+		tag    int
+		err    error
+	}{
+		{corrupt, new(interface{}), at - headerSize, 0x34, ErrUnknownTag},
+		{corrupt, new(users), at - headerSize, 0x34, ErrUnknownTag},
+		{b[:at+4], new(interface{}), at - headerSize, typeSTR_UTF8, ErrTruncated},
+		{b[:at+4], new(users), at - headerSize, typeSTR_UTF8, ErrTruncated},
+	} {
+		err := Unmarshal(tt.doc, tt.v)
+
+		var derr *DecodeError
+		if !errors.As(err, &derr) || !errors.Is(err, tt.err) {
+			t.Errorf("%T: expected a DecodeError wrapping %v, got %v", tt.v, tt.err, err)
+			continue
+		}
+		if derr.Path != "body.users[2].name" || derr.Offset != tt.offset || derr.Tag != tt.tag {
+			t.Errorf("%T: unexpected location %s at %d on tag 0x%x", tt.v, derr.Path, derr.Offset, derr.Tag)
+		}
+		if want := fmt.Sprintf("at body.users[2].name (offset %d, %s)", tt.offset, tagName(byte(tt.tag))); !strings.HasSuffix(err.Error(), want) {
+			t.Errorf("%T: got %q, expected it to end with %q", tt.v, err, want)
+		}
+	}
+}
+
+func TestErrorPathWithoutReport(t *testing.T) {
+	type S struct {
+		I8 int8
+	}
+	type items struct {
+		Items []S
+	}
+
+	for _, tt := range []struct {
+		v    map[string]interface{}
+		into func() interface{}
+		path string
+	}{
+		{map[string]interface{}{"Items": []interface{}{map[string]interface{}{}, map[string]interface{}{"Other": 1}}}, func() interface{} { return new(items) }, "body.Items[1].Other"},
+		{map[string]interface{}{"m": map[string]interface{}{"k": map[string]interface{}{"I8": 300}}}, func() interface{} { return new(map[string]map[string]S) }, "body.m.k.I8"},
+		{map[string]interface{}{"a": []interface{}{1, []interface{}{map[string]interface{}{"I8": 300}}}}, func() interface{} { return new(map[string][]interface{}) }, ""},
+	} {
+		b, err := Marshal(tt.v)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		d := &Decoder{Strict: true}
+		err = d.Unmarshal(b, tt.into())
+		var report DecodeReport
+		reported := d.Unmarshal(b, tt.into(), WithReport(&report))
+
+		if (err == nil) != (tt.path == "") || (err != nil && err.Error() != reported.Error()) {
+			t.Errorf("%v: got %v, expected %v as with a report", tt.v, err, reported)
+			continue
+		}
+		if err == nil {
+			continue
+		}
+
+		var derr *DecodeError
+		var serr *StrictError
+		if !errors.As(err, &derr) || !errors.As(err, &serr) || derr.Path != tt.path || serr.Path != tt.path {
+			t.Errorf("%v: expected the path %s, got %v", tt.v, tt.path, err)
+		}
+	}
+}
+
+func TestCorruptionCauses(t *testing.T) {
+	body := func(tags ...byte) []byte {
+		return append([]byte("=\xf3rl\x03\x00"), tags...)
+	}
+	for _, tt := range []struct {
+		doc   []byte
+		cause error
+	}{
+		{body(typeREFP, 5), ErrBadOffset},
+		{body(typeARRAY, 2, 1, typeREFP, 3), ErrUntrackedOffsetREFP},
+		{body(typeVARINT, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01), ErrBadVarint},
+		{body(typeARRAY, 0xff, 0xff, 0xff, 0xff, 0x7f), ErrBadSliceSize},
+		{body(typeOBJECT, 1, 1), ErrNotStringish},
+	} {
+		var v interface{}
+		err := Unmarshal(tt.doc, &v)
+
+		var corrupt ErrCorrupt
+		if !errors.As(err, &corrupt) || !errors.Is(err, tt.cause) || errors.Is(err, ErrTruncated) {
+			t.Errorf("%q: expected corruption caused by %v, got %v", tt.doc, tt.cause, err)
+		}
+		if !strings.Contains(err.Error(), tt.cause.Error()) {
+			t.Errorf("%q: cause missing from %q", tt.doc, err)
+		}
+	}
+
+	var v interface{}
+	err := Unmarshal(body(typeARRAY, 2, 1), &v)
+	var corrupt ErrCorrupt
+	if !errors.Is(err, ErrTruncated) || errors.As(err, &corrupt) {
+		t.Errorf("expected a truncated document, got %v", err)
+	}
+}
+
+func TestCanonical(t *testing.T) {
+	type S struct {
+		A, B, C, D, E string
+		M             map[string]int
+	}
+
+	build := func() interface{} {
+		m := make(map[string]interface{})
+		for i := 0; i < 32; i++ {
+			k := strconv.Itoa(i)
+			m["key"+k] = map[string]interface{}{"name": k, "value": i}
+		}
+		m["struct"] = S{A: "a", C: "c", M: map[string]int{"x": 3, "y": -1, "z": 10}}
+		return m
+	}
+
+	e := NewEncoderV3()
+	e.Canonical = true
+
+	expected, err := e.Marshal(build())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		b, err := e.Marshal(build())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(b, expected) {
+			t.Fatalf("canonical encoding differs between runs")
+		}
+	}
+
+	var out map[string]interface{}
+	if err := Unmarshal(expected, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(out) != 33 {
+		t.Errorf("unexpected decoded map of %d entries", len(out))
+	}
+}
+
+func TestOptions(t *testing.T) {
+	var eo EncoderOptions
+	err := json.Unmarshal([]byte(`{"version":1,"protocol_version":3,"compression":"zlib","compression_level":9,"compression_threshold":0,"canonical":true}`), &eo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := eo.NewEncoder()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if e.version != 3 || e.CompressionThreshold != 0 || !e.Canonical {
+		t.Errorf("options not applied: %+v", e)
+	}
+	if c, ok := e.Compression.(ZlibCompressor); !ok || c.Level != 9 {
+		t.Errorf("unexpected compressor %#v", e.Compression)
+	}
+
+	var do DecoderOptions
+	if err := json.Unmarshal([]byte(`{"version":1,"perl_compat":true,"max_copy_depth":2}`), &do); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := do.NewDecoder()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !d.PerlCompat || d.MaxCopyDepth != 2 {
+		t.Errorf("options not applied: %+v", d)
+	}
+
+	b, err := e.Marshal(map[string]interface{}{"foo": "bar"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out interface{}
+	if err := d.Unmarshal(b, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	bad := []EncoderOptions{
+		{},
+		{Version: OptionsVersion + 1},
+		{Version: 1, ProtocolVersion: 2, Compression: "zlib"},
+		{Version: 1, Compression: "snappy"},
+		{Version: 1, Compression: "lz4"},
+		{Version: 1, Compression: "snappy_incr", CompressionLevel: 3},
+		{Version: 1, Compression: "zstd"},
+		{Version: 1, ProtocolVersion: 4, Compression: "zstd", CompressionLevel: 42},
+		{Version: 1, ProtocolVersion: 5},
+	}
+
+	for _, o := range bad {
+		if err := o.Validate(); err == nil {
+			t.Errorf("expected error validating %+v", o)
+		}
+	}
+
+	if err := (DecoderOptions{Version: 1, MaxCopyDepth: -1}).Validate(); err == nil {
+		t.Errorf("expected error for negative MaxCopyDepth")
+	}
+}
+
+func TestOptionsErrorListsAllProblems(t *testing.T) {
+	err := EncoderOptions{Version: 1, ProtocolVersion: 1, Compression: "zlib", CompressionLevel: 42, TimeFormat: "julian"}.Validate()
+	var oerr *OptionsError
+	if !errors.As(err, &oerr) || len(oerr.Problems) != 3 {
+		t.Fatalf("expected 3 problems, got %v", err)
+	}
+	if !errors.Is(err, ErrBadZlibV3) {
+		t.Errorf("expected errors.Is to find ErrBadZlibV3 in %v", err)
+	}
+	if !strings.HasPrefix(err.Error(), "sereal: 3 problems with the options: ") {
+		t.Errorf("unexpected message %q", err)
+	}
+
+	err = DecoderOptions{Version: 1, MaxCopyDepth: -1, KeyMatch: "fuzzy"}.Validate()
+	if !errors.As(err, &oerr) || len(oerr.Problems) != 2 {
+		t.Errorf("expected 2 problems, got %v", err)
+	}
+
+	// conflicts of an Encoder fail Marshal before the body is encoded
+	e := NewEncoder()
+	e.Compression = ZlibCompressor{}
+	e.TimeFormat = TimeFormat(42)
+	if _, err = e.Marshal(map[string]int{"a": 1}); !errors.As(err, &oerr) || len(oerr.Problems) != 2 {
+		t.Errorf("expected 2 problems, got %v", err)
+	}
+	if err := NewEncoderV3().Validate(); err != nil {
+		t.Errorf("unexpected error validating the default encoder: %v", err)
+	}
+}
+
+func TestDecodeIntoExistingMapEntries(t *testing.T) {
+	type S struct {
+		A, B int
+		C    string
+	}
+
+	b, err := Marshal(map[string]interface{}{
+		"x": map[string]interface{}{"A": 5, "C": "five"},
+		"y": map[string]interface{}{"A": 6},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, pool := range []bool{false, true} {
+		d := NewDecoder()
+		d.PoolMapValues = pool
+
+		for i := 0; i < 3; i++ {
+			m := map[string]S{"x": {A: 1, B: 2}}
+			if err := d.Unmarshal(b, &m); err != nil {
+				t.Fatal(err)
+			}
+
+			expected := map[string]S{"x": {A: 5, B: 2, C: "five"}, "y": {A: 6}}
+			if !reflect.DeepEqual(m, expected) {
+				t.Errorf("PoolMapValues=%v: got %v, expected %v", pool, m, expected)
+			}
+		}
+	}
+
+	ints := map[string]int{"y": 1}
+	b, err = Marshal(map[string]interface{}{"y": 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Unmarshal(b, &ints); err != nil || ints["y"] != 3 {
+		t.Errorf("got %v (%v), expected y=3", ints, err)
+	}
+}
+
+func TestPoolMapValuesAllocs(t *testing.T) {
+	type S struct {
+		A, B, C, D int
+		E          string
+	}
+
+	src := make(map[string]S)
+	for i := 0; i < 50; i++ {
+		src[strconv.Itoa(i)] = S{A: i, E: "e"}
+	}
+
+	b, err := Marshal(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	allocs := func(d *Decoder) float64 {
+		dst := make(map[string]S)
+		return testing.AllocsPerRun(20, func() {
+			if err := d.Unmarshal(b, &dst); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+
+	plain := allocs(NewDecoder())
+	pooled := allocs(&Decoder{PoolMapValues: true})
+
+	if pooled >= plain {
+		t.Errorf("pooling didn't reduce allocations: %v vs %v", pooled, plain)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	a := map[string]interface{}{
+		"name":  "foo",
+		"list":  []interface{}{1, 2, 3},
+		"float": float32(0.1),
+		"obj":   PerlObject{Class: "Foo", Reference: map[string]interface{}{"x": 1}},
+		"gone":  true,
+	}
+
+	b := map[string]interface{}{
+		"name":  []byte("foo"),
+		"list":  []interface{}{1, 5, 3, 4},
+		"float": 0.1,
+		"obj":   PerlObject{Class: "Bar", Reference: map[string]interface{}{"x": 1}},
+		"new":   "here",
+	}
+
+	e := NewEncoderV3()
+	ea, err := e.Marshal(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e.Compression = SnappyCompressor{Incremental: true}
+	e.CompressionThreshold = 0
+	eb, err := e.Marshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := Diff(ea, eb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, d := range entries {
+		got = append(got, d.Path+": "+d.Reason)
+	}
+
+	expected := []string{
+		"body.gone: missing in B",
+		"body.list[1]: value differs",
+		"body.list[3]: missing in A",
+		"body.new: missing in A",
+		"body.obj: class differs",
+	}
+
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("got differences %q, expected %q", got, expected)
+	}
+
+	if entries, err := Diff(ea, ea); err != nil || len(entries) != 0 {
+		t.Errorf("document differs from itself: %v %v", entries, err)
+	}
+}
+
+func TestEqual(t *testing.T) {
+	v := map[string]interface{}{
+		"a": []interface{}{"x", "y", map[string]interface{}{"a": 1}},
+		"b": map[string]interface{}{"a": 2, "b": 3},
+		"c": "x",
+	}
+
+	plain, err := NewEncoderV3().Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := NewEncoderV3()
+	e.DisableDedup = true
+	e.Canonical = true
+	e.Compression = ZlibCompressor{}
+	e.CompressionThreshold = 0
+	compressed, err := e.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Equal(plain, compressed) {
+		t.Fatal("documents should differ in their encoding")
+	}
+
+	if eq, err := Equal(plain, compressed); err != nil || !eq {
+		t.Errorf("documents aren't equal: %v", err)
+	}
+
+	v["c"] = "z"
+	other, err := NewEncoderV3().Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if eq, err := Equal(plain, other); err != nil || eq {
+		t.Errorf("documents are equal: %v", err)
+	}
+
+	if _, err := Equal(plain, other[:3]); err == nil {
+		t.Errorf("expected error for truncated document")
+	}
+}
+
+func TestConvertAll(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sereal-batch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	in := filepath.Join(dir, "in")
+	out := filepath.Join(dir, "out")
+
+	write := DirOutput(in)
+	for i := 0; i < 20; i++ {
+		b, err := NewEncoderV2().MarshalWithHeader(map[string]interface{}{"i": i}, map[string]interface{}{
+			"id":     i,
+			"secret": "hunter2",
+			"name":   strings.Repeat("x", i),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := write(filepath.Join("sub", strconv.Itoa(i)), b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := write("broken", []byte("=srl\x01\x00garbage")); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"../escaped", "sub/../../escaped", "..", filepath.Join(dir, "absolute")} {
+		if err := write(name, []byte("=srl\x01\x00garbage")); err == nil {
+			t.Errorf("expected %q to be rejected", name)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "escaped")); !os.IsNotExist(err) {
+		t.Errorf("document written out of the output directory (%v)", err)
+	}
+
+	src, err := DirSource(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := NewEncoderV3()
+	e.Compression = ZlibCompressor{}
+	e.CompressionThreshold = 0
+
+	progress := 0
+	report, err := ConvertAll(src, BatchOptions{
+		Workers: 4,
+		Transform: ReencodeTransform(e, func(header, body interface{}) error {
+			m := reflect.ValueOf(body)
+			for m.Kind() == reflect.Ptr || m.Kind() == reflect.Interface {
+				m = m.Elem()
+			}
+			m.SetMapIndex(reflect.ValueOf("secret"), reflect.Value{})
+			return nil
+		}),
+		Output:   DirOutput(out),
+		Progress: func(*BatchReport) { progress++ },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Processed != 20 || report.Failed != 1 || progress != 21 {
+		t.Fatalf("unexpected report %+v after %d progress calls", report, progress)
+	}
+	if report.Errors[0].Name != "broken" {
+		t.Errorf("unexpected failure %v", report.Errors[0])
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(out, "sub", "7"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if h, err := readHeader(b); err != nil || h.version != 3 || h.doctype != serealZlib {
+		t.Errorf("document not converted: %+v %v", h, err)
+	}
+
+	var header, body map[string]interface{}
+	if err := NewDecoder().UnmarshalHeaderBody(b, &header, &body); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(header, map[string]interface{}{"i": 7}) {
+		t.Errorf("unexpected header %v", header)
+	}
+	if _, ok := body["secret"]; ok || body["name"] != "xxxxxxx" {
+		t.Errorf("unexpected body %v", body)
+	}
+
+	src, err = DirSource(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err = ConvertAll(src, BatchOptions{Workers: 1, Transform: ValidateTransform(NewDecoder()), StopOnError: true})
+	if err == nil || report.Failed != 1 {
+		t.Errorf("expected validation to stop on the broken document: %+v %v", report, err)
+	}
+}
+
+func TestCompressDocument(t *testing.T) {
+	v := map[string]interface{}{"foo": strings.Repeat("bar", 100), "baz": []interface{}{1, 2, 3}}
+
+	b, err := NewEncoderV3().MarshalWithHeader("header", v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []compressor{ZlibCompressor{}, SnappyCompressor{Incremental: true}} {
+		compressed, err := CompressDocument(b, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(compressed) >= len(b) {
+			t.Errorf("%T: document not compressed", c)
+		}
+
+		if eq, err := Equal(b, compressed); err != nil || !eq {
+			t.Errorf("%T: compressed document differs: %v", c, err)
+		}
+
+		raw, err := CompressDocument(compressed, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(raw, b) {
+			t.Errorf("%T: decompressed document differs", c)
+		}
+	}
+
+	if _, err := CompressDocument(b, SnappyCompressor{}); err == nil {
+		t.Errorf("expected error for non-incremental snappy in a v3 document")
+	}
+}
+
+func TestDumpTags(t *testing.T) {
+	b, err := NewEncoderV3().MarshalWithHeader("h", map[string]interface{}{"foo": []interface{}{-3, 1.5}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := DumpTags(&buf, b); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `version 3
+header:
+     1   STR_UTF8 "h"
+body:
+     1   HASH (1)
+     3     STR_UTF8 "foo"
+     8     ARRAY (2)
+    10       NEG_3
+    11       DOUBLE 1.5
+`
+	if buf.String() != expected {
+		t.Errorf("got\n%s\nexpected\n%s", buf.String(), expected)
+	}
+
+	// a suffix length of 0 written as a two byte varint, with no flag byte
+	buf.Reset()
+	if err := DumpTags(&buf, []byte("=\xf3rl\x03\x80\x00")); err != ErrTruncated {
+		t.Errorf("expected a document with an empty suffix and no body to be truncated, got %v", err)
+	}
+}
+
+func TestDumpAnnotated(t *testing.T) {
+	b, err := NewEncoderV3().MarshalWithHeader("h", map[string]interface{}{"foo": []interface{}{-3, 1.5, "0123456789"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := DumpAnnotated(&buf, b); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `     0  3d f3 72 6c              magic
+     4  03                       version 3, raw
+     5  04                       header suffix of 4 bytes
+     6  01                       flags 0x01
+header user data:
+     7  27 01 68                 @1      STR_UTF8 "h"
+body:
+    10  2a 01                    @1      HASH (1)
+    12  27 03 66 6f 6f           @3        STR_UTF8 "foo"
+    17  2b 03                    @8        ARRAY (3)
+    19  1d                       @10         NEG_3
+    20  23 00 00 00 00 00 00 f8  @11         DOUBLE 1.5
+    28  3f
+    29  27 0a 30 31 32 33 34 35  @20         STR_UTF8 "0123456789"
+    37  36 37 38 39
+`
+	if buf.String() != expected {
+		t.Errorf("got\n%s\nexpected\n%s", buf.String(), expected)
+	}
+
+	buf.Reset()
+	if err := DumpAnnotated(&buf, b[:len(b)-2]); err != ErrTruncated {
+		t.Errorf("expected a truncated document, got %v", err)
+	}
+	if !strings.HasSuffix(buf.String(), "    29  27 0a 30 31 32 33 34 35  @20         STR_UTF8\n    37  36 37\nerror: truncated document\n") {
+		t.Errorf("unexpected dump of a truncated document\n%s", buf.String())
+	}
+}
+
+func TestParseTree(t *testing.T) {
+	x := 5
+	b, err := NewEncoderV3().MarshalWithHeader("h", []interface{}{map[string]interface{}{"k": 1}, map[string]interface{}{"k": &x}, &x})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tree, err := ParseTree(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := &Tree{
+		Version: 3,
+		Header:  &Node{Offset: 1, Tag: "STR_UTF8", Detail: `"h"`},
+		Body: &Node{Offset: 1, Tag: "ARRAY", Detail: "(3)", Children: []*Node{
+			{Offset: 3, Tag: "HASH", Detail: "(1)", Children: []*Node{
+				{Offset: 5, Tag: "STR_UTF8", Detail: `"k"`},
+				{Offset: 8, Tag: "POS_1"},
+			}},
+			{Offset: 9, Tag: "HASH", Detail: "(1)", Children: []*Node{
+				{Offset: 11, Tag: "COPY", Detail: "-> 5", Ref: 5},
+				{Offset: 13, Tag: "REFN", Tracked: true, Children: []*Node{
+					{Offset: 14, Tag: "POS_5"},
+				}},
+			}},
+			{Offset: 15, Tag: "REFP", Detail: "-> 13", Ref: 13},
+		}},
+	}
+	if !reflect.DeepEqual(tree, want) {
+		got, _ := json.Marshal(tree)
+		expected, _ := json.Marshal(want)
+		t.Errorf("got\n%s\nexpected\n%s", got, expected)
+	}
+
+	var buf bytes.Buffer
+	if err := tree.WriteDOT(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"\t\th1 [label=\"@1 STR_UTF8 \\\"h\\\"\"];\n",
+		"\t\tb9 -> b11;\n",
+		"\t\tb11 -> b5 [style=dashed];\n",
+		"\t\tb15 -> b13 [style=dashed];\n",
+	} {
+		if !strings.Contains(buf.String(), line) {
+			t.Errorf("missing %q in\n%s", line, buf.String())
+		}
+	}
+
+	bad := []byte("=\xf3rl\x03\x00")
+	bad = append(bad, typeARRAY, 2, 1, typeCOPY, 2)
+	if _, err := ParseTree(bad); !errors.Is(err, ErrOffsetNotValue) {
+		t.Errorf("expected an offset not pointing to a value to be rejected, got %v", err)
+	}
+
+	// a suffix length of 0 written as a two byte varint, with no flag byte
+	if _, err := ParseTree([]byte("=\xf3rl\x03\x80\x00")); err != ErrTruncated {
+		t.Errorf("expected a document with an empty suffix and no body to be truncated, got %v", err)
+	}
+}
+
+func TestStat(t *testing.T) {
+	v := map[string]interface{}{"list": []interface{}{1, -1, "xy", 2.5, []interface{}{true, "xy"}}}
+	b, err := Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := Stat(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := DocumentStats{
+		Version:        3,
+		DocType:        "raw",
+		HeaderSize:     6,
+		BodySize:       len(b) - 6,
+		CompressedSize: len(b) - 6,
+		Tags:           map[string]int{"HASH": 1, "STR_UTF8": 3, "ARRAY": 2, "POS": 1, "NEG": 1, "DOUBLE": 1, "TRUE": 1},
+		Values:         10,
+		MaxDepth:       3,
+		Strings:        3,
+		StringBytes:    8,
+		Arrays:         2,
+		ArrayElements:  7,
+		MaxArrayLen:    5,
+		Hashes:         1,
+		HashEntries:    1,
+		MaxHashLen:     1,
+	}
+	if !reflect.DeepEqual(s, want) {
+		t.Errorf("got %+v\nexpected %+v", s, want)
+	}
+	if s.CompressionRatio() != 1 {
+		t.Errorf("unexpected compression ratio %v for a raw document", s.CompressionRatio())
+	}
+
+	e := NewEncoderV3()
+	e.Compression = SnappyCompressor{Incremental: true}
+	e.CompressionThreshold = 0
+	b, err = e.Marshal(strings.Repeat("sereal", 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, err = Stat(b); err != nil || s.DocType != "snappy_incr" || s.StringBytes != 600 || s.CompressionRatio() <= 1 {
+		t.Errorf("unexpected stats %+v (%v) for a compressed document", s, err)
+	}
+
+	if _, err := Stat(b[:len(b)-1]); err == nil {
+		t.Errorf("expected an error for a truncated document")
+	}
+}
+
+func TestThawError(t *testing.T) {
+	now := time.Now()
+
+	x, err := NewEncoderV3().Marshal(map[string]interface{}{"items": []interface{}{1, now}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var dst struct {
+		Items []ErrorBinaryUnmarshaler `sereal:"items"`
+	}
+
+	err = Unmarshal(x, &dst)
+
+	var terr *ThawError
+	if !errors.As(err, &terr) {
+		t.Fatalf("expected a ThawError, got %v", err)
+	}
+
+	if terr.Class != "time.Time" || terr.Path != "body.items[1]" || terr.Offset <= 0 || !errors.Is(err, errUnmarshaler) {
+		t.Errorf("unexpected error %#v", terr)
+	}
+
+	if !strings.HasPrefix(err.Error(), "sereal: thaw time.Time at body.items[1] (offset ") {
+		t.Errorf("unexpected message %q", err)
+	}
+}
+
+func TestToJSON(t *testing.T) {
+	type S struct {
+		Name  string
+		Score float64
+	}
+
+	shared := []interface{}{"x"}
+	v := map[string]interface{}{
+		"str":    "line\n\"quoted\"",
+		"bin":    []byte("binary"),
+		"ints":   []interface{}{0, -1, 15, -16, 300, -300},
+		"float":  1.5,
+		"nil":    nil,
+		"bools":  []interface{}{true, false},
+		"object": S{Name: "foo", Score: 2},
+		"a":      &shared,
+		"b":      &shared,
+		"keys":   map[string]interface{}{"dup": 1},
+		"more":   map[string]interface{}{"dup": 2},
+	}
+
+	for _, e := range []*Encoder{NewEncoderV2(), NewEncoderV3(), {PerlCompat: true, version: 3}} {
+		b, err := e.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var buf bytes.Buffer
+		if err := ToJSON(&buf, b); err != nil {
+			t.Fatal(err)
+		}
+
+		var got, expected interface{}
+		if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+			t.Fatalf("invalid JSON %s: %v", buf.Bytes(), err)
+		}
+
+		exp, _ := json.Marshal(map[string]interface{}{
+			"str": "line\n\"quoted\"", "bin": "binary", "ints": []int{0, -1, 15, -16, 300, -300},
+			"float": 1.5, "nil": nil, "bools": []bool{true, false}, "object": S{Name: "foo", Score: 2},
+			"a": []string{"x"}, "b": []string{"x"}, "keys": map[string]int{"dup": 1}, "more": map[string]int{"dup": 2},
+		})
+		json.Unmarshal(exp, &expected)
+
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("got %s, expected %s", buf.Bytes(), exp)
+		}
+	}
+
+	b, _ := Marshal(math.NaN())
+	if err := ToJSON(ioutil.Discard, b); err == nil {
+		t.Errorf("expected error for NaN")
+	}
+}
+
+func TestFromJSON(t *testing.T) {
+	src := `{"a": [1, -2, 3.5, "str", null, true, false, {}], "b": {"a": 12345678901234567890, "c": []}, "c": "x"}`
+
+	for _, e := range []*Encoder{NewEncoderV2(), NewEncoderV3(), {PerlCompat: true, version: 3}} {
+		b, err := e.FromJSON([]byte(src))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var got map[string]interface{}
+		if err := Unmarshal(b, &got); err != nil {
+			t.Fatal(err)
+		}
+
+		expected := map[string]interface{}{
+			"a": []interface{}{1, -2, 3.5, "str", nil, true, false, map[string]interface{}{}},
+			"b": map[string]interface{}{"a": "12345678901234567890", "c": []interface{}{}},
+			"c": "x",
+		}
+
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("got %#v, expected %#v", got, expected)
+		}
+
+		var buf bytes.Buffer
+		if err := ToJSON(&buf, b); err != nil {
+			t.Fatal(err)
+		}
+
+		if eq, err := Equal(b, mustFromJSON(t, buf.String())); err != nil || !eq {
+			t.Errorf("round trip through JSON differs: %s", buf.String())
+		}
+	}
+
+	for _, bad := range []string{`{"a": }`, `[1, 2`, `1 2`} {
+		if _, err := FromJSON([]byte(bad)); err == nil {
+			t.Errorf("expected error for %s", bad)
+		}
+	}
+}
+
+func mustFromJSON(t *testing.T, s string) []byte {
+	b, err := FromJSON([]byte(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestTranscode(t *testing.T) {
+	v := []interface{}{1, -1, 300, -300, "ab", []byte{1}, true, nil, 1.5, map[int]string{7: "x"}}
+
+	tests := []struct {
+		format   Format
+		expected string
+	}{
+		{FormatJSON, hex.EncodeToString([]byte(`[1,-1,300,-300,"ab","\u0001",true,null,1.5,{"7":"x"}]`))},
+		{FormatCBOR, "8a012019012c39012b6261624101f5f6fb3ff8000000000000a1076178"},
+		{FormatMsgPack, "9a01ffcd012cd1fed4a26162c40101c3c0cb3ff80000000000008107a178"},
+	}
+
+	for _, e := range []*Encoder{NewEncoderV2(), NewEncoderV3()} {
+		b, err := e.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, tt := range tests {
+			got, err := Transcode([]byte{0xff}, b, tt.format)
+			if err != nil {
+				t.Fatalf("%v: %v", tt.format, err)
+			}
+			if got[0] != 0xff || hex.EncodeToString(got[1:]) != tt.expected {
+				t.Errorf("%v: got %x, expected ff%s", tt.format, got, tt.expected)
+			}
+		}
+	}
+
+	cyclic := []interface{}{nil}
+	cyclic[0] = &cyclic
+	b, err := NewEncoderV3().Marshal(&cyclic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Transcode(nil, b, FormatCBOR); err != errTranscodeCycle {
+		t.Errorf("expected cycle error, got %v", err)
+	}
+
+	// each level is an array of a value and a REFP to it, doubling the
+	// output: 24 levels of about 4 bytes would expand to over 100MB of JSON
+	nested := func(levels int) []byte {
+		b := []byte("=\xf3rl\x03\x00")
+		for i := 0; i < levels; i++ {
+			b = append(b, typeARRAY|trackFlag, 2)
+		}
+		b = append(b, typeSHORT_BINARY_0+1, 'x')
+		for i := levels - 1; i >= 0; i-- {
+			b = append(b, typeREFP, byte(1+2*(i+1)))
+		}
+		return b
+	}
+
+	if got, err := Transcode(nil, nested(2), FormatJSON); err != nil || string(got) != `[["x","x"],["x","x"]]` {
+		t.Errorf("unexpected expansion of shared values %s (%v)", got, err)
+	}
+
+	bomb := nested(24)
+	if len(bomb) > 130 {
+		t.Fatalf("expected a document of at most 130 bytes, got %d", len(bomb))
+	}
+	if _, err := Transcode(nil, bomb, FormatJSON); err != errTranscodeTooLarge {
+		t.Errorf("expected shared values expanding too much to be rejected, got %v", err)
+	}
+	if err := ToJSON(ioutil.Discard, bomb); err != errTranscodeTooLarge {
+		t.Errorf("expected ToJSON to reject shared values expanding too much, got %v", err)
+	}
+}
+
+func TestSyncMapAndList(t *testing.T) {
+	type State struct {
+		Sessions *sync.Map
+		Queue    list.List
+	}
+
+	var in State
+	in.Sessions = &sync.Map{}
+	in.Sessions.Store("alice", 1)
+	in.Sessions.Store("bob", []interface{}{"x", "y"})
+	in.Queue.PushBack("first")
+	in.Queue.PushBack(2)
+
+	for _, e := range []*Encoder{NewEncoderV3(), {Canonical: true, version: 3}} {
+		b, err := e.Marshal(&in)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var generic map[string]interface{}
+		if err := Unmarshal(b, &generic); err != nil {
+			t.Fatal(err)
+		}
+		expected := map[string]interface{}{
+			"Sessions": map[string]interface{}{"alice": 1, "bob": []interface{}{"x", "y"}},
+			"Queue":    []interface{}{"first", 2},
+		}
+		if !reflect.DeepEqual(generic, expected) {
+			t.Errorf("got %#v, expected %#v", generic, expected)
+		}
+
+		var out State
+		out.Queue.PushBack("stale")
+		if err := Unmarshal(b, &out); err != nil {
+			t.Fatal(err)
+		}
+
+		got := map[interface{}]interface{}{}
+		out.Sessions.Range(func(k, v interface{}) bool {
+			got[k] = v
+			return true
+		})
+		if !reflect.DeepEqual(got, map[interface{}]interface{}{"alice": 1, "bob": []interface{}{"x", "y"}}) {
+			t.Errorf("got sessions %#v", got)
+		}
+
+		var queue []interface{}
+		for el := out.Queue.Front(); el != nil; el = el.Next() {
+			queue = append(queue, el.Value)
+		}
+		if !reflect.DeepEqual(queue, []interface{}{"first", 2}) {
+			t.Errorf("got queue %#v", queue)
+		}
+	}
+
+	var m sync.Map
+	m.Store(3, "three")
+	b, err := NewEncoderV3().Marshal(&m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out sync.Map
+	if err := Unmarshal(b, &out); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := out.Load(3); !ok || v != "three" {
+		t.Errorf("integer key lost: %v %v", v, ok)
+	}
+}
+
+func TestProfilePerl3x(t *testing.T) {
+	ary := []interface{}{5, 6}
+	scalar := 9
+	scalarRef, aryRef := &scalar, &ary
+	foo := func(v interface{}) PerlObject { return PerlObject{Class: "foo", Reference: v} }
+
+	// expected bodies are those of Perl/shared/t/lib/Sereal/TestSet.pm
+	tests := []struct {
+		name     string
+		v        interface{}
+		expected string
+	}{
+		{
+			"ary ref of hash refs with repeated strings",
+			[]interface{}{map[string]interface{}{"foooo": "foooo"}, map[string]interface{}{"foooo2": "foooo"}},
+			"42 51 65666f6f6f6f 65666f6f6f6f 51 66666f6f6f6f32 65666f6f6f6f",
+		},
+		{
+			"repeated hash keys",
+			[]interface{}{map[string]interface{}{"a": 1}, map[string]interface{}{"a": 2}},
+			"42 51 6161 01 51 2f03 02",
+		},
+		{"repeated substructure (REFP): scalar ref", []interface{}{&scalar, &scalar}, "42 28 89 2903"},
+		{"repeated substructure (REFP): array", []interface{}{&ary, &ary}, "42 28 ab02 05 06 2903"},
+		{"repeated substructure (REFP): asymmetric", []interface{}{&aryRef, []interface{}{1, aryRef}}, "42 28 28 ab02 05 06 42 01 2904"},
+		{"REFN to REFP: scalar ref ref", []interface{}{&scalar, &scalarRef}, "42 28 89 28 2903"},
+		{"REFN to REFP: scalar ref ref first", []interface{}{&scalarRef, &scalar}, "42 28 28 89 2904"},
+		{"REFN to REFP: array ref ref", []interface{}{&ary, &aryRef}, "42 28 ab02 05 06 28 2903"},
+		{"reused classname empty array", []interface{}{foo([]interface{}{}), foo([]interface{}{})}, "42 2c 63666f6f 40 2d03 40"},
+		{"wrapped objects", foo([]interface{}{foo(map[string]interface{}{})}), "2c 63666f6f 41 2d02 50"},
+		{"float", 1.5, "23 000000000000f83f"},
+		{"utf8", "é", "27 02c3a9"},
+	}
+
+	var e Encoder
+	if err := e.Profile(ProfilePerl3x); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range tests {
+		b, err := e.Marshal(tt.v)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+
+		expected := "3df3726c0300" + strings.Replace(tt.expected, " ", "", -1)
+		if got := hex.EncodeToString(b); got != expected {
+			t.Errorf("%s: got %s, expected %s", tt.name, got, expected)
+		}
+	}
+
+	if err := e.Profile(ProfileDefault); err != nil {
+		t.Fatal(err)
+	}
+	if e.PerlCompat || e.DisableFREEZE || e.version != 3 {
+		t.Errorf("default profile not restored")
+	}
+	if err := e.Profile(Profile(42)); err == nil {
+		t.Errorf("expected error for unknown profile")
+	}
+}
+
+func TestSplitter(t *testing.T) {
+	shared := []interface{}{"shared", 1}
+	var elements []interface{}
+	for i := 0; i < 20; i++ {
+		elements = append(elements, map[string]interface{}{
+			"id":     i,
+			"name":   strings.Repeat("x", i),
+			"shared": &shared,
+			"object": PerlObject{Class: "Item", Reference: map[string]interface{}{"id": i}},
+		})
+	}
+
+	for _, e := range []*Encoder{NewEncoderV2(), NewEncoderV3(), {PerlCompat: true, version: 3}} {
+		doc, err := e.Marshal(elements)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s, err := NewSplitter(doc, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Compression = SnappyCompressor{Incremental: true}
+
+		chunks, n := 0, 0
+		for {
+			chunk, err := s.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			chunks++
+
+			var part []interface{}
+			if err := Unmarshal(chunk, &part); err != nil {
+				t.Fatalf("chunk %d: %v", chunks, err)
+			}
+
+			expected, err := e.Marshal(elements[n : n+len(part)])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if eq, err := Equal(chunk, expected); err != nil || !eq {
+				t.Errorf("chunk %d differs from elements %d to %d: %v", chunks, n, n+len(part), err)
+			}
+			n += len(part)
+		}
+
+		if n != len(elements) || chunks < 2 || chunks == len(elements) {
+			t.Errorf("got %d elements in %d chunks", n, chunks)
+		}
+	}
+
+	b, _ := Marshal(map[string]interface{}{"a": 1})
+	if _, err := NewSplitter(b, 100); err == nil {
+		t.Errorf("expected error for a hash")
+	}
+}
+
+func TestUnmarshalHeaderBodyInfo(t *testing.T) {
+	body := strings.Repeat("compressible ", 200)
+
+	raw, err := NewEncoderV3().MarshalWithHeader("hdr", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := NewEncoderV3()
+	e.Compression = ZlibCompressor{}
+	zlib, err := e.MarshalWithHeader("hdr", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var d Decoder
+	var header, got string
+
+	info, err := d.UnmarshalHeaderBodyInfo(raw, &header, &got)
+	if err != nil || header != "hdr" || got != body {
+		t.Fatalf("decoding raw document: %v", err)
+	}
+	rawSize := len(raw) - info.HeaderSize
+	expected := DocumentInfo{Version: 3, DocType: "raw", SuffixFlags: 1, HeaderSize: info.HeaderSize, BodySize: rawSize, CompressedSize: rawSize}
+	if info != expected || info.HeaderSize <= headerSize {
+		t.Errorf("got %+v, expected %+v", info, expected)
+	}
+
+	info, err = d.UnmarshalHeaderBodyInfo(zlib, nil, &got)
+	if err != nil || got != body {
+		t.Fatalf("decoding zlib document: %v", err)
+	}
+	expected = DocumentInfo{Version: 3, DocType: "zlib", SuffixFlags: 1, HeaderSize: info.HeaderSize, BodySize: rawSize, CompressedSize: len(zlib) - info.HeaderSize}
+	if info != expected || info.CompressedSize >= info.BodySize {
+		t.Errorf("got %+v, expected %+v", info, expected)
+	}
+
+	info, err = d.UnmarshalHeaderBodyInfo(zlib, &header, nil)
+	if err != nil || info.DocType != "zlib" || info.BodySize != -1 {
+		t.Errorf("header only: got %+v, %v", info, err)
+	}
+
+	plain, _ := NewEncoderV2().Marshal(1)
+	info, err = d.UnmarshalHeaderBodyInfo(plain[:len(plain)-1], nil, &got)
+	if err == nil || info.Version != 2 || info.SuffixFlags != 0 {
+		t.Errorf("truncated document: got %+v, %v", info, err)
+	}
+}
+
+func TestStream(t *testing.T) {
+	zlib := NewEncoderV3()
+	zlib.Compression = ZlibCompressor{}
+	zlib.CompressionThreshold = 0
+	snappy := NewEncoderV3()
+	snappy.Compression = SnappyCompressor{Incremental: true}
+	snappy.CompressionThreshold = 0
+
+	encoders := []*Encoder{NewEncoder(), NewEncoderV2(), NewEncoderV3(), zlib, snappy}
+
+	for _, framing := range []Framing{FramingConcatenated, FramingLengthPrefixed} {
+		var buf bytes.Buffer
+		enc := NewStreamEncoder(&buf, nil)
+		enc.Framing = framing
+
+		var expected []interface{}
+		for i, e := range encoders {
+			enc.enc = e
+			v := map[string]interface{}{"i": i, "s": strings.Repeat("abc", i*100)}
+			if err := enc.EncodeWithHeader(i, v); err != nil {
+				t.Fatal(err)
+			}
+			expected = append(expected, v)
+		}
+
+		dec := NewStreamDecoder(iotest.OneByteReader(bytes.NewReader(buf.Bytes())), nil)
+		dec.Framing = framing
+
+		for i, v := range expected {
+			var header interface{}
+			var got map[string]interface{}
+			if err := dec.DecodeNextWithHeader(&header, &got); err != nil {
+				t.Fatalf("framing %d, document %d: %v", framing, i, err)
+			}
+			if !reflect.DeepEqual(got, v) || (i > 0 && header != i) {
+				t.Errorf("framing %d, document %d: got %v %v", framing, i, header, got)
+			}
+		}
+
+		var got interface{}
+		if err := dec.DecodeNext(&got); err != io.EOF {
+			t.Errorf("framing %d: expected io.EOF, got %v", framing, err)
+		}
+
+		dec = NewStreamDecoder(bytes.NewReader(buf.Bytes()[:buf.Len()-1]), nil)
+		dec.Framing = framing
+		var err error
+		for err == nil {
+			var v interface{}
+			err = dec.DecodeNext(&v)
+		}
+		if err != io.ErrUnexpectedEOF {
+			t.Errorf("framing %d: expected io.ErrUnexpectedEOF, got %v", framing, err)
+		}
+	}
+
+	legacy := NewEncoder()
+	legacy.Compression = SnappyCompressor{}
+	legacy.CompressionThreshold = 0
+	b, _ := legacy.Marshal("snappy")
+	if _, err := NewStreamDecoder(bytes.NewReader(b), nil).NextDocument(); err == nil || err == io.ErrUnexpectedEOF {
+		t.Errorf("expected error for legacy snappy, got %v", err)
+	}
+}
+
+type countingSnappy struct {
+	encoded, decoded *int
+}
+
+func (c countingSnappy) Encode(dst, src []byte) []byte {
+	*c.encoded++
+	return GoSnappy{}.Encode(dst, src)
+}
+
+func (c countingSnappy) Decode(dst, src []byte) ([]byte, error) {
+	*c.decoded++
+	return GoSnappy{}.Decode(dst, src)
+}
+
+func TestSnappyCodec(t *testing.T) {
+	var encoded, decoded int
+	RegisterSnappyCodec("counting", countingSnappy{&encoded, &decoded})
+
+	e, err := EncoderOptions{Version: 1, Compression: "snappy_incr", SnappyCodec: "counting", CompressionThreshold: new(int)}.NewEncoder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := DecoderOptions{Version: 1, SnappyCodec: "counting"}.NewDecoder()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := e.Marshal([]string{"foo", "foo", "foo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	if err := d.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	if encoded != 1 || decoded != 1 || len(got) != 3 {
+		t.Errorf("codec not used: encoded=%d decoded=%d got=%v", encoded, decoded, got)
+	}
+
+	if _, err := (DecoderOptions{Version: 1, SnappyCodec: "lz4"}).NewDecoder(); err == nil {
+		t.Errorf("expected error for unknown snappy codec")
+	}
+	if err := (EncoderOptions{Version: 1, Compression: "zlib", SnappyCodec: "go"}).Validate(); err == nil {
+		t.Errorf("expected error for snappy codec without snappy compression")
+	}
+
+	// corrupt the decoded length starting the snappy block, after the
+	// header and the snappy_incr length, keeping the framing intact
+	b[headerSize+2]++
+	var serr *SnappyError
+	if err := d.Unmarshal(b, &got); !errors.As(err, &serr) || !serr.Incremental {
+		t.Errorf("expected incremental SnappyError, got %v", err)
+	}
+
+	legacy := NewEncoder()
+	legacy.Compression = SnappyCompressor{}
+	legacy.CompressionThreshold = 0
+	b, err = legacy.Marshal([]string{"foo", "foo", "foo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b = b[:len(b)-2]
+	if err := d.Unmarshal(b, &got); !errors.As(err, &serr) || serr.Incremental {
+		t.Errorf("expected legacy SnappyError, got %v", err)
+	}
+}
+
+func TestDecodeHashStream(t *testing.T) {
+	shared := []interface{}{"shared", "shared"}
+	m := map[string]interface{}{
+		"a": &shared,
+		"b": &shared,
+		"c": "some long string",
+		"d": "some long string",
+		"e": 42,
+	}
+
+	for _, e := range []*Encoder{NewEncoderV2(), NewEncoderV3()} {
+		b, err := e.Marshal(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got := make(map[string]interface{})
+		err = DecodeHashStream(b, func(key string, value RawMessage) error {
+			// decode the raw value by splicing it into a document
+			doc, err := NewEncoderV3().Marshal(value)
+			if err != nil {
+				return err
+			}
+			var v interface{}
+			if err := Unmarshal(doc, &v); err != nil {
+				return err
+			}
+			got[key] = v
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		gb, err := e.Marshal(got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if eq, err := Equal(gb, b); !eq || err != nil {
+			t.Errorf("version %d: unexpected entries %v (%v)", e.version, got, err)
+		}
+	}
+
+	b, _ := Marshal(m)
+	stop := errors.New("stop")
+	n := 0
+	if err := DecodeHashStream(b, func(string, RawMessage) error { n++; return stop }); err != stop || n != 1 {
+		t.Errorf("expected iteration to stop with the error of fn, got %v after %d entries", err, n)
+	}
+
+	b, _ = Marshal([]int{1})
+	if err := DecodeHashStream(b, func(string, RawMessage) error { return nil }); err == nil {
+		t.Errorf("expected error for a body which isn't a hash")
+	}
+
+	var s struct {
+		A RawMessage
+		B RawMessage
+	}
+	b, _ = Marshal(map[string]interface{}{"A": 1})
+	if err := Unmarshal(b, &s); err != nil || !bytes.Equal(s.A, AppendInt(nil, 1)) {
+		t.Errorf("unexpected RawMessage %x (%v)", []byte(s.A), err)
+	}
+	if b, err := Marshal(s); err != nil {
+		t.Error(err)
+	} else if err := Unmarshal(b, &m); err != nil || m["A"] != 1 || m["B"] != nil {
+		t.Errorf("unexpected round trip %v (%v)", m, err)
+	}
+}
+
+func TestReadHeaderOnly(t *testing.T) {
+	type route struct {
+		Queue    string
+		Priority int
+	}
+
+	b, err := MarshalWithHeader(map[string]interface{}{"Queue": "jobs", "Priority": 3}, []string{"body"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a truncated body is never looked at
+	b = b[:len(b)-2]
+
+	var r route
+	if err := ReadHeaderOnly(b, &r); err != nil || r != (route{"jobs", 3}) {
+		t.Errorf("unexpected header %+v (%v)", r, err)
+	}
+
+	var queue string
+	if ok, err := HeaderField(b, "Queue", &queue); !ok || err != nil || queue != "jobs" {
+		t.Errorf("unexpected Queue %q, %v (%v)", queue, ok, err)
+	}
+	if ok, err := HeaderField(b, "Missing", &queue); ok || err != nil {
+		t.Errorf("unexpected Missing field %v (%v)", ok, err)
+	}
+
+	b, _ = Marshal("no header")
+	if err := ReadHeaderOnly(b, &r); err != ErrNoHeader {
+		t.Errorf("expected ErrNoHeader, got %v", err)
+	}
+	if ok, err := HeaderField(b, "Queue", &queue); ok || err != nil {
+		t.Errorf("unexpected field of a document without header %v (%v)", ok, err)
+	}
+
+	// a suffix length of 0 written as a two byte varint, with no flag byte
+	b = []byte("=\xf3rl\x03\x80\x00")
+	if err := ReadHeaderOnly(b, &r); err != ErrNoHeader {
+		t.Errorf("expected ErrNoHeader for an empty suffix, got %v", err)
+	}
+	if ok, err := HeaderField(b, "Queue", &queue); ok || err != nil {
+		t.Errorf("unexpected field of a document with an empty suffix %v (%v)", ok, err)
+	}
+}
+
+func TestPeekHeader(t *testing.T) {
+	body := strings.Repeat("abcd", 100)
+
+	zlib := NewEncoderV3()
+	zlib.Compression = ZlibCompressor{}
+	zlib.CompressionThreshold = 0
+
+	snappy := NewEncoderV3()
+	snappy.Compression = SnappyCompressor{Incremental: true}
+	snappy.CompressionThreshold = 0
+
+	legacy := NewEncoder()
+	legacy.Compression = SnappyCompressor{}
+	legacy.CompressionThreshold = 0
+
+	raw, _ := NewEncoderV3().Marshal(body)
+	bodySize := len(raw) - headerSize - 1
+
+	for _, e := range []*Encoder{NewEncoderV3(), zlib, snappy, legacy} {
+		var b []byte
+		var err error
+		if e.version == 1 {
+			b, err = e.Marshal(body)
+		} else {
+			b, err = e.MarshalWithHeader(map[string]interface{}{"type": "text"}, body)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		info, err := PeekHeader(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if info.Version != e.version || info.BodySize != bodySize || info.CompressedSize != len(b)-info.HeaderSize {
+			t.Errorf("%s: unexpected info %+v", info.DocType, info.DocumentInfo)
+		}
+
+		var want interface{}
+		if e.version > 1 {
+			want = map[string]interface{}{"type": "text"}
+		}
+		if !reflect.DeepEqual(info.Header, want) {
+			t.Errorf("%s: unexpected header %v", info.DocType, info.Header)
+		}
+	}
+
+	if _, err := PeekHeader([]byte("=srl")); err == nil {
+		t.Errorf("expected error for truncated document")
+	}
+}
+
+func TestRoots(t *testing.T) {
+	type reply struct {
+		ID   int
+		Name string
+	}
+
+	shared := &reply{1, "shared"}
+	b, err := EncodeRoots(shared, "ok", shared, 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var r1, r2 *reply
+	var status string
+	if err := DecodeRoots(b, &r1, &status, &r2, nil); err != nil {
+		t.Fatal(err)
+	}
+	if *r1 != *shared || *r2 != *shared || status != "ok" {
+		t.Errorf("unexpected roots %v %q %v", r1, status, r2)
+	}
+
+	// plain decoders see an array
+	var all []interface{}
+	if err := Unmarshal(b, &all); err != nil || len(all) != 4 {
+		t.Errorf("unexpected body %v (%v)", all, err)
+	}
+
+	if err := DecodeRoots(b, &r1); err == nil {
+		t.Errorf("expected error for a mismatched number of pointers")
+	}
+	if err := DecodeRoots(b, &r1, status, &r2, nil); err == nil {
+		t.Errorf("expected error for a non-pointer")
+	}
+
+	b, _ = Marshal([]interface{}{1, 2})
+	var i, j int
+	if err := DecodeRoots(b, &i, &j); err == nil {
+		t.Errorf("expected error for a document without roots flag")
+	}
+
+	// a suffix length of 0 written as a two byte varint, with no flag byte
+	if err := DecodeRoots([]byte("=\xf3rl\x03\x80\x00"), &i, &j); err == nil {
+		t.Errorf("expected error for a document with an empty suffix")
+	}
+}
+
+func TestDeprecatedTitleMatch(t *testing.T) {
+	type S struct {
+		Name   string
+		FooBar int `sereal:"Foo-Bar"`
+	}
+
+	b, _ := Marshal(map[string]interface{}{"name": "x", "foo-bar": 1})
+
+	var s S
+	if err := Unmarshal(b, &s); err != nil || s != (S{"x", 1}) {
+		t.Errorf("unexpected default decoding %+v (%v)", s, err)
+	}
+
+	off := false
+	d := &Decoder{DeprecatedTitleMatch: &off}
+	s = S{}
+	if err := d.Unmarshal(b, &s); err != nil || s != (S{"x", 0}) {
+		t.Errorf("unexpected decoding without title match %+v (%v)", s, err)
+	}
+
+	var m interface{}
+	Unmarshal(b, &m)
+	s = S{}
+	if err := d.Convert(m, &s); err != nil || s != (S{"x", 0}) {
+		t.Errorf("unexpected conversion without title match %+v (%v)", s, err)
+	}
+
+	changes := CheckTitleMatch(&[]S{})
+	want := []TitleMatchChange{{reflect.TypeOf(S{}), "FooBar", "Foo-Bar", "foo-bar"}}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("unexpected changes %v", changes)
+	}
+}
+
+func TestTrainDictionary(t *testing.T) {
+	var docs [][]byte
+	for i := 0; i < 50; i++ {
+		b, err := Marshal(map[string]interface{}{
+			"customer_id":   1000 + i,
+			"status":        "subscription_active",
+			"billing_email": fmt.Sprintf("user%d@example.com", i),
+			"features":      []string{"reporting", "exports", "single_sign_on"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		docs = append(docs, b)
+	}
+
+	dict, err := TrainDictionary(docs[:40], 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dict) == 0 || len(dict) > 256 {
+		t.Fatalf("unexpected dictionary size %d", len(dict))
+	}
+
+	plain := ZlibCompressor{}
+	withDict := ZlibCompressor{Dictionary: dict, DictionaryID: "d1"}
+	d := &Decoder{DictionaryResolver: func(id string) ([]byte, error) { return dict, nil }}
+
+	var plainSize, dictSize int
+	for _, doc := range docs[40:] {
+		b, err := CompressDocument(doc, plain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plainSize += len(b)
+
+		e := NewEncoderV3()
+		e.Compression = withDict
+		e.CompressionThreshold = 0
+		var v map[string]interface{}
+		if err := Unmarshal(doc, &v); err != nil {
+			t.Fatal(err)
+		}
+		if b, err = e.Marshal(v); err != nil {
+			t.Fatal(err)
+		}
+		dictSize += len(b)
+
+		var got map[string]interface{}
+		if err := d.Unmarshal(b, &got); err != nil || !reflect.DeepEqual(got, v) {
+			t.Errorf("unexpected round trip %v (%v)", got, err)
+		}
+	}
+
+	if dictSize >= plainSize {
+		t.Errorf("dictionary didn't help: %d bytes with it, %d without", dictSize, plainSize)
+	}
+}
+
+func TestUnmarshalBodyOnly(t *testing.T) {
+	e := NewEncoderV3()
+	e.Compression = ZlibCompressor{}
+	e.CompressionThreshold = 0
+
+	b, err := e.MarshalWithHeader(map[string]interface{}{"some": "header"}, []string{"body"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	if err := UnmarshalBodyOnly(b, &got); err != nil || !reflect.DeepEqual(got, []string{"body"}) {
+		t.Errorf("unexpected body %v (%v)", got, err)
+	}
+
+	// corrupt the header user data: it is never decoded
+	header, _ := readHeader(b)
+	b[header.suffixStart+1] = 0xff
+	got = nil
+	if err := NewDecoder().UnmarshalBodyOnly(b, &got); err != nil || !reflect.DeepEqual(got, []string{"body"}) {
+		t.Errorf("unexpected body %v (%v)", got, err)
+	}
+	if err := Unmarshal(b, &got); err == nil {
+		t.Errorf("expected Unmarshal to decode the corrupt header")
+	}
+}
+
+func TestSetCompressionLevel(t *testing.T) {
+	e := NewEncoderV3()
+	if err := e.SetCompressionLevel(ZlibBestSpeed); err == nil {
+		t.Errorf("expected error without compression")
+	}
+
+	e.Compression = SnappyCompressor{Incremental: true}
+	if err := e.SetCompressionLevel(ZlibBestSpeed); err == nil {
+		t.Errorf("expected error for snappy")
+	}
+
+	e.Compression = ZlibCompressor{DictionaryID: "kept"}
+	if err := e.SetCompressionLevel(ZlibBestCompression + 1); err == nil {
+		t.Errorf("expected error for a bad zlib level")
+	}
+	if err := e.SetCompressionLevel(ZlibBestSpeed); err != nil {
+		t.Fatal(err)
+	}
+	if c := e.Compression.(ZlibCompressor); c.Level != ZlibBestSpeed || c.DictionaryID != "kept" {
+		t.Errorf("unexpected compressor %+v", c)
+	}
+
+	e.Compression = ZstdCompressor{}
+	if err := e.SetCompressionLevel(ZstdBestCompression + 1); err == nil {
+		t.Errorf("expected error for a bad zstd level")
+	}
+	if err := e.SetCompressionLevel(ZstdBestSpeed); err != nil || e.Compression.(ZstdCompressor).Level != ZstdBestSpeed {
+		t.Errorf("unexpected compressor %+v (%v)", e.Compression, err)
+	}
+
+	if _, err := (ZstdCompressor{Level: -5}).compress([]byte("abc")); err == nil {
+		t.Errorf("expected error compressing with a bad zstd level")
+	}
+}
+
+// xorCompressor "compresses" by flipping bits and appending a marker, so
+// that its output is longer than its input
+type xorCompressor struct{}
+
+func (xorCompressor) Compress(b []byte) ([]byte, error) {
+	out := make([]byte, len(b), len(b)+1)
+	for i, c := range b {
+		out[i] = c ^ 0xaa
+	}
+	return append(out, 0x42), nil
+}
+
+func (xorCompressor) Decompress(dst, b []byte) ([]byte, error) {
+	if len(b) == 0 || b[len(b)-1] != 0x42 {
+		return nil, errors.New("bad xor marker")
+	}
+	out := dst[:0]
+	for _, c := range b[:len(b)-1] {
+		out = append(out, c^0xaa)
+	}
+	return out, nil
+}
+
+func TestRegisterCompressor(t *testing.T) {
+	if err := RegisterCompressor(byte(serealZlib), xorCompressor{}); err == nil {
+		t.Errorf("expected error registering a standard document type")
+	}
+	if err := RegisterCompressor(LastUnassignedDocType+1, xorCompressor{}); err == nil {
+		t.Errorf("expected error registering a document type out of the header bits")
+	}
+	if err := RegisterCompressor(9, xorCompressor{}); err != nil {
+		t.Fatal(err)
+	}
+
+	e := NewEncoderV3()
+	e.Compression = RegisteredCompressor{DocType: 9}
+	e.CompressionThreshold = 0
+
+	b, err := e.Marshal(map[string]interface{}{"foo": "bar"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got map[string]interface{}
+	if err := Unmarshal(b, &got); err != nil || got["foo"] != "bar" {
+		t.Errorf("unexpected body %v (%v)", got, err)
+	}
+
+	if info, err := PeekHeader(b); err != nil || info.DocType != "doctype9" || info.BodySize != -1 {
+		t.Errorf("unexpected info %+v (%v)", info.DocumentInfo, err)
+	}
+
+	raw, err := DecompressDocument(nil, b)
+	if err != nil || raw[4]>>4 != byte(serealRaw) {
+		t.Errorf("unexpected decompressed document %x (%v)", raw, err)
+	}
+
+	e.Compression = RegisteredCompressor{DocType: 10}
+	if _, err := e.Marshal("x"); err == nil {
+		t.Errorf("expected error for an unregistered document type")
+	}
+
+	b[4] = b[4]&0x0f | 10<<4
+	if err := Unmarshal(b, &got); err == nil {
+		t.Errorf("expected error decoding an unregistered document type")
+	}
+}
+
+func TestDumpPerl(t *testing.T) {
+	shared := []interface{}{1, "it's"}
+	v := map[string]interface{}{
+		"a":   &shared,
+		"b":   &shared,
+		"obj": &PerlObject{Class: "My::Obj", Reference: map[string]interface{}{"x": nil, "re": &PerlRegexp{Pattern: []byte("a/b"), Modifiers: []byte("i")}}},
+		"bin": []byte{0, 'a', '\n'},
+	}
+
+	b, err := (&Encoder{PerlCompat: true, Canonical: true, version: 3}).Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var perl interface{}
+	if err := (&Decoder{PerlCompat: true}).Unmarshal(b, &perl); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := DumpPerl(&buf, perl); err != nil {
+		t.Fatal(err)
+	}
+	// b was encoded as a reference to the tracked reference a
+	want := `$VAR1 = {
+  'a' => [
+    1,
+    'it\'s'
+  ],
+  'b' => \$VAR1->{'a'},
+  'bin' => "\x{0}a\n",
+  'obj' => bless( {
+    're' => qr/a\/b/i,
+    'x' => undef
+  }, 'My::Obj' )
+};
+`
+	if buf.String() != want {
+		t.Errorf("got\n%swant\n%s", buf.String(), want)
+	}
+
+	if got := fmt.Sprint(perl.(*map[string]interface{})); !strings.Contains(got, "bless( {") {
+		t.Errorf("expected PerlObject to format with String, got %s", got)
+	}
+}
+
+func TestDecompressBodyInPlace(t *testing.T) {
+	// compressed less than maxBodyPreallocRatio times, so that the
+	// announced size is trusted
+	var body []byte
+	for i := 0; i < 1000; i++ {
+		body = strconv.AppendInt(body, int64(i*i), 10)
+	}
+
+	for _, c := range []compressor{SnappyCompressor{Incremental: true}, ZlibCompressor{}} {
+		e := NewEncoderV3()
+		e.Compression = c
+		b, err := e.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		header, _ := readHeader(b)
+		bodyStart := headerSize + header.suffixSize
+		decomp, _ := documentDecompressor(header.version, header.doctype)
+
+		buf, err := decompressBody(decomp, b, header, bodyStart, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cap(buf) != len(buf) || buf[0] != b[bodyStart-1] {
+			t.Errorf("%T: expected the body decompressed in place after the prefix, got len %d cap %d", c, len(buf), cap(buf))
+		}
+
+		var got []byte
+		if err := Unmarshal(b, &got); err != nil || !bytes.Equal(got, body) {
+			t.Errorf("%T: unexpected body (%v)", c, err)
+		}
+	}
+}
+
+func TestDecompressAnnouncedSize(t *testing.T) {
+	// a snappy_incr body announcing 96MB in a few bytes
+	doc := []byte("=\xf3rl#\x00\x81\x81\x81\x810\x81\x80\x820")
+
+	for _, tc := range []struct {
+		name string
+		f    func() error
+	}{
+		{"Unmarshal", func() error { var v interface{}; return Unmarshal(doc, &v) }},
+		{"Validate", func() error { return Validate(doc) }},
+		{"Stat", func() error { _, err := Stat(doc); return err }},
+		{"ParseTree", func() error { _, err := ParseTree(doc); return err }},
+		{"ToJSON", func() error { return ToJSON(ioutil.Discard, doc) }},
+		{"DumpAnnotated", func() error { return DumpAnnotated(ioutil.Discard, doc) }},
+		{"DecompressDocument", func() error { _, err := DecompressDocument(nil, doc); return err }},
+	} {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		err := tc.f()
+		runtime.ReadMemStats(&after)
+
+		if err == nil {
+			t.Errorf("%s: no error", tc.name)
+		}
+		if n := after.TotalAlloc - before.TotalAlloc; n > 1<<20 {
+			t.Errorf("%s: allocated %d bytes", tc.name, n)
+		}
+	}
+
+	// zlib bodies shorter than announced are corrupt, whatever they announce
+	e := NewEncoderV3()
+	e.Compression = ZlibCompressor{}
+	e.CompressionThreshold = 0
+	b, err := e.Marshal("short")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bodyStart := headerSize + 1
+	for _, uln := range []uint{uint(b[bodyStart]) + 1, 1 << 30} {
+		short := append(varint(append([]byte(nil), b[:bodyStart]...), uln), b[bodyStart+1:]...)
+		var s string
+		if err := Unmarshal(short, &s); !errors.Is(err, ErrShortBody) {
+			t.Errorf("announcing %d bytes: got %v", uln, err)
+		}
+	}
+}
+
+func TestNormalizePerlify(t *testing.T) {
+	v := map[string]interface{}{
+		"a":     []interface{}{1, "two"},
+		"obj":   &PerlObject{Class: "My::Obj", Reference: map[string]interface{}{"x": nil}},
+		"undef": nil,
+		"bin":   []byte("bin"),
+	}
+
+	e := &Encoder{PerlCompat: true, version: 3}
+	b, err := e.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var native, perl interface{}
+	if err := Unmarshal(b, &native); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&Decoder{PerlCompat: true}).Unmarshal(b, &perl); err != nil {
+		t.Fatal(err)
+	}
+
+	if normalized := Normalize(perl); !reflect.DeepEqual(normalized, native) {
+		t.Errorf("Normalize: got %s, expected %s", spew.Sdump(normalized), spew.Sdump(native))
+	}
+	if !reflect.DeepEqual(Normalize(native), native) {
+		t.Errorf("Normalize changed a Go-native value")
+	}
+
+	perlified := Perlify(native)
+	pm, ok := perlified.(*map[string]interface{})
+	if !ok {
+		t.Fatalf("Perlify: expected a hash reference, got %T", perlified)
+	}
+	if _, ok := (*pm)["undef"].(*PerlUndef); !ok {
+		t.Errorf("Perlify: expected undef, got %T", (*pm)["undef"])
+	}
+
+	if b, err = e.Marshal(perlified); err != nil {
+		t.Fatal(err)
+	}
+	var again interface{}
+	if err := Unmarshal(b, &again); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(again, native) {
+		t.Errorf("Perlify: got %s, expected %s", spew.Sdump(again), spew.Sdump(native))
+	}
+
+	// shared data stays shared both ways
+	arr := &[]interface{}{1}
+	shared := Normalize(&map[string]interface{}{"a": arr, "b": &PerlWeakRef{Reference: arr}}).(map[string]interface{})
+	if reflect.ValueOf(shared["a"]).Pointer() != reflect.ValueOf(shared["b"]).Pointer() {
+		t.Errorf("Normalize didn't keep the shared array shared")
+	}
+
+	sl := []interface{}{1}
+	pm = Perlify(map[string]interface{}{"a": sl, "b": sl}).(*map[string]interface{})
+	if (*pm)["a"] != (*pm)["b"] {
+		t.Errorf("Perlify didn't keep the shared array shared")
+	}
+
+	cyclic := map[string]interface{}{}
+	cyclic["self"] = &PerlObject{Class: "Node", Reference: &cyclic}
+	if n := Normalize(&cyclic).(map[string]interface{}); reflect.ValueOf(n["self"]).Pointer() != reflect.ValueOf(n).Pointer() {
+		t.Errorf("Normalize didn't keep the cycle")
+	}
+}
+
+func TestZstdFrames(t *testing.T) {
+	// a single-segment frame holding one raw block, with an optional
+	// content checksum
+	rawFrame := func(content string, checksum bool) []byte {
+		fhd := byte(0x20)
+		if checksum {
+			fhd |= 0x04
+		}
+		h := uint32(len(content))<<3 | 1
+		frame := []byte{0x28, 0xb5, 0x2f, 0xfd, fhd, byte(len(content)), byte(h), byte(h >> 8), byte(h >> 16)}
+		frame = append(frame, content...)
+		if checksum {
+			frame = append(frame, 1, 2, 3, 4)
+		}
+		return frame
+	}
+
+	first, second := rawFrame("first frame ", false), rawFrame("second frame", true)
+	skippable := []byte{0x53, 0x2a, 0x4d, 0x18, 2, 0, 0, 0, 'x', 'x'}
+
+	var stream []byte
+	stream = append(stream, first...)
+	stream = append(stream, skippable...)
+	stream = append(stream, second...)
+
+	frames, err := zstdFrames(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 2 || !bytes.Equal(frames[0], first) || !bytes.Equal(frames[1], second) {
+		t.Fatalf("unexpected frames %x", frames)
+	}
+
+	if _, err := zstdFrames(stream[:len(stream)-1]); err == nil {
+		t.Errorf("expected error for a truncated frame")
+	}
+
+	var mu sync.Mutex
+	calls := 0
+	got, err := decodeZstdFrames(nil, frames, func(d, frame []byte) ([]byte, error) {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		return frame[9 : 9+int(frame[5])], nil
+	})
+	if err != nil || string(got) != "first frame second frame" || calls != 2 {
+		t.Errorf("unexpected decoded frames %q after %d calls (%v)", got, calls, err)
+	}
+
+	_, err = decodeZstdFrames(nil, frames, func(d, frame []byte) ([]byte, error) {
+		return nil, errBadZstdFrame
+	})
+	if err != errBadZstdFrame {
+		t.Errorf("expected the error of a frame, got %v", err)
+	}
+
+	if _, err := (ZstdCompressor{FrameSize: -1}).compress([]byte("abc")); err == nil {
+		t.Errorf("expected error for a negative frame size")
+	}
+}
+
+func TestUndefAsZero(t *testing.T) {
+	type S struct {
+		I int
+		S string
+		B bool
+		F float64
+		P *int
+	}
+
+	b, _ := Marshal(map[string]interface{}{"I": nil, "S": nil, "B": nil, "F": nil, "P": nil})
+	prev := 1
+	full := S{1, "s", true, 1.5, &prev}
+
+	s := full
+	if err := Unmarshal(b, &s); err != nil || s.I != 1 || s.S != "s" || !s.B || s.F != 1.5 || s.P != nil {
+		t.Errorf("unexpected default decoding %+v (%v)", s, err)
+	}
+
+	for _, d := range []*Decoder{{UndefAsZero: true}, {UndefAsZero: true, PerlCompat: true}} {
+		s = full
+		if err := d.Unmarshal(b, &s); err != nil || s != (S{}) {
+			t.Errorf("PerlCompat %v: unexpected decoding %+v (%v)", d.PerlCompat, s, err)
+		}
+	}
+
+	var m interface{}
+	Unmarshal(b, &m)
+	s = full
+	if err := (&Decoder{UndefAsZero: true}).Convert(m, &s); err != nil || s != (S{}) {
+		t.Errorf("unexpected conversion %+v (%v)", s, err)
+	}
+
+	var perl interface{}
+	if err := (&Decoder{UndefAsZero: true, PerlCompat: true}).Unmarshal(b, &perl); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := perl.(map[string]interface{})["I"].(*PerlUndef); !ok {
+		t.Errorf("expected PerlUndef in an interface{}, got %s", spew.Sdump(perl))
+	}
+}
+
+func TestAliasInput(t *testing.T) {
+	type S struct {
+		Bin []byte
+		Re  *PerlRegexp
+	}
+
+	b, err := NewEncoderV3().Marshal(map[string]interface{}{
+		"Bin": []byte("binary"),
+		"Re":  &PerlRegexp{Pattern: []byte("a+"), Modifiers: []byte("i")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inDocument := func(v []byte) bool {
+		p := reflect.ValueOf(v).Pointer()
+		start := reflect.ValueOf(b).Pointer()
+		return p >= start && p < start+uintptr(len(b))
+	}
+
+	for _, alias := range []bool{false, true} {
+		d := &Decoder{AliasInput: alias}
+
+		var m map[string]interface{}
+		if err := d.Unmarshal(b, &m); err != nil {
+			t.Fatal(err)
+		}
+		bin, re := m["Bin"].([]byte), m["Re"].(*PerlRegexp)
+		if inDocument(bin) != alias || inDocument(re.Pattern) != alias || inDocument(re.Modifiers) != alias {
+			t.Errorf("AliasInput %v: unexpected sharing of %s in interface{}", alias, spew.Sdump(m))
+		}
+		if alias && cap(bin) != len(bin) {
+			t.Errorf("expected aliased slices to be capped")
+		}
+
+		var s S
+		if err := d.Unmarshal(b, &s); err != nil {
+			t.Fatal(err)
+		}
+		if string(s.Bin) != "binary" || inDocument(s.Bin) != alias || inDocument(s.Re.Pattern) != alias {
+			t.Errorf("AliasInput %v: unexpected sharing of %s in struct", alias, spew.Sdump(s))
+		}
+	}
+}
+
+func TestStrict(t *testing.T) {
+	type S struct {
+		I8 int8
+		U  uint
+		I  int
+		F  float32
+	}
+
+	tests := []struct {
+		name   string
+		v      map[string]interface{}
+		reason string
+	}{
+		{"fits", map[string]interface{}{"I8": -128, "U": uint64(math.MaxUint64), "I": math.MinInt64, "F": 1.5}, ""},
+		{"int overflow", map[string]interface{}{"I8": 128}, "128 overflows int8"},
+		{"negative into unsigned", map[string]interface{}{"U": -1}, "negative -1 into uint"},
+		{"varint overflow", map[string]interface{}{"I": uint64(math.MaxUint64)}, "18446744073709551615 overflows int"},
+		{"float into int", map[string]interface{}{"I": 1.5}, "float 1.5 into int"},
+		{"float overflow", map[string]interface{}{"F": math.MaxFloat64}, "overflows float32"},
+		{"unknown key", map[string]interface{}{"Other": 1}, `no field of sereal.S for key "Other"`},
+	}
+
+	for _, tt := range tests {
+		b, err := Marshal(tt.v)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var s S
+		d := &Decoder{Strict: true}
+		err = d.Unmarshal(b, &s)
+		var serr *StrictError
+		if tt.reason == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", tt.name, err)
+			}
+		} else if !errors.As(err, &serr) || !strings.Contains(serr.Reason, tt.reason) || serr.Offset < 0 {
+			t.Errorf("%s: expected strict error %q, got %v", tt.name, tt.reason, err)
+		}
+
+		var m interface{}
+		Unmarshal(b, &m)
+		err = d.Convert(m, &s)
+		if tt.reason == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected conversion error %v", tt.name, err)
+			}
+		} else if tt.name != "varint overflow" && !errors.As(err, &serr) {
+			// the conversion doesn't know an int was a varint
+			t.Errorf("%s: expected strict conversion error, got %v", tt.name, err)
+		}
+	}
+
+	// without Strict the value is silently truncated
+	b, _ := Marshal(map[string]interface{}{"I8": 129, "Other": 1})
+	var s S
+	if err := Unmarshal(b, &s); err != nil || s.I8 != -127 {
+		t.Errorf("unexpected lenient decoding %+v (%v)", s, err)
+	}
+}
+
+func TestRemainField(t *testing.T) {
+	type S struct {
+		Name  string
+		Extra map[string]interface{} `sereal:",remain"`
+	}
+
+	b, err := Marshal(map[string]interface{}{"Name": "x", "a": 1, "b": []interface{}{"two"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := S{"x", map[string]interface{}{"a": 1, "b": []interface{}{"two"}}}
+
+	var s S
+	if err := (&Decoder{Strict: true}).Unmarshal(b, &s); err != nil || !reflect.DeepEqual(s, want) {
+		t.Errorf("unexpected decoding %+v (%v)", s, err)
+	}
+
+	var m interface{}
+	Unmarshal(b, &m)
+	s = S{}
+	if err := Convert(m, &s); err != nil || !reflect.DeepEqual(s, want) {
+		t.Errorf("unexpected conversion %+v (%v)", s, err)
+	}
+
+	// the remaining entries are written back as entries of the hash
+	s.Extra["Name"] = "ignored"
+	if b, err = Marshal(s); err != nil {
+		t.Fatal(err)
+	}
+	var back map[string]interface{}
+	if err := Unmarshal(b, &back); err != nil || !reflect.DeepEqual(back, map[string]interface{}{"Name": "x", "a": 1, "b": []interface{}{"two"}}) {
+		t.Errorf("unexpected round trip %v (%v)", back, err)
+	}
+
+	type Bad struct {
+		Extra []interface{} `sereal:",remain"`
+	}
+	if err := NewDecoder().Precompile(Bad{}); err == nil {
+		t.Errorf("expected error for a remain field which isn't a map")
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	c := Capabilities()
+
+	if !reflect.DeepEqual(c.EncodeVersions, []int{1, 2, 3, 4}) || !reflect.DeepEqual(c.DecodeVersions, []int{1, 2, 3, 4}) {
+		t.Errorf("unexpected versions %v %v", c.EncodeVersions, c.DecodeVersions)
+	}
+
+	hasZstd := false
+	for _, name := range c.Compressions {
+		if name == "zstd" {
+			hasZstd = true
+		}
+	}
+	if hasZstd != zstdCompiled {
+		t.Errorf("zstd listed is %v, compiled is %v", hasZstd, zstdCompiled)
+	}
+
+	if c.DefaultMaxCopyDepth != DefaultMaxCopyDepth || c.DefaultCompressionThreshold != 1024 || c.OptionsVersion != OptionsVersion {
+		t.Errorf("unexpected defaults %+v", c)
+	}
+
+	b, err := json.Marshal(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var back CapabilityReport
+	if err := json.Unmarshal(b, &back); err != nil || !reflect.DeepEqual(back, c) {
+		t.Errorf("unexpected JSON round trip %s (%v)", b, err)
+	}
+}
+
+func TestPresets(t *testing.T) {
+	v := map[string]interface{}{"key": strings.Repeat("value", 2000), "n": []interface{}{1, 2, 3}}
+
+	presets := []struct {
+		name string
+		enc  *Encoder
+		dec  *Decoder
+		typ  documentType
+	}{
+		{"cache", NewCacheEncoder(), NewCacheDecoder(), serealSnappyIncremental},
+		{"rpc", NewRPCEncoder(), NewRPCDecoder(), serealSnappyIncremental},
+		{"archive", NewArchiveEncoder(), NewArchiveDecoder(), serealZlib},
+	}
+
+	for _, p := range presets {
+		b, err := p.enc.Marshal(v)
+		if err != nil {
+			t.Errorf("%s: %v", p.name, err)
+			continue
+		}
+
+		if info, err := p.dec.PeekHeader(b); err != nil || info.DocType != p.typ.String() {
+			t.Errorf("%s: unexpected document type %+v (%v)", p.name, info, err)
+		}
+
+		var got map[string]interface{}
+		if err := p.dec.Unmarshal(b, &got); err != nil || !reflect.DeepEqual(got, v) {
+			t.Errorf("%s: unexpected round trip (%v)", p.name, err)
+		}
+	}
+}
+
+func TestKeyMatcher(t *testing.T) {
+	type S struct {
+		UserID    int
+		FirstName string
+		Tagged    string `sereal:"last_name"`
+	}
+
+	b, err := Marshal(map[string]interface{}{"user_id": 7, "FIRSTNAME": "Ada", "last_name": "Lovelace"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		matcher KeyMatcher
+		want    S
+	}{
+		{nil, S{Tagged: "Lovelace"}},
+		{ExactKeys, S{Tagged: "Lovelace"}},
+		{CaseInsensitiveKeys, S{FirstName: "Ada", Tagged: "Lovelace"}},
+		{SnakeCaseKeys, S{UserID: 7, FirstName: "Ada", Tagged: "Lovelace"}},
+	}
+
+	for i, tt := range tests {
+		d := &Decoder{KeyMatcher: tt.matcher}
+
+		var s S
+		if err := d.Unmarshal(b, &s); err != nil || s != tt.want {
+			t.Errorf("%d: unexpected decoding %+v (%v)", i, s, err)
+		}
+
+		var m interface{}
+		Unmarshal(b, &m)
+		s = S{}
+		if err := d.Convert(m, &s); err != nil || s != tt.want {
+			t.Errorf("%d: unexpected conversion %+v (%v)", i, s, err)
+		}
+	}
+
+	// KeyMatcher may change once the Decoder is used
+	shared := &Decoder{}
+	for _, i := range []int{1, 3, 2, 1} {
+		shared.KeyMatcher = tests[i].matcher
+
+		var s S
+		if err := shared.Unmarshal(b, &s); err != nil || s != tests[i].want {
+			t.Errorf("%d: unexpected decoding with a shared Decoder %+v (%v)", i, s, err)
+		}
+	}
+
+	d, err := DecoderOptions{Version: 1, KeyMatch: "snake_case"}.NewDecoder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s S
+	if err := d.Unmarshal(b, &s); err != nil || s.UserID != 7 {
+		t.Errorf("unexpected decoding %+v (%v)", s, err)
+	}
+
+	if _, err := (DecoderOptions{Version: 1, KeyMatch: "kebab"}).NewDecoder(); err == nil {
+		t.Errorf("expected error for an unknown key match")
+	}
+}
+
+func TestOrderedMap(t *testing.T) {
+	var m OrderedMap
+	var keys []string
+	for i := 20; i > 0; i-- {
+		key := "k" + strconv.Itoa(i)
+		keys = append(keys, key)
+		m.Set(key, i)
+	}
+	m.Set("k20", "first")
+
+	// a map would come back in another order, whether decoded in the order
+	// of the document or not
+	for _, e := range []*Encoder{NewEncoderV3(), {Canonical: true, CompressionThreshold: 1024}, {PerlCompat: true}} {
+		for _, v := range []interface{}{m, &m} {
+			b, err := e.Marshal(v)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var back *OrderedMap
+			if err := Unmarshal(b, &back); err != nil || !reflect.DeepEqual(back.Keys(), keys) {
+				t.Errorf("%T: unexpected decoding %v (%v)", v, back, err)
+			}
+		}
+
+		b, err := e.Marshal([]interface{}{m})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var back []OrderedMap
+		if err := Unmarshal(b, &back); err != nil || len(back) != 1 || !reflect.DeepEqual(back[0].Keys(), keys) {
+			t.Errorf("unexpected decoding %v (%v)", back, err)
+		}
+	}
+
+	if v, _ := m.Get("k20"); v != "first" {
+		t.Errorf("unexpected value %v", v)
+	}
+	m.Delete("k20")
+	if v, ok := m.Get("k20"); ok || m.Len() != 19 || m.Keys()[0] != "k19" {
+		t.Errorf("unexpected map after Delete %v %v %v", v, ok, m.Keys())
+	}
+}
+
+func TestRegexpFlags(t *testing.T) {
+	tests := []struct {
+		modifiers string
+		flags     RegexpFlags
+		canonical string
+	}{
+		{"", 0, ""},
+		{"d", 0, ""},
+		{"xim", RegexpMultiline | RegexpIgnoreCase | RegexpExtended, "mix"},
+		{"xxu", RegexpExtended | RegexpExtendedMore | RegexpUnicode, "uxx"},
+		{"npaa", RegexpNoCapture | RegexpKeepCopy | RegexpASCIIStrict, "aanp"},
+		{"sl", RegexpSingleLine | RegexpLocale, "ls"},
+	}
+
+	for _, tt := range tests {
+		f, err := ParseRegexpFlags(tt.modifiers)
+		if err != nil || f != tt.flags || f.String() != tt.canonical {
+			t.Errorf("%q: unexpected flags %v %q (%v)", tt.modifiers, f, f.String(), err)
+		}
+
+		// decoding normalizes the modifiers
+		b, err := Marshal(&PerlRegexp{Pattern: []byte("a+"), Modifiers: []byte(tt.modifiers)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var re *PerlRegexp
+		if err := Unmarshal(b, &re); err != nil || string(re.Modifiers) != tt.canonical || re.Flags != tt.flags {
+			t.Errorf("%q: unexpected decoding %+v (%v)", tt.modifiers, re, err)
+		}
+
+		// and encoding accepts the flags instead of the modifiers
+		b2, err := Marshal(&PerlRegexp{Pattern: []byte("a+"), Flags: tt.flags})
+		if err != nil || !bytes.Equal(b, b2) {
+			t.Errorf("%q: unexpected encoding of the flags %x, want %x (%v)", tt.modifiers, b2, b, err)
+		}
+	}
+
+	for _, bad := range []string{"g", "xxx", "aaa", "au", "lu"} {
+		if _, err := ParseRegexpFlags(bad); err == nil {
+			t.Errorf("%q: expected error", bad)
+		}
+	}
+
+	if _, err := Marshal(PerlRegexp{Pattern: []byte("a"), Modifiers: []byte("e")}); err == nil {
+		t.Errorf("expected error encoding invalid modifiers")
+	}
+	if _, err := Marshal(PerlRegexp{Pattern: []byte("a"), Flags: RegexpLocale | RegexpUnicode}); err == nil {
+		t.Errorf("expected error encoding several character sets")
+	}
+
+	// "r" is no regexp modifier
+	doc := []byte("=\xf3rl\x03\x00\x31\x62a+\x61i")
+	var v interface{}
+	if err := Unmarshal(doc, &v); err != nil {
+		t.Fatal(err)
+	}
+	doc[len(doc)-1] = 'r'
+	if err := Unmarshal(doc, &v); err == nil {
+		t.Errorf("expected error decoding invalid modifiers, got %v", v)
+	}
+}
+
+func TestTranslateRegexps(t *testing.T) {
+	tests := []struct {
+		pattern, modifiers string
+		match, nomatch     string
+	}{
+		{`^ab+c$`, "i", "ABBC", "ac"},
+		{`^a.b$`, "s", "a\nb", "ab"},
+		{`^b$`, "m", "a\nb", "c"},
+		{"^ a+ # the a's\n b [ x]$", "x", "aab ", "aab"},
+		{"^[ x ]$", "xx", "x", " "},
+		{`^(?<word>\w+)-(\d+)$`, "", "abc-12", "abc-"},
+		{`^(a)(b)$`, "n", "ab", "ba"},
+		{`^[]a]+$`, "", "]a]", "b"},
+		{`^[[:digit:]#]+$`, "x", "1#2", "a"},
+	}
+
+	for _, tt := range tests {
+		re, err := PerlRegexp{Pattern: []byte(tt.pattern), Modifiers: []byte(tt.modifiers)}.Compile()
+		if err != nil {
+			t.Errorf("/%s/%s: %v", tt.pattern, tt.modifiers, err)
+			continue
+		}
+		if !re.MatchString(tt.match) || re.MatchString(tt.nomatch) {
+			t.Errorf("/%s/%s translated to %s: wrong matches", tt.pattern, tt.modifiers, re)
+		}
+	}
+
+	if re, _ := (PerlRegexp{Pattern: []byte(`(a)(b)`), Modifiers: []byte("n")}).Compile(); re.NumSubexp() != 0 {
+		t.Errorf("expected no capture with /n, got %d", re.NumSubexp())
+	}
+
+	for _, bad := range []PerlRegexp{
+		{Pattern: []byte(`(a)\1`)},
+		{Pattern: []byte(`a(?=b)`)},
+		{Pattern: []byte(`a`), Modifiers: []byte("l")},
+	} {
+		var rerr *RegexpError
+		if _, err := bad.Compile(); !errors.As(err, &rerr) || rerr.Pattern != string(bad.Pattern) {
+			t.Errorf("/%s/%s: expected RegexpError, got %v", bad.Pattern, bad.Modifiers, err)
+		}
+	}
+
+	type rules struct {
+		Name  *regexp.Regexp
+		Other interface{}
+	}
+	b, err := Marshal(map[string]interface{}{
+		"Name":  &PerlRegexp{Pattern: []byte(`^[a-z]+$`), Modifiers: []byte("i")},
+		"Other": &PerlRegexp{Pattern: []byte(`^x$`)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var r rules
+	if err := Unmarshal(b, &r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Name == nil || !r.Name.MatchString("Bob") {
+		t.Errorf("expected a translated regexp, got %v", r.Name)
+	}
+	if _, ok := r.Other.(*PerlRegexp); !ok {
+		t.Errorf("expected a PerlRegexp without TranslateRegexps, got %T", r.Other)
+	}
+
+	d := NewDecoder()
+	d.TranslateRegexps = true
+	var v map[string]interface{}
+	if err := d.Unmarshal(b, &v); err != nil {
+		t.Fatal(err)
+	}
+	if re, ok := v["Other"].(*regexp.Regexp); !ok || !re.MatchString("x") {
+		t.Errorf("expected a translated regexp, got %v", v["Other"])
+	}
+
+	b, err = Marshal([]interface{}{&PerlRegexp{Pattern: []byte(`(a)\1`)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rerr *RegexpError
+	var arr interface{}
+	if err := d.Unmarshal(b, &arr); !errors.As(err, &rerr) || !strings.Contains(err.Error(), "body[0]") {
+		t.Errorf("expected RegexpError at body[0], got %v", err)
+	}
+}
+
+func TestRegisteredCompressorAlways(t *testing.T) {
+	if err := RegisterCompressor(14, xorCompressor{}); err != nil {
+		t.Fatal(err)
+	}
+
+	e := NewEncoderV3()
+	e.Compression = RegisteredCompressor{DocType: 14, Always: true}
+	e.CompressionThreshold = 1024
+
+	// small documents are marked too
+	b, err := e.Marshal(map[string]interface{}{"foo": "bar"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := PeekHeader(b); err != nil || info.DocType != "doctype14" {
+		t.Errorf("unexpected info %+v (%v)", info.DocumentInfo, err)
+	}
+
+	var got map[string]interface{}
+	if err := Unmarshal(b, &got); err != nil || got["foo"] != "bar" {
+		t.Errorf("unexpected body %v (%v)", got, err)
+	}
+
+	e.Compression = RegisteredCompressor{DocType: 14}
+	if b, err = e.Marshal("x"); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := PeekHeader(b); err != nil || info.DocType != "raw" {
+		t.Errorf("unexpected info %+v (%v)", info.DocumentInfo, err)
+	}
+}
+
+func TestTagOptions(t *testing.T) {
+	type S struct {
+		Ptr   *int                   `sereal:",omitempty"`
+		Map   map[string]interface{} `sereal:",omitempty"`
+		Slice []int                  `sereal:",omitempty"`
+		Int   int                    `sereal:",omitempty"`
+		Uint  uint8                  `sereal:",omitempty"`
+		Float float64                `sereal:",omitempty"`
+		Iface interface{}            `sereal:",omitempty"`
+		ID    int64                  `sereal:"id,string"`
+		Ratio float32                `sereal:"ratio,string,omitempty"`
+	}
+
+	e := NewEncoderV3()
+	e.StructAsMap = true
+
+	b, err := e.Marshal(S{Map: map[string]interface{}{}, Slice: []int{}, ID: -42})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m map[string]interface{}
+	if err := Unmarshal(b, &m); err != nil || !reflect.DeepEqual(m, map[string]interface{}{"id": "-42"}) {
+		t.Errorf("unexpected encoding %v (%v)", m, err)
+	}
+
+	one := 1
+	s := S{Ptr: &one, Map: map[string]interface{}{"a": 1}, Slice: []int{1}, Int: 1, Uint: 1, Float: 1, Iface: 1, ID: 1 << 40, Ratio: 0.1}
+	if b, err = e.Marshal(s); err != nil {
+		t.Fatal(err)
+	}
+	m = nil
+	if err := Unmarshal(b, &m); err != nil || len(m) != 9 || m["id"] != "1099511627776" || m["ratio"] != "0.1" {
+		t.Errorf("unexpected encoding %v (%v)", m, err)
+	}
+
+	// decoding into pointers to numbers isn't supported
+	delete(m, "Ptr")
+	s.Ptr = nil
+	if b, err = Marshal(m); err != nil {
+		t.Fatal(err)
+	}
+
+	var back S
+	if err := Unmarshal(b, &back); err != nil || !reflect.DeepEqual(back, s) {
+		t.Errorf("unexpected decoding %+v (%v)", back, err)
+	}
+	back = S{}
+	if err := Convert(m, &back); err != nil || !reflect.DeepEqual(back, s) {
+		t.Errorf("unexpected conversion %+v (%v)", back, err)
+	}
+
+	// numbers are accepted too, strings which aren't numbers rejected
+	for _, v := range []interface{}{map[string]interface{}{"id": 7}, map[string]interface{}{"id": "7"}} {
+		b, _ := Marshal(v)
+		back = S{}
+		if err := Unmarshal(b, &back); err != nil || back.ID != 7 {
+			t.Errorf("%v: unexpected decoding %+v (%v)", v, back, err)
+		}
+	}
+	b, _ = Marshal(map[string]interface{}{"id": "seven"})
+	if err := Unmarshal(b, &back); err == nil {
+		t.Errorf("expected error decoding a string which isn't a number")
+	}
+
+	type Bad struct {
+		Name string `sereal:",string"`
+	}
+	if err := NewEncoderV3().Precompile(Bad{}); err == nil {
+		t.Errorf("expected error for a string option on a string field")
+	}
+}
+
+// writeSizes records the size of the writes made to it
+type writeSizes struct {
+	bytes.Buffer
+	sizes []int
+}
+
+func (w *writeSizes) Write(b []byte) (int, error) {
+	w.sizes = append(w.sizes, len(b))
+	return w.Buffer.Write(b)
+}
+
+func TestStreamChunks(t *testing.T) {
+	for _, framing := range []Framing{FramingConcatenated, FramingLengthPrefixed} {
+		// only Write is promoted: writeSizes isn't an io.ReaderFrom
+		w := &struct{ io.Writer }{&writeSizes{}}
+		ws := w.Writer.(*writeSizes)
+
+		enc := NewStreamEncoder(w, nil)
+		enc.Framing = framing
+		enc.ChunkSize = 64
+
+		var expected []interface{}
+		for i := 0; i < 10; i++ {
+			v := strings.Repeat("x", i*20)
+			if err := enc.Encode(v); err != nil {
+				t.Fatal(err)
+			}
+			expected = append(expected, v)
+		}
+
+		for _, sz := range ws.sizes {
+			if sz != 64 {
+				t.Errorf("framing %d: unexpected write sizes %v", framing, ws.sizes)
+				break
+			}
+		}
+		held := ws.Len()
+		if err := enc.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if last := ws.sizes[len(ws.sizes)-1]; last >= 64 || ws.Len() != held+last {
+			t.Errorf("framing %d: unexpected flush of %d bytes", framing, last)
+		}
+
+		dec := NewStreamDecoder(bytes.NewReader(ws.Bytes()), nil)
+		dec.Framing = framing
+		for i, v := range expected {
+			var got string
+			if err := dec.DecodeNext(&got); err != nil || got != v {
+				t.Errorf("framing %d, document %d: got %q (%v)", framing, i, got, err)
+			}
+		}
+	}
+
+	// writers are flushed
+	var buf bytes.Buffer
+	bw := bufio.NewWriter(&buf)
+	enc := NewStreamEncoder(bw, nil)
+	if err := enc.Encode("small"); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("expected the document to be buffered")
+	}
+	if err := enc.Flush(); err != nil || buf.Len() == 0 {
+		t.Errorf("expected the document to be flushed (%v)", err)
+	}
+
+	// chunks are read from by writers which are io.ReaderFrom
+	ws := &writeSizes{}
+	rf := &struct {
+		io.Writer
+		io.ReaderFrom
+	}{ws, ws}
+	enc = NewStreamEncoder(rf, nil)
+	enc.ChunkSize = 8
+	if err := enc.Encode("sixteen bytes..."); err != nil || len(ws.sizes) != 0 || ws.Len() == 0 || ws.Len()%8 != 0 {
+		t.Errorf("expected the chunks to be read from, got writes %v of %d bytes (%v)", ws.sizes, ws.Len(), err)
+	}
+}
+
+func TestMapKeys(t *testing.T) {
+	type Named string
+
+	ints := map[int]string{-7: "a", 300: "b"}
+	uints := map[uint8]bool{1: true}
+	floats := map[float64]int{1.5: 1}
+	bools := map[bool]int{true: 1, false: 0}
+	named := map[Named]int{"x": 1}
+	times := map[time.Time]int{time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC): 1}
+
+	values := []interface{}{ints, uints, floats, bools, named, times}
+
+	keyEncoder := NewEncoderV3()
+	keyEncoder.KeyEncoder = FormatKey
+
+	for _, e := range []*Encoder{NewEncoderV3(), {PerlCompat: true}, keyEncoder} {
+		for _, v := range values {
+			b, err := e.Marshal(v)
+			if err != nil {
+				t.Errorf("%T: %v", v, err)
+				continue
+			}
+
+			back := reflect.New(reflect.TypeOf(v))
+			if err := Unmarshal(b, back.Interface()); err != nil || !reflect.DeepEqual(back.Elem().Interface(), v) {
+				t.Errorf("%T, PerlCompat %v: unexpected decoding %v (%v)", v, e.PerlCompat, back.Elem(), err)
+			}
+
+			if !e.PerlCompat && e.KeyEncoder == nil {
+				continue
+			}
+
+			// the keys are strings Perl can read
+			var generic interface{}
+			if err := Unmarshal(b, &generic); err != nil {
+				t.Errorf("%T: %v", v, err)
+				continue
+			}
+			if e.PerlCompat {
+				generic = Normalize(generic)
+			}
+			back = reflect.New(reflect.TypeOf(v))
+			if err := Convert(generic, back.Interface()); err != nil || !reflect.DeepEqual(back.Elem().Interface(), v) {
+				t.Errorf("%T: unexpected conversion %v (%v)", v, back.Elem(), err)
+			}
+		}
+	}
+
+	e := NewEncoderV3()
+	e.KeyEncoder = func(key interface{}) (string, error) { return fmt.Sprintf("k%v", key), nil }
+	b, _ := e.Marshal(map[int]int{1: 2})
+	var m map[string]int
+	if err := Unmarshal(b, &m); err != nil || m["k1"] != 2 {
+		t.Errorf("unexpected custom keys %v (%v)", m, err)
+	}
+	var bad map[int]int
+	if err := Unmarshal(b, &bad); err == nil {
+		t.Errorf("expected error parsing a key which isn't a number")
+	}
+}
+
+func TestVarintDecodeCrossCheck(t *testing.T) {
+	check := func(b []byte) {
+		n, sz, err := varintdecode(b)
+		pn, psz, perr := varintdecodePortable(b)
+		if n != pn || sz != psz || err != perr {
+			t.Fatalf("%x: got %d %d %v, portable %d %d %v", b, n, sz, err, pn, psz, perr)
+		}
+	}
+
+	// every pair of leading bytes, followed by bytes ending the varint at
+	// every later position or not at all
+	b := make([]byte, 10)
+	for i := 0; i < 1<<16; i++ {
+		b[0], b[1] = byte(i), byte(i>>8)
+		for _, fill := range []byte{0x00, 0x7f} {
+			for end := 2; end <= len(b); end++ {
+				for j := 2; j < len(b); j++ {
+					b[j] = fill | 0x80
+					if j == end {
+						b[j] = fill &^ 0x80
+					}
+				}
+				for _, l := range []int{0, 1, 2, 7, 8, 9, 10} {
+					check(b[:l])
+				}
+			}
+		}
+	}
+
+	// the varints of every power of two and its neighbours
+	for k := uint(0); k < 64; k++ {
+		for _, n := range []uint{1<<k - 1, 1 << k, 1<<k + 1} {
+			v := varint(nil, n)
+			check(v)
+			check(append(v, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff))
+		}
+	}
+
+	// random continuation bits
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000000; i++ {
+		b := make([]byte, r.Intn(13))
+		for j := range b {
+			b[j] = byte(r.Intn(256))
+			if r.Intn(5) > 0 {
+				b[j] |= 0x80
+			}
+		}
+		check(b)
+	}
+}
+
+func BenchmarkVarintDecode(b *testing.B) {
+	for _, bc := range []struct {
+		name     string
+		min, max uint
+	}{
+		{"1byte", 0, 1 << 7},
+		{"2bytes", 1 << 7, 1 << 14},
+		{"3to8bytes", 1 << 14, 1 << 56},
+		{"9to10bytes", 1 << 56, math.MaxUint64},
+	} {
+		r := rand.New(rand.NewSource(1))
+		var buf []byte
+		var ends []int
+		for i := 0; i < 1000; i++ {
+			n := bc.min + uint(r.Uint64())%(bc.max-bc.min)
+			buf = varint(buf, n)
+			ends = append(ends, len(buf))
+		}
+
+		b.Run(bc.name, func(b *testing.B) {
+			b.SetBytes(int64(len(buf)))
+			for i := 0; i < b.N; i++ {
+				for idx := 0; idx < len(buf); {
+					_, sz, err := varintdecode(buf[idx:])
+					if err != nil {
+						b.Fatal(err)
+					}
+					idx += sz
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkSkipStrings(b *testing.B) {
+	strs := make([]string, 1000)
+	for i := range strs {
+		strs[i] = strings.Repeat("x", i%200)
+	}
+	doc, err := (&Encoder{DisableDedup: true}).Marshal(strs)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.SetBytes(int64(len(doc)))
+	for i := 0; i < b.N; i++ {
+		if _, err := skipValue(doc, headerSize+1); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkPathBookkeeping compares decoding a document with and without
+// maintaining the path of the values, as done for WithReport. Small integers
+// in small arrays are the elements cheapest to decode, hence the ones the
+// bookkeeping weighs the most on.
+func BenchmarkPathBookkeeping(b *testing.B) {
+	const keys, elems = 100, 10
+
+	hash := make(map[string][]int, keys)
+	for i := 0; i < keys; i++ {
+		hash[strconv.Itoa(i)] = make([]int, elems)
+	}
+	doc, err := Marshal(hash)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, track := range []bool{false, true} {
+		b.Run(fmt.Sprintf("track=%v", track), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				var v interface{}
+				dec := decoder{Decoder: NewDecoder(), trackPath: track}
+				if err := dec.unmarshalHeaderBody(doc, nil, &v); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestFloatDecodeCrossCheck(t *testing.T) {
+	var d decoder
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 100000; i++ {
+		var b [9]byte
+		r.Read(b[:])
+
+		f, idx, err := d.decodeFloat(b[:], 1)
+		bits32 := uint32(b[1]) | uint32(b[2])<<8 | uint32(b[3])<<16 | uint32(b[4])<<24
+		if err != nil || idx != 5 || math.Float32bits(f) != bits32 {
+			t.Fatalf("%x: got float %v %d %v", b, f, idx, err)
+		}
+
+		g, idx, err := d.decodeDouble(b[:], 1)
+		bits64 := uint64(bits32) | uint64(b[5])<<32 | uint64(b[6])<<40 | uint64(b[7])<<48 | uint64(b[8])<<56
+		if err != nil || idx != 9 || math.Float64bits(g) != bits64 {
+			t.Fatalf("%x: got double %v %d %v", b, g, idx, err)
+		}
+	}
+
+	if _, _, err := d.decodeFloat(make([]byte, 4), 1); err != ErrTruncated {
+		t.Errorf("expected ErrTruncated, got %v", err)
+	}
+	if _, _, err := d.decodeDouble(make([]byte, 8), 1); err != ErrTruncated {
+		t.Errorf("expected ErrTruncated, got %v", err)
+	}
+}
+
+// lowerKey is a string key lower-cased when decoded
+type lowerKey string
+
+func (k *lowerKey) UnmarshalText(b []byte) error {
+	*k = lowerKey(strings.ToLower(string(b)))
+	return nil
+}
+
+// pointKey is a struct key written as "x,y"
+type pointKey struct{ X, Y int }
+
+func (p pointKey) MarshalText() ([]byte, error) {
+	return []byte(fmt.Sprintf("%d,%d", p.X, p.Y)), nil
+}
+
+func (p *pointKey) UnmarshalText(b []byte) error {
+	_, err := fmt.Sscanf(string(b), "%d,%d", &p.X, &p.Y)
+	return err
+}
+
+func TestTypedMapKeys(t *testing.T) {
+	b, err := Marshal(map[string]interface{}{"1": "a", "-20": "b", "ABC": "c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ints map[int]string
+	if err := Unmarshal(b, &ints); err == nil {
+		t.Errorf("expected error parsing %q as an int", "ABC")
+	}
+
+	var lower map[lowerKey]string
+	if err := Unmarshal(b, &lower); err != nil || !reflect.DeepEqual(lower, map[lowerKey]string{"1": "a", "-20": "b", "abc": "c"}) {
+		t.Errorf("unexpected decoding %v (%v)", lower, err)
+	}
+
+	if b, err = Marshal(map[string]int{"1": 1, "-20": 2}); err != nil {
+		t.Fatal(err)
+	}
+	var int8s map[int8]int
+	if err := Unmarshal(b, &int8s); err != nil || !reflect.DeepEqual(int8s, map[int8]int{1: 1, -20: 2}) {
+		t.Errorf("unexpected decoding %v (%v)", int8s, err)
+	}
+
+	points := map[pointKey]bool{{1, 2}: true, {-3, 4}: false}
+	e := NewEncoderV3()
+	e.PerlCompat = true
+	if b, err = e.Marshal(points); err != nil {
+		t.Fatal(err)
+	}
+	var back map[pointKey]bool
+	if err := Unmarshal(b, &back); err != nil || !reflect.DeepEqual(back, points) {
+		t.Errorf("unexpected decoding %v (%v)", back, err)
+	}
+	var generic map[string]interface{}
+	if err := Unmarshal(b, &generic); err != nil || generic["1,2"] != true {
+		t.Errorf("unexpected keys %v (%v)", generic, err)
+	}
+}
+
+func TestCoerceBools(t *testing.T) {
+	type S struct {
+		Int   int
+		Uint  uint8
+		Float float64
+		Str   string
+		Bool  bool
+	}
+
+	for _, v := range []bool{true, false} {
+		b, err := Marshal(map[string]interface{}{"Int": v, "Uint": v, "Float": v, "Str": v, "Bool": v})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var s S
+		if err := Unmarshal(b, &s); err == nil {
+			t.Errorf("expected error decoding a bool into an int")
+		}
+
+		want := S{Bool: v}
+		if v {
+			want = S{1, 1, 1, "1", true}
+		}
+
+		d := &Decoder{CoerceBools: true}
+		s = S{Str: "stale", Int: 5}
+		if err := d.Unmarshal(b, &s); err != nil || s != want {
+			t.Errorf("%v: unexpected decoding %+v (%v)", v, s, err)
+		}
+
+		var m interface{}
+		Unmarshal(b, &m)
+		s = S{Str: "stale", Int: 5}
+		if err := d.Convert(m, &s); err != nil || s != want {
+			t.Errorf("%v: unexpected conversion %+v (%v)", v, s, err)
+		}
+	}
+
+	e := NewEncoderV3()
+	e.BoolsAsInts = true
+	b, err := e.Marshal([]interface{}{true, false, S{Bool: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var back []interface{}
+	if err := Unmarshal(b, &back); err != nil || back[0] != 1 || back[1] != 0 || back[2].(map[string]interface{})["Bool"] != 1 {
+		t.Errorf("unexpected encoding %v (%v)", back, err)
+	}
+}
+
+func TestTimeFormat(t *testing.T) {
+	type S struct {
+		T time.Time
+	}
+
+	when := time.Date(2021, 6, 7, 8, 9, 10, 123456000, time.FixedZone("X", 3600))
+
+	for _, f := range []TimeFormat{TimeFREEZE, TimeEpoch, TimeRFC3339} {
+		e := NewEncoderV3()
+		e.TimeFormat = f
+		e.StructAsMap = true
+
+		b, err := e.Marshal(S{when})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var generic map[string]interface{}
+		if err := Unmarshal(b, &generic); err != nil {
+			t.Fatal(err)
+		}
+		switch f {
+		case TimeEpoch:
+			if generic["T"] != float64(when.UnixNano())/1e9 {
+				t.Errorf("%v: unexpected value %v", f, generic["T"])
+			}
+		case TimeRFC3339:
+			if generic["T"] != "2021-06-07T08:09:10.123456+01:00" {
+				t.Errorf("%v: unexpected value %v", f, generic["T"])
+			}
+		}
+
+		var s S
+		if err := Unmarshal(b, &s); err != nil || !s.T.Equal(when) {
+			t.Errorf("%v: unexpected decoding %v (%v)", f, s.T, err)
+		}
+
+		if f == TimeFREEZE {
+			continue
+		}
+		s = S{}
+		if err := Convert(generic, &s); err != nil || !s.T.Equal(when) {
+			t.Errorf("%v: unexpected conversion %v (%v)", f, s.T, err)
+		}
+	}
+
+	// Perl's integer epochs
+	b, _ := Marshal(map[string]interface{}{"T": 1600000000})
+	var s S
+	if err := Unmarshal(b, &s); err != nil || s.T.Unix() != 1600000000 {
+		t.Errorf("unexpected decoding %v (%v)", s.T, err)
+	}
+
+	b, _ = Marshal(map[string]interface{}{"T": "yesterday"})
+	if err := Unmarshal(b, &s); err == nil {
+		t.Errorf("expected error decoding a string which isn't a time")
+	}
+
+	if _, err := (EncoderOptions{Version: 1, TimeFormat: "unix"}).NewEncoder(); err == nil {
+		t.Errorf("expected error for an unknown time format")
+	}
+	if e, err := (EncoderOptions{Version: 1, TimeFormat: "epoch"}).NewEncoder(); err != nil || e.TimeFormat != TimeEpoch {
+		t.Errorf("unexpected encoder %+v (%v)", e, err)
+	}
+}
+
+func TestRawMessageMap(t *testing.T) {
+	shared := []interface{}{"shared", "shared"}
+	m := map[string]interface{}{
+		"a": &shared,
+		"b": &shared,
+		"c": "some long string",
+		"d": "some long string",
+		"e": 42,
+	}
+
+	for _, e := range []*Encoder{NewEncoderV2(), NewEncoderV3()} {
+		b, err := e.Marshal(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var raw map[string]RawMessage
+		if err := Unmarshal(b, &raw); err != nil {
+			t.Fatal(err)
+		}
+		if len(raw) != len(m) {
+			t.Fatalf("version %d: unexpected entries %v", e.version, raw)
+		}
+		for k, v := range raw {
+			if cap(v) != len(v) {
+				t.Errorf("version %d: value of %q can be appended to in place", e.version, k)
+			}
+			if err := checkRawValue(v); err != nil {
+				t.Errorf("version %d: value of %q: %v", e.version, k, err)
+			}
+		}
+
+		// re-assemble the document from the raw values
+		rb, err := e.Marshal(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got interface{}
+		if err := Unmarshal(rb, &got); err != nil {
+			t.Fatal(err)
+		}
+		want := map[string]interface{}{
+			"a": shared,
+			"b": shared,
+			"c": "some long string",
+			"d": "some long string",
+			"e": 42,
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("version %d: unexpected round trip %v, expected %v", e.version, got, want)
+		}
+	}
+
+	b, err := Marshal(map[string]RawMessage{"nil": nil})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v map[string]interface{}
+	if err := Unmarshal(b, &v); err != nil || len(v) != 1 || v["nil"] != nil {
+		t.Errorf("expected an empty RawMessage to be encoded as undef, got %v (%v)", v, err)
+	}
+
+	var merr *MarshalerError
+	if _, err := Marshal(map[string]RawMessage{"bad": {typeARRAY, 2, 1}}); !errors.As(err, &merr) {
+		t.Errorf("expected a MarshalerError for a truncated value, got %v", err)
+	}
+}
+
+func TestBigNumbers(t *testing.T) {
+	type numbers struct {
+		Huge  *big.Int
+		Neg   big.Int
+		Small *big.Int
+		Float *big.Float
+		Exact big.Float
+	}
+
+	huge, _ := new(big.Int).SetString("1267650600228229401496703205376", 10)
+	in := numbers{
+		Huge:  huge,
+		Small: big.NewInt(-3),
+		Float: new(big.Float).SetPrec(200).Quo(big.NewFloat(1), big.NewFloat(3)),
+	}
+	in.Neg.Neg(huge)
+	in.Exact.SetFloat64(0.5)
+
+	for _, f := range []BigFormat{BigString, BigFREEZE} {
+		e := NewEncoderV3()
+		e.BigFormat = f
+
+		b, err := e.Marshal(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var out numbers
+		if err := Unmarshal(b, &out); err != nil {
+			t.Fatalf("%v: %v", f, err)
+		}
+		if out.Huge.Cmp(in.Huge) != 0 || out.Neg.Cmp(&in.Neg) != 0 || out.Small.Cmp(in.Small) != 0 || out.Exact.Cmp(&in.Exact) != 0 {
+			t.Errorf("%v: unexpected round trip %v %v %v %v", f, out.Huge, &out.Neg, out.Small, &out.Exact)
+		}
+		if got, want := out.Float.Text('g', 20), in.Float.Text('g', 20); got != want {
+			t.Errorf("%v: unexpected float %s, expected %s", f, got, want)
+		}
+
+		var generic map[string]interface{}
+		if err := Unmarshal(b, &generic); err != nil {
+			t.Fatal(err)
+		}
+		if generic["Small"] != -3 || generic["Exact"] != 0.5 {
+			t.Errorf("%v: expected native numbers in range, got %v", f, generic)
+		}
+		switch h := generic["Huge"].(type) {
+		case string:
+			if f != BigString || h != huge.String() {
+				t.Errorf("%v: unexpected huge number %q", f, h)
+			}
+		case *big.Int:
+			if f != BigFREEZE || h.Cmp(huge) != 0 {
+				t.Errorf("%v: unexpected huge number %v", f, h)
+			}
+		default:
+			t.Errorf("%v: unexpected huge number %T", f, h)
+		}
+	}
+
+	b, _ := Marshal(uint64(math.MaxUint64))
+	var u *big.Int
+	if err := Unmarshal(b, &u); err != nil || u.String() != "18446744073709551615" {
+		t.Errorf("expected the varint not to wrap, got %v (%v)", u, err)
+	}
+
+	// a varint longer than 64 bits
+	raw := append([]byte{typeVARINT}, bytes.Repeat([]byte{0xff}, 10)...)
+	raw = append(raw, 0x01)
+	var v big.Int
+	if err := NewDecoder().unmarshalRaw(raw, &v); err != nil || v.BitLen() != 71 {
+		t.Errorf("expected a 71 bits integer, got %v (%v)", &v, err)
+	}
+
+	b, _ = Marshal("not a number")
+	if err := Unmarshal(b, &u); err == nil {
+		t.Errorf("expected error decoding a string which isn't a number")
+	}
+}
+
+func TestValidateUTF8(t *testing.T) {
+	bad := "caf\xe9"
+
+	// a Perl latin-1 string wrongly flagged as UTF-8, as a value and as a key
+	value := append([]byte("=\xf3rl\x03\x00"), typeSTR_UTF8, 4)
+	value = append(value, bad...)
+	key := append([]byte("=\xf3rl\x03\x00"), typeHASH, 1, typeSTR_UTF8, 4)
+	key = append(key, bad...)
+	key = append(key, 1)
+
+	d := NewDecoder()
+	for _, doc := range [][]byte{value, key} {
+		var v interface{}
+		if err := d.Unmarshal(doc, &v); err != nil {
+			t.Errorf("%x: %v", doc, err)
+		}
+
+		var v2 interface{}
+		var s string
+		var m map[string]int
+		d.ValidateUTF8 = true
+		if err := d.Unmarshal(doc, &v2); !errors.Is(err, ErrInvalidUTF8) {
+			t.Errorf("%x: expected ErrInvalidUTF8, got %v", doc, err)
+		}
+		if err := d.Unmarshal(doc, &s); doc[6] == typeSTR_UTF8 && !errors.Is(err, ErrInvalidUTF8) {
+			t.Errorf("%x: expected ErrInvalidUTF8 decoding into a string, got %v", doc, err)
+		}
+		if err := d.Unmarshal(doc, &m); doc[6] == typeHASH && !errors.Is(err, ErrInvalidUTF8) {
+			t.Errorf("%x: expected ErrInvalidUTF8 decoding into a map, got %v", doc, err)
+		}
+		d.ValidateUTF8 = false
+	}
+
+	e := NewEncoderV3()
+	e.ValidateUTF8 = true
+	b, err := e.Marshal([]string{bad, "caf\u00e9"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tags []byte
+	if _, err := walkValue(b, headerSize+1, func(idx int, tag byte) error {
+		tags = append(tags, tag)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(tags) != 3 || tags[1] != typeSHORT_BINARY_0+4 || tags[2] != typeSTR_UTF8 {
+		t.Errorf("expected the invalid string as BINARY and the valid one as STR_UTF8, got %x", b)
+	}
+
+	d.ValidateUTF8 = true
+	var out []interface{}
+	if err := d.Unmarshal(b, &out); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStringMode(t *testing.T) {
+	body := map[string]interface{}{"k\u00e9": []interface{}{"ascii", "caf\u00e9", "caf\xe9"}}
+
+	tests := []struct {
+		mode StringMode
+		tags []byte // of the key, then of the strings
+	}{
+		{StringUTF8, []byte{typeSTR_UTF8, typeSTR_UTF8, typeSTR_UTF8, typeSTR_UTF8}},
+		{StringBinary, []byte{typeSHORT_BINARY_0 + 3, typeSHORT_BINARY_0 + 5, typeSHORT_BINARY_0 + 5, typeSHORT_BINARY_0 + 4}},
+		{StringAuto, []byte{typeSTR_UTF8, typeSHORT_BINARY_0 + 5, typeSTR_UTF8, typeSHORT_BINARY_0 + 4}},
+	}
+
+	for _, tt := range tests {
+		e := NewEncoderV3()
+		e.StringMode = tt.mode
+
+		b, err := e.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var tags []byte
+		if _, err := walkValue(b, headerSize+1, func(idx int, tag byte) error {
+			if tag == typeSTR_UTF8 || tag >= typeSHORT_BINARY_0 && tag < typeSHORT_BINARY_0+32 {
+				tags = append(tags, tag)
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(tags, tt.tags) {
+			t.Errorf("%v: expected tags %x, got %x", tt.mode, tt.tags, tags)
+		}
+
+		var out map[string][]string
+		if err := Unmarshal(b, &out); err != nil {
+			t.Fatal(err)
+		}
+		if s := out["k\u00e9"]; len(s) != 3 || s[1] != "caf\u00e9" || s[2] != "caf\xe9" {
+			t.Errorf("%v: unexpected round trip %q", tt.mode, out)
+		}
+	}
+
+	e := NewEncoderV3()
+	if err := e.Profile(ProfilePerl3x); err != nil || e.StringMode != StringAuto {
+		t.Errorf("expected ProfilePerl3x to detect binary strings, got %v (%v)", e.StringMode, err)
+	}
+
+	e.StringMode = StringMode(7)
+	if _, err := e.Marshal("x"); err == nil {
+		t.Errorf("expected error for an unknown string mode")
+	}
+	if err := (EncoderOptions{Version: 1, StringMode: "latin1"}).Validate(); err == nil {
+		t.Errorf("expected error for an unknown string mode")
+	}
+}
+
+func TestBinaryAsString(t *testing.T) {
+	e := NewEncoderV3()
+	e.StringMode = StringBinary
+	b, err := e.Marshal(map[string]interface{}{
+		"name":  "caf\xe9",
+		"long":  strings.Repeat("x", 40),
+		"bytes": []byte{1, 2},
+		"list":  []interface{}{"a"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var plain map[string]interface{}
+	if err := Unmarshal(b, &plain); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := plain["name"].([]byte); !ok {
+		t.Errorf("expected []byte by default, got %T", plain["name"])
+	}
+
+	d := NewDecoder()
+	d.BinaryAsString = true
+	var v map[string]interface{}
+	if err := d.Unmarshal(b, &v); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"name":  "caf\xe9",
+		"long":  strings.Repeat("x", 40),
+		"bytes": "\x01\x02",
+		"list":  []interface{}{"a"},
+	}
+	if !reflect.DeepEqual(v, want) {
+		t.Errorf("expected %q, got %q", want, v)
+	}
+
+	// typed targets are unaffected
+	var typed struct{ Bytes []byte }
+	if err := d.Unmarshal(b, &typed); err != nil || !bytes.Equal(typed.Bytes, []byte{1, 2}) {
+		t.Errorf("unexpected %v (%v)", typed, err)
+	}
+}
+
+func TestUseNumber(t *testing.T) {
+	in := map[string]interface{}{
+		"small":  -3,
+		"big":    uint64(math.MaxUint64),
+		"neg":    int64(math.MinInt64),
+		"float":  float32(0.1),
+		"double": 0.1,
+		"exp":    1e300,
+	}
+
+	b, err := Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewDecoder()
+	d.UseNumber = true
+
+	var out map[string]interface{}
+	if err := d.Unmarshal(b, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]interface{}{
+		"small":  Number("-3"),
+		"big":    Number("18446744073709551615"),
+		"neg":    Number("-9223372036854775808"),
+		"float":  Number("0.1"),
+		"double": Number("0.1"),
+		"exp":    Number("1e+300"),
+	}
+	if !reflect.DeepEqual(out, want) {
+		t.Errorf("unexpected numbers %v, expected %v", out, want)
+	}
+
+	js, err := json.Marshal(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(js), `{"big":18446744073709551615,"double":0.1,"exp":1e+300,"float":0.1,"neg":-9223372036854775808,"small":-3}`; got != want {
+		t.Errorf("unexpected JSON %s, expected %s", got, want)
+	}
+
+	// numbers decoded from JSON with UseNumber survive the trip through Sereal
+	jd := json.NewDecoder(strings.NewReader(`{"id":1234567890123456789,"ratio":0.30000000000000004}`))
+	jd.UseNumber()
+	var fromJSON map[string]interface{}
+	if err := jd.Decode(&fromJSON); err != nil {
+		t.Fatal(err)
+	}
+	if b, err = Marshal(fromJSON); err != nil {
+		t.Fatal(err)
+	}
+	out = nil
+	if err := d.Unmarshal(b, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out["id"] != Number("1234567890123456789") || out["ratio"] != Number("0.30000000000000004") {
+		t.Errorf("unexpected numbers %v", out)
+	}
+
+	// Number fields take numbers without UseNumber, and are encoded as numbers
+	var s struct{ N Number }
+	b, _ = Marshal(map[string]interface{}{"N": 42})
+	if err := Unmarshal(b, &s); err != nil || s.N != "42" {
+		t.Errorf("unexpected Number field %q (%v)", s.N, err)
+	}
+	b, _ = Marshal(s)
+	var v map[string]interface{}
+	if err := Unmarshal(b, &v); err != nil || v["N"] != 42 {
+		t.Errorf("expected Number to be encoded as an integer, got %v (%v)", v, err)
+	}
+}
+
+func TestScanReport(t *testing.T) {
+	for _, e := range []*Encoder{NewEncoder(), NewEncoderV2(), NewEncoderV3()} {
+		b, err := e.MarshalWithHeader(map[string]interface{}{"k": "shared"}, []interface{}{"shared", "shared", &PerlObject{"Foo", map[string]interface{}{}}})
+		if e.version == 1 {
+			b, err = e.Marshal([]interface{}{"shared", "shared"})
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r := ScanReport(b); !r.OK() || r.Values == 0 {
+			t.Errorf("version %d: unexpected issues in a valid document: %v", e.version, r)
+		}
+	}
+
+	doc := []byte("=\xf3rl\x03\x00")
+	doc = append(doc,
+		typeARRAY, 6, // 6
+		1,            // 8
+		0x34,         // 9: unknown tag
+		typeREFP, 99, // 10: offset after the tag
+		typeREFP, 2, // 12: offset inside the array header
+		typeVARINT, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01, // 14: too long
+		typeSHORT_BINARY_0+5, 'a', 'b', // 26: cut short
+	)
+
+	r := ScanReport(doc)
+	var got []string
+	for _, i := range r.Issues {
+		got = append(got, i.String())
+	}
+	want := []string{
+		"body at 9: " + ErrUnknownTag.Error(),
+		"body at 10: " + ErrCorrupt{ErrBadOffset}.Error(),
+		"body at 12: " + ErrCorrupt{ErrOffsetNotValue}.Error(),
+		"body at 15: " + ErrCorrupt{ErrBadVarint}.Error(),
+		"body at 29: " + ErrTruncated.Error(),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected issues\n%s\nexpected\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if r.TruncatedAt != 26 || r.Values != 7 {
+		t.Errorf("unexpected truncation point %d and %d values", r.TruncatedAt, r.Values)
+	}
+
+	if r := ScanReport([]byte("=srl")); r.OK() || r.Issues[0].Err != ErrTruncated {
+		t.Errorf("expected a truncated header, got %v", r)
+	}
+
+	b, _ := Marshal(1)
+	if r := ScanReport(append(b, 1)); len(r.Issues) != 1 || r.Issues[0].Offset != len(b) {
+		t.Errorf("expected trailing bytes to be reported, got %v", r)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	type node struct {
+		Name string
+		Next *node
+	}
+	a := &node{Name: "a"}
+	a.Next = &node{"b", a}
+
+	var docs [][]byte
+	for _, e := range []*Encoder{NewEncoderV2(), NewEncoderV3()} {
+		for _, v := range []interface{}{
+			map[string]interface{}{"k": "shared", "l": []interface{}{1, -5, 3.5, "x", nil, true}},
+			[]interface{}{"shared", "shared", &PerlObject{"Foo", map[string]interface{}{"a": 1}}},
+			a,
+			&PerlRegexp{Pattern: []byte("a+"), Modifiers: []byte("i")},
+		} {
+			b, err := e.MarshalWithHeader(map[string]interface{}{"h": 1}, v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := Validate(b); err != nil {
+				t.Errorf("version %d: unexpected error for %T: %v", e.version, v, err)
+			}
+			docs = append(docs, b)
+		}
+	}
+
+	body := func(tags ...byte) []byte {
+		return append([]byte("=\xf3rl\x03\x00"), tags...)
+	}
+	for _, tt := range []struct {
+		doc    []byte
+		offset int
+		tag    int
+		err    error
+	}{
+		{body(typeARRAY, 2, 1, typeREFP, 3), 9, typeREFP, ErrCorrupt{ErrUntrackedOffsetREFP}},
+		{body(typeARRAY, 2, 1|trackFlag, typeALIAS, 2), 9, typeALIAS, ErrCorrupt{ErrOffsetNotValue}},
+		{body(typeOBJECT, 1, typeHASH, 0), 7, 1, ErrCorrupt{ErrNotStringish}},
+		{body(typeARRAY, 2, 1, typeVARINT, 0xff), 11, typeVARINT, ErrTruncated},
+		{body(typeARRAY, 1, 1, 2), 9, 2, ErrCorrupt{ErrTrailingBytes}},
+		{body(append(bytes.Repeat([]byte{typeREFN}, maxScanDepth+1), 1)...), 6 + maxScanDepth, typeREFN, ErrCorrupt{ErrTooDeep}},
+		{[]byte("=srl"), 0, -1, ErrTruncated},
+	} {
+		err := Validate(tt.doc)
+		var verr *ValidationError
+		if !errors.As(err, &verr) || verr.Offset != tt.offset || verr.Tag != tt.tag || !errors.Is(err, tt.err) {
+			t.Errorf("%q: got %v, expected %v at %d on tag %d", tt.doc, err, tt.err, tt.offset, tt.tag)
+		}
+	}
+
+	// mutated documents must be rejected or scanned without panicking
+	rnd := rand.New(rand.NewSource(1))
+	for n := 0; n < 20000; n++ {
+		b := append([]byte(nil), docs[rnd.Intn(len(docs))]...)
+		i := 6 + rnd.Intn(len(b)-6)
+		if rnd.Intn(4) == 0 {
+			b = b[:i]
+		} else {
+			b[i] = byte(rnd.Intn(256))
+		}
+
+		Validate(b)
+		ScanReport(b)
+		var v interface{}
+		NewDecoder().Unmarshal(b, &v)
+	}
+}
+
+func TestSharedPointers(t *testing.T) {
+	type node struct {
+		Name string
+		Next *node
+	}
+
+	a := &node{Name: "a"}
+	b := &node{Name: "b", Next: a}
+	a.Next = b
+
+	type pair struct {
+		A, B *node
+	}
+
+	for _, p := range []Profile{ProfileDefault, ProfilePerl3x} {
+		e := NewEncoderV3()
+		if err := e.Profile(p); err != nil {
+			t.Fatal(err)
+		}
+
+		buf, err := e.Marshal(a)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var out *node
+		if err := Unmarshal(buf, &out); err != nil {
+			t.Fatalf("profile %v: %v", p, err)
+		}
+		if out.Name != "a" || out.Next.Name != "b" || out.Next.Next != out {
+			t.Errorf("profile %v: expected a cycle, got %+v", p, out)
+		}
+
+		leaf := &node{Name: "leaf"}
+		if buf, err = e.Marshal(pair{leaf, leaf}); err != nil {
+			t.Fatal(err)
+		}
+
+		var pr pair
+		if err := Unmarshal(buf, &pr); err != nil {
+			t.Fatalf("profile %v: %v", p, err)
+		}
+		if pr.A == nil || pr.A != pr.B || pr.A.Name != "leaf" {
+			t.Errorf("profile %v: expected shared pointers, got %+v", p, pr)
+		}
+	}
+
+	// my $h = {}; $h->{self} = $h
+	type self struct {
+		Self *self `sereal:"self"`
+	}
+	doc := []byte("=\xf3rl\x03\x00")
+	doc = append(doc, typeREFN, typeHASH|trackFlag, 1, typeSHORT_BINARY_0+4, 's', 'e', 'l', 'f', typeREFP, 2)
+
+	var s self
+	if err := Unmarshal(doc, &s); err != nil {
+		t.Fatal(err)
+	}
+	if s.Self != &s {
+		t.Errorf("expected the struct to refer to itself, got %p for %p", s.Self, &s)
+	}
+
+	var ps *self
+	if err := Unmarshal(doc, &ps); err != nil {
+		t.Fatal(err)
+	}
+	if ps.Self != ps {
+		t.Errorf("expected the struct to refer to itself, got %p for %p", ps.Self, ps)
+	}
+}
+
+func TestDedupTuning(t *testing.T) {
+	type obj struct{ A int }
+	e := NewEncoderV3()
+	e.RegisterClass(obj{}, "Obj")
+
+	body := []interface{}{
+		map[string]interface{}{"id": 1, "name_of_the_thing": 2},
+		map[string]interface{}{"id": 3, "name_of_the_thing": 4},
+		obj{5}, obj{6},
+	}
+
+	count := func(b []byte, tag byte) int {
+		n := 0
+		_, err := walkValue(b, headerSize+1, func(idx int, t byte) error {
+			if t == tag {
+				n++
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	full, err := e.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count(full, typeCOPY) != 3 || count(full, typeOBJECTV) != 1 {
+		t.Errorf("expected 3 COPY and 1 OBJECTV tags, got %x", full)
+	}
+
+	// "id" and "A" are too short to be deduped
+	e.DedupMinLength = 3
+	short, err := e.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count(short, typeCOPY) != 1 || count(short, typeOBJECTV) != 1 {
+		t.Errorf("expected 1 COPY and 1 OBJECTV tags, got %x", short)
+	}
+
+	// only the first two keys are remembered
+	e.DedupMinLength = 0
+	e.DedupMaxEntries = 2
+	capped, err := e.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count(capped, typeCOPY) != 2 || count(capped, typeOBJECTV) != 0 {
+		t.Errorf("expected 2 COPY and no OBJECTV tags, got %x", capped)
+	}
+
+	for _, b := range [][]byte{full, short, capped} {
+		var got []interface{}
+		if err := Unmarshal(b, &got); err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 4 {
+			t.Errorf("expected 4 values, got %v", got)
+		}
+	}
+
+	if err := (EncoderOptions{Version: 1, DedupMinLength: -1}).Validate(); err == nil {
+		t.Errorf("expected error for negative DedupMinLength")
+	}
+}
+
+func TestEncodeCycles(t *testing.T) {
+	m := map[string]interface{}{"name": "m"}
+	m["self"] = m
+
+	s := []interface{}{"s", nil}
+	s[1] = s
+
+	type tree map[string]tree
+	tr := tree{}
+	tr["child"] = tree{"up": tr}
+
+	type list []interface{}
+	l := list{1, nil}
+	l[1] = []interface{}{l}
+
+	for _, v := range []interface{}{m, s, tr, l, &m} {
+		for _, e := range []*Encoder{NewEncoder(), NewEncoderV3(), {PerlCompat: true, version: 3}} {
+			if _, err := e.Marshal(v); !errors.Is(err, ErrCircular) {
+				t.Errorf("%T: expected ErrCircular, got %v", v, err)
+			}
+		}
+	}
+
+	// the same map or slice twice, or views of the same array, aren't cycles
+	shared := map[string]int{"x": 1}
+	arr := []interface{}{1, 2, 3}
+	nested := []interface{}{arr, arr[:2], arr[1:], shared, shared, []interface{}{arr[:1]}}
+	buf, err := Marshal(nested)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out []interface{}
+	if err := Unmarshal(buf, &out); err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != len(nested) {
+		t.Errorf("expected %d values, got %v", len(nested), out)
+	}
+
+	// pointer cycles through maps are written as REFP tags
+	type node struct {
+		Children map[string]*node
+	}
+	root := &node{Children: map[string]*node{}}
+	root.Children["loop"] = root
+	if buf, err = Marshal(root); err != nil {
+		t.Fatal(err)
+	}
+
+	var nr *node
+	if err := Unmarshal(buf, &nr); err != nil {
+		t.Fatal(err)
+	}
+	if nr.Children["loop"] != nr {
+		t.Errorf("expected a cycle, got %+v", nr)
+	}
+}
+
+func TestPerlAliasRoundTrip(t *testing.T) {
+	// my @a; $a[0] = "foo"; aliased into $a[1] and $h{b}: [ "foo", ALIAS, { a => 1, b => ALIAS } ]
+	doc := []byte("=\xf3rl\x03\x00")
+	doc = append(doc, typeARRAYREF_0+3, (typeSHORT_BINARY_0+3)|trackFlag, 'f', 'o', 'o', typeALIAS, 2,
+		typeHASHREF_0+2, typeSHORT_BINARY_0+1, 'a', 1, typeSHORT_BINARY_0+1, 'b', typeALIAS, 2)
+
+	d := NewDecoder()
+	d.PerlCompat = true
+
+	var v interface{}
+	if err := d.Unmarshal(doc, &v); err != nil {
+		t.Fatal(err)
+	}
+
+	arr := *v.(*[]interface{})
+	pa, ok := arr[0].(*PerlAlias)
+	if !ok || arr[1] != pa || !reflect.DeepEqual(pa.Alias, []byte("foo")) {
+		t.Fatalf("expected both elements to share an alias of foo, got %v", arr)
+	}
+	if h := *arr[2].(*map[string]interface{}); h["b"] != pa {
+		t.Errorf("expected the hash value to share the alias, got %v", h)
+	}
+
+	e := NewEncoderV3()
+	if err := e.Profile(ProfilePerl3x); err != nil {
+		t.Fatal(err)
+	}
+	e.Canonical = true
+
+	b, err := e.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aliases := 0
+	if _, err := walkValue(b, headerSize+1, func(idx int, tag byte) error {
+		if tag == typeALIAS {
+			aliases++
+			if offs := int(b[idx+1]); b[headerSize+offs]&trackFlag == 0 || b[headerSize+offs]&^trackFlag != typeSHORT_BINARY_0+3 {
+				t.Errorf("ALIAS at %d refers to %x", idx, b[headerSize+offs])
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if aliases != 2 {
+		t.Errorf("expected 2 ALIAS tags, got %x", b)
+	}
+
+	// and the round trip is stable
+	var v2 interface{}
+	if err := d.Unmarshal(b, &v2); err != nil {
+		t.Fatal(err)
+	}
+	if b2, err := e.Marshal(v2); err != nil || !bytes.Equal(b, b2) {
+		t.Errorf("round trip differs:\n got %x\nwant %x (%v)", b2, b, err)
+	}
+
+	// without PerlCompat, aliases are still decoded as copies
+	var plain []interface{}
+	if err := Unmarshal(doc, &plain); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(plain[1], []byte("foo")) {
+		t.Errorf("expected a copy of the aliased value, got %v", plain)
+	}
+}
+
+func TestOffsetTable(t *testing.T) {
+	type user struct {
+		Name string
+		Tags []string
+	}
+
+	u := &user{"alice", []string{"admin", "ops"}}
+	body := map[string]interface{}{
+		"users": []interface{}{u, u},
+		"count": 2,
+	}
+
+	for _, e := range []*Encoder{NewEncoder(), NewEncoderV2(), NewEncoderV3(), {Compression: SnappyCompressor{Incremental: true}, version: 3}} {
+		var offsets OffsetTable
+		b, err := e.MarshalWithHeader(map[string]interface{}{"v": 7}, body, WithOffsets(&offsets))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b, err = DecompressDocument(nil, b); err != nil {
+			t.Fatal(err)
+		}
+
+		tagAt := func(path string) byte {
+			offs, ok := offsets.Path(path)
+			if !ok {
+				t.Fatalf("version %d: no offset for %s", e.version, path)
+			}
+			return b[offs] &^ trackFlag
+		}
+
+		if e.version > 1 {
+			if tag := tagAt("header.v"); tag != 7 {
+				t.Errorf("version %d: unexpected tag %s for header.v", e.version, tagName(tag))
+			}
+		}
+		if tag := tagAt("body.count"); tag != 2 {
+			t.Errorf("version %d: unexpected tag %s for body.count", e.version, tagName(tag))
+		}
+		if tag := tagAt("body.users[0]"); tag != typeOBJECT {
+			t.Errorf("version %d: unexpected tag %s for body.users[0]", e.version, tagName(tag))
+		}
+		if tag := tagAt("body.users[1]"); tag != typeREFP {
+			t.Errorf("version %d: unexpected tag %s for body.users[1]", e.version, tagName(tag))
+		}
+		if offs, _ := offsets.Path("body.users[0].Name"); !bytes.HasPrefix(b[offs:], AppendString(nil, "alice")) {
+			t.Errorf("version %d: unexpected value at %d for body.users[0].Name", e.version, offs)
+		}
+		if tag := tagAt("body.users[0].Tags[1]"); tag != typeSTR_UTF8 {
+			t.Errorf("version %d: unexpected tag %s for body.users[0].Tags[1]", e.version, tagName(tag))
+		}
+
+		want, _ := offsets.Path("body.users[0]")
+		if offs, ok := offsets.Pointer(u); !ok || offs != want {
+			t.Errorf("version %d: unexpected offset %d for the pointer, expected %d", e.version, offs, want)
+		}
+
+		if h, _ := readHeader(b); offsets.BodyStart != headerSize+h.suffixSize {
+			t.Errorf("version %d: unexpected body start %d", e.version, offsets.BodyStart)
+		}
+	}
+}
+
+func TestPath(t *testing.T) {
+	shared := []interface{}{1, 2}
+	doc := map[string]interface{}{
+		"store": map[string]interface{}{
+			"book": []interface{}{
+				map[string]interface{}{"title": "a", "price": 1},
+				map[string]interface{}{"title": "b", "price": 2},
+				map[string]interface{}{"title": "c"},
+			},
+			"bicycle": map[string]interface{}{"color": "red"},
+		},
+		"x": &shared,
+		"y": &shared,
+	}
+
+	for _, e := range []*Encoder{{Canonical: true, version: 2}, {Canonical: true, version: 3, Compression: SnappyCompressor{Incremental: true}}} {
+		b, err := e.Marshal(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tests := []struct {
+			path string
+			want []interface{}
+		}{
+			{"$.store.book[0].title", []interface{}{"a"}},
+			{"$.store.book[*].title", []interface{}{"a", "b", "c"}},
+			{"$.store.book.*.title", []interface{}{"a", "b", "c"}},
+			{"$.store.book[-1].title", []interface{}{"c"}},
+			{"$.store.book[0,2].title", []interface{}{"a", "c"}},
+			{"$.store.book[1:].title", []interface{}{"b", "c"}},
+			{"$.store.book[::2].title", []interface{}{"a", "c"}},
+			{"$.store.book[::-1].title", []interface{}{"c", "b", "a"}},
+			{"$['store']['bicycle'][\"color\"]", []interface{}{"red"}},
+			{"$.store.book[0]['title', 'price']", []interface{}{"a", 1}},
+			{"$.store.book[*].price", []interface{}{1, 2}},
+			{"$.store.book[5]", nil},
+			{"$.nope", nil},
+			{"$.store.bicycle.color.nope", nil},
+			{"$.x[1]", []interface{}{2}},
+			{"$.y[1]", []interface{}{2}},
+			{"$.y[*]", []interface{}{1, 2}},
+			{"$..title", []interface{}{"a", "b", "c"}},
+			{"$..price", []interface{}{1, 2}},
+			{"$..book[1].title", []interface{}{"b"}},
+			{"$.store..color", []interface{}{"red"}},
+			{"$..[0].title", []interface{}{"a"}},
+			{"$..['color','title']", []interface{}{"red", "a", "b", "c"}},
+			{"$.x..*", []interface{}{1, 2}},
+			{"$..[1]", []interface{}{map[string]interface{}{"price": 2, "title": "b"}, 2}},
+			{"$..nope", nil},
+		}
+
+		for _, tt := range tests {
+			got, err := MustCompilePath(tt.path).Query(b)
+			if err != nil {
+				t.Errorf("version %d: %s: %v", e.version, tt.path, err)
+				continue
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("version %d: %s: got %#v, expected %#v", e.version, tt.path, got, tt.want)
+			}
+		}
+	}
+
+	for _, path := range []string{"", "store", "$..", "$...x", "$..[", "$.", "$[", "$['a'", "$[x]", "$[1:2:0]", "$[1,2:3]", "$.a]"} {
+		if _, err := CompilePath(path); err == nil {
+			t.Errorf("no error compiling %q", path)
+		}
+	}
+
+	// a hash whose value "a" refers to the hash itself
+	cyclic := []byte("=\xf3rl\x03\x00\x28\xaa\x01\x61a\x29\x02")
+	if got, err := MustCompilePath("$..b").Query(cyclic); err != nil || got != nil {
+		t.Errorf("recursive descent in a cycle: got %v (%v)", got, err)
+	}
+
+	if _, err := MustCompilePath("$.a").Query([]byte("=srl")); err == nil {
+		t.Error("no error querying a truncated document")
+	}
+}
+
+// longDoubleBytes returns f as Perl writes a long double on x86-64
+func longDoubleBytes(f float64) []byte {
+	var mant uint64
+	var exp int
+	switch {
+	case math.IsNaN(f):
+		mant, exp = 0xc000000000000000, 0x7fff
+	case math.IsInf(f, 0):
+		mant, exp = 0x8000000000000000, 0x7fff
+	case f != 0:
+		frac, e := math.Frexp(math.Abs(f))
+		mant, exp = uint64(math.Ldexp(frac, 64)), e+16382
+	}
+	if math.Signbit(f) {
+		exp |= 0x8000
+	}
+
+	b := make([]byte, 16)
+	binary.LittleEndian.PutUint64(b, mant)
+	binary.LittleEndian.PutUint16(b[8:], uint16(exp))
+	return b
+}
+
+func TestLongDouble(t *testing.T) {
+	doc := func(ld []byte) []byte {
+		return append([]byte("=\xf3rl\x03\x00\x24"), ld...)
+	}
+
+	var d decoder
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 100000; i++ {
+		f := math.Float64frombits(r.Uint64())
+		got, idx, err := d.decodeLongDouble(append([]byte{typeLONG_DOUBLE}, longDoubleBytes(f)...), 1)
+		if err != nil || idx != 17 || (math.Float64bits(got) != math.Float64bits(f) && !math.IsNaN(f)) || math.IsNaN(got) != math.IsNaN(f) {
+			t.Fatalf("%v: got %v %d %v", f, got, idx, err)
+		}
+	}
+	if _, _, err := d.decodeLongDouble(make([]byte, 16), 1); err != ErrTruncated {
+		t.Errorf("expected ErrTruncated, got %v", err)
+	}
+
+	// 1/3 rounded to 64 bits of mantissa, then to the 53 of a float64
+	third := []byte{0xab, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xfd, 0x3f, 0, 0, 0, 0, 0, 0}
+	huge := []byte{0, 0, 0, 0, 0, 0, 0, 0x80, 0xfe, 0x7f, 0, 0, 0, 0, 0, 0}
+	tiny := []byte{0, 0, 0, 0, 0, 0, 0, 0x80, 0x01, 0x80, 0, 0, 0, 0, 0, 0}
+
+	tests := []struct {
+		ld   []byte
+		want float64
+		text string
+	}{
+		{longDoubleBytes(1), 1, "1"},
+		{longDoubleBytes(-2.5), -2.5, "-2.5"},
+		{longDoubleBytes(math.Inf(1)), math.Inf(1), "+Inf"},
+		{longDoubleBytes(math.Inf(-1)), math.Inf(-1), "-Inf"},
+		{longDoubleBytes(math.NaN()), math.NaN(), "NaN"},
+		{third, 1.0 / 3, "0.33333333333333333334"},
+		{huge, math.Inf(1), "5.9486574767861588254e+4931"},
+		{tiny, math.Copysign(0, -1), "-3.3621031431120935063e-4932"},
+	}
+
+	for _, tt := range tests {
+		b := doc(tt.ld)
+
+		var f float64
+		if err := Unmarshal(b, &f); err != nil || !(f == tt.want && math.Signbit(f) == math.Signbit(tt.want) || f != f && tt.want != tt.want) {
+			t.Errorf("%s: got float64 %v (%v)", tt.text, f, err)
+		}
+
+		var v interface{}
+		if err := Unmarshal(b, &v); err != nil || !FloatEqual(v, tt.want) {
+			t.Errorf("%s: got %#v (%v)", tt.text, v, err)
+		}
+
+		var n Number
+		if err := Unmarshal(b, &n); err != nil || string(n) != tt.text {
+			t.Errorf("%s: got Number %q (%v)", tt.text, n, err)
+		}
+
+		var x big.Float
+		err := Unmarshal(b, &x)
+		if tt.want != tt.want {
+			if err == nil {
+				t.Errorf("%s: no error decoding into big.Float", tt.text)
+			}
+		} else if err != nil || x.Text('g', -1) != tt.text {
+			t.Errorf("%s: got big.Float %s (%v)", tt.text, x.Text('g', -1), err)
+		}
+
+		r := NewValueReader(append([]byte{typeLONG_DOUBLE}, tt.ld...))
+		if f, err := r.ReadFloat(); err != nil || !FloatEqual(f, tt.want) {
+			t.Errorf("%s: ReadFloat got %v (%v)", tt.text, f, err)
+		}
+	}
+
+	var js bytes.Buffer
+	if err := ToJSON(&js, doc(longDoubleBytes(-2.5))); err != nil || js.String() != "-2.5" {
+		t.Errorf("unexpected JSON %s (%v)", js.String(), err)
+	}
+	if err := Validate(doc(third)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFloatSpecialValues(t *testing.T) {
+	values := []float64{math.NaN(), math.Inf(1), math.Inf(-1), math.Copysign(0, -1)}
+
+	for _, e := range []*Encoder{NewEncoderV2(), NewEncoderV3(), {CanonicalFloats: true, version: 3}} {
+		for _, f := range values {
+			for _, v := range []interface{}{f, float32(f)} {
+				b, err := e.Marshal(v)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				var got interface{}
+				if err := Unmarshal(b, &got); err != nil || !FloatEqual(got, v) || math.Signbit(reflect.ValueOf(got).Float()) != math.Signbit(f) {
+					t.Errorf("%T %v: got %#v (%v)", v, v, got, err)
+				}
+
+				var f32 float32
+				if err := Unmarshal(b, &f32); err != nil || !FloatEqual(f32, v) {
+					t.Errorf("%T %v: got float32 %v (%v)", v, v, f32, err)
+				}
+
+				d := NewDecoder()
+				d.Strict = true
+				var f64 float64
+				if err := d.Unmarshal(b, &f64); err != nil || !FloatEqual(f64, v) || math.Signbit(f64) != math.Signbit(f) {
+					t.Errorf("%T %v: got float64 %v (%v)", v, v, f64, err)
+				}
+
+				var n Number
+				if err := Unmarshal(b, &n); err != nil {
+					t.Errorf("%T %v: %v", v, v, err)
+				} else if again, err := e.Marshal(n); err != nil {
+					t.Error(err)
+				} else if err := Unmarshal(again, &f64); err != nil || !FloatEqual(f64, v) {
+					t.Errorf("%T %v: got %v through Number %q (%v)", v, v, f64, n, err)
+				}
+			}
+		}
+	}
+}
+
+func TestIntegerEncoding(t *testing.T) {
+	type myInt8 int8
+	type myInt int
+	type myUint64 uint64
+
+	maxVarint := []byte{typeVARINT, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}
+
+	tests := []struct {
+		v    interface{}
+		want []byte
+	}{
+		{0, []byte{0x00}},
+		{15, []byte{0x0f}},
+		{16, []byte{typeVARINT, 16}},
+		{-1, []byte{0x1f}},
+		{-16, []byte{0x10}},
+		{-17, []byte{typeZIGZAG, 33}},
+		{int8(-128), []byte{typeZIGZAG, 0xff, 0x01}},
+		{int16(-16), []byte{0x10}},
+		{int32(math.MinInt32), []byte{typeZIGZAG, 0xff, 0xff, 0xff, 0xff, 0x0f}},
+		{int64(math.MaxInt64), []byte{typeVARINT, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f}},
+		{int64(math.MinInt64), []byte{typeZIGZAG, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}},
+		{uint8(15), []byte{0x0f}},
+		{uint8(255), []byte{typeVARINT, 0xff, 0x01}},
+		{uint(16), []byte{typeVARINT, 16}},
+		{uint64(1 << 63), []byte{typeVARINT, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x01}},
+		{uint64(math.MaxUint64), maxVarint},
+		{myInt8(-1), []byte{0x1f}},
+		{myInt8(-100), []byte{typeZIGZAG, 199, 0x01}},
+		{myInt(-17), []byte{typeZIGZAG, 33}},
+		{myUint64(math.MaxUint64), maxVarint},
+		{json.Number("-0"), []byte{typeDOUBLE, 0, 0, 0, 0, 0, 0, 0, 0x80}},
+	}
+
+	for _, tt := range tests {
+		b, err := NewEncoderV3().Marshal(tt.v)
+		if err != nil {
+			t.Errorf("%T %v: %v", tt.v, tt.v, err)
+			continue
+		}
+
+		if body := b[6:]; !bytes.Equal(body, tt.want) {
+			t.Errorf("%T %v: got %x, expected %x", tt.v, tt.v, body, tt.want)
+			continue
+		}
+
+		if _, ok := tt.v.(json.Number); ok {
+			// only decoded from strings
+			continue
+		}
+		got := reflect.New(reflect.TypeOf(tt.v))
+		if err := Unmarshal(b, got.Interface()); err != nil {
+			t.Errorf("%T %v: %v", tt.v, tt.v, err)
+		} else if got := got.Elem().Interface(); !reflect.DeepEqual(got, tt.v) {
+			t.Errorf("%T %v: got back %v", tt.v, tt.v, got)
+		}
+	}
+
+	if b := AppendUint(nil, math.MaxUint64); !bytes.Equal(b, maxVarint) {
+		t.Errorf("AppendUint: got %x", b)
+	}
+	if b := AppendInt(nil, -16); !bytes.Equal(b, []byte{0x10}) {
+		t.Errorf("AppendInt: got %x", b)
+	}
+}
+
+func TestArrayOverflowPolicy(t *testing.T) {
+	long, err := Marshal([]interface{}{1, 2, 3, 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	short, err := Marshal([]int{7})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := [3]int{9, 9, 9}
+	if err := Unmarshal(long, &a); err != nil || a != [3]int{1, 2, 3} {
+		t.Errorf("discard: got %v (%v)", a, err)
+	}
+	if err := Unmarshal(short, &a); err != nil || a != [3]int{7, 0, 0} {
+		t.Errorf("short: got %v (%v)", a, err)
+	}
+
+	d, err := DecoderOptions{Version: 1, ArrayOverflowPolicy: "error"}.NewDecoder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.ArrayOverflowPolicy != ArrayError {
+		t.Errorf("unexpected policy %v", d.ArrayOverflowPolicy)
+	}
+
+	a = [3]int{9, 9, 9}
+	err = d.Unmarshal(long, &a)
+	var derr *DecodeError
+	if !errors.Is(err, ErrArrayOverflow) || !errors.As(err, &derr) || derr.Path != "body" {
+		t.Errorf("expected ErrArrayOverflow, got %v", err)
+	}
+	if a != [3]int{9, 9, 9} {
+		t.Errorf("array modified before the error: %v", a)
+	}
+
+	nested, err := Marshal(map[string]interface{}{"a": []interface{}{"x", "y"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s struct{ A [1]string }
+	if err := d.Unmarshal(nested, &s); !errors.Is(err, ErrArrayOverflow) || !errors.As(err, &derr) || derr.Path != "body.a" {
+		t.Errorf("expected ErrArrayOverflow at body.a, got %v", err)
+	}
+	if err := d.Unmarshal(short, &a); err != nil || a != [3]int{7, 0, 0} {
+		t.Errorf("short: got %v (%v)", a, err)
+	}
+
+	if _, err := (DecoderOptions{Version: 1, ArrayOverflowPolicy: "truncate"}).NewDecoder(); err == nil {
+		t.Error("expected error for an unknown policy")
+	}
+}
+
+func TestSkipIgnoredValues(t *testing.T) {
+	// the same keys, with scalars or nested values to skip
+	scalars := map[string]interface{}{"n": 1}
+	nested := map[string]interface{}{"n": 1}
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("field%d", i)
+		scalars[key] = i
+		nested[key] = map[string]interface{}{"list": []interface{}{"x", 1.5, []byte("y")}, "n": i}
+	}
+
+	var s struct {
+		N int `sereal:"n"`
+	}
+	allocs := func(v interface{}) float64 {
+		b, err := Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return testing.AllocsPerRun(10, func() { Unmarshal(b, &s) })
+	}
+	if base, n := allocs(scalars), allocs(nested); s.N != 1 || n > base {
+		t.Errorf("skipping nested values took %v allocations, %v for scalars", n, base)
+	}
+
+	// skipped values may hold tracked values referred to further on
+	shared := []int{1, 2}
+	b, err := (&Encoder{Canonical: true, version: 3}).Marshal(map[string]interface{}{"a": &shared, "b": &shared})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v struct {
+		B *[]int `sereal:"b"`
+	}
+	if err := Unmarshal(b, &v); err != nil || v.B == nil || !reflect.DeepEqual(*v.B, shared) {
+		t.Errorf("got %v (%v)", v.B, err)
+	}
+
+	b, err = Marshal([]interface{}{1, &shared, &shared})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var a [1]int
+	if err := Unmarshal(b, &a); err != nil || a != [1]int{1} {
+		t.Errorf("got %v (%v)", a, err)
+	}
+}
+
+func TestValue(t *testing.T) {
+	shared := []interface{}{1, "two"}
+	doc := map[string]interface{}{
+		"int":    -300,
+		"small":  -3,
+		"big":    uint64(math.MaxUint64),
+		"float":  1.5,
+		"str":    "héllo",
+		"bin":    []byte("raw"),
+		"bool":   true,
+		"undef":  nil,
+		"list":   []interface{}{"a", map[string]interface{}{"k": "v"}, "a"},
+		"x":      &shared,
+		"y":      &shared,
+		"object": &PerlObject{Class: "Foo::Bar", Reference: map[string]interface{}{"id": 7}},
+	}
+
+	for _, e := range []*Encoder{{Canonical: true, version: 2}, {Canonical: true, version: 3, Compression: SnappyCompressor{Incremental: true}}} {
+		b, err := e.Marshal(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var v Value
+		if err := Unmarshal(b, &v); err != nil {
+			t.Fatalf("version %d: %v", e.version, err)
+		}
+
+		if v.Kind() != KindHash || v.Len() != len(doc) {
+			t.Fatalf("version %d: got %v of length %d, expected hash of length %d", e.version, v.Kind(), v.Len(), len(doc))
+		}
+
+		if got := v.Get("int"); got.Kind() != KindInt || got.Int() != -300 || got.Uint() != 0 {
+			t.Errorf("version %d: int: got %v %d", e.version, got.Kind(), got.Int())
+		}
+		if got := v.Get("small").Int(); got != -3 {
+			t.Errorf("version %d: small: got %d", e.version, got)
+		}
+		if got := v.Get("big"); got.Kind() != KindUint || got.Uint() != math.MaxUint64 || got.Int() != 0 {
+			t.Errorf("version %d: big: got %v %d", e.version, got.Kind(), got.Uint())
+		}
+		if got := v.Get("float"); got.Kind() != KindFloat || got.Float() != 1.5 {
+			t.Errorf("version %d: float: got %v %v", e.version, got.Kind(), got.Float())
+		}
+		if got := v.Get("str"); got.Kind() != KindString || got.Str() != "héllo" {
+			t.Errorf("version %d: str: got %v %q", e.version, got.Kind(), got.Str())
+		}
+		if got := v.Get("bin"); got.Kind() != KindBytes || string(got.Bytes()) != "raw" {
+			t.Errorf("version %d: bin: got %v %q", e.version, got.Kind(), got.Bytes())
+		}
+		if got := v.Get("bool"); got.Kind() != KindBool || !got.Bool() {
+			t.Errorf("version %d: bool: got %v %v", e.version, got.Kind(), got.Bool())
+		}
+		if got := v.Get("undef").Kind(); got != KindUndef {
+			t.Errorf("version %d: undef: got %v", e.version, got)
+		}
+		if got := v.Get("nope"); got.Kind() != KindInvalid || got.Str() != "" || got.Len() != 0 {
+			t.Errorf("version %d: nope: got %v", e.version, got.Kind())
+		}
+
+		list := v.Get("list")
+		if list.Kind() != KindArray || list.Len() != 3 {
+			t.Errorf("version %d: list: got %v of length %d", e.version, list.Kind(), list.Len())
+		}
+		// the second "a" is a COPY of the first
+		if got := list.Index(2).Str(); got != "a" {
+			t.Errorf("version %d: list[2]: got %q", e.version, got)
+		}
+		if got := list.Index(1).Get("k").Str(); got != "v" {
+			t.Errorf("version %d: list[1].k: got %q", e.version, got)
+		}
+		if got := list.Index(3).Kind(); got != KindInvalid {
+			t.Errorf("version %d: list[3]: got %v", e.version, got)
+		}
+
+		// x and y refer to the same array, one of them through REFP
+		for _, k := range []string{"x", "y"} {
+			if got := v.Get(k).Kind(); got != KindRef {
+				t.Errorf("version %d: %s: got %v", e.version, k, got)
+			}
+			s := v.Get(k).Slice()
+			if len(s) != 2 || s[0].Int() != 1 || s[1].Str() != "two" {
+				t.Errorf("version %d: %s: got %d elements", e.version, k, len(s))
+			}
+		}
+
+		obj := v.Get("object")
+		if obj.Kind() != KindObject || obj.Class() != "Foo::Bar" || obj.Get("id").Int() != 7 {
+			t.Errorf("version %d: object: got %v of class %q", e.version, obj.Kind(), obj.Class())
+		}
+
+		if keys := v.Keys(); !reflect.DeepEqual(keys, []string{"big", "bin", "bool", "float", "int", "list", "object", "small", "str", "undef", "x", "y"}) {
+			t.Errorf("version %d: got keys %q", e.version, keys)
+		}
+		if m := v.Map(); len(m) != len(doc) || m["str"].Str() != "héllo" {
+			t.Errorf("version %d: got map of %d entries", e.version, len(m))
+		}
+
+		got, err := v.Get("list").Index(1).Interface()
+		if err != nil || !reflect.DeepEqual(got, map[string]interface{}{"k": "v"}) {
+			t.Errorf("version %d: list[1]: got %#v, %v", e.version, got, err)
+		}
+		got, err = v.Get("y").Elem().Interface()
+		if err != nil || !reflect.DeepEqual(got, shared) {
+			t.Errorf("version %d: y: got %#v, %v", e.version, got, err)
+		}
+
+		// the Value outlives the input unless it is aliased
+		for i := range b {
+			b[i] = 0
+		}
+		if got := v.Get("str").Str(); got != "héllo" {
+			t.Errorf("version %d: str after clearing the input: got %q", e.version, got)
+		}
+	}
+
+	// Value fields hold parts of a document decoded into a struct
+	var s struct {
+		Name  string
+		Attrs Value
+	}
+	b, err := Marshal(map[string]interface{}{"Name": "n", "Attrs": map[string]interface{}{"a": []interface{}{1, 2}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Unmarshal(b, &s); err != nil {
+		t.Fatal(err)
+	}
+	if s.Name != "n" || s.Attrs.Get("a").Index(1).Int() != 2 {
+		t.Errorf("got name %q and attrs of kind %v", s.Name, s.Attrs.Kind())
+	}
+
+	// the whole value is checked up front
+	b, err = NewEncoderV3().Marshal(map[string]interface{}{"a": []interface{}{"x"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n := len(b) - 1; n > headerSize; n-- {
+		var v Value
+		if err := Unmarshal(b[:n], &v); err == nil {
+			t.Errorf("no error decoding %d of %d bytes", n, len(b))
+		}
+	}
+
+	var v Value
+	bad := append(b[:headerSize+1:headerSize+1], typeHASH, 1, 1, typeUNDEF)
+	if err := Unmarshal(bad, &v); !errors.Is(err, ErrNotStringish) {
+		t.Errorf("non string key: got %v", err)
+	}
+}
+
+func TestDecodeCommon(t *testing.T) {
+	// the named types go through the reflection path
+	type (
+		stringMap map[string]string
+		int64Map  map[string]int64
+		intMap    map[string]int
+		ifaceMap  map[string]interface{}
+		strings   []string
+		int64s    []int64
+		ints      []int
+		ifaces    []interface{}
+	)
+	types := []struct{ fast, named reflect.Type }{
+		{reflect.TypeOf(map[string]string(nil)), reflect.TypeOf(stringMap(nil))},
+		{reflect.TypeOf(map[string]int64(nil)), reflect.TypeOf(int64Map(nil))},
+		{reflect.TypeOf(map[string]int(nil)), reflect.TypeOf(intMap(nil))},
+		{reflect.TypeOf(map[string]interface{}(nil)), reflect.TypeOf(ifaceMap(nil))},
+		{reflect.TypeOf([]string(nil)), reflect.TypeOf(strings(nil))},
+		{reflect.TypeOf([]int64(nil)), reflect.TypeOf(int64s(nil))},
+		{reflect.TypeOf([]int(nil)), reflect.TypeOf(ints(nil))},
+		{reflect.TypeOf([]interface{}(nil)), reflect.TypeOf(ifaces(nil))},
+	}
+
+	s := "shared"
+	docs := []interface{}{
+		map[string]interface{}{"a": "x", "b": "x", "c": []byte("y"), "d": nil},
+		map[string]interface{}{"a": 1, "b": -20, "c": 300, "d": -300},
+		map[string]interface{}{"a": uint64(math.MaxUint64), "b": 1.5, "c": true},
+		map[string]interface{}{"a": &s, "b": &s},
+		&map[string]interface{}{"a": "x"},
+		[]interface{}{"x", "x", []byte("y"), nil, &s, &s},
+		[]interface{}{1, -20, 300, -300, uint64(math.MaxUint64), "7"},
+		&[]interface{}{1, 2},
+		"scalar",
+	}
+
+	for _, e := range []*Encoder{NewEncoderV3(), {PerlCompat: true, version: 3}} {
+		for i, doc := range docs {
+			b, err := e.Marshal(doc)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, typ := range types {
+				fast := reflect.New(typ.fast)
+				fastErr := Unmarshal(b, fast.Interface())
+
+				slow := reflect.New(typ.named)
+				slowErr := Unmarshal(b, slow.Interface())
+
+				if fmt.Sprint(fastErr) != fmt.Sprint(slowErr) {
+					t.Errorf("doc %d into %v: got error %v, expected %v", i, typ.fast, fastErr, slowErr)
+					continue
+				}
+				if got, want := fast.Elem().Interface(), slow.Elem().Convert(typ.fast).Interface(); !reflect.DeepEqual(got, want) {
+					t.Errorf("doc %d into %v: got %#v, expected %#v", i, typ.fast, got, want)
+				}
+			}
+		}
+	}
+
+	b, err := Marshal(map[string]string{"a": "x", "b": "y", "c": "z"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fast := testing.AllocsPerRun(100, func() {
+		var m map[string]string
+		Unmarshal(b, &m)
+	})
+	slow := testing.AllocsPerRun(100, func() {
+		var m stringMap
+		Unmarshal(b, &m)
+	})
+	if fast >= slow {
+		t.Errorf("got %v allocations without reflection, %v with", fast, slow)
+	}
+}
+
+func TestArena(t *testing.T) {
+	doc := map[string]interface{}{
+		"name":  "arena",
+		"bin":   []byte("raw"),
+		"list":  []interface{}{"a", "b", []interface{}{"c", strings.Repeat("x", 100)}},
+		"empty": []interface{}{},
+		"n":     1,
+	}
+	b, err := Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var want interface{}
+	if err := Unmarshal(b, &want); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, size := range []int{0, 64} {
+		a := &Arena{BlockSize: size}
+		for i := 0; i < 3; i++ {
+			var got interface{}
+			if err := Unmarshal(b, &got, WithArena(a)); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("block size %d: got %#v, expected %#v", size, got, want)
+			}
+
+			// appending to a decoded slice leaves the next value alone
+			m := got.(map[string]interface{})
+			bin := m["bin"].([]byte)
+			_ = append(bin, "!!!!!!!!"...)
+			list := m["list"].([]interface{})
+			_ = append(list, 0)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("block size %d: got %#v after appending, expected %#v", size, got, want)
+			}
+
+			a.Reset()
+		}
+
+		if size == 0 && (len(a.bytes) != 1 || len(a.ifaces) != 1) {
+			t.Errorf("got %d byte blocks and %d interface{} blocks, expected the first ones reused", len(a.bytes), len(a.ifaces))
+		}
+	}
+
+	var s struct {
+		Name string
+		Bin  []byte
+	}
+	if err := Unmarshal(b, &s, WithArena(&Arena{})); err != nil {
+		t.Fatal(err)
+	}
+	if s.Name != "arena" || string(s.Bin) != "raw" {
+		t.Errorf("got %+v", s)
+	}
+
+	var a Arena
+	with := testing.AllocsPerRun(100, func() {
+		var v interface{}
+		Unmarshal(b, &v, WithArena(&a))
+		a.Reset()
+	})
+	without := testing.AllocsPerRun(100, func() {
+		var v interface{}
+		Unmarshal(b, &v)
+	})
+	if with >= without {
+		t.Errorf("got %v allocations with an arena, %v without", with, without)
+	}
+}
+
+func TestTagsCacheShared(t *testing.T) {
+	type Shared struct {
+		A string `sereal:"a"`
+		B int    `sereal:"b,omitempty"`
+	}
+
+	b, err := Marshal(Shared{"x", 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	typ := reflect.TypeOf(Shared{})
+	sf, ok := tcache.fields.Load(typ)
+	if !ok {
+		t.Fatal("fields not cached by the encoder")
+	}
+
+	// a new Decoder finds the fields built for the Encoder
+	var s Shared
+	if err := (&Decoder{}).Unmarshal(b, &s); err != nil || s != (Shared{"x", 1}) {
+		t.Errorf("got %+v, %v", s, err)
+	}
+	if again, _ := tcache.fields.Load(typ); !reflect.DeepEqual(again, sf) {
+		t.Errorf("fields built again")
+	}
+
+	perDecoder := testing.AllocsPerRun(100, func() {
+		var s Shared
+		(&Decoder{}).Unmarshal(b, &s)
+	})
+	shared := NewDecoder()
+	reused := testing.AllocsPerRun(100, func() {
+		var s Shared
+		shared.Unmarshal(b, &s)
+	})
+	// the only extra allocation is the Decoder itself
+	if perDecoder > reused+1 {
+		t.Errorf("got %v allocations with a new Decoder each time, %v with the same", perDecoder, reused)
+	}
+}
+
+type planDuration int64
+
+func (d planDuration) MarshalBinary() ([]byte, error) { return []byte("d" + strconv.Itoa(int(d))), nil }
+
+func TestStructPlan(t *testing.T) {
+	type Planned struct {
+		S      string                 `sereal:"s"`
+		B      []byte                 `sereal:"b"`
+		T      bool                   `sereal:"t,omitempty"`
+		I8     int8                   `sereal:"i8"`
+		U      uint                   `sereal:"u"`
+		F      float32                `sereal:"f"`
+		D      float64                `sereal:"d,omitempty"`
+		N      int                    `sereal:"n,string"`
+		Dur    planDuration           `sereal:"dur"`
+		L      []int                  `sereal:"l"`
+		Remain map[string]interface{} `sereal:",remain"`
+	}
+
+	for _, tc := range []struct {
+		name string
+		in   Planned
+		want map[string]interface{}
+	}{
+		{
+			"all",
+			Planned{"x", []byte("y"), true, -8, 8, 1.5, 2.5, 42, 3, []int{1}, nil},
+			map[string]interface{}{"s": "x", "b": []byte("y"), "t": true, "i8": -8, "u": 8, "f": float32(1.5), "d": 2.5, "n": []byte("42"), "l": []interface{}{1}},
+		},
+		{
+			"omitted",
+			Planned{},
+			map[string]interface{}{"s": []byte(""), "b": []byte{}, "i8": 0, "u": 0, "f": float32(0), "n": []byte("0"), "l": []interface{}{}},
+		},
+		{
+			"remain",
+			Planned{S: "x", Remain: map[string]interface{}{"s": "lost", "extra": 1}},
+			map[string]interface{}{"s": "x", "b": []byte{}, "i8": 0, "u": 0, "f": float32(0), "n": []byte("0"), "l": []interface{}{}, "extra": 1},
+		},
+	} {
+		e := NewEncoderV3()
+		e.StructAsMap = true
+		b, err := e.Marshal(tc.in)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+
+		var got map[string]interface{}
+		if err := (&Decoder{}).Unmarshal(b, &got); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		// named types keep going through Encoder.encode
+		if _, ok := got["dur"].(*PerlFreeze); !ok {
+			t.Errorf("%s: dur not frozen: %#v", tc.name, got["dur"])
+		}
+		delete(got, "dur")
+
+		for k, v := range got {
+			if s, ok := v.(string); ok {
+				got[k] = []byte(s)
+			}
+		}
+		for k, v := range tc.want {
+			if s, ok := v.(string); ok {
+				tc.want[k] = []byte(s)
+			}
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %#v, want %#v", tc.name, got, tc.want)
+		}
+
+		if tc.in.Remain != nil {
+			continue
+		}
+
+		// the plan writes the fields in the canonical order
+		e.Canonical = true
+		c, err := e.Marshal(tc.in)
+		if err != nil || !bytes.Equal(b, c) {
+			t.Errorf("%s: canonical output differs: %x, %x, %v", tc.name, b, c, err)
+		}
+	}
+
+	if _, ok := tcache.plans.Load(reflect.TypeOf(Planned{})); !ok {
+		t.Error("plan not cached")
+	}
+}
+
+func TestEncoderSetVersion(t *testing.T) {
+	e := &Encoder{}
+	if v := e.Version(); v != ProtocolVersion {
+		t.Errorf("zero Encoder writes version %d", v)
+	}
+
+	for v := 1; v <= MaxSupportedVersion; v++ {
+		if err := e.SetVersion(v); err != nil {
+			t.Fatalf("version %d: %v", v, err)
+		}
+		b, err := e.Marshal("pinned")
+		if err != nil {
+			t.Fatalf("version %d: %v", v, err)
+		}
+		if got := int(b[4] & 0x0f); got != v || e.Version() != v {
+			t.Errorf("version %d: wrote version %d", v, got)
+		}
+	}
+
+	for _, v := range []int{0, -1, MaxSupportedVersion + 1} {
+		if err := e.SetVersion(v); err == nil {
+			t.Errorf("no error setting version %d", v)
+		}
+	}
+
+	// zlib needs v3, zstd v4
+	e.Compression = ZlibCompressor{}
+	if err := e.SetVersion(2); err == nil || e.Version() != MaxSupportedVersion {
+		t.Errorf("version %d with zlib: %v", e.Version(), err)
+	}
+	e.Compression = ZstdCompressor{}
+	if err := e.SetVersion(3); err == nil || e.Version() != MaxSupportedVersion {
+		t.Errorf("version %d with zstd: %v", e.Version(), err)
+	}
+}
@@ -1,7 +1,9 @@
 package sereal
 
 import (
+	"fmt"
 	"math"
+	"sync"
 
 	"github.com/golang/snappy"
 )
@@ -9,8 +11,86 @@ import (
 // SnappyCompressor compresses a Sereal document using the Snappy format.
 type SnappyCompressor struct {
 	Incremental bool // enable incremental parsing
+
+	// Codec is the snappy implementation used, GoSnappy when nil
+	Codec SnappyCodec
+}
+
+// A SnappyCodec is an implementation of the snappy block format, with the
+// Encode and Decode conventions of github.com/golang/snappy. Faster
+// implementations, e.g. github.com/klauspost/compress/snappy or a binding to
+// the C library, can be used in place of the default GoSnappy.
+type SnappyCodec interface {
+	Encode(dst, src []byte) []byte
+	Decode(dst, src []byte) ([]byte, error)
+}
+
+// GoSnappy is the pure-Go SnappyCodec of github.com/golang/snappy
+type GoSnappy struct{}
+
+// Encode returns the snappy encoding of src, reusing dst if it is large
+// enough
+func (GoSnappy) Encode(dst, src []byte) []byte { return snappy.Encode(dst, src) }
+
+// Decode returns the decoding of the snappy block src, reusing dst if it is
+// large enough
+func (GoSnappy) Decode(dst, src []byte) ([]byte, error) { return snappy.Decode(dst, src) }
+
+var snappyCodecs = struct {
+	sync.RWMutex
+	m map[string]SnappyCodec
+}{m: map[string]SnappyCodec{"go": GoSnappy{}}}
+
+// RegisterSnappyCodec makes codec available under name to EncoderOptions
+// and DecoderOptions. GoSnappy is registered as "go".
+func RegisterSnappyCodec(name string, codec SnappyCodec) {
+	snappyCodecs.Lock()
+	snappyCodecs.m[name] = codec
+	snappyCodecs.Unlock()
 }
 
+// LookupSnappyCodec returns the codec registered under name, GoSnappy for
+// an empty name
+func LookupSnappyCodec(name string) (SnappyCodec, error) {
+	if name == "" {
+		return GoSnappy{}, nil
+	}
+
+	snappyCodecs.RLock()
+	codec, ok := snappyCodecs.m[name]
+	snappyCodecs.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("sereal: unknown snappy codec %q", name)
+	}
+	return codec, nil
+}
+
+func snappyCodec(c SnappyCodec) SnappyCodec {
+	if c == nil {
+		return GoSnappy{}
+	}
+	return c
+}
+
+// A SnappyError is returned when the snappy body of a document can't be
+// decompressed. Incremental tells which framing the document declared:
+// snappy_incr, where the compressed block is preceded by its length, or
+// the legacy v1 snappy, where it runs to the end of the document.
+type SnappyError struct {
+	Incremental bool
+	Err         error
+}
+
+func (e *SnappyError) Error() string {
+	if e.Incremental {
+		return "sereal: snappy_incr body: " + e.Err.Error()
+	}
+	return "sereal: legacy snappy body: " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error
+func (e *SnappyError) Unwrap() error { return e.Err }
+
 func (c SnappyCompressor) compress(b []byte) ([]byte, error) {
 	// XXX this could be more efficient!  I'm creating a new buffer to
 	//     store the compressed document, which isn't necessary.  You
@@ -21,7 +101,7 @@ func (c SnappyCompressor) compress(b []byte) ([]byte, error) {
 		return nil, ErrTooLarge
 	}
 
-	compressed := snappy.Encode(nil, b)
+	compressed := snappyCodec(c.Codec).Encode(nil, b)
 
 	if c.Incremental {
 		// shrink down b to reuse the allocated buffer
@@ -39,19 +119,141 @@ func (c SnappyCompressor) decompress(d, b []byte) ([]byte, error) {
 	if c.Incremental {
 		ln, sz, err := varintdecode(b)
 		if err != nil {
-			return nil, err
+			return nil, &SnappyError{Incremental: true, Err: err}
 		}
 
 		if ln < 0 || sz+ln > len(b) || ln > math.MaxInt32 {
-			return nil, ErrCorrupt{errBadOffset}
+			return nil, &SnappyError{Incremental: true, Err: ErrCorrupt{ErrBadSnappyLength}}
 		}
 		b = b[sz : sz+ln]
 	}
 
-	decompressed, err := snappy.Decode(d, b)
+	decompressed, err := snappyDecode(snappyCodec(c.Codec), d, b)
+	if err != nil {
+		return nil, &SnappyError{Incremental: c.Incremental, Err: err}
+	}
+
+	return decompressed, nil
+}
+
+// maxSnappyRatio bounds the ratio of the decoded length of snappy blocks to
+// their length: no element produces more than 64 bytes out of 3
+const maxSnappyRatio = 22
+
+// snappyDecode decodes the snappy block b with codec, unless it announces
+// more bytes than it can produce, which codecs would allocate before
+// finding out
+func snappyDecode(codec SnappyCodec, d, b []byte) ([]byte, error) {
+	dLen, sz, err := varintdecode(b)
 	if err != nil {
 		return nil, err
 	}
+	if dLen < 0 || dLen > maxSnappyRatio*(len(b)-sz) {
+		return nil, ErrCorrupt{ErrBadSnappyBlock}
+	}
+
+	return codec.Decode(d, b)
+}
+
+// tolerantSnappyDecompressor decompresses snappy_incr bodies whose length
+// prefix disagrees with the compressed stream. Some old Perl encoders emitted
+// such documents; the length of the stream is then recovered from the snappy
+// framing itself.
+type tolerantSnappyDecompressor struct {
+	logger Logger
+	codec  SnappyCodec
+}
+
+func (c tolerantSnappyDecompressor) decompress(d, b []byte) ([]byte, error) {
+	ln, sz, err := varintdecode(b)
+	if err != nil {
+		return nil, &SnappyError{Incremental: true, Err: err}
+	}
+
+	codec := snappyCodec(c.codec)
+	if ln >= 0 && ln <= math.MaxInt32 && sz+ln <= len(b) {
+		if decompressed, err := snappyDecode(codec, d, b[sz:sz+ln]); err == nil {
+			return decompressed, nil
+		}
+	}
+
+	actual, err := snappyBlockLen(b[sz:])
+	if err != nil {
+		return nil, &SnappyError{Incremental: true, Err: err}
+	}
+
+	if c.logger != nil {
+		c.logger.Printf("sereal: snappy_incr length prefix is %d but compressed stream is %d bytes, using the latter", ln, actual)
+	}
+
+	decompressed, err := snappyDecode(codec, d, b[sz:sz+actual])
+	if err != nil {
+		return nil, &SnappyError{Incremental: true, Err: err}
+	}
 
 	return decompressed, nil
 }
+
+// snappyBlockLen returns the length of the snappy block at the start of b by
+// walking its elements until the announced decoded length is reached
+func snappyBlockLen(b []byte) (int, error) {
+	dLen, idx, err := varintdecode(b)
+	if err != nil {
+		return 0, err
+	}
+
+	if dLen < 0 {
+		return 0, ErrCorrupt{ErrBadSnappyBlock}
+	}
+
+	for produced := 0; produced < dLen; {
+		if idx >= len(b) {
+			return 0, ErrTruncated
+		}
+
+		tag := b[idx]
+		idx++
+
+		var n int
+		switch tag & 0x03 {
+		case 0x00: // literal
+			n = int(tag >> 2)
+			if n >= 60 {
+				extra := n - 59
+				if idx+extra > len(b) {
+					return 0, ErrTruncated
+				}
+				n = 0
+				for i := extra - 1; i >= 0; i-- {
+					n = n<<8 | int(b[idx+i])
+				}
+				idx += extra
+			}
+			n++
+			idx += n
+
+		case 0x01: // copy with 1-byte offset
+			n = 4 + int(tag>>2)&0x07
+			idx++
+
+		case 0x02: // copy with 2-byte offset
+			n = 1 + int(tag>>2)
+			idx += 2
+
+		case 0x03: // copy with 4-byte offset
+			n = 1 + int(tag>>2)
+			idx += 4
+		}
+
+		if idx > len(b) {
+			return 0, ErrTruncated
+		}
+
+		produced += n
+		if produced > dLen {
+			return 0, ErrCorrupt{ErrBadSnappyBlock}
+		}
+	}
+
+	return idx, nil
+}
@@ -0,0 +1,285 @@
+package sereal
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Splitter splits a document whose body is an array into standalone
+// documents holding consecutive runs of its elements, like Perl's
+// Sereal::Splitter. Elements are copied tag by tag, without being decoded.
+//
+// COPY, REFP, ALIAS and OBJECTV tags referring to data of an earlier chunk
+// are replaced by a copy of that data, so the chunks can be decoded on
+// their own. Header user data is copied to every chunk.
+type Splitter struct {
+	// ChunkSize is the body size, in bytes, above which a chunk is ended.
+	// Chunks hold at least one element, so they may be larger.
+	ChunkSize int
+
+	// optionally compress the body of the chunks using SnappyCompressor, ZlibCompressor or ZstdCompressor
+	// CompressionThreshold specifies threshold in bytes above which compression is attempted: 1024 bytes by default
+	Compression          compressor
+	CompressionThreshold int
+
+	doc       []byte // decompressed document
+	version   byte
+	bodyStart int
+	by        []byte // body, as offsets refer to it
+	idx       int    // offset of the next element in by
+	remaining int    // number of elements not returned yet
+	isRef     bool   // whether the array was a reference
+	targets   map[int]bool
+
+	out     []byte
+	outBase int         // offset of out[0] in the chunk
+	moved   map[int]int // offsets in by of the targets copied into the current chunk, and their offset there
+}
+
+// NewSplitter returns a Splitter for the document doc, whose body must be an
+// array or a reference to one. Chunks are ended once their body is
+// chunkSize bytes long.
+func NewSplitter(doc []byte, chunkSize int) (*Splitter, error) {
+	b, err := DecompressDocument(nil, doc)
+	if err != nil {
+		return nil, err
+	}
+
+	header, _ := readHeader(b)
+
+	s := &Splitter{
+		ChunkSize:            chunkSize,
+		CompressionThreshold: 1024,
+		doc:                  b,
+		version:              header.version,
+		bodyStart:            headerSize + header.suffixSize,
+		targets:              make(map[int]bool),
+	}
+
+	if s.version == 1 {
+		// v1 offsets are relative to the start of the document
+		s.by, s.idx = b, s.bodyStart
+	} else {
+		s.by, s.idx = b[s.bodyStart-1:], 1
+	}
+
+	if _, err := walkValue(s.by, s.idx, func(idx int, tag byte) error {
+		if isOffsetTag(tag) {
+			offs, _, err := varintdecode(s.by[idx+1:])
+			if err != nil {
+				return err
+			}
+			s.targets[offs] = true
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	for s.by[s.idx]&^trackFlag == typePAD {
+		s.idx++
+	}
+
+	tag := s.by[s.idx] &^ trackFlag
+	if tag == typeREFN {
+		s.isRef = true
+		s.idx++
+		for s.by[s.idx]&^trackFlag == typePAD {
+			s.idx++
+		}
+		tag = s.by[s.idx] &^ trackFlag
+	}
+	s.idx++
+
+	switch {
+	case tag == typeARRAY:
+		ln, sz, err := varintdecode(s.by[s.idx:])
+		if err != nil {
+			return nil, err
+		}
+		if ln < 0 || ln > math.MaxInt32 {
+			return nil, ErrCorrupt{ErrBadSliceSize}
+		}
+		s.remaining = ln
+		s.idx += sz
+
+	case tag >= typeARRAYREF_0 && tag < typeARRAYREF_0+16 && !s.isRef:
+		s.isRef = true
+		s.remaining = int(tag & 0x0f)
+
+	default:
+		return nil, fmt.Errorf("sereal: can't split a document whose body is %s", tagName(tag))
+	}
+
+	return s, nil
+}
+
+// Next returns the next chunk, or io.EOF once all the elements have been
+// returned
+func (s *Splitter) Next() ([]byte, error) {
+	if s.remaining == 0 {
+		return nil, io.EOF
+	}
+
+	var header []byte
+	if s.version == 1 {
+		header = append(header, s.doc[:headerSize]...)
+		header = append(header, 0)
+		s.outBase = len(header)
+	} else {
+		header = append(header, s.doc[:s.bodyStart]...)
+		s.outBase = 1
+	}
+	header[4] &= 0x0f // raw
+
+	s.out = s.out[:0]
+	s.moved = make(map[int]int)
+
+	if s.isRef {
+		s.out = append(s.out, typeREFN)
+	}
+	s.out = append(s.out, typeARRAY)
+	lenOffset := len(s.out)
+	for i := 0; i < binary.MaxVarintLen32; i++ {
+		s.out = append(s.out, typePAD)
+	}
+
+	n := 0
+	for s.remaining > 0 && (n == 0 || len(s.out) < s.ChunkSize) {
+		idx, err := s.copyValue(s.idx)
+		if err != nil {
+			s.remaining = 0
+			return nil, err
+		}
+		s.idx = idx
+		s.remaining--
+		n++
+	}
+
+	binary.PutUvarint(s.out[lenOffset:], uint64(n))
+
+	body := s.out
+	if s.Compression != nil && (s.CompressionThreshold == 0 || len(body) >= s.CompressionThreshold) {
+		doctype, err := compressionDocType(int(s.version), s.Compression)
+		if err != nil {
+			return nil, err
+		}
+		if body, err = s.Compression.compress(body); err != nil {
+			return nil, err
+		}
+		header[4] |= byte(doctype) << 4
+	}
+
+	return append(header, body...), nil
+}
+
+// copyValue appends the value starting at by[idx] to the current chunk and
+// returns the offset of the first byte after it
+func (s *Splitter) copyValue(idx int) (int, error) {
+	by := s.by
+	for idx < len(by) && by[idx]&^trackFlag == typePAD {
+		idx++
+	}
+	if idx >= len(by) {
+		return 0, ErrTruncated
+	}
+
+	if s.targets[idx] {
+		s.moved[idx] = len(s.out) + s.outBase
+	}
+
+	tag := by[idx] &^ trackFlag
+
+	switch {
+	case isOffsetTag(tag):
+		offs, sz, err := varintdecode(by[idx+1:])
+		if err != nil {
+			return 0, err
+		}
+		if offs < 0 || offs >= idx {
+			return 0, ErrCorrupt{ErrBadOffset}
+		}
+		next := idx + 1 + sz
+
+		if moved, ok := s.moved[offs]; ok {
+			s.out = appendTagVarint(s.out, tag, uint(moved))
+			if tag == typeREFP || tag == typeALIAS {
+				s.out[moved-s.outBase] |= trackFlag
+			}
+		} else {
+			// the target is in an earlier chunk: copy it here
+			switch tag {
+			case typeREFP:
+				s.out = append(s.out, typeREFN)
+			case typeOBJECTV:
+				s.out = append(s.out, typeOBJECT)
+			case typeOBJECTV_FREEZE:
+				s.out = append(s.out, typeOBJECT_FREEZE)
+			}
+			if _, err := s.copyValue(offs); err != nil {
+				return 0, err
+			}
+		}
+
+		if tag == typeOBJECTV || tag == typeOBJECTV_FREEZE {
+			return s.copyValue(next)
+		}
+		return next, nil
+
+	case tag == typeREFN, tag == typeWEAKEN:
+		s.out = append(s.out, tag)
+		return s.copyValue(idx + 1)
+
+	case tag == typeARRAY, tag == typeHASH:
+		ln, sz, err := varintdecode(by[idx+1:])
+		if err != nil {
+			return 0, err
+		}
+		if ln < 0 || ln > math.MaxInt32 {
+			return 0, ErrCorrupt{ErrBadSliceSize}
+		}
+		s.out = append(s.out, tag)
+		s.out = append(s.out, by[idx+1:idx+1+sz]...)
+		if tag == typeHASH {
+			ln *= 2
+		}
+		return s.copyValues(idx+1+sz, ln)
+
+	case tag >= typeARRAYREF_0 && tag < typeARRAYREF_0+16:
+		s.out = append(s.out, tag)
+		return s.copyValues(idx+1, int(tag&0x0f))
+
+	case tag >= typeHASHREF_0 && tag < typeHASHREF_0+16:
+		s.out = append(s.out, tag)
+		return s.copyValues(idx+1, 2*int(tag&0x0f))
+
+	case tag == typeOBJECT, tag == typeOBJECT_FREEZE, tag == typeREGEXP:
+		s.out = append(s.out, tag)
+		return s.copyValues(idx+1, 2)
+	}
+
+	// scalars are copied as they are
+	next, err := skipValue(by, idx)
+	if err != nil {
+		return 0, err
+	}
+	s.out = append(s.out, tag)
+	s.out = append(s.out, by[idx+1:next]...)
+	return next, nil
+}
+
+func (s *Splitter) copyValues(idx int, n int) (int, error) {
+	if n > len(s.by)-idx {
+		return 0, ErrTruncated
+	}
+
+	var err error
+	for i := 0; i < n; i++ {
+		if idx, err = s.copyValue(idx); err != nil {
+			return 0, err
+		}
+	}
+	return idx, nil
+}
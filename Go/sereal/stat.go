@@ -0,0 +1,150 @@
+package sereal
+
+// DocumentStats sums up what a document holds, see Stat
+type DocumentStats struct {
+	Version        int    // protocol version
+	DocType        string // "raw", "snappy", "snappy_incr", "zlib" or "zstd"
+	HeaderSize     int    // size of the header, suffix included
+	BodySize       int    // size of the uncompressed body
+	CompressedSize int    // size of the body as stored, equal to BodySize for raw documents
+
+	// Tags counts the tags of the body by name, those holding a small
+	// number in the tag byte being counted together, e.g. SHORT_BINARY for
+	// SHORT_BINARY_0 to SHORT_BINARY_31. PAD tags are left out.
+	Tags map[string]int
+
+	Values      int // number of tags of the body, i.e. of values including those nested in others
+	MaxDepth    int // deepest nesting of a value, 0 for a body holding a single scalar
+	Strings     int // number of BINARY, SHORT_BINARY and STR_UTF8 strings
+	StringBytes int // total length of the strings
+
+	Arrays        int // number of arrays, ARRAY and ARRAYREF_N tags
+	ArrayElements int // total number of elements of the arrays
+	MaxArrayLen   int
+	Hashes        int // number of hashes, HASH and HASHREF_N tags
+	HashEntries   int // total number of key/value pairs of the hashes
+	MaxHashLen    int
+}
+
+// CompressionRatio returns the size of the uncompressed body divided by the
+// size of the body as stored, 1 for raw documents
+func (s *DocumentStats) CompressionRatio() float64 {
+	if s.CompressedSize == 0 {
+		return 1
+	}
+	return float64(s.BodySize) / float64(s.CompressedSize)
+}
+
+// Stat walks the body of the document b, decompressing it first, and sums up
+// what it holds without decoding any value. Header user data is only
+// counted in HeaderSize.
+func Stat(b []byte) (DocumentStats, error) {
+	header, err := checkHeader(b)
+	if err != nil {
+		return DocumentStats{}, err
+	}
+
+	bodyStart := headerSize + header.suffixSize
+	if bodyStart > len(b) || bodyStart < 0 {
+		return DocumentStats{}, ErrCorrupt{ErrBadOffset}
+	}
+
+	s := DocumentStats{
+		Version:        int(header.version),
+		DocType:        header.doctype.String(),
+		HeaderSize:     bodyStart,
+		CompressedSize: len(b) - bodyStart,
+		Tags:           make(map[string]int),
+	}
+
+	b, err = DecompressDocument(nil, b)
+	if err != nil {
+		return s, err
+	}
+	s.BodySize = len(b) - bodyStart
+
+	by, idx := b[bodyStart-1:], 1
+	if header.version == 1 {
+		by, idx = b, bodyStart
+	}
+
+	_, err = walkTree(by, idx, 0, func(idx int, tag byte, depth int) error {
+		s.count(by, idx, tag, depth)
+		return nil
+	})
+	return s, err
+}
+
+// count adds the value starting at by[idx], whose tag is tag, to s
+func (s *DocumentStats) count(by []byte, idx int, tag byte, depth int) {
+	s.Tags[tagFamily(tag)]++
+	s.Values++
+	if depth > s.MaxDepth {
+		s.MaxDepth = depth
+	}
+
+	// the lengths are checked by walkTree once the tag has been counted
+	switch {
+	case tag == typeBINARY, tag == typeSTR_UTF8:
+		if ln, _, err := varintdecode(by[idx+1:]); err == nil {
+			s.Strings++
+			s.StringBytes += ln
+		}
+
+	case tag >= typeSHORT_BINARY_0 && tag < typeSHORT_BINARY_0+32:
+		s.Strings++
+		s.StringBytes += int(tag & 0x1f)
+
+	case tag == typeARRAY:
+		if ln, _, err := varintdecode(by[idx+1:]); err == nil {
+			s.array(ln)
+		}
+
+	case tag >= typeARRAYREF_0 && tag < typeARRAYREF_0+16:
+		s.array(int(tag & 0x0f))
+
+	case tag == typeHASH:
+		if ln, _, err := varintdecode(by[idx+1:]); err == nil {
+			s.hash(ln)
+		}
+
+	case tag >= typeHASHREF_0 && tag < typeHASHREF_0+16:
+		s.hash(int(tag & 0x0f))
+	}
+}
+
+func (s *DocumentStats) array(ln int) {
+	s.Arrays++
+	s.ArrayElements += ln
+	if ln > s.MaxArrayLen {
+		s.MaxArrayLen = ln
+	}
+}
+
+func (s *DocumentStats) hash(ln int) {
+	s.Hashes++
+	s.HashEntries += ln
+	if ln > s.MaxHashLen {
+		s.MaxHashLen = ln
+	}
+}
+
+// tagFamily returns the name of tag, without the number held in the tag
+// byte for POS_N, NEG_N, SHORT_BINARY_N, ARRAYREF_N and HASHREF_N
+func tagFamily(tag byte) string {
+	tag &^= trackFlag
+
+	switch {
+	case tag < 0x10:
+		return "POS"
+	case tag < typeVARINT:
+		return "NEG"
+	case tag >= typeSHORT_BINARY_0:
+		return "SHORT_BINARY"
+	case tag >= typeHASHREF_0:
+		return "HASHREF"
+	case tag >= typeARRAYREF_0:
+		return "ARRAYREF"
+	}
+	return tagName(tag)
+}
@@ -0,0 +1,349 @@
+package sereal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// A Framing is the way documents are delimited in a stream
+type Framing int
+
+const (
+	// FramingConcatenated writes documents back to back, as Perl's
+	// Sereal::Decoder reads them with its incremental option. Their end is
+	// found by parsing them; legacy (v1) snappy documents can't be
+	// delimited this way.
+	FramingConcatenated Framing = iota
+
+	// FramingLengthPrefixed precedes each document with its length as a
+	// varint
+	FramingLengthPrefixed
+)
+
+// errNeedMore tells more of the stream must be read to delimit a document
+var errNeedMore = errors.New("sereal: need more data")
+
+// A StreamEncoder writes a sequence of documents to a single io.Writer
+type StreamEncoder struct {
+	Framing Framing
+
+	// ChunkSize, if positive, gathers the documents into writes of exactly
+	// ChunkSize bytes, the bytes left over being held until more documents
+	// complete a chunk or Flush is called. Chunks are handed to ReadFrom if
+	// the writer is an io.ReaderFrom. Otherwise each document is written as
+	// soon as it is encoded, in a single write.
+	ChunkSize int
+
+	w       io.Writer
+	enc     *Encoder
+	buf     []byte
+	pending []byte // bytes of the next chunk
+	err     error  // error of a chunk write, returned from then on
+}
+
+// NewStreamEncoder returns a StreamEncoder writing the documents produced by
+// e to w. A nil e stands for NewEncoderV3().
+func NewStreamEncoder(w io.Writer, e *Encoder) *StreamEncoder {
+	if e == nil {
+		e = NewEncoderV3()
+	}
+	return &StreamEncoder{w: w, enc: e}
+}
+
+// Encode writes the document encoding body
+func (s *StreamEncoder) Encode(body interface{}) error {
+	return s.EncodeWithHeader(nil, body)
+}
+
+// EncodeWithHeader writes the document encoding header and body
+func (s *StreamEncoder) EncodeWithHeader(header interface{}, body interface{}) error {
+	doc, err := s.enc.MarshalWithHeader(header, body)
+	if err != nil {
+		return err
+	}
+	return s.WriteDocument(doc)
+}
+
+// WriteDocument writes the already encoded document doc
+func (s *StreamEncoder) WriteDocument(doc []byte) error {
+	if s.ChunkSize > 0 {
+		if s.Framing == FramingLengthPrefixed {
+			s.buf = varint(s.buf[:0], uint(len(doc)))
+			if err := s.chunk(s.buf); err != nil {
+				return err
+			}
+		}
+		return s.chunk(doc)
+	}
+
+	if err := s.flushPending(); err != nil {
+		return err
+	}
+
+	if s.Framing == FramingLengthPrefixed {
+		s.buf = varint(s.buf[:0], uint(len(doc)))
+		s.buf = append(s.buf, doc...)
+		doc = s.buf
+	}
+
+	_, err := s.w.Write(doc)
+	return err
+}
+
+// Flush writes the bytes held for the next chunk, then flushes the writer if
+// it has a Flush method, as bufio.Writer does
+func (s *StreamEncoder) Flush() error {
+	if err := s.flushPending(); err != nil {
+		return err
+	}
+
+	if f, ok := s.w.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// chunk adds b to the chunks, writing those which are complete. Complete
+// chunks of b are written from b rather than copied.
+func (s *StreamEncoder) chunk(b []byte) error {
+	if s.err != nil {
+		return s.err
+	}
+
+	for len(b) > 0 {
+		if len(s.pending) == 0 && len(b) >= s.ChunkSize {
+			if s.err = s.write(b[:s.ChunkSize]); s.err != nil {
+				return s.err
+			}
+			b = b[s.ChunkSize:]
+			continue
+		}
+
+		n := s.ChunkSize - len(s.pending)
+		if n > len(b) {
+			n = len(b)
+		}
+		s.pending = append(s.pending, b[:n]...)
+		b = b[n:]
+
+		if len(s.pending) == s.ChunkSize {
+			if s.err = s.write(s.pending); s.err != nil {
+				return s.err
+			}
+			s.pending = s.pending[:0]
+		}
+	}
+
+	return nil
+}
+
+// flushPending writes the bytes held for the next chunk
+func (s *StreamEncoder) flushPending() error {
+	if s.err != nil {
+		return s.err
+	}
+	if len(s.pending) == 0 {
+		return nil
+	}
+
+	s.err = s.write(s.pending)
+	s.pending = s.pending[:0]
+	return s.err
+}
+
+// write writes the chunk b
+func (s *StreamEncoder) write(b []byte) error {
+	if rf, ok := s.w.(io.ReaderFrom); ok {
+		_, err := rf.ReadFrom(bytes.NewReader(b))
+		return err
+	}
+
+	_, err := s.w.Write(b)
+	return err
+}
+
+// A StreamDecoder reads a sequence of documents from a single io.Reader
+type StreamDecoder struct {
+	Framing Framing
+
+	// MaxDocumentSize is the size above which documents are rejected rather
+	// than buffered, 0 meaning no limit
+	MaxDocumentSize int
+
+	r     io.Reader
+	dec   *Decoder
+	buf   []byte
+	start int   // offset in buf of the next document
+	err   error // error returned by r
+}
+
+// NewStreamDecoder returns a StreamDecoder reading documents from r and
+// decoding them with d. A nil d stands for NewDecoder().
+func NewStreamDecoder(r io.Reader, d *Decoder) *StreamDecoder {
+	if d == nil {
+		d = NewDecoder()
+	}
+	return &StreamDecoder{r: r, dec: d}
+}
+
+// DecodeNext decodes the body of the next document into body. It returns
+// io.EOF once the stream is over, and io.ErrUnexpectedEOF if it ends in the
+// middle of a document.
+func (s *StreamDecoder) DecodeNext(body interface{}, opts ...UnmarshalOption) error {
+	return s.DecodeNextWithHeader(nil, body, opts...)
+}
+
+// DecodeNextWithHeader decodes the header and the body of the next document
+// into header and body, as DecodeNext does
+func (s *StreamDecoder) DecodeNextWithHeader(header interface{}, body interface{}, opts ...UnmarshalOption) error {
+	doc, err := s.NextDocument()
+	if err != nil {
+		return err
+	}
+	return s.dec.UnmarshalHeaderBody(doc, header, body, opts...)
+}
+
+// NextDocument returns the next document, without decoding it. It is only
+// valid until the next call.
+func (s *StreamDecoder) NextDocument() ([]byte, error) {
+	for {
+		avail := s.buf[s.start:]
+
+		n, skip, err := s.documentLength(avail)
+		if err == nil {
+			s.start += n
+			return avail[skip:n], nil
+		}
+		if err != errNeedMore {
+			return nil, err
+		}
+
+		if s.MaxDocumentSize > 0 && len(avail) > s.MaxDocumentSize+binary.MaxVarintLen64 {
+			return nil, fmt.Errorf("sereal: document larger than %d bytes", s.MaxDocumentSize)
+		}
+
+		if s.err != nil {
+			if s.err == io.EOF && len(avail) > 0 {
+				return nil, io.ErrUnexpectedEOF
+			}
+			return nil, s.err
+		}
+
+		s.fill()
+	}
+}
+
+// fill reads more of the stream, doubling the buffer when it is full
+func (s *StreamDecoder) fill() {
+	if s.start > 0 {
+		n := copy(s.buf, s.buf[s.start:])
+		s.buf = s.buf[:n]
+		s.start = 0
+	}
+
+	if len(s.buf) == cap(s.buf) {
+		size := 2 * cap(s.buf)
+		if size < 4096 {
+			size = 4096
+		}
+		buf := make([]byte, len(s.buf), size)
+		copy(buf, s.buf)
+		s.buf = buf
+	}
+
+	n, err := s.r.Read(s.buf[len(s.buf):cap(s.buf)])
+	s.buf = s.buf[:len(s.buf)+n]
+	if err != nil {
+		s.err = err
+	}
+}
+
+// documentLength returns the number of bytes taken by the first document of
+// b, framing included, and the size of the framing preceding it. It returns
+// errNeedMore if b ends before the document does.
+func (s *StreamDecoder) documentLength(b []byte) (int, int, error) {
+	if len(b) == 0 {
+		return 0, 0, errNeedMore
+	}
+
+	if s.Framing == FramingLengthPrefixed {
+		ln, sz, err := varintdecode(b)
+		if err != nil {
+			return 0, 0, needMore(err)
+		}
+		if ln < 0 || (s.MaxDocumentSize > 0 && ln > s.MaxDocumentSize) {
+			return 0, 0, fmt.Errorf("sereal: bad document length %d", ln)
+		}
+		if sz+ln > len(b) {
+			return 0, 0, errNeedMore
+		}
+		return sz + ln, sz, nil
+	}
+
+	if len(b) <= headerSize {
+		return 0, 0, errNeedMore
+	}
+
+	header, err := checkHeader(b)
+	if err != nil {
+		return 0, 0, needMore(err)
+	}
+
+	bodyStart := headerSize + header.suffixSize
+	if bodyStart >= len(b) {
+		return 0, 0, errNeedMore
+	}
+
+	switch header.doctype {
+	case serealRaw:
+		if header.version == 1 {
+			end, err := skipValue(b, bodyStart)
+			return end, 0, needMore(err)
+		}
+		end, err := skipValue(b[bodyStart-1:], 1)
+		return bodyStart - 1 + end, 0, needMore(err)
+
+	case serealSnappyIncremental, serealZstd:
+		ln, sz, err := varintdecode(b[bodyStart:])
+		if err != nil {
+			return 0, 0, needMore(err)
+		}
+		return s.bodyEnd(b, bodyStart+sz, ln)
+
+	case serealZlib:
+		_, usz, err := varintdecode(b[bodyStart:])
+		if err != nil {
+			return 0, 0, needMore(err)
+		}
+		ln, sz, err := varintdecode(b[bodyStart+usz:])
+		if err != nil {
+			return 0, 0, needMore(err)
+		}
+		return s.bodyEnd(b, bodyStart+usz+sz, ln)
+	}
+
+	return 0, 0, fmt.Errorf("sereal: can't delimit %s documents in a stream", header.doctype)
+}
+
+// bodyEnd checks the compressed body of ln bytes starting at b[idx] is
+// complete
+func (s *StreamDecoder) bodyEnd(b []byte, idx int, ln int) (int, int, error) {
+	if ln < 0 {
+		return 0, 0, ErrCorrupt{ErrBadOffset}
+	}
+	if idx+ln > len(b) {
+		return 0, 0, errNeedMore
+	}
+	return idx + ln, 0, nil
+}
+
+// needMore turns the errors caused by a document cut short into errNeedMore
+func needMore(err error) error {
+	if errors.Is(err, ErrTruncated) || errors.Is(err, ErrBadVarint) {
+		return errNeedMore
+	}
+	return err
+}
@@ -0,0 +1,86 @@
+package sereal
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+)
+
+// A StrictError is returned in Strict mode when a value can't be decoded
+// without loss
+type StrictError struct {
+	Path   string // logical location of the value, e.g. "body.items[7]"
+	Offset int    // offset of the value's tag in its section, or -1 if unknown
+	Reason string
+}
+
+func (e *StrictError) Error() string {
+	s := "sereal: strict: " + e.Reason + " at " + e.Path
+	if e.Offset >= 0 {
+		s += " (offset " + strconv.Itoa(e.Offset) + ")"
+	}
+	return s
+}
+
+func (d *decoder) strictError(offset int, format string, args ...interface{}) error {
+	return &StrictError{Path: d.pathString(), Offset: offset, Reason: fmt.Sprintf(format, args...)}
+}
+
+// setInt stores i into ptr, checking in Strict mode that it fits. unsigned
+// tells i was a VARINT, whose values above math.MaxInt64 wrap around to
+// negative ints.
+func (d *decoder) setInt(ptr reflect.Value, i int, unsigned bool, offset int) error {
+	if d.Strict {
+		switch ptr.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			if (unsigned && i < 0) || ptr.OverflowInt(int64(i)) {
+				return d.strictError(offset, "%s overflows %v", formatInt(i, unsigned), ptr.Type())
+			}
+
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			if !unsigned && i < 0 {
+				return d.strictError(offset, "negative %d into %v", i, ptr.Type())
+			}
+			if ptr.OverflowUint(uint64(i)) {
+				return d.strictError(offset, "%s overflows %v", formatInt(i, unsigned), ptr.Type())
+			}
+		}
+	}
+
+	setInt(ptr, i)
+	return nil
+}
+
+func formatInt(i int, unsigned bool) string {
+	if unsigned {
+		return strconv.FormatUint(uint64(i), 10)
+	}
+	return strconv.Itoa(i)
+}
+
+// setFloat stores f into ptr, checking in Strict mode that ptr is a float
+// able to hold it
+func (d *decoder) setFloat(ptr reflect.Value, f float64, offset int) error {
+	if d.Strict {
+		switch ptr.Kind() {
+		case reflect.Float32, reflect.Float64:
+			if ptr.OverflowFloat(f) {
+				return d.strictError(offset, "%v overflows %v", f, ptr.Type())
+			}
+		default:
+			return d.strictError(offset, "float %v into %v", f, ptr.Type())
+		}
+	}
+
+	ptr.SetFloat(f)
+	return nil
+}
+
+// unknownKey reports in Strict mode the hash keys matching no field of the
+// struct they are decoded into
+func (d *decoder) unknownKey(st reflect.Value, key []byte, offset int) error {
+	if d.Strict {
+		return d.strictError(offset, "no field of %v for key %q", st.Type(), key)
+	}
+	return nil
+}
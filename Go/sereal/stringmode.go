@@ -0,0 +1,62 @@
+package sereal
+
+import (
+	"fmt"
+	"unicode/utf8"
+)
+
+// A StringMode is the way an Encoder writes Go strings, hash keys included.
+// Perl reads STR_UTF8 strings as character strings, with the UTF-8 flag,
+// and BINARY ones as byte strings.
+type StringMode int
+
+const (
+	// StringUTF8 writes all strings as STR_UTF8, or with ValidateUTF8 only
+	// those which are valid UTF-8
+	StringUTF8 StringMode = iota
+
+	// StringBinary writes all strings as BINARY, leaving their decoding to
+	// the consumer
+	StringBinary
+
+	// StringAuto writes ASCII strings and those which aren't valid UTF-8 as
+	// BINARY, and the others as STR_UTF8, as Perl does for strings which
+	// need the UTF-8 flag. It is the mode of ProfilePerl3x.
+	StringAuto
+)
+
+func (m StringMode) String() string {
+	switch m {
+	case StringUTF8:
+		return "utf8"
+	case StringBinary:
+		return "binary"
+	case StringAuto:
+		return "auto"
+	}
+	return fmt.Sprintf("StringMode(%d)", int(m))
+}
+
+// parseStringMode returns the StringMode named s, StringUTF8 if s is empty
+func parseStringMode(s string) (StringMode, error) {
+	for m := StringUTF8; m <= StringAuto; m++ {
+		if s == m.String() {
+			return m, nil
+		}
+	}
+	if s == "" {
+		return StringUTF8, nil
+	}
+	return 0, fmt.Errorf("sereal: unknown string mode %q", s)
+}
+
+// stringIsBinary tells whether e writes s as BINARY rather than STR_UTF8
+func (e *Encoder) stringIsBinary(s string) bool {
+	switch e.StringMode {
+	case StringBinary:
+		return true
+	case StringAuto:
+		return isASCII(s) || !utf8.ValidString(s)
+	}
+	return e.ValidateUTF8 && !utf8.ValidString(s)
+}
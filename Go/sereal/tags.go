@@ -1,7 +1,9 @@
 package sereal
 
 import (
+	"fmt"
 	"reflect"
+	"strconv"
 	"strings"
 )
 
@@ -43,6 +45,17 @@ func (o tagOptions) Contains(optionName string) bool {
 	return false
 }
 
+// unknown returns the first option not listed in knownTagOptions, or the
+// empty string
+func (o tagOptions) unknown() string {
+	for _, opt := range strings.Split(string(o), ",") {
+		if opt != "" && !knownTagOptions[opt] {
+			return opt
+		}
+	}
+	return ""
+}
+
 func isEmptyValue(v reflect.Value) bool {
 	switch v.Kind() {
 	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
@@ -60,3 +73,52 @@ func isEmptyValue(v reflect.Value) bool {
 	}
 	return false
 }
+
+func isNumberKind(k reflect.Kind) bool {
+	switch k {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+// formatNumber returns the number v as a decimal string, for fields tagged
+// ",string"
+func formatNumber(v reflect.Value) string {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return strconv.FormatUint(v.Uint(), 10)
+	}
+	return strconv.FormatFloat(v.Float(), 'g', -1, v.Type().Bits())
+}
+
+// parseNumber stores the number s into v, a field tagged ",string"
+func parseNumber(v reflect.Value, s string) error {
+	var err error
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var i int64
+		if i, err = strconv.ParseInt(s, 10, v.Type().Bits()); err == nil {
+			v.SetInt(i)
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		var u uint64
+		if u, err = strconv.ParseUint(s, 10, v.Type().Bits()); err == nil {
+			v.SetUint(u)
+		}
+	default:
+		var f float64
+		if f, err = strconv.ParseFloat(s, v.Type().Bits()); err == nil {
+			v.SetFloat(f)
+		}
+	}
+
+	if err != nil {
+		return fmt.Errorf("can't decode string %q into %v", s, v.Type())
+	}
+	return nil
+}
@@ -1,14 +1,42 @@
 package sereal
 
-import "reflect"
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+)
 
+// tagsCache holds the fields of the struct types met so far. They only
+// depend on the type, so a single cache, tcache, is shared by all Encoders
+// and Decoders: those made per request don't parse the tags again.
 type tagsCache struct {
-	cmap map[reflect.Type]map[string]tag
+	fields sync.Map // reflect.Type -> structFields
+	plans  sync.Map // reflect.Type -> *structPlan
+}
+
+var tcache tagsCache
+
+// structFields describes how a struct type is encoded
+type structFields struct {
+	tags        map[string]tag
+	classField  int // index of the field tagged ",class", or -1
+	remainField int // index of the field tagged ",remain", or -1
 }
 
 type tag struct {
 	id        int
 	omitEmpty bool
+	asString  bool // the number is encoded as a string, see ",string"
+}
+
+// knownTagOptions lists the options accepted after the name in a "sereal"
+// struct tag
+var knownTagOptions = map[string]bool{
+	"omitempty": true,
+	"class":     true,
+	"remain":    true,
+	"string":    true,
 }
 
 func (tc *tagsCache) Get(ptr reflect.Value) map[string]tag {
@@ -16,34 +44,202 @@ func (tc *tagsCache) Get(ptr reflect.Value) map[string]tag {
 		return nil
 	}
 
-	if tc.cmap == nil {
-		tc.cmap = make(map[reflect.Type]map[string]tag)
+	sf, _ := tc.get(ptr.Type())
+	return sf.tags
+}
+
+// ClassField returns the index of the field of the struct ptr which holds the
+// class name of the object, if any
+func (tc *tagsCache) ClassField(ptr reflect.Value) (int, bool) {
+	if ptr.Kind() != reflect.Struct {
+		return 0, false
+	}
+
+	sf, _ := tc.get(ptr.Type())
+	return sf.classField, sf.classField >= 0
+}
+
+// RemainField returns the index of the map field of the struct ptr which
+// holds the hash entries matching no other field, if any
+func (tc *tagsCache) RemainField(ptr reflect.Value) (int, bool) {
+	if ptr.Kind() != reflect.Struct {
+		return 0, false
 	}
 
-	ptrType := ptr.Type()
-	if m, ok := tc.cmap[ptrType]; ok {
-		return m
+	sf, _ := tc.get(ptr.Type())
+	return sf.remainField, sf.remainField >= 0
+}
+
+// get returns the fields of the struct type ptrType, building them if needed.
+// Problems with the struct tags are reported, but don't prevent the fields
+// from being cached: later fields win over earlier ones with the same name,
+// and unknown options are ignored.
+func (tc *tagsCache) get(ptrType reflect.Type) (structFields, error) {
+	if sf, ok := tc.fields.Load(ptrType); ok {
+		return sf.(structFields), nil
 	}
 
+	sf, err := buildFields(ptrType)
+	tc.fields.Store(ptrType, sf)
+	return sf, err
+}
+
+// structPlan is the way the Encoder writes the fields of a struct type,
+// compiled once from its structFields
+type structPlan struct {
+	fields []fieldPlan // sorted by name, so that output is stable
+}
+
+type fieldPlan struct {
+	name      string
+	index     int
+	omitEmpty bool
+	asString  bool
+
+	// encode appends values of the predeclared types without boxing them
+	// into an interface{}, nil for the others which go through
+	// Encoder.encode
+	encode func(e *Encoder, by []byte, fv reflect.Value, strTable map[string]int) []byte
+}
+
+// plan returns the encoding plan of the struct type typ, building it if
+// needed
+func (tc *tagsCache) plan(typ reflect.Type) *structPlan {
+	if p, ok := tc.plans.Load(typ); ok {
+		return p.(*structPlan)
+	}
+
+	sf, _ := tc.get(typ)
+	p := buildPlan(typ, sf)
+	tc.plans.Store(typ, p)
+	return p
+}
+
+func buildPlan(typ reflect.Type, sf structFields) *structPlan {
+	p := &structPlan{fields: make([]fieldPlan, 0, len(sf.tags))}
+	for name, t := range sf.tags {
+		p.fields = append(p.fields, fieldPlan{
+			name:      name,
+			index:     t.id,
+			omitEmpty: t.omitEmpty,
+			asString:  t.asString,
+			encode:    fieldEncoders[typ.Field(t.id).Type],
+		})
+	}
+	sort.Slice(p.fields, func(i, j int) bool { return p.fields[i].name < p.fields[j].name })
+	return p
+}
+
+// fieldEncoders encode the struct fields of the types Encoder.encode
+// handles without reflection, named types excluded as they may implement
+// Marshaler or another interface
+var fieldEncoders = map[reflect.Type]func(e *Encoder, by []byte, fv reflect.Value, strTable map[string]int) []byte{
+	reflect.TypeOf(""): func(e *Encoder, by []byte, fv reflect.Value, strTable map[string]int) []byte {
+		return e.encodeString(by, fv.String(), false, strTable)
+	},
+	reflect.TypeOf([]byte(nil)): func(e *Encoder, by []byte, fv reflect.Value, strTable map[string]int) []byte {
+		return e.encodeBytes(by, fv.Bytes(), false, strTable)
+	},
+	reflect.TypeOf(false): func(e *Encoder, by []byte, fv reflect.Value, strTable map[string]int) []byte {
+		return e.encodeBool(by, fv.Bool())
+	},
+	reflect.TypeOf(float32(0)): func(e *Encoder, by []byte, fv reflect.Value, strTable map[string]int) []byte {
+		return e.encodeFloat(by, float32(fv.Float()))
+	},
+	reflect.TypeOf(float64(0)): func(e *Encoder, by []byte, fv reflect.Value, strTable map[string]int) []byte {
+		return e.encodeDouble(by, fv.Float())
+	},
+}
+
+func init() {
+	encodeInt := func(e *Encoder, by []byte, fv reflect.Value, strTable map[string]int) []byte {
+		return e.encodeInt(by, fv.Int())
+	}
+	encodeUint := func(e *Encoder, by []byte, fv reflect.Value, strTable map[string]int) []byte {
+		return e.encodeUint(by, fv.Uint())
+	}
+	for _, v := range []interface{}{int(0), int8(0), int16(0), int32(0), int64(0)} {
+		fieldEncoders[reflect.TypeOf(v)] = encodeInt
+	}
+	for _, v := range []interface{}{uint(0), uint8(0), uint16(0), uint32(0), uint64(0)} {
+		fieldEncoders[reflect.TypeOf(v)] = encodeUint
+	}
+}
+
+func buildFields(ptrType reflect.Type) (structFields, error) {
+	var err error
 	m := make(map[string]tag)
+	classField, remainField := -1, -1
 
 	l := ptrType.NumField()
 	for i := 0; i < l; i++ {
-		name, opts := parseTag(ptrType.Field(i).Tag.Get("sereal"))
+		field := ptrType.Field(i)
+		name, opts := parseTag(field.Tag.Get("sereal"))
 		if name == "-" {
 			// sereal tag is "-" -- skip
 			continue
 		}
 
+		if opts.Contains("class") {
+			// holds the class name rather than a hash entry
+			switch {
+			case field.Type.Kind() != reflect.String:
+				if err == nil {
+					err = fmt.Errorf("sereal: %s: class field %s must be a string", ptrType, field.Name)
+				}
+			case classField >= 0:
+				if err == nil {
+					err = fmt.Errorf("sereal: %s: fields %s and %s are both tagged as class", ptrType, ptrType.Field(classField).Name, field.Name)
+				}
+			default:
+				classField = i
+			}
+			continue
+		}
+
+		if opts.Contains("remain") {
+			// holds the hash entries matching no other field
+			switch {
+			case field.Type.Kind() != reflect.Map || field.Type.Key().Kind() != reflect.String:
+				if err == nil {
+					err = fmt.Errorf("sereal: %s: remain field %s must be a map with string keys", ptrType, field.Name)
+				}
+			case remainField >= 0:
+				if err == nil {
+					err = fmt.Errorf("sereal: %s: fields %s and %s are both tagged as remain", ptrType, ptrType.Field(remainField).Name, field.Name)
+				}
+			default:
+				remainField = i
+			}
+			continue
+		}
+
 		if name == "" {
 			// no tag? make one from the field name
-			if pkgpath := ptrType.Field(i).PkgPath; pkgpath != "" {
+			if pkgpath := field.PkgPath; pkgpath != "" {
 				// field not exported -- skip
 				continue
 			}
-			name = ptrType.Field(i).Name
+			name = field.Name
+		}
+
+		if err == nil {
+			if prev, ok := m[name]; ok {
+				err = fmt.Errorf("sereal: %s: fields %s and %s are both named %q", ptrType, ptrType.Field(prev.id).Name, field.Name, name)
+			} else if opt := opts.unknown(); opt != "" {
+				err = fmt.Errorf("sereal: %s: unknown option %q in tag of field %s", ptrType, opt, field.Name)
+			}
 		}
-		m[name] = tag{i, opts.Contains("omitempty")}
+
+		asString := opts.Contains("string")
+		if asString && !isNumberKind(field.Type.Kind()) {
+			if err == nil {
+				err = fmt.Errorf("sereal: %s: string field %s must be a number", ptrType, field.Name)
+			}
+			asString = false
+		}
+
+		m[name] = tag{i, opts.Contains("omitempty"), asString}
 	}
 
 	// empty map -- may as well store a nil
@@ -51,6 +247,63 @@ func (tc *tagsCache) Get(ptr reflect.Value) map[string]tag {
 		m = nil
 	}
 
-	tc.cmap[ptrType] = m
-	return m
+	return structFields{m, classField, remainField}, err
+}
+
+// precompile builds the fields of the struct types reachable from typ, and
+// returns the first problem found with their tags
+func (tc *tagsCache) precompile(typ reflect.Type, seen map[reflect.Type]bool) error {
+	if seen[typ] {
+		return nil
+	}
+	seen[typ] = true
+
+	switch typ.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Array:
+		return tc.precompile(typ.Elem(), seen)
+
+	case reflect.Map:
+		if err := tc.precompile(typ.Key(), seen); err != nil {
+			return err
+		}
+		return tc.precompile(typ.Elem(), seen)
+
+	case reflect.Struct:
+		// built again, so that errors are reported every time
+		sf, err := buildFields(typ)
+		tc.fields.Store(typ, sf)
+		tc.plans.Store(typ, buildPlan(typ, sf))
+		if err != nil {
+			return err
+		}
+
+		for i := 0; i < typ.NumField(); i++ {
+			if err := tc.precompile(typ.Field(i).Type, seen); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// precompileTypes precompiles the types of the given instances
+func (tc *tagsCache) precompileTypes(types []interface{}) error {
+	seen := make(map[reflect.Type]bool)
+	for _, t := range types {
+		typ, ok := t.(reflect.Type)
+		if !ok {
+			typ = reflect.TypeOf(t)
+		}
+
+		if typ == nil {
+			continue
+		}
+
+		if err := tc.precompile(typ, seen); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
@@ -0,0 +1,253 @@
+// Package testcorpus checks a Decoder and an Encoder against a corpus of
+// reference Sereal documents, such as the test_dir corpus written by the
+// Perl test suite or documents saved from production. Each document is
+// decoded, encoded again and compared with the reference, either as the same
+// data, see sereal.Diff, or byte for byte.
+//
+// It also generates test vectors from Go values, in every protocol version
+// and compression, see Generate, and checks that a decoder gives the values
+// back, see Verify.
+//
+// Downstream projects typically run it from a test:
+//
+//	func TestCorpus(t *testing.T) {
+//		testcorpus.Test(t, os.DirFS("testdata/corpus"), testcorpus.Options{})
+//	}
+package testcorpus
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/Weborama/Sereal/Go/sereal"
+)
+
+// PerlPattern matches the names of the documents of the corpus written by
+// Sereal::TestSet::write_test_files
+const PerlPattern = "test_data_?????"
+
+// Options configures Check and Test
+type Options struct {
+	// Pattern selects the documents by their base name, with the syntax
+	// of path.Match. The default is every regular file.
+	Pattern string
+
+	// Decoder and Encoder are used for the round trip. The default ones
+	// are in PerlCompat mode, so that documents written by Perl decode to
+	// values which encode back to the same data.
+	Decoder *sereal.Decoder
+	Encoder *sereal.Encoder
+
+	// Exact requires the encoded documents to be the same bytes as the
+	// references, rather than the same data. It is ignored when Golden is
+	// set.
+	Exact bool
+
+	// Golden, if set, is the suffix of the files holding the bytes the
+	// encoded documents must be, e.g. "-go.out". Documents without such a
+	// file are only checked for the same data.
+	Golden string
+}
+
+// Stages of the check of a document at which it may fail
+const (
+	StageRead   = "read"   // reading the reference
+	StageDecode = "decode" // decoding the reference
+	StageEncode = "encode" // encoding the decoded value
+	StageData   = "data"   // the encoded document holds other data
+	StageBytes  = "bytes"  // the encoded document has other bytes
+	StageValue  = "value"  // the decoded test vector is another value, see Verify
+)
+
+// A Failure is a document of the corpus which failed its check
+type Failure struct {
+	Name  string // path of the document within the corpus
+	Stage string // see the Stage constants
+	Err   error
+
+	// Diff holds the differences found at StageData
+	Diff []sereal.DiffEntry
+}
+
+func (f Failure) Error() string {
+	return fmt.Sprintf("%s: %s: %v", f.Name, f.Stage, f.Err)
+}
+
+// A Report is the outcome of checking a corpus
+type Report struct {
+	Documents int // documents checked
+	Failures  []Failure
+}
+
+// OK reports whether every document passed its check
+func (r *Report) OK() bool {
+	return len(r.Failures) == 0
+}
+
+// String sums up the report, one line per failure
+func (r *Report) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%d documents, %d failed\n", r.Documents, len(r.Failures))
+	for _, f := range r.Failures {
+		fmt.Fprintln(&sb, f.Error())
+		for _, e := range f.Diff {
+			fmt.Fprintf(&sb, "\t%v\n", e)
+		}
+	}
+	return sb.String()
+}
+
+// Documents returns the paths of the documents of fsys opts selects, in
+// lexical order
+func Documents(fsys fs.FS, opts Options) ([]string, error) {
+	pattern := opts.Pattern
+	if pattern == "" {
+		pattern = "*"
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("testcorpus: pattern %q: %v", pattern, err)
+	}
+
+	var names []string
+	err := fs.WalkDir(fsys, ".", func(name string, de fs.DirEntry, err error) error {
+		if err != nil || !de.Type().IsRegular() {
+			return err
+		}
+		if opts.Golden != "" && strings.HasSuffix(name, opts.Golden) {
+			return nil
+		}
+		if ok, _ := path.Match(pattern, de.Name()); ok {
+			names = append(names, name)
+		}
+		return nil
+	})
+	return names, err
+}
+
+// Check checks every document of fsys opts selects. The error is about the
+// corpus itself, failures of documents are in the report.
+func Check(fsys fs.FS, opts Options) (*Report, error) {
+	names, err := Documents(fsys, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	c := newChecker(fsys, opts)
+	r := &Report{}
+	for _, name := range names {
+		r.Documents++
+		if f := c.check(name); f != nil {
+			r.Failures = append(r.Failures, *f)
+		}
+	}
+	return r, nil
+}
+
+// Test checks every document of fsys opts selects in a subtest of t named
+// after it, failing the subtests of the documents which fail their check
+func Test(t *testing.T, fsys fs.FS, opts Options) {
+	t.Helper()
+
+	names, err := Documents(fsys, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) == 0 {
+		t.Skip("testcorpus: no documents")
+	}
+
+	c := newChecker(fsys, opts)
+	for _, name := range names {
+		name := name
+		t.Run(name, func(t *testing.T) {
+			if f := c.check(name); f != nil {
+				t.Errorf("%s: %v", f.Stage, f.Err)
+				for _, e := range f.Diff {
+					t.Log(e)
+				}
+			}
+		})
+	}
+}
+
+type checker struct {
+	fsys fs.FS
+	opts Options
+	dec  *sereal.Decoder
+	enc  *sereal.Encoder
+}
+
+func newChecker(fsys fs.FS, opts Options) *checker {
+	c := &checker{fsys: fsys, opts: opts, dec: opts.Decoder, enc: opts.Encoder}
+	if c.dec == nil {
+		c.dec = &sereal.Decoder{PerlCompat: true}
+	}
+	if c.enc == nil {
+		c.enc = &sereal.Encoder{PerlCompat: true}
+	}
+	return c
+}
+
+// check checks the document name, returning nil if it passes
+func (c *checker) check(name string) *Failure {
+	fail := func(stage string, err error) *Failure {
+		return &Failure{Name: name, Stage: stage, Err: err}
+	}
+
+	ref, err := fs.ReadFile(c.fsys, name)
+	if err != nil {
+		return fail(StageRead, err)
+	}
+
+	var header, body interface{}
+	if err := c.dec.UnmarshalHeaderBody(ref, &header, &body); err != nil {
+		return fail(StageDecode, err)
+	}
+
+	b, err := c.enc.MarshalWithHeader(header, body)
+	if err != nil {
+		return fail(StageEncode, err)
+	}
+
+	diff, err := sereal.Diff(ref, b)
+	if err != nil {
+		return fail(StageData, err)
+	}
+	if len(diff) > 0 {
+		f := fail(StageData, fmt.Errorf("%d differences", len(diff)))
+		f.Diff = diff
+		return f
+	}
+
+	want := ref
+	if c.opts.Golden != "" {
+		golden, err := fs.ReadFile(c.fsys, name+c.opts.Golden)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			return nil
+		case err != nil:
+			return fail(StageRead, err)
+		}
+		want = golden
+	} else if !c.opts.Exact {
+		return nil
+	}
+
+	if !bytes.Equal(b, want) {
+		return fail(StageBytes, fmt.Errorf("%d bytes, want %d, first difference at offset %d", len(b), len(want), firstDifference(b, want)))
+	}
+	return nil
+}
+
+func firstDifference(a, b []byte) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
@@ -0,0 +1,127 @@
+package testcorpus
+
+import (
+	"io/fs"
+	"os"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/Weborama/Sereal/Go/sereal"
+)
+
+func TestCheck(t *testing.T) {
+	enc := sereal.NewEncoderV3()
+	doc := func(v interface{}) *fstest.MapFile {
+		b, err := enc.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &fstest.MapFile{Data: b}
+	}
+
+	fsys := fstest.MapFS{
+		"test_data_00001":        doc("hello"),
+		"test_data_00002":        doc(map[string]interface{}{"a": []interface{}{1, "b"}}),
+		"test_data_00002-go.out": doc("not the same"),
+		"sub/test_data_00003":    {Data: []byte("not sereal")},
+		"README":                 {Data: []byte("not a document")},
+	}
+
+	opts := Options{Pattern: PerlPattern, Encoder: enc}
+	r, err := Check(fsys, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Documents != 3 || len(r.Failures) != 1 || r.Failures[0].Name != "sub/test_data_00003" || r.Failures[0].Stage != StageDecode {
+		t.Errorf("got %v", r)
+	}
+
+	opts.Golden = "-go.out"
+	r, err = Check(fsys, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Documents != 3 || len(r.Failures) != 2 || r.Failures[0].Name != "sub/test_data_00003" || r.Failures[1].Stage != StageBytes {
+		t.Errorf("golden: got %v", r)
+	}
+
+	// the default PerlCompat encoder writes references the non PerlCompat
+	// one didn't
+	r, err = Check(fsys, Options{Pattern: "test_data_0000[12]", Exact: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Documents != 2 || len(r.Failures) != 1 || r.Failures[0].Name != "test_data_00002" || r.Failures[0].Stage != StageBytes {
+		t.Errorf("exact: got %v", r)
+	}
+
+	if _, err := Check(fsys, Options{Pattern: "["}); err == nil {
+		t.Error("no error for a bad pattern")
+	}
+}
+
+func TestTest(t *testing.T) {
+	b, err := sereal.NewEncoderV3().Marshal([]interface{}{"a", 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	Test(t, fstest.MapFS{"doc.srl": {Data: b}}, Options{Encoder: sereal.NewEncoderV3()})
+}
+
+func TestGenerateVerify(t *testing.T) {
+	type point struct{ X, Y int }
+	vectors := []Vector{
+		{"undef", nil},
+		{"string", "hello"},
+		{"int", -42},
+		{"float", 1.5},
+		{"bytes", []byte{0, 1, 2}},
+		{"array", []interface{}{1, "two", []byte("three")}},
+		{"map", map[string]string{"a": "x", "b": "y"}},
+		{"struct", point{1, 2}},
+		{"long", strings.Repeat("compressible ", 100)},
+	}
+
+	dir := t.TempDir()
+	if err := Generate(dir, vectors, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	names := make(map[string]bool)
+	for _, v := range Variants() {
+		names[v.Name] = true
+	}
+	zstd := false
+	for _, c := range sereal.Capabilities().Compressions {
+		zstd = zstd || c == "zstd"
+	}
+	if !names["v1-snappy"] || !names["v4-zlib"] || names["v2-snappy"] || names["v4-zstd"] != zstd {
+		t.Errorf("unexpected variants %v", names)
+	}
+
+	fsys := os.DirFS(dir)
+	r := Verify(fsys, &sereal.Decoder{}, vectors, nil)
+	if r.Documents != len(vectors)*len(Variants()) || !r.OK() {
+		t.Errorf("got %v", r)
+	}
+
+	// the compressed variants are compressed
+	plain, err := fs.ReadFile(fsys, "v3/long")
+	if err != nil {
+		t.Fatal(err)
+	}
+	zlib, err := fs.ReadFile(fsys, "v3-zlib/long")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zlib) >= len(plain) {
+		t.Errorf("zlib variant is %d bytes, %d uncompressed", len(zlib), len(plain))
+	}
+
+	vectors[1].Value = "bye"
+	r = Verify(fsys, &sereal.Decoder{}, vectors, []Variant{{Name: "v2"}, {Name: "v5"}})
+	if len(r.Failures) != 1+len(vectors) || r.Failures[0].Stage != StageValue || r.Failures[1].Stage != StageRead {
+		t.Errorf("got %v", r)
+	}
+}
@@ -0,0 +1,140 @@
+package testcorpus
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+
+	"github.com/Weborama/Sereal/Go/sereal"
+)
+
+// A Vector is a value test vectors are generated from, and which decoding
+// them must give back
+type Vector struct {
+	Name  string
+	Value interface{}
+}
+
+// A Variant is an encoding test vectors are written in
+type Variant struct {
+	Name    string
+	Options sereal.EncoderOptions
+}
+
+// Variants returns every protocol version with no compression and with each
+// compression valid for it, named after both, e.g. "v1", "v1-snappy" or
+// "v4-zstd". zstd is only included when the sereal package is built with it,
+// see sereal.Capabilities.
+func Variants() []Variant {
+	zstd := false
+	for _, c := range sereal.Capabilities().Compressions {
+		zstd = zstd || c == "zstd"
+	}
+
+	var vs []Variant
+	for version := 1; version <= sereal.MaxSupportedVersion; version++ {
+		compressions := []string{"", "snappy_incr"}
+		if version == 1 {
+			compressions = append(compressions, "snappy")
+		}
+		if version >= 3 {
+			compressions = append(compressions, "zlib")
+		}
+		if version >= 4 && zstd {
+			compressions = append(compressions, "zstd")
+		}
+
+		for _, c := range compressions {
+			name := fmt.Sprintf("v%d", version)
+			if c != "" {
+				name += "-" + c
+			}
+
+			// compress even the smallest documents
+			threshold := 0
+			vs = append(vs, Variant{name, sereal.EncoderOptions{
+				Version:              sereal.OptionsVersion,
+				ProtocolVersion:      version,
+				Compression:          c,
+				CompressionThreshold: &threshold,
+			}})
+		}
+	}
+	return vs
+}
+
+// Generate writes each vector in each variant, Variants() if nil, to the file
+// dir/<variant>/<vector>, creating the directories as needed
+func Generate(dir string, vectors []Vector, variants []Variant) error {
+	if variants == nil {
+		variants = Variants()
+	}
+
+	for _, v := range variants {
+		enc, err := v.Options.NewEncoder()
+		if err != nil {
+			return fmt.Errorf("testcorpus: variant %s: %v", v.Name, err)
+		}
+
+		vdir := filepath.Join(dir, v.Name)
+		if err := os.MkdirAll(vdir, 0755); err != nil {
+			return err
+		}
+
+		for _, vec := range vectors {
+			b, err := enc.Marshal(vec.Value)
+			if err != nil {
+				return fmt.Errorf("testcorpus: encoding %s as %s: %v", vec.Name, v.Name, err)
+			}
+			if err := os.WriteFile(filepath.Join(vdir, vec.Name), b, 0644); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Verify decodes the test vectors of fsys written by Generate with d into new
+// values of the types of the vectors, and checks that they equal them, as
+// reflect.DeepEqual does. Documents missing from fsys fail at StageRead.
+func Verify(fsys fs.FS, d *sereal.Decoder, vectors []Vector, variants []Variant) *Report {
+	if variants == nil {
+		variants = Variants()
+	}
+
+	r := &Report{}
+	for _, v := range variants {
+		for _, vec := range vectors {
+			r.Documents++
+			name := path.Join(v.Name, vec.Name)
+			if f := verify(fsys, d, name, vec.Value); f != nil {
+				r.Failures = append(r.Failures, *f)
+			}
+		}
+	}
+	return r
+}
+
+func verify(fsys fs.FS, d *sereal.Decoder, name string, want interface{}) *Failure {
+	b, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return &Failure{Name: name, Stage: StageRead, Err: err}
+	}
+
+	typ := reflect.TypeOf(&want).Elem()
+	if want != nil {
+		typ = reflect.TypeOf(want)
+	}
+
+	got := reflect.New(typ)
+	if err := d.Unmarshal(b, got.Interface()); err != nil {
+		return &Failure{Name: name, Stage: StageDecode, Err: err}
+	}
+	if !reflect.DeepEqual(got.Elem().Interface(), want) {
+		return &Failure{Name: name, Stage: StageValue, Err: fmt.Errorf("got %#v, want %#v", got.Elem().Interface(), want)}
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package sereal
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"time"
+)
+
+// A TimeFormat is the way an Encoder writes time.Time values. Decoders read
+// all of them back into time.Time values.
+type TimeFormat int
+
+const (
+	// TimeFREEZE writes the FREEZE of MarshalBinary, which only Go can thaw
+	TimeFREEZE TimeFormat = iota
+
+	// TimeEpoch writes the seconds since the Unix epoch as a double, as
+	// Perl's Time::HiRes::time returns them. Their precision is about a
+	// microsecond, and the location is lost.
+	TimeEpoch
+
+	// TimeRFC3339 writes a string in the format of time.RFC3339Nano
+	TimeRFC3339
+)
+
+func (f TimeFormat) String() string {
+	switch f {
+	case TimeFREEZE:
+		return "freeze"
+	case TimeEpoch:
+		return "epoch"
+	case TimeRFC3339:
+		return "rfc3339"
+	}
+	return fmt.Sprintf("TimeFormat(%d)", int(f))
+}
+
+// parseTimeFormat returns the TimeFormat named s, TimeFREEZE if s is empty
+func parseTimeFormat(s string) (TimeFormat, error) {
+	for f := TimeFREEZE; f <= TimeRFC3339; f++ {
+		if s == f.String() {
+			return f, nil
+		}
+	}
+	if s == "" {
+		return TimeFREEZE, nil
+	}
+	return 0, fmt.Errorf("sereal: unknown time format %q", s)
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// encodeTime appends t in the TimeFormat of e, which isn't TimeFREEZE
+func (e *Encoder) encodeTime(by []byte, t time.Time, strTable map[string]int) ([]byte, error) {
+	switch e.TimeFormat {
+	case TimeEpoch:
+		return e.encodeDouble(by, float64(t.UnixNano())/1e9), nil
+	case TimeRFC3339:
+		return e.encodeString(by, t.Format(time.RFC3339Nano), false, strTable), nil
+	}
+	return nil, fmt.Errorf("sereal: unknown time format %v", e.TimeFormat)
+}
+
+// isTimeTag tells whether tag is one of a time.Time written with TimeEpoch or
+// TimeRFC3339
+func isTimeTag(tag byte) bool {
+	return tag <= typeDOUBLE || isStringishTag(tag)
+}
+
+// decodeTime decodes into the time.Time ptr seconds since the Unix epoch or
+// an RFC 3339 string. The value starts at by[idx], its tag being tag.
+func (d *decoder) decodeTime(by []byte, idx int, tag byte, ptr reflect.Value) (int, error) {
+	if isStringishTag(tag) {
+		s, next, err := d.decodeStringish(by, idx)
+		if err != nil {
+			return 0, err
+		}
+		t, err := time.Parse(time.RFC3339Nano, string(s))
+		if err != nil {
+			return 0, fmt.Errorf("sereal: %v", err)
+		}
+		ptr.Set(reflect.ValueOf(t))
+		return next, nil
+	}
+
+	idx++
+
+	var sec float64
+	var err error
+	switch {
+	case tag < typeVARINT:
+		sec = float64(d.decodeInt(tag))
+	case tag == typeVARINT:
+		var i int
+		i, idx, err = d.decodeVarint(by, idx)
+		sec = float64(uint(i))
+	case tag == typeZIGZAG:
+		var i int
+		i, idx, err = d.decodeZigzag(by, idx)
+		sec = float64(i)
+	case tag == typeFLOAT:
+		var f float32
+		f, idx, err = d.decodeFloat(by, idx)
+		sec = float64(f)
+	case tag == typeDOUBLE:
+		sec, idx, err = d.decodeDouble(by, idx)
+	default:
+		return 0, fmt.Errorf("sereal: can't decode tag 0x%x into time.Time", tag)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	ptr.Set(reflect.ValueOf(epochTime(sec)))
+	return idx, nil
+}
+
+// convertTime converts seconds since the Unix epoch or an RFC 3339 string
+// into the time.Time ptr. It reports whether v is one of them.
+func convertTime(v interface{}, ptr reflect.Value) (bool, error) {
+	var sec float64
+	switch v := v.(type) {
+	case string, []byte:
+		t, err := time.Parse(time.RFC3339Nano, fmt.Sprintf("%s", v))
+		if err != nil {
+			return true, err
+		}
+		ptr.Set(reflect.ValueOf(t))
+		return true, nil
+	case int:
+		sec = float64(v)
+	case uint:
+		sec = float64(v)
+	case float32:
+		sec = float64(v)
+	case float64:
+		sec = v
+	default:
+		return false, nil
+	}
+
+	ptr.Set(reflect.ValueOf(epochTime(sec)))
+	return true, nil
+}
+
+// epochTime returns the time sec seconds after the Unix epoch, rounded to the
+// microsecond as doubles hold no more for current dates
+func epochTime(sec float64) time.Time {
+	whole, frac := math.Modf(sec)
+	return time.Unix(int64(whole), int64(math.Round(frac*1e6))*1e3)
+}
@@ -0,0 +1,150 @@
+package sereal
+
+import (
+	"reflect"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// fieldForKey returns the field of tags, those of typ, the hash key is
+// decoded into: the field of that name, or else the one matched by
+// KeyMatcher if set, or else the one named after the key with its first
+// letter upper-cased, or title-cased under DeprecatedTitleMatch
+func (d *Decoder) fieldForKey(typ reflect.Type, tags map[string]tag, key string) (tag, bool) {
+	if fld, ok := tags[key]; ok {
+		return fld, true
+	}
+
+	if d.KeyMatcher != nil {
+		fld, ok := d.foldedTags(typ, tags)[d.KeyMatcher(key)]
+		return fld, ok
+	}
+
+	if d.DeprecatedTitleMatch == nil {
+		fld, ok := tags[FieldNameForKey(key)]
+		return fld, ok
+	}
+
+	if *d.DeprecatedTitleMatch {
+		fld, ok := tags[strings.Title(key)]
+		return fld, ok
+	}
+
+	fld, ok := tags[upperFirst(key)]
+	return fld, ok
+}
+
+// FieldNameForKey returns the name of the struct field a Decoder with
+// neither KeyMatcher nor DeprecatedTitleMatch set decodes the hash key into
+// when no field is named after the key itself: for now the key passed
+// through strings.Title. Code generated by sereal-gen matches keys with it.
+func FieldNameForKey(key string) string {
+	return strings.Title(key)
+}
+
+// upperFirst returns s with its first letter upper-cased
+func upperFirst(s string) string {
+	r, sz := utf8.DecodeRuneInString(s)
+	if r == utf8.RuneError || unicode.IsUpper(r) {
+		return s
+	}
+	return string(unicode.ToUpper(r)) + s[sz:]
+}
+
+// A TitleMatchChange is a struct field which some hash keys are only
+// decoded into under Decoder.DeprecatedTitleMatch
+type TitleMatchChange struct {
+	Type  reflect.Type // struct type
+	Field string       // name of the Go field
+	Name  string       // name of the field in documents
+	Key   string       // a hash key which stops matching the field
+}
+
+// CheckTitleMatch reports the fields of the struct types of the given
+// instances, and of the struct types they contain, which some hash keys
+// stop matching once Decoder.DeprecatedTitleMatch is off. Instances may also
+// be given as a reflect.Type.
+func CheckTitleMatch(types ...interface{}) []TitleMatchChange {
+	var changes []TitleMatchChange
+	seen := make(map[reflect.Type]bool)
+
+	var check func(typ reflect.Type)
+	check = func(typ reflect.Type) {
+		if seen[typ] {
+			return
+		}
+		seen[typ] = true
+
+		switch typ.Kind() {
+		case reflect.Ptr, reflect.Slice, reflect.Array:
+			check(typ.Elem())
+
+		case reflect.Map:
+			check(typ.Key())
+			check(typ.Elem())
+
+		case reflect.Struct:
+			sf, _ := buildFields(typ)
+			for name, fld := range sf.tags {
+				if key, ok := titleOnlyKey(name); ok {
+					changes = append(changes, TitleMatchChange{typ, typ.Field(fld.id).Name, name, key})
+				}
+			}
+
+			for i := 0; i < typ.NumField(); i++ {
+				check(typ.Field(i).Type)
+			}
+		}
+	}
+
+	for _, t := range types {
+		typ, ok := t.(reflect.Type)
+		if !ok {
+			typ = reflect.TypeOf(t)
+		}
+
+		if typ != nil {
+			check(typ)
+		}
+	}
+
+	return changes
+}
+
+// titleOnlyKey returns a key which strings.Title turns into name but which
+// doesn't match it with only its first letter upper-cased, if there is one
+func titleOnlyKey(name string) (string, bool) {
+	// lower-case the letters strings.Title may have changed, i.e. those
+	// starting a word
+	prev := ' '
+	key := strings.Map(func(r rune) rune {
+		startsWord := isTitleSeparator(prev)
+		prev = r
+		if startsWord {
+			return unicode.ToLower(r)
+		}
+		return r
+	}, name)
+
+	if key == name || strings.Title(key) != name || upperFirst(key) == name {
+		return "", false
+	}
+	return key, true
+}
+
+// isTitleSeparator reports whether r separates words for strings.Title
+func isTitleSeparator(r rune) bool {
+	if r <= 0x7F {
+		switch {
+		case '0' <= r && r <= '9', 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', r == '_':
+			return false
+		}
+		return true
+	}
+
+	if unicode.IsLetter(r) || unicode.IsDigit(r) {
+		return false
+	}
+	return unicode.IsSpace(r)
+}
@@ -0,0 +1,605 @@
+package sereal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"unicode/utf8"
+)
+
+// A Format is a serialization format Sereal documents can be transcoded to
+type Format int
+
+// Formats supported by Transcode
+const (
+	FormatJSON    Format = iota // JSON, as written by ToJSON
+	FormatCBOR                  // CBOR (RFC 8949)
+	FormatMsgPack               // MessagePack
+)
+
+func (f Format) String() string {
+	switch f {
+	case FormatJSON:
+		return "JSON"
+	case FormatCBOR:
+		return "CBOR"
+	case FormatMsgPack:
+		return "MessagePack"
+	}
+	return fmt.Sprintf("Format(%d)", int(f))
+}
+
+var (
+	errTranscodeCycle    = errors.New("sereal: cyclic reference can't be transcoded")
+	errTranscodeTooLarge = errors.New("sereal: shared values expand to too much output to be transcoded")
+)
+
+// maxTranscodeRatio bounds the output of Transcode relative to the size of
+// the uncompressed document, so that a few bytes of nested REFP, ALIAS or
+// COPY tags can't be expanded to gigabytes. minTranscodeLimit keeps small
+// documents sharing a large value working.
+const (
+	maxTranscodeRatio = 256
+	minTranscodeLimit = 1 << 20
+)
+
+// Transcode appends the body of the Sereal document src, converted to the
+// given format, to dst. The conversion is done tag by tag, without decoding
+// src into Go values first.
+//
+// Values shared through REFP, ALIAS and COPY tags are written again where
+// they are referred to; cyclic references are an error, and so is output
+// growing past 256 times the size of the uncompressed document, or 1MB if
+// that is more, as shared values are written again. Objects are written as
+// their data, without their class, and regular expressions as their
+// pattern. For CBOR and MessagePack, STR_UTF8 tags become text strings and
+// binary strings become byte strings; integer hash keys are kept.
+func Transcode(dst, src []byte, format Format) ([]byte, error) {
+	var sink transcodeSink
+	switch format {
+	case FormatJSON:
+		sink = &jsonSink{buf: dst}
+	case FormatCBOR:
+		sink = &cborSink{buf: dst}
+	case FormatMsgPack:
+		sink = &msgpackSink{buf: dst}
+	default:
+		return nil, fmt.Errorf("sereal: unknown format %v", format)
+	}
+
+	b, err := DecompressDocument(nil, src)
+	if err != nil {
+		return nil, err
+	}
+
+	header, _ := readHeader(b)
+	bodyStart := headerSize + header.suffixSize
+
+	limit := maxTranscodeRatio * len(b)
+	if limit < minTranscodeLimit {
+		limit = minTranscodeLimit
+	}
+
+	t := tagTranscoder{sink: sink, active: make(map[int]bool), limit: len(dst) + limit}
+	if header.version == 1 {
+		// v1 offsets are relative to the start of the document
+		t.by, t.sectionStart = b, bodyStart
+		_, err = t.value(bodyStart)
+	} else {
+		t.by, t.sectionStart = b[bodyStart-1:], 1
+		_, err = t.value(1)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return sink.bytes(), nil
+}
+
+// A transcodeSink writes the values found by a tagTranscoder in some format
+type transcodeSink interface {
+	null()
+	bool(b bool)
+	int(n int64)
+	uint(n uint64)
+	float(f float64, bits int) error
+	string(s []byte, isUTF8 bool)
+	beginArray(n int)
+	beginMap(n int)
+	elem(i int, isMap bool) // before each array element or hash key
+	key()                   // between a hash key and its value
+	end(isMap bool)
+	stringKeys() bool // whether integer hash keys must be written as strings
+	bytes() []byte
+}
+
+// tagTranscoder walks the tags of a document section, handing its values to
+// a sink
+type tagTranscoder struct {
+	sink         transcodeSink
+	by           []byte
+	sectionStart int
+	active       map[int]bool // offsets of the REFP and ALIAS targets being written
+	limit        int          // length of the sink's output shared values can't expand past
+}
+
+// expanded checks the output hasn't grown past the limit after a shared
+// value was written again
+func (t *tagTranscoder) expanded() error {
+	if len(t.sink.bytes()) > t.limit {
+		return errTranscodeTooLarge
+	}
+	return nil
+}
+
+// target reads the offset operand of the tag at by[idx-1]
+func (t *tagTranscoder) target(idx int) (offs int, next int, err error) {
+	offs, sz, err := varintdecode(t.by[idx:])
+	if err != nil {
+		return 0, 0, err
+	}
+	if offs < t.sectionStart || offs >= idx {
+		return 0, 0, ErrCorrupt{ErrBadOffset}
+	}
+	return offs, idx + sz, nil
+}
+
+// value writes the value starting at by[idx] and returns the offset of the
+// first byte after it
+func (t *tagTranscoder) value(idx int) (int, error) {
+	by := t.by
+	if idx < 0 || idx >= len(by) {
+		return 0, ErrTruncated
+	}
+
+	tag := by[idx] &^ trackFlag
+	for tag == typePAD {
+		idx++
+		if idx >= len(by) {
+			return 0, ErrTruncated
+		}
+		tag = by[idx] &^ trackFlag
+	}
+
+	start := idx
+	idx++
+
+	switch {
+	case tag < typeVARINT:
+		n := int64(tag)
+		if tag&0x10 == 0x10 {
+			n -= 32 // negative number
+		}
+		t.sink.int(n)
+
+	case tag == typeVARINT, tag == typeZIGZAG:
+		n, sz, err := varintdecode(by[idx:])
+		if err != nil {
+			return 0, err
+		}
+		idx += sz
+		if tag == typeZIGZAG {
+			t.sink.int(int64(uint(n)>>1) ^ -int64(n&1))
+		} else {
+			t.sink.uint(uint64(uint(n)))
+		}
+
+	case tag == typeFLOAT:
+		if idx+4 > len(by) {
+			return 0, ErrTruncated
+		}
+		f := math.Float32frombits(binary.LittleEndian.Uint32(by[idx:]))
+		if err := t.sink.float(float64(f), 32); err != nil {
+			return 0, err
+		}
+		idx += 4
+
+	case tag == typeDOUBLE:
+		if idx+8 > len(by) {
+			return 0, ErrTruncated
+		}
+		f := math.Float64frombits(binary.LittleEndian.Uint64(by[idx:]))
+		if err := t.sink.float(f, 64); err != nil {
+			return 0, err
+		}
+		idx += 8
+
+	case tag == typeLONG_DOUBLE:
+		f, next, err := (*decoder)(nil).decodeLongDouble(by, idx)
+		if err != nil {
+			return 0, err
+		}
+		if err := t.sink.float(f, 64); err != nil {
+			return 0, err
+		}
+		idx = next
+
+	case tag == typeUNDEF, tag == typeCANONICAL_UNDEF:
+		t.sink.null()
+
+	case tag == typeTRUE:
+		t.sink.bool(true)
+
+	case tag == typeFALSE:
+		t.sink.bool(false)
+
+	case tag == typeBINARY, tag == typeSTR_UTF8, tag >= typeSHORT_BINARY_0 && tag < typeSHORT_BINARY_0+32, tag == typeCOPY:
+		s, isUTF8, next, err := t.stringish(start)
+		if err != nil {
+			return 0, err
+		}
+		t.sink.string(s, isUTF8)
+		if tag == typeCOPY {
+			if err := t.expanded(); err != nil {
+				return 0, err
+			}
+		}
+		idx = next
+
+	case tag == typeREFN, tag == typeWEAKEN:
+		return t.value(idx)
+
+	case tag == typeREFP, tag == typeALIAS:
+		offs, next, err := t.target(idx)
+		if err != nil {
+			return 0, err
+		}
+		if t.active[offs] {
+			return 0, errTranscodeCycle
+		}
+		t.active[offs] = true
+		_, err = t.value(offs)
+		delete(t.active, offs)
+		if err != nil {
+			return 0, err
+		}
+		if err := t.expanded(); err != nil {
+			return 0, err
+		}
+		idx = next
+
+	case tag == typeARRAY, tag >= typeARRAYREF_0 && tag < typeARRAYREF_0+16:
+		ln := int(tag & 0x0f)
+		if tag == typeARRAY {
+			var sz int
+			var err error
+			if ln, sz, err = varintdecode(by[idx:]); err != nil {
+				return 0, err
+			}
+			idx += sz
+		}
+		if ln < 0 || ln > len(by)-idx {
+			return 0, ErrCorrupt{ErrBadSliceSize}
+		}
+
+		t.sink.beginArray(ln)
+		for i := 0; i < ln; i++ {
+			t.sink.elem(i, false)
+			var err error
+			if idx, err = t.value(idx); err != nil {
+				return 0, err
+			}
+		}
+		t.sink.end(false)
+
+	case tag == typeHASH, tag >= typeHASHREF_0 && tag < typeHASHREF_0+16:
+		ln := int(tag & 0x0f)
+		if tag == typeHASH {
+			var sz int
+			var err error
+			if ln, sz, err = varintdecode(by[idx:]); err != nil {
+				return 0, err
+			}
+			idx += sz
+		}
+		if ln < 0 || ln > (len(by)-idx)/2 {
+			return 0, ErrCorrupt{ErrBadHashSize}
+		}
+
+		t.sink.beginMap(ln)
+		for i := 0; i < ln; i++ {
+			t.sink.elem(i, true)
+			var err error
+			if idx, err = t.key(idx); err != nil {
+				return 0, err
+			}
+			t.sink.key()
+			if idx, err = t.value(idx); err != nil {
+				return 0, err
+			}
+		}
+		t.sink.end(true)
+
+	case tag == typeOBJECT, tag == typeOBJECT_FREEZE:
+		_, _, next, err := t.stringish(idx)
+		if err != nil {
+			return 0, err
+		}
+		return t.value(next)
+
+	case tag == typeOBJECTV, tag == typeOBJECTV_FREEZE:
+		_, next, err := t.target(idx)
+		if err != nil {
+			return 0, err
+		}
+		return t.value(next)
+
+	case tag == typeREGEXP:
+		pattern, isUTF8, next, err := t.stringish(idx)
+		if err != nil {
+			return 0, err
+		}
+		t.sink.string(pattern, isUTF8)
+		if _, _, idx, err = t.stringish(next); err != nil {
+			return 0, err
+		}
+
+	default:
+		return 0, fmt.Errorf("sereal: can't transcode tag %s", tagName(tag))
+	}
+
+	return idx, nil
+}
+
+// key writes the hash key starting at by[idx]. Integer keys, as used for
+// some Go maps, are written as strings if the sink requires it.
+func (t *tagTranscoder) key(idx int) (int, error) {
+	if s, isUTF8, next, err := t.stringish(idx); err == nil {
+		t.sink.string(s, isUTF8)
+		if err := t.expanded(); err != nil {
+			return 0, err
+		}
+		return next, nil
+	}
+
+	for idx < len(t.by) && t.by[idx]&^trackFlag == typePAD {
+		idx++
+	}
+	if idx >= len(t.by) {
+		return 0, ErrTruncated
+	}
+
+	if tag := t.by[idx] &^ trackFlag; tag > typeZIGZAG {
+		return 0, fmt.Errorf("sereal: can't transcode hash key %s", tagName(tag))
+	}
+
+	if !t.sink.stringKeys() {
+		return t.value(idx)
+	}
+
+	// integers are written in decimal by a jsonSink
+	sink := t.sink
+	var num jsonSink
+	t.sink = &num
+	next, err := t.value(idx)
+	t.sink = sink
+	if err != nil {
+		return 0, err
+	}
+	t.sink.string(num.buf, true)
+	return next, nil
+}
+
+// stringish returns the string starting at by[idx], following COPY tags, and
+// whether it is a STR_UTF8
+func (t *tagTranscoder) stringish(idx int) ([]byte, bool, int, error) {
+	by := t.by
+	for idx < len(by) && by[idx]&^trackFlag == typePAD {
+		idx++
+	}
+	if idx >= len(by) {
+		return nil, false, 0, ErrTruncated
+	}
+
+	tag := by[idx] &^ trackFlag
+	idx++
+
+	switch {
+	case tag == typeBINARY, tag == typeSTR_UTF8:
+		ln, sz, err := varintdecode(by[idx:])
+		if err != nil {
+			return nil, false, 0, err
+		}
+		idx += sz
+		if ln < 0 || ln > len(by)-idx {
+			return nil, false, 0, ErrCorrupt{ErrBadStringSize}
+		}
+		return by[idx : idx+ln], tag == typeSTR_UTF8, idx + ln, nil
+
+	case tag >= typeSHORT_BINARY_0 && tag < typeSHORT_BINARY_0+32:
+		ln := int(tag & 0x1f)
+		if ln > len(by)-idx {
+			return nil, false, 0, ErrTruncated
+		}
+		return by[idx : idx+ln], false, idx + ln, nil
+
+	case tag == typeCOPY:
+		offs, next, err := t.target(idx)
+		if err != nil {
+			return nil, false, 0, err
+		}
+		if by[offs]&^trackFlag == typeCOPY {
+			return nil, false, 0, ErrCorrupt{ErrNestedCOPY}
+		}
+		s, isUTF8, _, err := t.stringish(offs)
+		return s, isUTF8, next, err
+	}
+
+	return nil, false, 0, fmt.Errorf("%w, got %s", ErrCorrupt{ErrNotStringish}, tagName(tag))
+}
+
+// cborSink writes CBOR for a tagTranscoder
+type cborSink struct {
+	buf []byte
+}
+
+// head appends the initial bytes of an item of the given major type
+func (c *cborSink) head(major byte, n uint64) {
+	major <<= 5
+	switch {
+	case n < 24:
+		c.buf = append(c.buf, major|byte(n))
+	case n <= math.MaxUint8:
+		c.buf = append(c.buf, major|24, byte(n))
+	case n <= math.MaxUint16:
+		c.buf = append(c.buf, major|25, byte(n>>8), byte(n))
+	case n <= math.MaxUint32:
+		c.buf = append(c.buf, major|26)
+		c.buf = append(c.buf, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	default:
+		c.buf = append(c.buf, major|27)
+		c.buf = appendUint64(c.buf, n)
+	}
+}
+
+func (c *cborSink) null()            { c.buf = append(c.buf, 0xf6) }
+func (c *cborSink) uint(n uint64)    { c.head(0, n) }
+func (c *cborSink) beginArray(n int) { c.head(4, uint64(n)) }
+func (c *cborSink) beginMap(n int)   { c.head(5, uint64(n)) }
+func (c *cborSink) elem(int, bool)   {}
+func (c *cborSink) key()             {}
+func (c *cborSink) end(bool)         {}
+func (c *cborSink) stringKeys() bool { return false }
+func (c *cborSink) bytes() []byte    { return c.buf }
+
+func (c *cborSink) bool(b bool) {
+	if b {
+		c.buf = append(c.buf, 0xf5)
+	} else {
+		c.buf = append(c.buf, 0xf4)
+	}
+}
+
+func (c *cborSink) int(n int64) {
+	if n < 0 {
+		c.head(1, uint64(-1-n))
+	} else {
+		c.head(0, uint64(n))
+	}
+}
+
+func (c *cborSink) float(f float64, bits int) error {
+	if bits == 32 {
+		c.buf = append(c.buf, 0xfa)
+		c.buf = appendUint32(c.buf, math.Float32bits(float32(f)))
+	} else {
+		c.buf = append(c.buf, 0xfb)
+		c.buf = appendUint64(c.buf, math.Float64bits(f))
+	}
+	return nil
+}
+
+func (c *cborSink) string(s []byte, isUTF8 bool) {
+	if isUTF8 && utf8.Valid(s) {
+		c.head(3, uint64(len(s)))
+	} else {
+		c.head(2, uint64(len(s)))
+	}
+	c.buf = append(c.buf, s...)
+}
+
+// msgpackSink writes MessagePack for a tagTranscoder
+type msgpackSink struct {
+	buf []byte
+}
+
+func (m *msgpackSink) null()            { m.buf = append(m.buf, 0xc0) }
+func (m *msgpackSink) elem(int, bool)   {}
+func (m *msgpackSink) key()             {}
+func (m *msgpackSink) end(bool)         {}
+func (m *msgpackSink) stringKeys() bool { return false }
+func (m *msgpackSink) bytes() []byte    { return m.buf }
+
+func (m *msgpackSink) bool(b bool) {
+	if b {
+		m.buf = append(m.buf, 0xc3)
+	} else {
+		m.buf = append(m.buf, 0xc2)
+	}
+}
+
+// sized appends the prefix of a value of length n, using fix if n is below
+// fixMax and the 8 (if available), 16 or 32 bit variants otherwise
+func (m *msgpackSink) sized(n int, fix byte, fixMax int, tag8, tag16, tag32 byte) {
+	switch {
+	case n < fixMax:
+		m.buf = append(m.buf, fix|byte(n))
+	case tag8 != 0 && n <= math.MaxUint8:
+		m.buf = append(m.buf, tag8, byte(n))
+	case n <= math.MaxUint16:
+		m.buf = append(m.buf, tag16, byte(n>>8), byte(n))
+	default:
+		m.buf = append(m.buf, tag32)
+		m.buf = appendUint32(m.buf, uint32(n))
+	}
+}
+
+func (m *msgpackSink) beginArray(n int) { m.sized(n, 0x90, 16, 0, 0xdc, 0xdd) }
+func (m *msgpackSink) beginMap(n int)   { m.sized(n, 0x80, 16, 0, 0xde, 0xdf) }
+
+func (m *msgpackSink) string(s []byte, isUTF8 bool) {
+	if isUTF8 && utf8.Valid(s) {
+		m.sized(len(s), 0xa0, 32, 0xd9, 0xda, 0xdb)
+	} else {
+		// bin has no fixed size variant
+		m.sized(len(s), 0, 0, 0xc4, 0xc5, 0xc6)
+	}
+	m.buf = append(m.buf, s...)
+}
+
+func (m *msgpackSink) uint(n uint64) {
+	switch {
+	case n <= 0x7f:
+		m.buf = append(m.buf, byte(n))
+	case n <= math.MaxUint8:
+		m.buf = append(m.buf, 0xcc, byte(n))
+	case n <= math.MaxUint16:
+		m.buf = append(m.buf, 0xcd, byte(n>>8), byte(n))
+	case n <= math.MaxUint32:
+		m.buf = append(m.buf, 0xce)
+		m.buf = appendUint32(m.buf, uint32(n))
+	default:
+		m.buf = append(m.buf, 0xcf)
+		m.buf = appendUint64(m.buf, n)
+	}
+}
+
+func (m *msgpackSink) int(n int64) {
+	switch {
+	case n >= 0:
+		m.uint(uint64(n))
+	case n >= -32:
+		m.buf = append(m.buf, byte(n))
+	case n >= math.MinInt8:
+		m.buf = append(m.buf, 0xd0, byte(n))
+	case n >= math.MinInt16:
+		m.buf = append(m.buf, 0xd1, byte(n>>8), byte(n))
+	case n >= math.MinInt32:
+		m.buf = append(m.buf, 0xd2)
+		m.buf = appendUint32(m.buf, uint32(n))
+	default:
+		m.buf = append(m.buf, 0xd3)
+		m.buf = appendUint64(m.buf, uint64(n))
+	}
+}
+
+func (m *msgpackSink) float(f float64, bits int) error {
+	if bits == 32 {
+		m.buf = append(m.buf, 0xca)
+		m.buf = appendUint32(m.buf, math.Float32bits(float32(f)))
+	} else {
+		m.buf = append(m.buf, 0xcb)
+		m.buf = appendUint64(m.buf, math.Float64bits(f))
+	}
+	return nil
+}
+
+func appendUint32(b []byte, n uint32) []byte {
+	return append(b, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+}
+
+func appendUint64(b []byte, n uint64) []byte {
+	return appendUint32(appendUint32(b, uint32(n>>32)), uint32(n))
+}
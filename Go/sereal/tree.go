@@ -0,0 +1,150 @@
+package sereal
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// A Node is a tag of a document along with the values nested in it. The
+// values referred to by COPY, REFP, ALIAS, OBJECTV and OBJECTV_FREEZE tags
+// are not nested in them but designated by Ref.
+type Node struct {
+	Offset   int     `json:"offset"`            // offset of the tag in its section, as used by COPY and REFP
+	Tag      string  `json:"tag"`               // name of the tag, e.g. "HASH"
+	Detail   string  `json:"detail,omitempty"`  // operand of the tag as printed by DumpTags, e.g. a number or a quoted string
+	Tracked  bool    `json:"tracked,omitempty"` // whether the tag has the track flag
+	Ref      int     `json:"ref,omitempty"`     // offset of the value referred to, 0 if none is
+	Children []*Node `json:"children,omitempty"`
+}
+
+// A Tree is the explicit tree of tags of a document, as returned by
+// ParseTree. It can be marshaled to JSON, or to Graphviz DOT with WriteDOT.
+type Tree struct {
+	Version int   `json:"version"`
+	Header  *Node `json:"header,omitempty"` // root of the header user data, nil if there is none
+	Body    *Node `json:"body"`
+}
+
+// ParseTree parses the document b into the tree of its tags, decompressing
+// it first, without decoding any value. PAD tags are left out. It fails if
+// the document is cut short or corrupt, or if a tag refers to an offset
+// which isn't the start of a value of its section.
+func ParseTree(b []byte) (*Tree, error) {
+	b, err := DecompressDocument(nil, b)
+	if err != nil {
+		return nil, err
+	}
+
+	header, err := readHeader(b)
+	if err != nil {
+		return nil, err
+	}
+	bodyStart := headerSize + header.suffixSize
+	t := &Tree{Version: int(header.version)}
+
+	if header.suffixLen > 0 && b[header.suffixStart]&1 == 1 {
+		// header offsets are relative to the flag byte
+		if t.Header, err = parseSection(b[header.suffixStart:bodyStart], 1); err != nil {
+			return nil, err
+		}
+	}
+
+	if header.version == 1 {
+		t.Body, err = parseSection(b, bodyStart)
+	} else {
+		t.Body, err = parseSection(b[bodyStart-1:], 1)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// parseSection returns the tree of the value starting at by[idx]
+func parseSection(by []byte, idx int) (*Node, error) {
+	var stack []*Node // ancestors of the next node, by depth
+	nodes := make(map[int]bool)
+
+	_, err := walkTree(by, idx, 0, func(idx int, tag byte, depth int) error {
+		n := &Node{
+			Offset:  idx,
+			Tag:     tagName(tag),
+			Detail:  strings.TrimPrefix(tagDetail(by, idx, tag), " "),
+			Tracked: by[idx]&trackFlag == trackFlag,
+		}
+
+		switch tag {
+		case typeCOPY, typeREFP, typeALIAS, typeOBJECTV, typeOBJECTV_FREEZE:
+			offs, _, err := varintdecode(by[idx+1:])
+			if err != nil {
+				return err
+			}
+			if !nodes[offs] {
+				return ErrCorrupt{ErrOffsetNotValue}
+			}
+			n.Ref = offs
+		}
+		nodes[idx] = true
+
+		stack = append(stack[:depth], n)
+		if depth > 0 {
+			parent := stack[depth-1]
+			parent.Children = append(parent.Children, n)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return stack[0], nil
+}
+
+// WriteDOT writes the tree to w as a Graphviz digraph, with an edge from
+// each node to its children and a dashed one to the value it refers to, if
+// any
+func (t *Tree) WriteDOT(w io.Writer) error {
+	var sb strings.Builder
+	sb.WriteString("digraph sereal {\n\tnode [shape=box, fontname=monospace];\n")
+
+	if t.Header != nil {
+		writeDOTSection(&sb, "header", "h", t.Header)
+	}
+	writeDOTSection(&sb, "body", "b", t.Body)
+
+	sb.WriteString("}\n")
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+// writeDOTSection writes the nodes of a section as a cluster, their ids being
+// prefix followed by their offset
+func writeDOTSection(sb *strings.Builder, name string, prefix string, root *Node) {
+	fmt.Fprintf(sb, "\tsubgraph cluster_%s {\n\t\tlabel=%s;\n", name, name)
+
+	var walk func(n *Node)
+	walk = func(n *Node) {
+		label := "@" + strconv.Itoa(n.Offset) + " " + n.Tag
+		if n.Detail != "" {
+			label += " " + n.Detail
+		}
+		if n.Tracked {
+			label += " (tracked)"
+		}
+		fmt.Fprintf(sb, "\t\t%s%d [label=%s];\n", prefix, n.Offset, strconv.Quote(label))
+
+		if n.Ref != 0 {
+			fmt.Fprintf(sb, "\t\t%s%d -> %s%d [style=dashed];\n", prefix, n.Offset, prefix, n.Ref)
+		}
+		for _, c := range n.Children {
+			fmt.Fprintf(sb, "\t\t%s%d -> %s%d;\n", prefix, n.Offset, prefix, c.Offset)
+			walk(c)
+		}
+	}
+	walk(root)
+
+	sb.WriteString("\t}\n")
+}
@@ -0,0 +1,560 @@
+package sereal
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"reflect"
+	"sync"
+)
+
+// A Kind is the kind of value held by a Value
+type Kind int
+
+const (
+	// KindInvalid is the kind of the zero Value, and of the values looked
+	// up past the end of an array or for a missing key
+	KindInvalid Kind = iota
+	KindUndef
+	KindBool
+	KindInt   // POS, NEG, ZIGZAG and VARINT up to math.MaxInt64
+	KindUint  // VARINT beyond math.MaxInt64
+	KindFloat // FLOAT, DOUBLE and LONG_DOUBLE
+	KindString
+	KindBytes
+	KindArray
+	KindHash
+	KindRef    // REFN, REFP, WEAKEN, ARRAYREF and HASHREF
+	KindObject // OBJECT, OBJECTV and their FREEZE variants
+	KindRegexp
+)
+
+var kindNames = [...]string{
+	KindInvalid: "invalid",
+	KindUndef:   "undef",
+	KindBool:    "bool",
+	KindInt:     "int",
+	KindUint:    "uint",
+	KindFloat:   "float",
+	KindString:  "string",
+	KindBytes:   "bytes",
+	KindArray:   "array",
+	KindHash:    "hash",
+	KindRef:     "ref",
+	KindObject:  "object",
+	KindRegexp:  "regexp",
+}
+
+func (k Kind) String() string {
+	if k >= 0 && int(k) < len(kindNames) {
+		return kindNames[k]
+	}
+	return fmt.Sprintf("Kind(%d)", int(k))
+}
+
+// Value is a decoded value read straight from the document, decoded into by
+// passing a *Value to Unmarshal or using it as the type of a struct field.
+// Containers are only expanded when their elements are first looked up, and
+// strings are only copied by Str.
+//
+// The whole section holding a Value is validated when it is decoded, so its
+// methods can't fail on corrupt data. Unless Decoder.AliasInput is set the
+// section is copied once, and shared by all the Values decoded from it.
+//
+// Typed accessors return the zero value of their type when the Value is of
+// another kind. Len, Index, Get, Slice, Map and Keys go through references
+// and objects to the array or hash they stand for.
+type Value struct {
+	doc   *valueDoc
+	idx   int  // offset of the tag, COPY and ALIAS tags resolved
+	deref bool // the array or hash of an ARRAYREF or HASHREF, not the reference
+}
+
+// valueDoc is the section shared by the Values decoded from it
+type valueDoc struct {
+	dec     *Decoder
+	section string
+	by      []byte
+	src     []byte   // section the Values were decoded from, maybe a copy of by
+	start   int      // smallest offset inside the section
+	elems   sync.Map // offset of a container → offsets of its elements
+}
+
+var valueType = reflect.TypeOf(Value{})
+
+// decodeIntoValue sets ptr, a Value, to the value starting at by[idx] after
+// validating it and every value it refers to
+func (d *decoder) decodeIntoValue(by []byte, idx int, ptr reflect.Value) (int, error) {
+	if err := d.checkValue(by, idx); err != nil {
+		return 0, err
+	}
+
+	// tracked values inside are decoded for the references further on
+	end, err := d.skip(by, idx)
+	if err != nil {
+		return 0, err
+	}
+
+	if d.values == nil || len(d.values.src) != len(by) || &d.values.src[0] != &by[0] {
+		doc := &valueDoc{dec: d.Decoder, section: d.section, by: by, src: by, start: d.sectionStart}
+		if !d.AliasInput {
+			doc.by = append([]byte(nil), by...)
+		}
+		d.values = doc
+	}
+
+	ptr.Set(reflect.ValueOf(Value{doc: d.values, idx: d.values.resolve(idx)}))
+	return end, nil
+}
+
+// checkValue validates the value starting at by[idx]: its structure, the
+// offsets it refers to and the values found there, and that hash keys,
+// class names and regexps are strings
+func (d *decoder) checkValue(by []byte, idx int) error {
+	// the values whose elements must be strings: every other one for
+	// hashes, the first for objects and both for regexps
+	type frame struct {
+		depth int
+		tag   byte
+		pos   int
+	}
+
+	var frames []frame
+	seen := make(map[int]bool)
+
+	todo := []int{idx}
+	for len(todo) > 0 {
+		start := todo[len(todo)-1]
+		todo = todo[:len(todo)-1]
+		frames = frames[:0]
+
+		_, err := walkTree(by, start, 0, func(i int, tag byte, depth int) error {
+			for len(frames) > 0 && frames[len(frames)-1].depth > depth {
+				frames = frames[:len(frames)-1]
+			}
+
+			if n := len(frames); n > 0 && frames[n-1].depth == depth {
+				f := &frames[n-1]
+				var stringish bool
+				switch {
+				case f.tag == typeHASH || f.tag >= typeHASHREF_0 && f.tag < typeHASHREF_0+16:
+					stringish = f.pos%2 == 0
+				case f.tag == typeREGEXP:
+					stringish = true
+				default:
+					stringish = f.pos == 0
+				}
+				f.pos++
+
+				if stringish {
+					if _, _, err := d.decodeStringish(by, i); err != nil {
+						return err
+					}
+				}
+			}
+
+			switch {
+			case tag == typeHASH, tag >= typeHASHREF_0 && tag < typeHASHREF_0+16,
+				tag == typeOBJECT, tag == typeOBJECT_FREEZE, tag == typeREGEXP:
+				frames = append(frames, frame{depth: depth + 1, tag: tag})
+			}
+
+			if !isOffsetTag(tag) {
+				return nil
+			}
+
+			offs, _, err := varintdecode(by[i+1:])
+			if err != nil {
+				return err
+			}
+			if err := d.checkOffset(offs, i); err != nil {
+				return err
+			}
+
+			if tag == typeOBJECTV || tag == typeOBJECTV_FREEZE {
+				if _, _, err := d.decodeStringish(by, offs); err != nil {
+					return err
+				}
+			} else if !seen[offs] {
+				seen[offs] = true
+				todo = append(todo, offs)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// resolve returns the offset of the value by[idx] stands for once PAD, COPY
+// and ALIAS tags have been gone through
+func (doc *valueDoc) resolve(idx int) int {
+	for {
+		idx = skipPads(doc.by, idx)
+		switch doc.by[idx] &^ trackFlag {
+		case typeCOPY, typeALIAS:
+			idx, _, _ = varintdecode(doc.by[idx+1:])
+		default:
+			return idx
+		}
+	}
+}
+
+// at returns the Value of the value by[idx] stands for
+func (doc *valueDoc) at(idx int) Value {
+	return Value{doc: doc, idx: doc.resolve(idx)}
+}
+
+func (v Value) tag() byte { return v.doc.by[v.idx] &^ trackFlag }
+
+// Kind returns the kind of v
+func (v Value) Kind() Kind {
+	if v.doc == nil {
+		return KindInvalid
+	}
+
+	switch tag := v.tag(); {
+	case tag < typeVARINT, tag == typeZIGZAG:
+		return KindInt
+	case tag == typeVARINT:
+		if n, _, _ := varintdecode(v.doc.by[v.idx+1:]); n < 0 {
+			return KindUint
+		}
+		return KindInt
+	case tag == typeFLOAT, tag == typeDOUBLE, tag == typeLONG_DOUBLE:
+		return KindFloat
+	case tag == typeUNDEF, tag == typeCANONICAL_UNDEF:
+		return KindUndef
+	case tag == typeTRUE, tag == typeFALSE:
+		return KindBool
+	case tag == typeSTR_UTF8:
+		return KindString
+	case tag == typeBINARY, tag >= typeSHORT_BINARY_0 && tag < typeSHORT_BINARY_0+32:
+		return KindBytes
+	case tag == typeARRAY:
+		return KindArray
+	case tag == typeHASH:
+		return KindHash
+	case tag >= typeARRAYREF_0 && tag < typeARRAYREF_0+16:
+		if v.deref {
+			return KindArray
+		}
+		return KindRef
+	case tag >= typeHASHREF_0 && tag < typeHASHREF_0+16:
+		if v.deref {
+			return KindHash
+		}
+		return KindRef
+	case tag == typeREFN, tag == typeREFP, tag == typeWEAKEN:
+		return KindRef
+	case tag == typeOBJECT, tag == typeOBJECTV, tag == typeOBJECT_FREEZE, tag == typeOBJECTV_FREEZE:
+		return KindObject
+	case tag == typeREGEXP:
+		return KindRegexp
+	}
+	return KindInvalid
+}
+
+// Bool returns the boolean v holds
+func (v Value) Bool() bool {
+	return v.doc != nil && v.tag() == typeTRUE
+}
+
+// Int returns the integer v holds if it is of kind KindInt
+func (v Value) Int() int64 {
+	if v.Kind() != KindInt {
+		return 0
+	}
+
+	by := v.doc.by[v.idx+1:]
+	switch tag := v.tag(); tag {
+	case typeVARINT:
+		n, _, _ := varintdecode(by)
+		return int64(n)
+	case typeZIGZAG:
+		// as decodeZigzag does
+		n, _, _ := varintdecode(by)
+		return -(1 + int64(uint64(n)>>1))
+	default:
+		if tag&0x10 != 0 {
+			return int64(tag) - 32
+		}
+		return int64(tag)
+	}
+}
+
+// Uint returns the integer v holds if it is of kind KindUint, or of kind
+// KindInt and not negative
+func (v Value) Uint() uint64 {
+	switch v.Kind() {
+	case KindUint:
+		n, _, _ := varintdecode(v.doc.by[v.idx+1:])
+		return uint64(n)
+	case KindInt:
+		if n := v.Int(); n >= 0 {
+			return uint64(n)
+		}
+	}
+	return 0
+}
+
+// Float returns the number v holds if it is of kind KindFloat. Long doubles
+// are rounded to the nearest float64.
+func (v Value) Float() float64 {
+	if v.Kind() != KindFloat {
+		return 0
+	}
+
+	by := v.doc.by[v.idx+1:]
+	switch v.tag() {
+	case typeFLOAT:
+		return float64(math.Float32frombits(binary.LittleEndian.Uint32(by)))
+	case typeDOUBLE:
+		return math.Float64frombits(binary.LittleEndian.Uint64(by))
+	default:
+		x, nan := longDouble(by)
+		if nan {
+			return math.NaN()
+		}
+		f, _ := x.Float64()
+		return f
+	}
+}
+
+// Bytes returns the bytes of the string v holds if it is of kind KindString
+// or KindBytes. They belong to the document and must not be modified.
+func (v Value) Bytes() []byte {
+	if k := v.Kind(); k != KindString && k != KindBytes {
+		return nil
+	}
+
+	return v.doc.stringAt(v.idx)
+}
+
+// stringAt returns the bytes of the string starting at by[idx], COPY tags
+// resolved
+func (doc *valueDoc) stringAt(idx int) []byte {
+	idx = doc.resolve(idx)
+	tag := doc.by[idx] &^ trackFlag
+	idx++
+
+	ln := int(tag & 0x1f)
+	if tag == typeBINARY || tag == typeSTR_UTF8 {
+		var sz int
+		ln, sz, _ = varintdecode(doc.by[idx:])
+		idx += sz
+	}
+	return doc.by[idx : idx+ln]
+}
+
+// Str returns a copy of the string v holds if it is of kind KindString or
+// KindBytes
+func (v Value) Str() string {
+	return string(v.Bytes())
+}
+
+// Elem returns the value v refers to if it is of kind KindRef, or the value
+// blessed by v if it is of kind KindObject
+func (v Value) Elem() Value {
+	if v.doc == nil {
+		return Value{}
+	}
+
+	by := v.doc.by
+	switch tag := v.tag(); {
+	case tag == typeREFN, tag == typeWEAKEN:
+		return v.doc.at(v.idx + 1)
+	case tag == typeREFP:
+		offs, _, _ := varintdecode(by[v.idx+1:])
+		return v.doc.at(offs)
+	case tag >= typeARRAYREF_0 && tag < typeARRAYREF_0+16, tag >= typeHASHREF_0 && tag < typeHASHREF_0+16:
+		if v.deref {
+			return Value{}
+		}
+		return Value{doc: v.doc, idx: v.idx, deref: true}
+	case tag == typeOBJECT, tag == typeOBJECT_FREEZE:
+		end, _ := skipValue(by, v.idx+1)
+		return v.doc.at(end)
+	case tag == typeOBJECTV, tag == typeOBJECTV_FREEZE:
+		_, sz, _ := varintdecode(by[v.idx+1:])
+		return v.doc.at(v.idx + 1 + sz)
+	}
+	return Value{}
+}
+
+// Class returns the class name of v if it is of kind KindObject
+func (v Value) Class() string {
+	if v.Kind() != KindObject {
+		return ""
+	}
+
+	idx := v.idx + 1
+	if tag := v.tag(); tag == typeOBJECTV || tag == typeOBJECTV_FREEZE {
+		idx, _, _ = varintdecode(v.doc.by[idx:])
+	}
+	return string(v.doc.stringAt(idx))
+}
+
+// container returns the array or hash v stands for, or the zero Value
+func (v Value) container() Value {
+	// references can form cycles: stop once there have been more hops than
+	// bytes
+	for hops := 0; v.doc != nil && hops <= len(v.doc.by); hops++ {
+		switch v.Kind() {
+		case KindArray, KindHash:
+			return v
+		case KindRef, KindObject:
+			v = v.Elem()
+		default:
+			return Value{}
+		}
+	}
+	return Value{}
+}
+
+// elems returns the offsets of the elements of c, an array or hash, keys
+// and values alternating for hashes. They are found on first use.
+func (c Value) elems() []int {
+	if offs, ok := c.doc.elems.Load(c.idx); ok {
+		return offs.([]int)
+	}
+
+	by := c.doc.by
+	idx := c.idx + 1
+
+	var n int
+	switch tag := c.tag(); {
+	case tag == typeARRAY, tag == typeHASH:
+		var sz int
+		n, sz, _ = varintdecode(by[idx:])
+		idx += sz
+	default:
+		n = int(tag & 0x0f)
+	}
+	if c.Kind() == KindHash {
+		n *= 2
+	}
+
+	offs := make([]int, n)
+	for i := range offs {
+		offs[i] = idx
+		idx, _ = skipValue(by, idx)
+	}
+
+	actual, _ := c.doc.elems.LoadOrStore(c.idx, offs)
+	return actual.([]int)
+}
+
+// Len returns the number of elements of the array or entries of the hash v
+// stands for
+func (v Value) Len() int {
+	c := v.container()
+	if c.doc == nil {
+		return 0
+	}
+	if c.Kind() == KindHash {
+		return len(c.elems()) / 2
+	}
+	return len(c.elems())
+}
+
+// Index returns the i-th element of the array v stands for
+func (v Value) Index(i int) Value {
+	c := v.container()
+	if c.Kind() != KindArray {
+		return Value{}
+	}
+
+	elems := c.elems()
+	if i < 0 || i >= len(elems) {
+		return Value{}
+	}
+	return c.doc.at(elems[i])
+}
+
+// Get returns the value of key in the hash v stands for. The last entry
+// wins if the key is repeated.
+func (v Value) Get(key string) Value {
+	c := v.container()
+	if c.Kind() != KindHash {
+		return Value{}
+	}
+
+	elems := c.elems()
+	for i := len(elems) - 2; i >= 0; i -= 2 {
+		if k := c.doc.at(elems[i]).Bytes(); string(k) == key {
+			return c.doc.at(elems[i+1])
+		}
+	}
+	return Value{}
+}
+
+// Keys returns the keys of the hash v stands for, in document order
+func (v Value) Keys() []string {
+	c := v.container()
+	if c.Kind() != KindHash {
+		return nil
+	}
+
+	elems := c.elems()
+	keys := make([]string, 0, len(elems)/2)
+	for i := 0; i < len(elems); i += 2 {
+		keys = append(keys, c.doc.at(elems[i]).Str())
+	}
+	return keys
+}
+
+// Slice returns the elements of the array v stands for
+func (v Value) Slice() []Value {
+	c := v.container()
+	if c.Kind() != KindArray {
+		return nil
+	}
+
+	elems := c.elems()
+	s := make([]Value, len(elems))
+	for i, offs := range elems {
+		s[i] = c.doc.at(offs)
+	}
+	return s
+}
+
+// Map returns the entries of the hash v stands for
+func (v Value) Map() map[string]Value {
+	c := v.container()
+	if c.Kind() != KindHash {
+		return nil
+	}
+
+	elems := c.elems()
+	m := make(map[string]Value, len(elems)/2)
+	for i := 0; i < len(elems); i += 2 {
+		m[c.doc.at(elems[i]).Str()] = c.doc.at(elems[i+1])
+	}
+	return m
+}
+
+// Interface decodes v as Unmarshal decodes into an interface{}, using the
+// settings of the Decoder v was decoded with
+func (v Value) Interface() (interface{}, error) {
+	if v.doc == nil {
+		return nil, nil
+	}
+
+	d := &decoder{Decoder: v.doc.dec, tracked: make(map[int]reflect.Value), section: v.doc.section, sectionStart: v.doc.start}
+	iface, err := d.decodeAt(v.doc.by, v.idx)
+	if err != nil || !v.deref {
+		return iface, err
+	}
+
+	switch p := iface.(type) {
+	case *[]interface{}:
+		return *p, nil
+	case *map[string]interface{}:
+		return *p, nil
+	}
+	return iface, nil
+}
@@ -0,0 +1,18 @@
+//go:build !(amd64 || arm64 || loong64 || mips64 || mips64le || ppc64 || ppc64le || riscv64 || s390x || wasm) || purego
+// +build !amd64,!arm64,!loong64,!mips64,!mips64le,!ppc64,!ppc64le,!riscv64,!s390x,!wasm purego
+
+package sereal
+
+// varintdecode decodes the varint at the start of by. On 32-bit platforms
+// the 64-bit arithmetic packing a word of 7-bit groups costs more than
+// reading a byte at a time.
+func varintdecode(by []byte) (n int, sz int, err error) {
+	// most varints are lengths and offsets of one or two bytes
+	if len(by) > 0 && by[0] < 0x80 {
+		return int(by[0]), 1, nil
+	}
+	if len(by) > 1 && by[1] < 0x80 {
+		return int(by[0]&0x7f) | int(by[1])<<7, 2, nil
+	}
+	return varintdecodePortable(by)
+}
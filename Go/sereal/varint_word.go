@@ -0,0 +1,57 @@
+//go:build (amd64 || arm64 || loong64 || mips64 || mips64le || ppc64 || ppc64le || riscv64 || s390x || wasm) && !purego
+// +build amd64 arm64 loong64 mips64 mips64le ppc64 ppc64le riscv64 s390x wasm
+// +build !purego
+
+package sereal
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// varintdecode decodes the varint at the start of by. On 64-bit platforms
+// the varints of more than two bytes are read with a single word load, as
+// long as 8 bytes are left.
+func varintdecode(by []byte) (n int, sz int, err error) {
+	// most varints are lengths and offsets of one or two bytes
+	if len(by) > 0 && by[0] < 0x80 {
+		return int(by[0]), 1, nil
+	}
+	if len(by) > 1 && by[1] < 0x80 {
+		return int(by[0]&0x7f) | int(by[1])<<7, 2, nil
+	}
+	if len(by) < 8 {
+		return varintdecodePortable(by)
+	}
+
+	// find the last byte from the continuation bits, then pack the 7-bit
+	// groups together
+	u := binary.LittleEndian.Uint64(by)
+	stops := ^u & 0x8080808080808080
+	sz = 8
+	if stops != 0 {
+		sz = bits.TrailingZeros64(stops)/8 + 1
+	}
+
+	u &= 0x7f7f7f7f7f7f7f7f
+	if sz < 8 {
+		u &= 1<<(8*uint(sz)) - 1
+	}
+	u = u&0x007f007f007f007f | u&0x7f007f007f007f00>>1
+	u = u&0x00003fff00003fff | u&0x3fff00003fff0000>>2
+	u = u&0x000000000fffffff | u&0x0fffffff00000000>>4
+
+	if stops != 0 {
+		return int(u), sz, nil
+	}
+
+	// the 9th and 10th bytes hold the 8 high bits, the bits of the 10th
+	// beyond the 64th being dropped as varintdecodePortable does
+	if len(by) > 8 && by[8] < 0x80 {
+		return int(u | uint64(by[8])<<56), 9, nil
+	}
+	if len(by) > 9 && by[9] < 0x80 {
+		return int(u | uint64(by[8]&0x7f)<<56 | uint64(by[9])<<63), 10, nil
+	}
+	return varintdecodePortable(by)
+}
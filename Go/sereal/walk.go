@@ -0,0 +1,182 @@
+package sereal
+
+import (
+	"errors"
+	"math"
+)
+
+// walkValue calls fn for every tag of the value starting at by[idx], in
+// document order, and returns the offset of the first byte after the value.
+// PAD tags are skipped. Tags referring to other offsets (COPY, REFP, ALIAS,
+// OBJECTV and OBJECTV_FREEZE) are reported but not followed.
+func walkValue(by []byte, idx int, fn func(idx int, tag byte) error) (int, error) {
+	if fn == nil {
+		return walkTree(by, idx, 0, nil)
+	}
+
+	return walkTree(by, idx, 0, func(idx int, tag byte, depth int) error {
+		return fn(idx, tag)
+	})
+}
+
+// walkTree is walkValue also giving fn the nesting depth of each tag: the
+// values inside a container or reference are one level deeper than it.
+func walkTree(by []byte, idx int, depth int, fn func(idx int, tag byte, depth int) error) (int, error) {
+	if idx < 0 || idx >= len(by) {
+		return 0, ErrTruncated
+	}
+
+	tag := by[idx] &^ trackFlag
+	for tag == typePAD {
+		idx++
+		if idx >= len(by) {
+			return 0, ErrTruncated
+		}
+
+		tag = by[idx] &^ trackFlag
+	}
+
+	if fn != nil {
+		if err := fn(idx, tag, depth); err != nil {
+			return 0, err
+		}
+	}
+
+	idx++
+
+	switch {
+	case tag < typeVARINT, tag == typeUNDEF, tag == typeCANONICAL_UNDEF, tag == typeTRUE, tag == typeFALSE:
+		return idx, nil
+
+	case tag == typeVARINT, tag == typeZIGZAG, tag == typeCOPY, tag == typeREFP, tag == typeALIAS:
+		_, sz, err := varintdecode(by[idx:])
+		if err != nil {
+			return 0, err
+		}
+		return idx + sz, nil
+
+	case tag == typeFLOAT:
+		return walkFixed(by, idx, 4)
+
+	case tag == typeDOUBLE:
+		return walkFixed(by, idx, 8)
+
+	case tag == typeLONG_DOUBLE:
+		return walkFixed(by, idx, 16)
+
+	case tag == typeBINARY, tag == typeSTR_UTF8:
+		if idx < len(by) && by[idx] < 0x80 {
+			return walkFixed(by, idx+1, int(by[idx]))
+		}
+		_, end, err := stringSpan(by, idx)
+		return end, err
+
+	case tag >= typeSHORT_BINARY_0 && tag < typeSHORT_BINARY_0+32:
+		return walkFixed(by, idx, int(tag&0x1f))
+
+	case tag == typeREFN, tag == typeWEAKEN:
+		return walkTree(by, idx, depth+1, fn)
+
+	case tag == typeARRAY, tag == typeHASH:
+		ln, sz, err := varintdecode(by[idx:])
+		if err != nil {
+			return 0, err
+		}
+		idx += sz
+
+		if tag == typeHASH {
+			if ln < 0 || ln > math.MaxInt32 {
+				return 0, ErrCorrupt{ErrBadHashSize}
+			}
+			ln *= 2
+		} else if ln < 0 || ln > math.MaxInt32 {
+			return 0, ErrCorrupt{ErrBadSliceSize}
+		}
+
+		return walkValues(by, idx, ln, depth+1, fn)
+
+	case tag >= typeARRAYREF_0 && tag < typeARRAYREF_0+16:
+		return walkValues(by, idx, int(tag&0x0f), depth+1, fn)
+
+	case tag >= typeHASHREF_0 && tag < typeHASHREF_0+16:
+		return walkValues(by, idx, 2*int(tag&0x0f), depth+1, fn)
+
+	case tag == typeOBJECT, tag == typeOBJECT_FREEZE, tag == typeREGEXP:
+		// class name and object, or pattern and modifiers
+		return walkValues(by, idx, 2, depth+1, fn)
+
+	case tag == typeOBJECTV, tag == typeOBJECTV_FREEZE:
+		_, sz, err := varintdecode(by[idx:])
+		if err != nil {
+			return 0, err
+		}
+		return walkTree(by, idx+sz, depth+1, fn)
+	}
+
+	return 0, ErrUnknownTag
+}
+
+func walkValues(by []byte, idx int, n int, depth int, fn func(idx int, tag byte, depth int) error) (int, error) {
+	if n > len(by)-idx {
+		// every value takes at least one byte
+		return 0, ErrTruncated
+	}
+
+	var err error
+	for i := 0; i < n; i++ {
+		if idx, err = walkTree(by, idx, depth, fn); err != nil {
+			return 0, err
+		}
+	}
+
+	return idx, nil
+}
+
+func walkFixed(by []byte, idx int, ln int) (int, error) {
+	if idx+ln > len(by) {
+		return 0, ErrTruncated
+	}
+	return idx + ln, nil
+}
+
+// skipValue returns the offset of the first byte after the value starting at
+// by[idx] without decoding it
+func skipValue(by []byte, idx int) (int, error) {
+	return walkValue(by, idx, nil)
+}
+
+// errTrackedValue stops the walk of skip at the first tracked value
+var errTrackedValue = errors.New("tracked value")
+
+// skip returns the offset of the first byte after the value starting at
+// by[idx], for values the decoder throws away. They are only decoded if they
+// hold tracked values, which REFP and ALIAS tags further on may refer to.
+func (d *decoder) skip(by []byte, idx int) (int, error) {
+	if d.skipWalk == nil {
+		// made once, as the functions given to walkTree escape
+		d.skipWalk = func(i int, tag byte, depth int) error {
+			if d.skipBy[i]&trackFlag != 0 {
+				return errTrackedValue
+			}
+			return nil
+		}
+	}
+
+	d.skipBy = by
+	end, err := walkTree(by, idx, 0, d.skipWalk)
+	if err != errTrackedValue {
+		return end, err
+	}
+
+	var iface interface{}
+	return d.decode(by, idx, &iface)
+}
+
+// isOffsetTag reports whether tag refers to another offset of the document
+func isOffsetTag(tag byte) bool {
+	switch tag {
+	case typeCOPY, typeREFP, typeALIAS, typeOBJECTV, typeOBJECTV_FREEZE:
+		return true
+	}
+	return false
+}
@@ -2,12 +2,22 @@ package sereal
 
 import (
 	"compress/zlib"
+	"io"
 	"math"
 )
 
 // ZlibCompressor compresses a Sereal document using the zlib format.
 type ZlibCompressor struct {
 	Level int // compression level, set to ZlibDefaultCompression by default
+
+	// Dictionary is an optional preset dictionary. Documents compressed with
+	// a dictionary can only be decompressed with the same dictionary.
+	Dictionary []byte
+
+	// DictionaryID identifies Dictionary. When set, it is stored in the
+	// header of the documents so that Decoder.DictionaryResolver can find the
+	// dictionary without any out-of-band configuration.
+	DictionaryID string
 }
 
 // Zlib constants
@@ -31,7 +41,7 @@ func (c ZlibCompressor) compress(buf []byte) ([]byte, error) {
 		c.Level = ZlibDefaultCompression
 	}
 
-	tail, err := zlibEncode(buf, c.Level)
+	tail, err := zlibEncode(buf, c.Level, c.Dictionary)
 	if err != nil {
 		return nil, err
 	}
@@ -44,26 +54,41 @@ func (c ZlibCompressor) compress(buf []byte) ([]byte, error) {
 }
 
 func (c ZlibCompressor) decompress(d, buf []byte) ([]byte, error) {
+	r, uln, err := c.bodyReader(buf)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return readBody(d[:0], r, uln, len(buf))
+}
+
+func (c ZlibCompressor) bodyReader(buf []byte) (io.ReadCloser, int, error) {
 	// Read the claimed length of the uncompressed document
 	uln, usz, err := varintdecode(buf)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	buf = buf[usz:]
 
 	// Read the claimed length of the compressed document
 	cln, csz, err := varintdecode(buf)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
 	if cln < 0 || cln > math.MaxInt32 || csz+cln > len(buf) {
-		return nil, ErrCorrupt{errBadOffset}
+		return nil, 0, ErrCorrupt{ErrBadOffset}
 	}
 
 	buf = buf[csz : csz+cln]
 
-	// XXX Perhaps check if len(buf) == cln
+	if uln < 0 || uln > math.MaxInt32 {
+		return nil, 0, ErrCorrupt{ErrBadOffset}
+	}
 
-	return zlibDecode(uln, buf)
+	r, err := zlibReader(buf, c.Dictionary)
+	return r, uln, err
 }
+
+func (c ZlibCompressor) dictionaryID() string { return c.DictionaryID }
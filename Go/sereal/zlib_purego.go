@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"compress/zlib"
 	"fmt"
+	"io"
 	"sync"
 )
 
@@ -22,16 +23,25 @@ func init() {
 	}
 }
 
-func zlibEncode(buf []byte, level int) ([]byte, error) {
+func zlibEncode(buf []byte, level int, dict []byte) ([]byte, error) {
 	pool := zlibWriterPools[level]
 	if pool == nil {
 		return nil, fmt.Errorf("unknown level %d", level)
 	}
 
 	var comp bytes.Buffer
-	zw := pool.Get().(*zlib.Writer)
-	defer pool.Put(zw)
-	zw.Reset(&comp)
+	var zw *zlib.Writer
+	if dict == nil {
+		zw = pool.Get().(*zlib.Writer)
+		defer pool.Put(zw)
+		zw.Reset(&comp)
+	} else {
+		// pooled writers can't switch dictionaries
+		var err error
+		if zw, err = zlib.NewWriterLevelDict(&comp, level, dict); err != nil {
+			return nil, err
+		}
+	}
 
 	_, err := zw.Write(buf)
 	if err != nil {
@@ -46,19 +56,7 @@ func zlibEncode(buf []byte, level int) ([]byte, error) {
 	return comp.Bytes(), nil
 }
 
-func zlibDecode(uln int, buf []byte) ([]byte, error) {
-	zr, err := zlib.NewReader(bytes.NewReader(buf))
-	if err != nil {
-		return nil, err
-	}
-	defer zr.Close()
-
-	dec := bytes.NewBuffer(make([]byte, 0, uln))
-	_, err = dec.ReadFrom(zr)
-	if err != nil {
-		return nil, err
-	}
-
-	// XXX Perhaps check if the number of read bytes == uln
-	return dec.Bytes(), nil
+// zlibReader returns a reader of the zlib stream buf decompressed
+func zlibReader(buf []byte, dict []byte) (io.ReadCloser, error) {
+	return zlib.NewReaderDict(bytes.NewReader(buf), dict)
 }
@@ -1,12 +1,25 @@
 package sereal
 
 import (
+	"fmt"
 	"math"
 )
 
 // ZstdCompressor compresses a Sereal document using the zstd format.
 type ZstdCompressor struct {
 	Level int // compression level, set to ZstdDefaultCompression by default
+
+	// Dictionary is an optional dictionary, e.g. built by TrainDictionary.
+	// Documents compressed with a dictionary can only be decompressed with
+	// the same dictionary.
+	Dictionary []byte
+
+	// DictionaryID identifies Dictionary, as for ZlibCompressor
+	DictionaryID string
+
+	// FrameSize, if set, splits the document into independent zstd frames
+	// compressing FrameSize bytes each, which are decompressed concurrently
+	FrameSize int
 }
 
 // Zstd constants
@@ -29,9 +42,27 @@ func (c ZstdCompressor) compress(buf []byte) ([]byte, error) {
 		c.Level = ZstdDefaultCompression
 	}
 
-	tail, err := zstdEncode(buf, c.Level)
-	if err != nil {
-		return nil, err
+	if c.Level < ZstdBestSpeed || c.Level > ZstdBestCompression {
+		return nil, fmt.Errorf("sereal: bad zstd compression level %d", c.Level)
+	}
+
+	if c.FrameSize < 0 {
+		return nil, fmt.Errorf("sereal: negative zstd frame size %d", c.FrameSize)
+	}
+
+	var tail []byte
+	for first := true; first || len(buf) > 0; first = false {
+		chunk := buf
+		if c.FrameSize > 0 && len(chunk) > c.FrameSize {
+			chunk = chunk[:c.FrameSize]
+		}
+		buf = buf[len(chunk):]
+
+		frame, err := zstdEncode(chunk, c.Level, c.Dictionary)
+		if err != nil {
+			return nil, err
+		}
+		tail = append(tail, frame...)
 	}
 
 	var head []byte
@@ -49,10 +80,20 @@ func (c ZstdCompressor) decompress(d, buf []byte) ([]byte, error) {
 	}
 
 	if ln < 0 || ln > math.MaxInt32 || sz+ln > len(buf) {
-		return nil, ErrCorrupt{errBadOffset}
+		return nil, ErrCorrupt{ErrBadOffset}
 	}
 
 	buf = buf[sz : sz+ln]
 
-	return zstdDecode(d, buf)
+	// bodies of several frames, e.g. written with FrameSize, are
+	// decompressed one frame per goroutine
+	if frames, err := zstdFrames(buf); err == nil && len(frames) > 1 {
+		return decodeZstdFrames(d, frames, func(d, frame []byte) ([]byte, error) {
+			return zstdDecode(d, frame, c.Dictionary)
+		})
+	}
+
+	return zstdDecode(d, buf, c.Dictionary)
 }
+
+func (c ZstdCompressor) dictionaryID() string { return c.DictionaryID }
@@ -3,15 +3,40 @@
 package sereal
 
 import (
+	"bytes"
+	"io/ioutil"
+
 	"github.com/DataDog/zstd"
 )
 
-func zstdEncode(buf []byte, level int) ([]byte, error) {
-	dst, err := zstd.CompressLevel(nil, buf, level)
-	return dst, err
+// zstdCompiled tells zstd documents can be encoded and decoded
+const zstdCompiled = true
+
+func zstdEncode(buf []byte, level int, dict []byte) ([]byte, error) {
+	if len(dict) == 0 {
+		dst, err := zstd.CompressLevel(nil, buf, level)
+		return dst, err
+	}
+
+	var dst bytes.Buffer
+	w := zstd.NewWriterLevelDict(&dst, level, dict)
+	if _, err := w.Write(buf); err != nil {
+		w.Close()
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return dst.Bytes(), nil
 }
 
-func zstdDecode(d, buf []byte) ([]byte, error) {
-	dst, err := zstd.Decompress(d, buf)
-	return dst, err
+func zstdDecode(d, buf []byte, dict []byte) ([]byte, error) {
+	if len(dict) == 0 {
+		dst, err := zstd.Decompress(d, buf)
+		return dst, err
+	}
+
+	r := zstd.NewReaderDict(bytes.NewReader(buf), dict)
+	defer r.Close()
+	return ioutil.ReadAll(r)
 }
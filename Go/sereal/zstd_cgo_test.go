@@ -0,0 +1,207 @@
+// +build clibs
+
+package sereal
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestZstdV4(t *testing.T) {
+	e := NewEncoderV3()
+	e.Compression = ZstdCompressor{}
+	e.CompressionThreshold = 0
+	if err := e.SetVersion(4); err != nil {
+		t.Fatal(err)
+	}
+
+	in := map[string]interface{}{"name": strings.Repeat("zstd ", 100), "n": 4}
+	b, err := e.Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b[4]&0x0f != 4 || documentType(b[4]>>4) != serealZstd {
+		t.Errorf("got version %d, document type %d", b[4]&0x0f, b[4]>>4)
+	}
+
+	var out map[string]interface{}
+	if err := Unmarshal(b, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(out, in) {
+		t.Errorf("got %#v", out)
+	}
+}
+
+func TestZstdCompressionLevel(t *testing.T) {
+	var in []string
+	for i := 0; i < 500; i++ {
+		in = append(in, strings.Repeat("level ", i%7), "x")
+	}
+
+	var sizes []int
+	for _, level := range []int{ZstdBestSpeed, ZstdBestCompression} {
+		e := NewEncoderV3()
+		e.Compression = ZstdCompressor{}
+		if err := e.SetCompressionLevel(level); err != nil {
+			t.Fatal(err)
+		}
+
+		// zstd needs v4
+		if _, err := e.Marshal(in); err == nil {
+			t.Errorf("level %d: no error encoding v3", level)
+		}
+		if err := e.SetVersion(4); err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := e.Marshal(in)
+		if err != nil {
+			t.Fatalf("level %d: %v", level, err)
+		}
+		sizes = append(sizes, len(b))
+
+		var out []string
+		if err := Unmarshal(b, &out); err != nil || !reflect.DeepEqual(out, in) {
+			t.Errorf("level %d: round trip failed: %v", level, err)
+		}
+	}
+
+	if sizes[1] > sizes[0] {
+		t.Errorf("best compression gives %d bytes, best speed %d", sizes[1], sizes[0])
+	}
+}
+
+func TestZstdDictionary(t *testing.T) {
+	var docs [][]byte
+	for i := 0; i < 50; i++ {
+		b, err := Marshal(map[string]interface{}{
+			"customer_id":   1000 + i,
+			"status":        "subscription_active",
+			"billing_email": fmt.Sprintf("user%d@example.com", i),
+			"features":      []string{"reporting", "exports", "single_sign_on"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		docs = append(docs, b)
+	}
+
+	dict, err := TrainDictionary(docs[:40], 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resolver := &Decoder{DictionaryResolver: func(id string) ([]byte, error) {
+		if id != "d1" {
+			return nil, fmt.Errorf("unknown dictionary %q", id)
+		}
+		return dict, nil
+	}}
+
+	sizes := make(map[string]int)
+	for _, tc := range []struct {
+		name string
+		c    ZstdCompressor
+		d    *Decoder
+	}{
+		{"plain", ZstdCompressor{}, &Decoder{}},
+		{"identified", ZstdCompressor{Dictionary: dict, DictionaryID: "d1"}, resolver},
+		{"decoder", ZstdCompressor{Dictionary: dict}, &Decoder{Dictionary: dict}},
+	} {
+		e := NewEncoderV3()
+		e.Compression = tc.c
+		e.CompressionThreshold = 0
+		if err := e.SetVersion(4); err != nil {
+			t.Fatal(err)
+		}
+
+		size := 0
+		for _, doc := range docs[40:] {
+			var v map[string]interface{}
+			if err := Unmarshal(doc, &v); err != nil {
+				t.Fatal(err)
+			}
+			b, err := e.Marshal(v)
+			if err != nil {
+				t.Fatalf("%s: %v", tc.name, err)
+			}
+			size += len(b)
+
+			var got map[string]interface{}
+			if err := tc.d.Unmarshal(b, &got); err != nil || !reflect.DeepEqual(got, v) {
+				t.Errorf("%s: round trip failed: %v", tc.name, err)
+			}
+			if tc.c.Dictionary != nil {
+				if err := Unmarshal(b, &got); err == nil {
+					t.Errorf("%s: decoded without the dictionary", tc.name)
+				}
+			}
+		}
+		sizes[tc.name] = size
+	}
+
+	if sizes["identified"] >= sizes["plain"] || sizes["decoder"] >= sizes["plain"] {
+		t.Errorf("dictionaries don't help: %v", sizes)
+	}
+}
+
+func TestZstdFramesRoundTrip(t *testing.T) {
+	in := make([]map[string]interface{}, 2000)
+	for i := range in {
+		in[i] = map[string]interface{}{"id": i, "name": fmt.Sprintf("frame %d", i%17)}
+	}
+
+	dict := []byte(strings.Repeat("name frame id ", 20))
+	for _, c := range []ZstdCompressor{{FrameSize: 4096}, {FrameSize: 4096, Dictionary: dict}} {
+		e := NewEncoderV3()
+		e.Compression = c
+		if err := e.SetVersion(4); err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := e.Marshal(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		bodyStart := headerSize + 1
+		_, sz, err := varintdecode(b[bodyStart:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		frames, err := zstdFrames(b[bodyStart+sz:])
+		if err != nil || len(frames) < 2 {
+			t.Fatalf("got %d frames, %v", len(frames), err)
+		}
+
+		var out []map[string]interface{}
+		if err := (&Decoder{Dictionary: c.Dictionary}).Unmarshal(b, &out); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(out, in) {
+			t.Errorf("%d frames: round trip failed", len(frames))
+		}
+	}
+
+	// without a dictionary, documents decompress on their own too
+	e := NewEncoderV3()
+	e.Compression = ZstdCompressor{FrameSize: 4096}
+	if err := e.SetVersion(4); err != nil {
+		t.Fatal(err)
+	}
+	b, err := e.Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := DecompressDocument(nil, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out []map[string]interface{}
+	if err := Unmarshal(raw, &out); err != nil || !reflect.DeepEqual(out, in) {
+		t.Errorf("decompressed document: %v", err)
+	}
+}
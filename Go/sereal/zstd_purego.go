@@ -8,10 +8,13 @@ import (
 
 var errNoZstd = errors.New("sereal: zstd not supported in pure-Go build")
 
-func zstdEncode(buf []byte, level int) ([]byte, error) {
+// zstdCompiled tells zstd documents can be encoded and decoded
+const zstdCompiled = false
+
+func zstdEncode(buf []byte, level int, dict []byte) ([]byte, error) {
 	return nil, errNoZstd
 }
 
-func zstdDecode(d, buf []byte) ([]byte, error) {
+func zstdDecode(d, buf []byte, dict []byte) ([]byte, error) {
 	return nil, errNoZstd
 }
@@ -0,0 +1,161 @@
+package sereal
+
+import (
+	"encoding/binary"
+	"errors"
+	"runtime"
+	"sync"
+)
+
+const (
+	zstdFrameMagic     = 0xFD2FB528
+	zstdSkippableMagic = 0x184D2A50 // to 0x184D2A5F
+)
+
+var errBadZstdFrame = errors.New("sereal: bad zstd frame")
+
+// zstdFrames splits the zstd stream b into its frames, leaving out the
+// skippable ones. Only the headers of the frames and of their blocks are
+// read.
+func zstdFrames(b []byte) ([][]byte, error) {
+	var frames [][]byte
+
+	for len(b) > 0 {
+		if len(b) < 4 {
+			return nil, errBadZstdFrame
+		}
+
+		magic := binary.LittleEndian.Uint32(b)
+		if magic&^0xf == zstdSkippableMagic {
+			if len(b) < 8 {
+				return nil, errBadZstdFrame
+			}
+			sz := uint64(binary.LittleEndian.Uint32(b[4:]))
+			if sz > uint64(len(b)-8) {
+				return nil, errBadZstdFrame
+			}
+			b = b[8+sz:]
+			continue
+		}
+
+		if magic != zstdFrameMagic {
+			return nil, errBadZstdFrame
+		}
+
+		n, err := zstdFrameLen(b)
+		if err != nil {
+			return nil, err
+		}
+		frames = append(frames, b[:n])
+		b = b[n:]
+	}
+
+	return frames, nil
+}
+
+// zstdFrameLen returns the length of the zstd frame starting b
+func zstdFrameLen(b []byte) (int, error) {
+	if len(b) < 5 {
+		return 0, errBadZstdFrame
+	}
+
+	descriptor := b[4]
+	idx := 5
+
+	singleSegment := descriptor&0x20 != 0
+	if !singleSegment {
+		idx++ // window descriptor
+	}
+
+	idx += [...]int{0, 1, 2, 4}[descriptor&0x3] // dictionary ID
+
+	switch descriptor >> 6 { // frame content size
+	case 0:
+		if singleSegment {
+			idx++
+		}
+	case 1:
+		idx += 2
+	case 2:
+		idx += 4
+	case 3:
+		idx += 8
+	}
+
+	for {
+		if idx+3 > len(b) {
+			return 0, errBadZstdFrame
+		}
+
+		header := uint32(b[idx]) | uint32(b[idx+1])<<8 | uint32(b[idx+2])<<16
+		idx += 3
+
+		size := int(header >> 3)
+		switch (header >> 1) & 0x3 {
+		case 1: // RLE: a single byte repeated size times
+			size = 1
+		case 3:
+			return 0, errBadZstdFrame
+		}
+
+		if size > len(b)-idx {
+			return 0, errBadZstdFrame
+		}
+		idx += size
+
+		if header&1 == 1 { // last block
+			break
+		}
+	}
+
+	if descriptor&0x4 != 0 {
+		idx += 4 // content checksum
+	}
+	if idx > len(b) {
+		return 0, errBadZstdFrame
+	}
+
+	return idx, nil
+}
+
+// decodeZstdFrames decompresses the frames with decode, concurrently, into
+// a single buffer reusing d if it is large enough
+func decodeZstdFrames(d []byte, frames [][]byte, decode func(d, frame []byte) ([]byte, error)) ([]byte, error) {
+	decoded := make([][]byte, len(frames))
+	errs := make([]error, len(frames))
+
+	// at most one frame per CPU at a time
+	sem := make(chan struct{}, runtime.GOMAXPROCS(0))
+
+	var wg sync.WaitGroup
+	for i := range frames {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			decoded[i], errs[i] = decode(nil, frames[i])
+		}(i)
+	}
+	wg.Wait()
+
+	size := 0
+	for i := range frames {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		size += len(decoded[i])
+	}
+
+	if cap(d) < size {
+		d = make([]byte, 0, size)
+	}
+	d = d[:0]
+	for _, frame := range decoded {
+		d = append(d, frame...)
+	}
+
+	return d, nil
+}